@@ -5,19 +5,33 @@
 // over the limited number of open connections. The number of such connections
 // is equivalent to workersCount.
 //
+// The test may consist of two phases - warm-up phase with warmupRequestsCount
+// requests and measurement phase with requestsCount requests. Stats
+// for each phase are reported separately, so the results for cold cache
+// may be compared to the results for warm cache.
+//
+// The following stats are shown for each phase:
+//   * time taken for the phase
+//   * Kbytes read - the total size of responses' body
+//   * qps - average queries per second
+//   * Kbps - average Kbytes per second received from the server
+//   * response time percentiles. Response time is measured from the moment
+//     the request is queued for sending until the response is read,
+//     so it includes the time spent in requests' pipeline.
+//
+// Stats may be written in text, CSV or JSON format for comparing results
+// across runs and machines.
+//
 // Known limitations:
 //   * It cannot test HTTP servers without HTTP/1.1 keep-alive connections
-//     support.
-//   * Currently it shows only the following stats:
-//         * time taken for the test
-//         * Kbytes read - the total size of responses' body
-//         * qps - average queries per second
-//         * Kbps - average Kbytes per second received from the server.
+//     support unless disableKeepalive is set.
 package main
 
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -25,24 +39,30 @@ import (
 	"math/rand"
 	"net"
 	"net/url"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc/bench"
 	"github.com/vharitonsky/iniflags"
 )
 
 var (
 	numCpu = runtime.NumCPU()
 
+	disableKeepalive                = flag.Bool("disableKeepalive", false, "Whether to send each request over a new connection. Connections are reused for up to requestsPerConnectionCount requests by default")
 	filesCount                      = flag.Int("filesCount", 500, "The number of distinct files to cache. Random query parameter is added to testUrl for generating distinct file urls")
 	goMaxProcs                      = flag.Int("goMaxProcs", numCpu, "The number of go procs")
 	maxPendingRequestsPerConnection = flag.Int("maxPendingRequestsPerConnection", 100, "The maximum number of pending requests per connection to the testUrl")
-	requestsCount                   = flag.Int("requestsCount", 100000, "The number of requests to perform")
+	outputFormat                    = flag.String("outputFormat", "text", "Format for the results. Supported values: 'text', 'csv', 'json'")
+	requestsCount                   = flag.Int("requestsCount", 100000, "The number of requests to perform during the measurement phase")
 	requestsPerConnectionCount      = flag.Int("requestsPerConnectionCount", 100, "The maximum number of requests per connection to the testUrl. This value shouldn't exceed max keepalive requests count set on the server")
 	testUrl                         = flag.String("testUrl", "http://localhost:8098/", "Url to test")
+	warmupRequestsCount             = flag.Int("warmupRequestsCount", 0, "The number of requests to perform during the warm-up phase before the measurement phase. For instance, set it to filesCount for filling the cache before the measurement. Leave zero for skipping the warm-up phase")
 	workersCount                    = flag.Int("workersCount", 4*numCpu, "The number of workers")
 )
 
@@ -54,9 +74,17 @@ var (
 
 func main() {
 	iniflags.Parse()
-	flag.VisitAll(func(f *flag.Flag) {
-		fmt.Printf("%s=%v\n", f.Name, f.Value)
-	})
+	if *outputFormat == "text" {
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("%s=%v\n", f.Name, f.Value)
+		})
+	}
+	if *outputFormat != "text" && *outputFormat != "csv" && *outputFormat != "json" {
+		log.Fatalf("Unsupported outputFormat=[%s]. Supported values: text, csv, json\n", *outputFormat)
+	}
+	if *disableKeepalive {
+		*requestsPerConnectionCount = 1
+	}
 
 	runtime.GOMAXPROCS(*goMaxProcs)
 
@@ -65,38 +93,146 @@ func main() {
 		log.Fatalf("Error=[%s] when parsing testUrl=[%s]\n", err, *testUrl)
 	}
 
+	var results []*phaseResult
+	if *warmupRequestsCount > 0 {
+		results = append(results, runPhase("warmup", *warmupRequestsCount, testUri))
+	}
+	results = append(results, runPhase("measurement", *requestsCount, testUri))
+	writeResults(os.Stdout, results)
+}
+
+// Stats for a single test phase.
+type phaseResult struct {
+	name          string
+	requestsCount int
+	duration      time.Duration
+	bytesRead     int64
+	responseTime  bench.Histogram
+}
+
+// Stats collected by a single worker.
+type workerStats struct {
+	bytesRead    int64
+	responseTime bench.Histogram
+}
+
+func runPhase(name string, requestsCount int, testUri *url.URL) *phaseResult {
 	ch := make(chan int, 100000)
-	bytesRead := make([]int64, *workersCount)
+	stats := make([]workerStats, *workersCount)
 	wg := &sync.WaitGroup{}
 
 	for i := 0; i < *workersCount; i++ {
 		wg.Add(1)
-		go worker(ch, wg, testUri, &bytesRead[i])
+		go worker(ch, wg, testUri, &stats[i])
 	}
 
-	log.Printf("Test started\n")
+	log.Printf("Phase %s started\n", name)
 	startTime := time.Now()
-	for i := 0; i < *requestsCount; i++ {
+	for i := 0; i < requestsCount; i++ {
 		ch <- 1
 	}
 	close(ch)
 	wg.Wait()
-	duration := time.Since(startTime)
-	seconds := float64(duration) / float64(time.Second)
 
-	var totalBytesRead int64
-	for i := 0; i < *workersCount; i++ {
-		totalBytesRead += bytesRead[i]
-	}
-	kbytesRead := float64(totalBytesRead) / float64(1000)
-	qps := float64(*requestsCount) / seconds
-	kbps := kbytesRead / seconds
-	log.Printf("Done\n")
-	log.Printf("%d requests from %d workers in %s\n", *requestsCount, *workersCount, duration)
-	log.Printf("%.0f Kbytes read, %.0f qps, %.0f Kbps\n", kbytesRead, qps, kbps)
+	r := &phaseResult{
+		name:          name,
+		requestsCount: requestsCount,
+		duration:      time.Since(startTime),
+	}
+	for i := range stats {
+		r.bytesRead += stats[i].bytesRead
+		r.responseTime.Merge(&stats[i].responseTime)
+	}
+	log.Printf("Phase %s done: %d requests from %d workers in %s\n", name, requestsCount, *workersCount, r.duration)
+	return r
 }
 
-func worker(ch <-chan int, wg *sync.WaitGroup, testUri *url.URL, bytesRead *int64) {
+// Phase results in the form suitable for CSV and JSON output.
+//
+// Durations are in milliseconds.
+type phaseReport struct {
+	Phase          string  `json:"phase"`
+	Requests       int     `json:"requests"`
+	Workers        int     `json:"workers"`
+	DurationMs     float64 `json:"durationMs"`
+	KbytesRead     float64 `json:"kbytesRead"`
+	Qps            float64 `json:"qps"`
+	Kbps           float64 `json:"kbps"`
+	ResponseMinMs  float64 `json:"responseMinMs"`
+	ResponseAvgMs  float64 `json:"responseAvgMs"`
+	ResponseP50Ms  float64 `json:"responseP50Ms"`
+	ResponseP90Ms  float64 `json:"responseP90Ms"`
+	ResponseP99Ms  float64 `json:"responseP99Ms"`
+	ResponseP999Ms float64 `json:"responseP999Ms"`
+	ResponseMaxMs  float64 `json:"responseMaxMs"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *phaseResult) report() *phaseReport {
+	seconds := r.duration.Seconds()
+	kbytesRead := float64(r.bytesRead) / float64(1000)
+	h := &r.responseTime
+	return &phaseReport{
+		Phase:          r.name,
+		Requests:       r.requestsCount,
+		Workers:        *workersCount,
+		DurationMs:     milliseconds(r.duration),
+		KbytesRead:     kbytesRead,
+		Qps:            float64(r.requestsCount) / seconds,
+		Kbps:           kbytesRead / seconds,
+		ResponseMinMs:  milliseconds(h.Min()),
+		ResponseAvgMs:  milliseconds(h.Mean()),
+		ResponseP50Ms:  milliseconds(h.Percentile(50)),
+		ResponseP90Ms:  milliseconds(h.Percentile(90)),
+		ResponseP99Ms:  milliseconds(h.Percentile(99)),
+		ResponseP999Ms: milliseconds(h.Percentile(99.9)),
+		ResponseMaxMs:  milliseconds(h.Max()),
+	}
+}
+
+func writeResults(w io.Writer, results []*phaseResult) {
+	switch *outputFormat {
+	case "json":
+		var reports []*phaseReport
+		for _, r := range results {
+			reports = append(reports, r.report())
+		}
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		if err := e.Encode(reports); err != nil {
+			log.Fatalf("Cannot write results in JSON: [%s]\n", err)
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"phase", "requests", "workers", "durationMs", "kbytesRead", "qps", "kbps",
+			"responseMinMs", "responseAvgMs", "responseP50Ms", "responseP90Ms", "responseP99Ms", "responseP999Ms", "responseMaxMs"})
+		for _, r := range results {
+			rr := r.report()
+			f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+			cw.Write([]string{rr.Phase, strconv.Itoa(rr.Requests), strconv.Itoa(rr.Workers), f(rr.DurationMs), f(rr.KbytesRead), f(rr.Qps), f(rr.Kbps),
+				f(rr.ResponseMinMs), f(rr.ResponseAvgMs), f(rr.ResponseP50Ms), f(rr.ResponseP90Ms), f(rr.ResponseP99Ms), f(rr.ResponseP999Ms), f(rr.ResponseMaxMs)})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Fatalf("Cannot write results in CSV: [%s]\n", err)
+		}
+	default:
+		for _, r := range results {
+			rr := r.report()
+			h := &r.responseTime
+			fmt.Fprintf(w, "Phase %s\n", r.name)
+			fmt.Fprintf(w, "%d requests from %d workers in %s\n", r.requestsCount, *workersCount, r.duration)
+			fmt.Fprintf(w, "%.0f Kbytes read, %.0f qps, %.0f Kbps\n", rr.KbytesRead, rr.Qps, rr.Kbps)
+			fmt.Fprintf(w, "Response time: min=%s, avg=%s, p50=%s, p90=%s, p99=%s, p99.9=%s, max=%s\n",
+				h.Min(), h.Mean(), h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Percentile(99.9), h.Max())
+		}
+	}
+}
+
+func worker(ch <-chan int, wg *sync.WaitGroup, testUri *url.URL, stats *workerStats) {
 	defer wg.Done()
 
 	hostPort := testUri.Host
@@ -108,16 +244,12 @@ func worker(ch <-chan int, wg *sync.WaitGroup, testUri *url.URL, bytesRead *int6
 		hostPort = net.JoinHostPort(hostPort, port)
 	}
 
-	for {
-		n := issueRequestsPerConnection(ch, hostPort, testUri)
-		if n == 0 {
-			break
-		}
-		*bytesRead += n
+	for issueRequestsPerConnection(ch, hostPort, testUri, stats) {
 	}
 }
 
-func issueRequestsPerConnection(ch <-chan int, hostPort string, testUri *url.URL) int64 {
+// Returns false if there are no more requests to issue.
+func issueRequestsPerConnection(ch <-chan int, hostPort string, testUri *url.URL, stats *workerStats) bool {
 	conn, err := net.Dial("tcp", hostPort)
 	if err != nil {
 		log.Fatalf("Error=[%s] when connecting to [%s]\n", err, hostPort)
@@ -131,15 +263,16 @@ func issueRequestsPerConnection(ch <-chan int, hostPort string, testUri *url.URL
 		}
 	}
 
-	statsChan := make(chan int64)
-	requestsChan := make(chan int, *maxPendingRequestsPerConnection)
-	go readResponses(conn, statsChan, requestsChan)
-	writeRequests(conn, ch, requestsChan, testUri)
+	doneChan := make(chan struct{})
+	requestsChan := make(chan time.Time, *maxPendingRequestsPerConnection)
+	go readResponses(conn, stats, doneChan, requestsChan)
+	requestsWritten := writeRequests(conn, ch, requestsChan, testUri)
 	close(requestsChan)
-	return <-statsChan
+	<-doneChan
+	return requestsWritten > 0
 }
 
-func writeRequests(conn net.Conn, ch <-chan int, requestsChan chan<- int, testUri *url.URL) {
+func writeRequests(conn net.Conn, ch <-chan int, requestsChan chan<- time.Time, testUri *url.URL) int {
 	var requestsWritten int
 	w := bufio.NewWriter(conn)
 	requestUri := testUri.RequestURI()
@@ -147,20 +280,25 @@ func writeRequests(conn net.Conn, ch <-chan int, requestsChan chan<- int, testUr
 	if strings.Contains(requestUri, "?") {
 		delimiter = "&"
 	}
+	connectionHeader := ""
+	if *disableKeepalive {
+		connectionHeader = "Connection: close\r\n"
+	}
 	for _ = range ch {
-		requestStr := []byte(fmt.Sprintf("GET %s%s%d HTTP/1.1\r\nHost: %s\r\nUser-Agent: go-cdn-booster-bench\r\n\r\n",
-			requestUri, delimiter, rand.Intn(*filesCount), testUri.Host))
+		requestStr := []byte(fmt.Sprintf("GET %s%s%d HTTP/1.1\r\nHost: %s\r\nUser-Agent: go-cdn-booster-bench\r\n%s\r\n",
+			requestUri, delimiter, rand.Intn(*filesCount), testUri.Host, connectionHeader))
+		startTime := time.Now()
 		if _, err := w.Write(requestStr); err != nil {
 			log.Fatalf("Error=[%s] when writing HTTP request [%d] to connection\n", err, requestsWritten)
 		}
 		requestsWritten += 1
 		select {
-		case requestsChan <- requestsWritten:
+		case requestsChan <- startTime:
 		default:
 			if err := w.Flush(); err != nil {
 				log.Fatalf("Error when flushing requests' buffer: [%s]\n", err)
 			}
-			requestsChan <- requestsWritten
+			requestsChan <- startTime
 		}
 		if requestsWritten == *requestsPerConnectionCount {
 			break
@@ -169,20 +307,22 @@ func writeRequests(conn net.Conn, ch <-chan int, requestsChan chan<- int, testUr
 	if err := w.Flush(); err != nil {
 		log.Fatalf("Error when flushing requests' buffer: [%s]\n", err)
 	}
+	return requestsWritten
 }
 
 var responsePool sync.Pool
 
-func readResponses(r io.Reader, statsChan chan<- int64, requestsChan <-chan int) {
+func readResponses(r io.Reader, stats *workerStats, doneChan chan<- struct{}, requestsChan <-chan time.Time) {
 	v := responsePool.Get()
 	if v == nil {
 		v = &fasthttp.Response{}
 	}
 	resp := v.(*fasthttp.Response)
 
-	var bytesRead int64
 	rb := bufio.NewReader(r)
-	for n := range requestsChan {
+	n := 0
+	for startTime := range requestsChan {
+		n++
 		err := resp.Read(rb)
 		if err != nil {
 			log.Fatalf("Error when reading response %d: [%s]\n", n, err)
@@ -190,8 +330,9 @@ func readResponses(r io.Reader, statsChan chan<- int64, requestsChan <-chan int)
 		if resp.StatusCode() != 200 {
 			log.Fatalf("Unexpected status code for the response %d: [%d]\n", n, resp.StatusCode())
 		}
-		bytesRead += int64(len(resp.Body()))
+		stats.responseTime.Add(time.Since(startTime))
+		stats.bytesRead += int64(len(resp.Body()))
 	}
-	statsChan <- bytesRead
+	close(doneChan)
 	responsePool.Put(v)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	adminListenAddr = flag.String("adminListenAddr", "", "TCP address to listen to admin API requests. The admin API mustn't be exposed to untrusted networks. Leave empty for disabling admin API")
+)
+
+// Admin API handlers keyed by request path.
+var adminHandlers = map[string]fasthttp.RequestHandler{}
+
+func registerAdminHandler(path string, h fasthttp.RequestHandler) {
+	if _, ok := adminHandlers[path]; ok {
+		panic("BUG: duplicate admin handler for path " + path)
+	}
+	adminHandlers[path] = h
+}
+
+func serveAdmin(ln net.Listener, addr string) {
+	logMessage("Listening admin API on [%s]", addr)
+	s := &fasthttp.Server{
+		Handler: adminRequestHandler,
+		Name:    "go-cdn-booster",
+	}
+	s.Serve(ln)
+}
+
+func adminRequestHandler(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	h, ok := adminHandlers[path]
+	if !ok {
+		var paths []string
+		for p := range adminHandlers {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		ctx.Error("Unknown admin API path. Supported paths: "+strings.Join(paths, ", "), fasthttp.StatusNotFound)
+		return
+	}
+	h(ctx)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	admissionMinRequests = flag.Int("admissionMinRequests", 0, "The minimum number of requests for an url within admissionWindow before its' response is cached. Responses for less frequently requested urls are proxied to clients without caching. "+
+		"This protects the cache from pollution by one-hit-wonder urls. Leave zero for caching all the responses")
+	admissionWindow     = flag.Duration("admissionWindow", time.Hour, "Request frequencies used by admissionMinRequests are halved after each admissionWindow, so old requests are gradually forgotten")
+	admissionSketchSize = flag.Int("admissionSketchSize", 1024*1024, "The number of counters per row in the frequency sketch used by admissionMinRequests. Higher values reduce frequency overestimation for long-tail workloads at the cost of higher memory usage")
+)
+
+// The number of rows in the frequency sketch.
+const sketchDepth = 4
+
+// Count-min sketch with 8-bit saturating counters.
+//
+// It estimates request frequencies for keys in a fixed amount of memory.
+// The estimate never underestimates the real frequency, but may overestimate
+// it due to hash collisions.
+type frequencySketch struct {
+	mu   sync.Mutex
+	rows [sketchDepth][]uint8
+}
+
+var admission *frequencySketch
+
+func initAdmission() {
+	if *admissionMinRequests <= 0 {
+		return
+	}
+	if *admissionMinRequests > 255 {
+		logFatal("admissionMinRequests=%d cannot exceed 255", *admissionMinRequests)
+	}
+	if *admissionSketchSize <= 0 {
+		logFatal("admissionSketchSize=%d must be positive", *admissionSketchSize)
+	}
+	if *admissionWindow <= 0 {
+		logFatal("admissionWindow=%s must be positive", *admissionWindow)
+	}
+	admission = newFrequencySketch(*admissionSketchSize)
+	go func() {
+		for range time.Tick(*admissionWindow) {
+			admission.age()
+		}
+	}()
+	logMessage("Caching responses only for urls requested at least %d times within admissionWindow=%s", *admissionMinRequests, *admissionWindow)
+}
+
+// Registers request for the given key and returns true if the response
+// for the key may be stored in the cache.
+func admitToCache(key []byte) bool {
+	if admission == nil {
+		return true
+	}
+	return admission.increment(key) >= *admissionMinRequests
+}
+
+func newFrequencySketch(size int) *frequencySketch {
+	s := &frequencySketch{}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// Increments frequency for the given key and returns the new estimate.
+func (s *frequencySketch) increment(key []byte) int {
+	h1, h2 := sketchHashes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 255
+	for i := range s.rows {
+		row := s.rows[i]
+		idx := (h1 + uint64(i)*h2) % uint64(len(row))
+		if row[idx] < 255 {
+			row[idx]++
+		}
+		if int(row[idx]) < n {
+			n = int(row[idx])
+		}
+	}
+	return n
+}
+
+// Halves all the counters, so old requests are gradually forgotten.
+func (s *frequencySketch) age() {
+	s.mu.Lock()
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] >>= 1
+		}
+	}
+	s.mu.Unlock()
+}
+
+// Returns two hashes for deriving row indexes via double hashing.
+func sketchHashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := (h1 >> 32) | (h1 << 32)
+	return h1, h2 | 1
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	allowedPathPrefixes = flag.String("allowedPathPrefixes", "", "Comma-separated list of request path prefixes, which may be proxied to upstream, for instance, '/static/,/images/'. "+
+		"Requests for other paths are rejected with 403 Forbidden without hitting upstream. See also allowedPathsRegexp. Leave empty for allowing all the paths")
+	allowedPathsRegexp = flag.String("allowedPathsRegexp", "", "Regular expression for request paths, which may be proxied to upstream, for instance, '^/[a-z0-9/_-]+\\.(js|css|png)$'. "+
+		"Paths matching either allowedPathPrefixes or allowedPathsRegexp are allowed. Leave empty for allowing all the paths")
+)
+
+// Non-nil if proxied paths are restricted.
+var pathAllowlist *allowedPaths
+
+type allowedPaths struct {
+	prefixes [][]byte
+	re       *regexp.Regexp
+}
+
+func initPathAllowlist() {
+	a := &allowedPaths{}
+	for _, p := range strings.Split(*allowedPathPrefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			a.prefixes = append(a.prefixes, []byte(p))
+		}
+	}
+	if *allowedPathsRegexp != "" {
+		re, err := regexp.Compile(*allowedPathsRegexp)
+		if err != nil {
+			logFatal("Cannot compile allowedPathsRegexp=[%s]: [%s]", *allowedPathsRegexp, err)
+		}
+		a.re = re
+	}
+	if len(a.prefixes) == 0 && a.re == nil {
+		return
+	}
+	pathAllowlist = a
+}
+
+func (a *allowedPaths) isAllowed(path []byte) bool {
+	for _, p := range a.prefixes {
+		if bytes.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return a.re != nil && a.re.Match(path)
+}
+
+// Responds with 403 Forbidden and returns false if the request path
+// mustn't be proxied to upstream.
+//
+// Always returns true if proxied paths aren't restricted.
+func checkPathAllowed(ctx *fasthttp.RequestCtx) bool {
+	if pathAllowlist == nil || pathAllowlist.isAllowed(ctx.Path()) {
+		return true
+	}
+	atomic.AddInt64(&stats.ForbiddenPathsCount, 1)
+	ctx.Error("Forbidden", fasthttp.StatusForbidden)
+	return false
+}
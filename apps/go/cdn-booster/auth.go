@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	authCredentialsFile = flag.String("authCredentialsFile", "", "Path to file with 'user:password' lines for Basic authentication of clients. "+
+		"Passwords may be given either as is or as 'sha256:<hex-encoded sha256 of password>'. Empty lines and lines starting with '#' are ignored. "+
+		"Clients must be authenticated either via authCredentialsFile or via authTokensFile if any of these flags is set. Leave empty for disabling Basic authentication")
+	authTokensFile = flag.String("authTokensFile", "", "Path to file with bearer tokens for authentication of clients, one token per line. "+
+		"Empty lines and lines starting with '#' are ignored. See authCredentialsFile. Leave empty for disabling bearer token authentication")
+	authExemptPaths = flag.String("authExemptPaths", "", "Comma-separated list of request path prefixes, which don't require client authentication, for instance, '/robots.txt,/public/'. "+
+		"See authCredentialsFile and authTokensFile")
+	authRealm = flag.String("authRealm", "go-cdn-booster", "Realm sent to unauthenticated clients in WWW-Authenticate header. See authCredentialsFile")
+)
+
+type clientAuth struct {
+	// Sha256 hashes of passwords by user name.
+	passwordHashes map[string][]byte
+
+	// Sha256 hashes of bearer tokens.
+	tokenHashes map[[sha256.Size]byte]struct{}
+
+	exemptPaths []string
+
+	wwwAuthenticate string
+}
+
+// Nil if client authentication is disabled.
+var auth *clientAuth
+
+func initAuth() {
+	if *authCredentialsFile == "" && *authTokensFile == "" {
+		return
+	}
+	a := &clientAuth{
+		passwordHashes: make(map[string][]byte),
+		tokenHashes:    make(map[[sha256.Size]byte]struct{}),
+	}
+	var challenges []string
+	if *authCredentialsFile != "" {
+		lines, err := readAuthLines(*authCredentialsFile)
+		if err != nil {
+			logFatal("Cannot read authCredentialsFile=[%s]: [%s]", *authCredentialsFile, err)
+		}
+		for _, line := range lines {
+			n := strings.IndexByte(line, ':')
+			if n <= 0 {
+				logFatal("Cannot find 'user:password' in authCredentialsFile=[%s]", *authCredentialsFile)
+			}
+			h, err := parsePasswordHash(line[n+1:])
+			if err != nil {
+				logFatal("Invalid password for user [%s] in authCredentialsFile=[%s]: [%s]", line[:n], *authCredentialsFile, err)
+			}
+			a.passwordHashes[line[:n]] = h
+		}
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q", *authRealm))
+	}
+	if *authTokensFile != "" {
+		lines, err := readAuthLines(*authTokensFile)
+		if err != nil {
+			logFatal("Cannot read authTokensFile=[%s]: [%s]", *authTokensFile, err)
+		}
+		for _, line := range lines {
+			a.tokenHashes[sha256.Sum256([]byte(line))] = struct{}{}
+		}
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", *authRealm))
+	}
+	for _, p := range strings.Split(*authExemptPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			a.exemptPaths = append(a.exemptPaths, p)
+		}
+	}
+	a.wwwAuthenticate = strings.Join(challenges, ", ")
+	auth = a
+	logMessage("Client authentication is enabled for %d users and %d tokens", len(a.passwordHashes), len(a.tokenHashes))
+}
+
+// Returns non-empty lines except comments.
+func readAuthLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+func parsePasswordHash(password string) ([]byte, error) {
+	if !strings.HasPrefix(password, "sha256:") {
+		h := sha256.Sum256([]byte(password))
+		return h[:], nil
+	}
+	h, err := hex.DecodeString(password[len("sha256:"):])
+	if err != nil {
+		return nil, err
+	}
+	if len(h) != sha256.Size {
+		return nil, fmt.Errorf("unexpected sha256 size=%d. Expected %d", len(h), sha256.Size)
+	}
+	return h, nil
+}
+
+// Responds with 401 Unauthorized and returns false if the client
+// isn't authenticated.
+//
+// Always returns true if client authentication is disabled.
+func checkAuth(ctx *fasthttp.RequestCtx) bool {
+	if auth == nil || auth.isExempt(ctx.Path()) || auth.isAuthenticated(ctx.Request.Header.Peek("Authorization")) {
+		return true
+	}
+	atomic.AddInt64(&stats.AuthFailuresCount, 1)
+	ctx.Response.Header.Set("WWW-Authenticate", auth.wwwAuthenticate)
+	ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+	return false
+}
+
+func (a *clientAuth) isExempt(path []byte) bool {
+	for _, p := range a.exemptPaths {
+		if bytes.HasPrefix(path, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *clientAuth) isAuthenticated(authorization []byte) bool {
+	n := bytes.IndexByte(authorization, ' ')
+	if n < 0 {
+		return false
+	}
+	scheme := string(bytes.ToLower(authorization[:n]))
+	credentials := bytes.TrimSpace(authorization[n+1:])
+	switch scheme {
+	case "basic":
+		return a.checkBasic(credentials)
+	case "bearer":
+		_, ok := a.tokenHashes[sha256.Sum256(credentials)]
+		return ok
+	}
+	return false
+}
+
+func (a *clientAuth) checkBasic(credentials []byte) bool {
+	buf, err := base64.StdEncoding.DecodeString(string(credentials))
+	if err != nil {
+		return false
+	}
+	n := bytes.IndexByte(buf, ':')
+	if n < 0 {
+		return false
+	}
+	expectedHash, ok := a.passwordHashes[string(buf[:n])]
+	if !ok {
+		return false
+	}
+	h := sha256.Sum256(buf[n+1:])
+	return subtle.ConstantTimeCompare(h[:], expectedHash) == 1
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	negativeCacheTtl = flag.Duration("negativeCacheTtl", time.Minute, "Cache duration for heuristically cacheable error responses such as 404 and 410 without explicit freshness in Cache-Control or Expires headers. Set to zero for disabling caching of such responses")
+)
+
+// Returns ttl for caching the upstream response with the given status code.
+//
+// Returns false if the response mustn't be cached. Status codes are
+// classified according to RFC 9110, section 15.1 and RFC 9111, section 4.2.2:
+//   - heuristically cacheable successful responses and permanent redirects
+//     are cached forever as 200 responses always were;
+//   - heuristically cacheable error responses are cached for the duration
+//     from Cache-Control or Expires headers or for negativeCacheTtl,
+//     which may be overridden by caching rules;
+//   - temporary redirects are cached only if they have explicit freshness;
+//   - other responses aren't cached.
+//
+// Ttls from statusTtls take precedence over the classification above.
+func cacheableTtl(resp *fasthttp.Response) (time.Duration, bool) {
+	if ttl, ok := getCacheRules().statusTtls.lookup(resp.StatusCode()); ok {
+		return ttl, ttl > 0
+	}
+	switch resp.StatusCode() {
+	case fasthttp.StatusOK, fasthttp.StatusNonAuthoritativeInfo, fasthttp.StatusNoContent,
+		fasthttp.StatusMultipleChoices, fasthttp.StatusMovedPermanently, fasthttp.StatusPermanentRedirect:
+		return ybc.MaxTtl, true
+	case fasthttp.StatusNotFound, fasthttp.StatusMethodNotAllowed, fasthttp.StatusGone,
+		fasthttp.StatusRequestURITooLong, fasthttp.StatusNotImplemented:
+		if ttl, ok := explicitTtl(&resp.Header); ok {
+			return ttl, ttl > 0
+		}
+		ttl := getCacheRules().negativeCacheTtl
+		return ttl, ttl > 0
+	case fasthttp.StatusFound, fasthttp.StatusTemporaryRedirect:
+		ttl, ok := explicitTtl(&resp.Header)
+		return ttl, ok && ttl > 0
+	}
+	return 0, false
+}
+
+// Returns freshness lifetime from s-maxage or max-age Cache-Control
+// directives or from Expires header. See RFC 9111, section 4.2.1.
+//
+// Returns false if the response has no explicit freshness.
+func explicitTtl(h *fasthttp.ResponseHeader) (time.Duration, bool) {
+	var maxAge time.Duration
+	hasMaxAge := false
+	for _, directive := range bytes.Split(h.Peek("Cache-Control"), []byte(",")) {
+		directive = bytes.TrimSpace(directive)
+		n := bytes.IndexByte(directive, '=')
+		if n < 0 {
+			if string(bytes.ToLower(directive)) == "no-store" {
+				return 0, true
+			}
+			continue
+		}
+		name := string(bytes.ToLower(directive[:n]))
+		if name != "s-maxage" && (name != "max-age" || hasMaxAge) {
+			continue
+		}
+		seconds, err := strconv.Atoi(string(bytes.Trim(directive[n+1:], "\"")))
+		if err != nil || seconds < 0 {
+			continue
+		}
+		maxAge = time.Duration(seconds) * time.Second
+		hasMaxAge = true
+		if name == "s-maxage" {
+			// s-maxage overrides max-age for shared caches.
+			return maxAge, true
+		}
+	}
+	if hasMaxAge {
+		return maxAge, true
+	}
+
+	expires := h.Peek("Expires")
+	if len(expires) == 0 {
+		return 0, false
+	}
+	expiresTime, err := fasthttp.ParseHTTPDate(expires)
+	if err != nil {
+		// Invalid Expires values mean 'already expired'.
+		return 0, true
+	}
+	date := time.Now()
+	if v := h.Peek("Date"); len(v) > 0 {
+		if t, err := fasthttp.ParseHTTPDate(v); err == nil {
+			date = t
+		}
+	}
+	return expiresTime.Sub(date), true
+}
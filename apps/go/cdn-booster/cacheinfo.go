@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+func initCacheInfo() {
+	registerAdminHandler("/cache-info", cacheInfoHandler)
+}
+
+// Metadata for cached object returned by /cache-info admin API endpoint.
+type cacheInfo struct {
+	Url    string `json:"url"`
+	Cached bool   `json:"cached"`
+
+	Size            int    `json:"size,omitempty"`
+	StatusCode      int    `json:"statusCode,omitempty"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Etag            string `json:"etag,omitempty"`
+	LastModified    string `json:"lastModified,omitempty"`
+	FetchTime       string `json:"fetchTime,omitempty"`
+	Ttl             string `json:"ttl,omitempty"`
+	RemainingTtl    string `json:"remainingTtl,omitempty"`
+
+	// Approximate number of requests for the url. Available only
+	// if topUrlsCount is set.
+	Hits *uint64 `json:"hits,omitempty"`
+}
+
+// Admin API handler returning metadata for the object cached
+// for the url passed in url query arg.
+//
+// Optional acceptEncoding query arg selects the cached encoding variant.
+// See varyAcceptEncoding.
+func cacheInfoHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	rawUrl := string(ctx.QueryArgs().Peek("url"))
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		ctx.Error(fmt.Sprintf("Invalid url=[%s]. Expected absolute url", rawUrl), fasthttp.StatusBadRequest)
+		return
+	}
+
+	var h fasthttp.RequestHeader
+	h.SetRequestURI(u.RequestURI())
+	h.SetHost(u.Host)
+	if v := ctx.QueryArgs().Peek("acceptEncoding"); len(v) > 0 {
+		h.SetBytesV("Accept-Encoding", v)
+	}
+	ci := getCacheInfo(&h)
+	ci.Url = rawUrl
+	data, err := json.MarshalIndent(ci, "", "  ")
+	if err != nil {
+		logFatal("BUG: cannot marshal cache info: [%s]", err)
+	}
+	ctx.Success("application/json", data)
+}
+
+func getCacheInfo(h *fasthttp.RequestHeader) *cacheInfo {
+	defer acquireCacheGen().release()
+
+	ci := &cacheInfo{}
+	if topHits != nil {
+		hits := topHits.estimate(h.RequestURI())
+		ci.Hits = &hits
+	}
+	key := urlCacheKey(nil, h, primaryOrigin)
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err != ybc.ErrCacheMiss {
+			logFatal("Unexpected error when obtaining cache value by key=[%s]: [%s]", key, err)
+		}
+		return ci
+	}
+	remainingTtl := item.Ttl()
+	var ih itemHeader
+	if item, err = unmarshalItem(item, &ih); err != nil {
+		item.Close()
+		return ci
+	}
+	defer item.Close()
+
+	ci.Cached = true
+	ci.Size = item.Available()
+	ci.StatusCode = ih.statusCode
+	if ci.StatusCode == 0 {
+		ci.StatusCode = fasthttp.StatusOK
+	}
+	ci.ContentType = ih.contentType
+	ci.ContentEncoding = ih.contentEncoding
+	ci.Etag = ih.etag
+	ci.LastModified = ih.lastModified.Format(time.RFC3339)
+	ci.FetchTime = ih.fetchTime.Format(time.RFC3339)
+	if ih.ttl > 0 {
+		ci.Ttl = ih.ttl.String()
+	}
+	ci.RemainingTtl = remainingTtl.String()
+	return ci
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Developer flags for testing cache stampedes and upstream failover
+// against a real instance. They mustn't be used in production.
+var (
+	chaosUpstreamLatency        = flag.Duration("chaosUpstreamLatency", 0, "Developer flag. Artificial latency added to chaosUpstreamLatencyPercent of upstream requests. Leave zero for disabling latency injection")
+	chaosUpstreamLatencyPercent = flag.Float64("chaosUpstreamLatencyPercent", 100, "Developer flag. Percentage of upstream requests delayed by chaosUpstreamLatency")
+	chaosUpstreamErrorPercent   = flag.Float64("chaosUpstreamErrorPercent", 0, "Developer flag. Percentage of upstream requests failed without sending them to upstream, as if upstream were unreachable")
+	chaosCacheMissPercent       = flag.Float64("chaosCacheMissPercent", 0, "Developer flag. Percentage of requests for cached objects, which are treated as cache misses, so they are fetched from upstream and stored in the cache again")
+)
+
+var errChaosUpstreamFailure = errors.New("upstream request failed due to chaosUpstreamErrorPercent")
+
+// Set if any of chaos flags is enabled.
+var chaosEnabled bool
+
+func initChaos() {
+	checkChaosPercent("chaosUpstreamLatencyPercent", *chaosUpstreamLatencyPercent)
+	checkChaosPercent("chaosUpstreamErrorPercent", *chaosUpstreamErrorPercent)
+	checkChaosPercent("chaosCacheMissPercent", *chaosCacheMissPercent)
+	if *chaosUpstreamLatency < 0 {
+		logFatal("chaosUpstreamLatency=%s cannot be negative", *chaosUpstreamLatency)
+	}
+	if *chaosUpstreamLatency > 0 && *chaosUpstreamLatencyPercent > 0 {
+		chaosEnabled = true
+		logMessage("CHAOS: delaying %.3f%% of upstream requests by %s", *chaosUpstreamLatencyPercent, *chaosUpstreamLatency)
+	}
+	if *chaosUpstreamErrorPercent > 0 {
+		chaosEnabled = true
+		logMessage("CHAOS: failing %.3f%% of upstream requests", *chaosUpstreamErrorPercent)
+	}
+	if *chaosCacheMissPercent > 0 {
+		chaosEnabled = true
+		logMessage("CHAOS: treating %.3f%% of cache hits as cache misses", *chaosCacheMissPercent)
+	}
+}
+
+func checkChaosPercent(name string, v float64) {
+	if v < 0 || v > 100 {
+		logFatal("%s=%v must be in the range [0..100]", name, v)
+	}
+}
+
+func chaosHit(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Delays the upstream request by chaosUpstreamLatency and returns
+// an error if the request must fail according to chaosUpstreamErrorPercent.
+func injectUpstreamChaos() error {
+	if !chaosEnabled {
+		return nil
+	}
+	if *chaosUpstreamLatency > 0 && chaosHit(*chaosUpstreamLatencyPercent) {
+		atomic.AddInt64(&stats.ChaosUpstreamDelaysCount, 1)
+		time.Sleep(*chaosUpstreamLatency)
+	}
+	if chaosHit(*chaosUpstreamErrorPercent) {
+		atomic.AddInt64(&stats.ChaosUpstreamErrorsCount, 1)
+		return errChaosUpstreamFailure
+	}
+	return nil
+}
+
+// Returns true if the cache hit must be treated as cache miss according
+// to chaosCacheMissPercent.
+func isChaosCacheMiss() bool {
+	if !chaosEnabled || !chaosHit(*chaosCacheMissPercent) {
+		return false
+	}
+	atomic.AddInt64(&stats.ChaosCacheMissesCount, 1)
+	return true
+}
+
+func (s *Stats) writeChaosStats(w io.Writer) {
+	if !chaosEnabled {
+		return
+	}
+	fmt.Fprintf(w, "CHAOS: delayed upstream requests: %d\n", atomic.LoadInt64(&s.ChaosUpstreamDelaysCount))
+	fmt.Fprintf(w, "CHAOS: failed upstream requests: %d\n", atomic.LoadInt64(&s.ChaosUpstreamErrorsCount))
+	fmt.Fprintf(w, "CHAOS: forced cache misses: %d\n", atomic.LoadInt64(&s.ChaosCacheMissesCount))
+}
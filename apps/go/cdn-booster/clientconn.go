@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	clientReadTimeout        = flag.Duration("clientReadTimeout", 10*time.Second, "The maximum duration for reading the whole request header from client. Clients sending request headers slower are disconnected, which protects from slowloris-style attacks")
+	clientWriteTimeout       = flag.Duration("clientWriteTimeout", 0, "The maximum duration for writing the whole response to client. Clients reading responses slower are disconnected. Big responses may legitimately take long time to download over slow networks, so the timeout is disabled by default. Leave zero for disabling the timeout")
+	clientIdleTimeout        = flag.Duration("clientIdleTimeout", time.Minute, "The maximum duration for waiting for the next request on keep-alive client connection")
+	clientMaxRequestsPerConn = flag.Int("clientMaxRequestsPerConn", 0, "The maximum number of requests served over a single client connection. The connection is closed after the last request. Leave zero for unlimited number of requests")
+	clientMaxConnsPerIP      = flag.Int("clientMaxConnsPerIP", 0, "The maximum number of concurrent client connections from a single IP. Leave zero for unlimited number of connections")
+	clientMaxHeaderSize      = flag.Int("clientMaxHeaderSize", 8*1024, "The maximum size of client request header in bytes. Requests with bigger headers are rejected. May be overridden by readBufferSize in listenersConfigFile")
+)
+
+func initClientConns() {
+	if *clientReadTimeout <= 0 {
+		logFatal("clientReadTimeout=%s must be positive", *clientReadTimeout)
+	}
+	if *clientIdleTimeout <= 0 {
+		logFatal("clientIdleTimeout=%s must be positive", *clientIdleTimeout)
+	}
+	if *clientMaxHeaderSize <= 0 {
+		logFatal("clientMaxHeaderSize=%d must be positive", *clientMaxHeaderSize)
+	}
+}
+
+// Returns server for client requests with connection limits set up
+// via client* flags.
+//
+// fasthttp reads request header into the read buffer, so the buffer size
+// limits the header size.
+func newClientServer(h fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:            h,
+		Name:               "go-cdn-booster",
+		ReadBufferSize:     *clientMaxHeaderSize,
+		ReadTimeout:        *clientReadTimeout,
+		WriteTimeout:       *clientWriteTimeout,
+		IdleTimeout:        *clientIdleTimeout,
+		MaxRequestsPerConn: *clientMaxRequestsPerConn,
+		MaxConnsPerIP:      *clientMaxConnsPerIP,
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// The suffix for cache files being compacted.
+const compactedFilesSuffix = ".compacted"
+
+// Cache generation, which may be replaced by compacted cache.
+type cacheGen struct {
+	ybc.Cacher
+
+	// The number of users of the cache generation.
+	//
+	// The cache is closed after it is replaced and all the users
+	// are gone.
+	refs int64
+}
+
+var (
+	// Contains *cacheGen.
+	currentCacheGen atomic.Value
+
+	// Non-zero while the compaction is in progress.
+	isCompacting uint32
+)
+
+// Returns cache, which may be replaced by compacted cache at runtime.
+func newCompactableCache(c ybc.Cacher) ybc.Cacher {
+	currentCacheGen.Store(&cacheGen{
+		Cacher: c,
+	})
+	registerAdminHandler("/compact", compactHandler)
+	return compactableCache{}
+}
+
+// Returns the current cache generation. The returned generation
+// isn't closed until release() is called.
+//
+// Items and set transactions obtained from the cache may be used only
+// while the generation obtained before them isn't released. Compactions
+// are serialized, so items obtained from the newer generation are protected
+// by the older generation as well.
+func acquireCacheGen() *cacheGen {
+	for {
+		g := currentCacheGen.Load().(*cacheGen)
+		atomic.AddInt64(&g.refs, 1)
+		if currentCacheGen.Load().(*cacheGen) == g {
+			return g
+		}
+		// The generation has been replaced in the mean time.
+		g.release()
+	}
+}
+
+func (g *cacheGen) release() {
+	atomic.AddInt64(&g.refs, -1)
+}
+
+func compactHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("Method not allowed. Use POST for starting the compaction", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&isCompacting, 0, 1) {
+		ctx.Error("The compaction is already in progress", fasthttp.StatusConflict)
+		return
+	}
+	defer atomic.StoreUint32(&isCompacting, 0)
+
+	msg, err := compactCache()
+	if err != nil {
+		logMessage("Cannot compact cache: [%s]", err)
+		ctx.Error(fmt.Sprintf("Cannot compact cache: %s", err), fasthttp.StatusInternalServerError)
+		return
+	}
+	logMessage("%s", msg)
+	ctx.Success("text/plain", []byte(msg))
+}
+
+type iterableCache interface {
+	Iterate(f func(key []byte, item *ybc.Item) bool)
+}
+
+// Copies live items into fresh cache files and then switches to these files.
+//
+// This drops space occupied by expired, deleted and overwritten items,
+// so long-running persistent caches don't accumulate fragmentation.
+// The compaction requires free disk space for the copy of cache files.
+// Items stored in the cache while live items are copied are lost
+// after the switch.
+//
+// Returns human-readable compaction summary.
+func compactCache() (string, error) {
+	startTime := time.Now()
+	configs := cacheConfigs(compactedFilesSuffix)
+
+	// Remove leftovers from the previous failed compaction.
+	configs.RemoveCluster()
+	compacted, err := openCacheFiles(configs)
+	if err != nil {
+		return "", fmt.Errorf("cannot open cache files for compaction: [%s]", err)
+	}
+
+	g := acquireCacheGen()
+	var copiedCount, skippedCount int
+	var copiedBytes int64
+	g.Cacher.(iterableCache).Iterate(func(key []byte, item *ybc.Item) bool {
+		ttl := item.Ttl()
+		if ttl <= 0 {
+			return true
+		}
+		value := item.Peek()
+		if err := compacted.Set(key, value, ttl); err != nil {
+			skippedCount++
+			return true
+		}
+		copiedCount++
+		copiedBytes += int64(len(value))
+		return true
+	})
+	g.release()
+
+	currentCacheGen.Store(&cacheGen{
+		Cacher: compacted,
+	})
+	for atomic.LoadInt64(&g.refs) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	g.Close()
+
+	// Compacted files remain open after renaming, so they are used
+	// by the cache until the next compaction or restart.
+	for i, cfg := range cacheConfigs("") {
+		if cfg.DataFile == "" {
+			// Anonymous cache has no files.
+			break
+		}
+		if err = os.Rename(configs[i].IndexFile, cfg.IndexFile); err != nil {
+			return "", fmt.Errorf("cannot replace index file [%s]: [%s]", cfg.IndexFile, err)
+		}
+		if err = os.Rename(configs[i].DataFile, cfg.DataFile); err != nil {
+			return "", fmt.Errorf("cannot replace data file [%s]: [%s]", cfg.DataFile, err)
+		}
+	}
+	return fmt.Sprintf("Compacted %d items with total size %.3f MBytes in %s. Skipped %d items, which didn't fit the compacted cache",
+		copiedCount, float64(copiedBytes)/1000000, time.Since(startTime), skippedCount), nil
+}
+
+// Cache, which delegates calls to the current cache generation.
+type compactableCache struct{}
+
+func (c compactableCache) Set(key []byte, value []byte, ttl time.Duration) error {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.Set(key, value, ttl)
+}
+
+func (c compactableCache) Get(key []byte) ([]byte, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.Get(key)
+}
+
+func (c compactableCache) AppendGet(dst, key []byte) ([]byte, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.AppendGet(dst, key)
+}
+
+func (c compactableCache) Delete(key []byte) bool {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.Delete(key)
+}
+
+func (c compactableCache) Clear() {
+	g := acquireCacheGen()
+	defer g.release()
+	g.Clear()
+}
+
+func (c compactableCache) Close() error {
+	return currentCacheGen.Load().(*cacheGen).Close()
+}
+
+func (c compactableCache) GetDe(key []byte, graceDuration time.Duration) ([]byte, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.GetDe(key, graceDuration)
+}
+
+func (c compactableCache) GetDeAsync(key []byte, graceDuration time.Duration) ([]byte, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.GetDeAsync(key, graceDuration)
+}
+
+func (c compactableCache) SetItem(key []byte, value []byte, ttl time.Duration) (*ybc.Item, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.SetItem(key, value, ttl)
+}
+
+func (c compactableCache) GetItem(key []byte) (*ybc.Item, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.GetItem(key)
+}
+
+func (c compactableCache) GetDeItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.GetDeItem(key, graceDuration)
+}
+
+func (c compactableCache) GetDeAsyncItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.GetDeAsyncItem(key, graceDuration)
+}
+
+func (c compactableCache) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (*ybc.SetTxn, error) {
+	g := acquireCacheGen()
+	defer g.release()
+	return g.NewSetTxn(key, valueSize, ttl)
+}
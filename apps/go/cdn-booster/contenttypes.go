@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Content type families for traffic breakdown in stats.
+const (
+	contentTypeImage = iota
+	contentTypeJs
+	contentTypeCss
+	contentTypeHtml
+	contentTypeOther
+	contentTypeFamiliesCount
+)
+
+var contentTypeFamilyNames = [contentTypeFamiliesCount]string{
+	contentTypeImage: "image",
+	contentTypeJs:    "js",
+	contentTypeCss:   "css",
+	contentTypeHtml:  "html",
+	contentTypeOther: "other",
+}
+
+var (
+	jsContentTypes = [][]byte{
+		[]byte("application/javascript"),
+		[]byte("application/x-javascript"),
+		[]byte("application/ecmascript"),
+		[]byte("text/javascript"),
+		[]byte("text/ecmascript"),
+	}
+	htmlContentTypes = [][]byte{
+		[]byte("text/html"),
+		[]byte("application/xhtml+xml"),
+	}
+	cssContentType = []byte("text/css")
+	imagePrefix    = []byte("image/")
+)
+
+// Returns content type family for the given Content-Type header value.
+func getContentTypeFamily(contentType []byte) int {
+	if n := bytes.IndexByte(contentType, ';'); n >= 0 {
+		contentType = contentType[:n]
+	}
+	contentType = bytes.TrimSpace(contentType)
+	if len(contentType) >= len(imagePrefix) && bytes.EqualFold(contentType[:len(imagePrefix)], imagePrefix) {
+		return contentTypeImage
+	}
+	if bytes.EqualFold(contentType, cssContentType) {
+		return contentTypeCss
+	}
+	for _, ct := range jsContentTypes {
+		if bytes.EqualFold(contentType, ct) {
+			return contentTypeJs
+		}
+	}
+	for _, ct := range htmlContentTypes {
+		if bytes.EqualFold(contentType, ct) {
+			return contentTypeHtml
+		}
+	}
+	return contentTypeOther
+}
+
+// Returns counters for bytes sent to clients and bytes read from upstream
+// for the given content type family.
+func (s *Stats) contentTypeCounters(family int) (sent, read *int64) {
+	switch family {
+	case contentTypeImage:
+		return &s.BytesSentImage, &s.BytesReadImage
+	case contentTypeJs:
+		return &s.BytesSentJs, &s.BytesReadJs
+	case contentTypeCss:
+		return &s.BytesSentCss, &s.BytesReadCss
+	case contentTypeHtml:
+		return &s.BytesSentHtml, &s.BytesReadHtml
+	default:
+		return &s.BytesSentOther, &s.BytesReadOther
+	}
+}
+
+// Registers n bytes with the given content type sent to the client.
+func registerBytesSent(contentType []byte, n int) {
+	atomic.AddInt64(&stats.BytesSentToClients, int64(n))
+	sent, _ := stats.contentTypeCounters(getContentTypeFamily(contentType))
+	atomic.AddInt64(sent, int64(n))
+}
+
+// Registers n bytes with the given content type read from upstream.
+func registerBytesRead(contentType []byte, n int) {
+	atomic.AddInt64(&stats.BytesReadFromUpstream, int64(n))
+	_, read := stats.contentTypeCounters(getContentTypeFamily(contentType))
+	atomic.AddInt64(read, int64(n))
+}
+
+// Writes traffic breakdown by content type families.
+func (s *Stats) writeContentTypeStats(w io.Writer) {
+	for family, name := range contentTypeFamilyNames {
+		sent, read := s.contentTypeCounters(family)
+		fmt.Fprintf(w, "Sent to clients (%s): %.3f MBytes\n", name, float64(atomic.LoadInt64(sent))/1000000)
+		fmt.Fprintf(w, "Read from upstream (%s): %.3f MBytes\n", name, float64(atomic.LoadInt64(read))/1000000)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	corsConfigFile = flag.String("corsConfigFile", "", "Path to JSON file with CORS rules. CORS preflight requests matching the rules are answered without hitting upstream, while Access-Control-Allow-* headers are added to responses for matching requests. "+
+		"Leave empty for disabling CORS handling")
+)
+
+// CORS rules from corsConfigFile.
+type corsConfig struct {
+	// The first rule matching request uri wins.
+	Rules []corsRule `json:"rules"`
+}
+
+type corsRule struct {
+	// Regular expression matched against request uri.
+	Pattern string `json:"pattern"`
+
+	// Origins allowed to access matching resources. "*" allows any origin.
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// Methods allowed in preflight requests. Default is GET and HEAD.
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+
+	// Request headers allowed in preflight requests. "*" allows
+	// any requested headers.
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+
+	// Response headers exposed to clients.
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+
+	// The duration for caching preflight responses by clients.
+	MaxAge string `json:"maxAge,omitempty"`
+}
+
+// Compiled form of corsRule.
+type compiledCorsRule struct {
+	re               *regexp.Regexp
+	anyOrigin        bool
+	allowedOrigins   map[string]struct{}
+	allowedMethods   string
+	anyHeader        bool
+	allowedHeaders   string
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+var corsRules []*compiledCorsRule
+
+func initCors() {
+	if *corsConfigFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*corsConfigFile)
+	if err != nil {
+		logFatal("Cannot read corsConfigFile=[%s]: [%s]", *corsConfigFile, err)
+	}
+	var c corsConfig
+	if err = json.Unmarshal(data, &c); err != nil {
+		logFatal("Cannot parse corsConfigFile=[%s]: [%s]", *corsConfigFile, err)
+	}
+	for _, r := range c.Rules {
+		cr, err := r.compile()
+		if err != nil {
+			logFatal("Invalid rule in corsConfigFile=[%s]: %s", *corsConfigFile, err)
+		}
+		corsRules = append(corsRules, cr)
+	}
+	logMessage("Loaded %d CORS rules from corsConfigFile=[%s]", len(corsRules), *corsConfigFile)
+}
+
+func (r *corsRule) compile() (*compiledCorsRule, error) {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile pattern [%s]: [%s]", r.Pattern, err)
+	}
+	if len(r.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("allowedOrigins cannot be empty for pattern [%s]", r.Pattern)
+	}
+	cr := &compiledCorsRule{
+		re:               re,
+		allowedOrigins:   make(map[string]struct{}, len(r.AllowedOrigins)),
+		allowedMethods:   "GET, HEAD",
+		exposedHeaders:   strings.Join(r.ExposedHeaders, ", "),
+		allowCredentials: r.AllowCredentials,
+	}
+	for _, o := range r.AllowedOrigins {
+		if o == "*" {
+			cr.anyOrigin = true
+			continue
+		}
+		cr.allowedOrigins[o] = struct{}{}
+	}
+	if len(r.AllowedMethods) > 0 {
+		cr.allowedMethods = strings.Join(r.AllowedMethods, ", ")
+	}
+	var headers []string
+	for _, h := range r.AllowedHeaders {
+		if h == "*" {
+			cr.anyHeader = true
+			continue
+		}
+		headers = append(headers, h)
+	}
+	cr.allowedHeaders = strings.Join(headers, ", ")
+	if r.MaxAge != "" {
+		maxAge, err := time.ParseDuration(r.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse maxAge=[%s] for pattern [%s]: [%s]", r.MaxAge, r.Pattern, err)
+		}
+		cr.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	}
+	return cr, nil
+}
+
+// Returns the first rule matching the request if the request origin
+// is allowed by the rule.
+func findCorsRule(ctx *fasthttp.RequestCtx) (*compiledCorsRule, []byte) {
+	if corsRules == nil {
+		return nil, nil
+	}
+	origin := ctx.Request.Header.Peek("Origin")
+	if len(origin) == 0 {
+		return nil, nil
+	}
+	requestURI := ctx.RequestURI()
+	for _, cr := range corsRules {
+		if !cr.re.Match(requestURI) {
+			continue
+		}
+		if !cr.anyOrigin {
+			if _, ok := cr.allowedOrigins[string(origin)]; !ok {
+				return nil, nil
+			}
+		}
+		return cr, origin
+	}
+	return nil, nil
+}
+
+func (cr *compiledCorsRule) setAllowOrigin(h *fasthttp.ResponseHeader, origin []byte) {
+	// Credentialed requests don't accept wildcard origin.
+	if cr.anyOrigin && !cr.allowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.SetBytesV("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if cr.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Answers CORS preflight request without hitting upstream.
+//
+// Returns false if the request isn't a preflight request matching
+// CORS rules.
+func handleCorsPreflight(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsOptions() || len(ctx.Request.Header.Peek("Access-Control-Request-Method")) == 0 {
+		return false
+	}
+	cr, origin := findCorsRule(ctx)
+	if cr == nil {
+		return false
+	}
+	atomic.AddInt64(&stats.CorsPreflightsCount, 1)
+	h := &ctx.Response.Header
+	cr.setAllowOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", cr.allowedMethods)
+	if cr.anyHeader {
+		if v := ctx.Request.Header.Peek("Access-Control-Request-Headers"); len(v) > 0 {
+			h.SetBytesV("Access-Control-Allow-Headers", v)
+		}
+	} else if cr.allowedHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", cr.allowedHeaders)
+	}
+	if cr.maxAge != "" {
+		h.Set("Access-Control-Max-Age", cr.maxAge)
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+	return true
+}
+
+// Adds Access-Control-Allow-* headers to the response if the request
+// matches CORS rules.
+func setCorsHeaders(ctx *fasthttp.RequestCtx) {
+	cr, origin := findCorsRule(ctx)
+	if cr == nil {
+		return
+	}
+	h := &ctx.Response.Header
+	cr.setAllowOrigin(h, origin)
+	if cr.exposedHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", cr.exposedHeaders)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	dedupMinSize = flag.Int("dedupMinSize", 0, "The minimum size in bytes of response bodies, which are deduplicated by their SHA-256 hash, for instance, 65536. "+
+		"Identical bodies served under distinct urls such as urls with cache-busting query strings are stored in the cache only once, "+
+		"while urls refer to them via small items. Leave zero for disabling deduplication")
+)
+
+// Keys for deduplicated bodies start with this prefix. '#' cannot occur
+// at the beginning of keys built from request host and uri.
+const dedupBlobKeyPrefix = "#blob="
+
+func dedupBlobKey(bodyHash string) []byte {
+	return []byte(dedupBlobKeyPrefix + bodyHash)
+}
+
+// Stores the body in the cache under its' hash if dedupMinSize is set.
+//
+// Returns the hex-encoded body hash, which must be stored in the item header
+// instead of the body. Returns empty string if the body must be stored
+// together with the item header.
+func storeDedupBody(body []byte, ttl time.Duration) string {
+	if *dedupMinSize <= 0 || len(body) < *dedupMinSize {
+		return ""
+	}
+	h := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(h[:])
+	key := dedupBlobKey(bodyHash)
+
+	if item, err := cache.GetItem(key); err == nil {
+		ok := item.Size() == len(body) && item.Ttl() >= ttl
+		item.Close()
+		if ok {
+			atomic.AddInt64(&stats.DedupHitsCount, 1)
+			atomic.AddInt64(&stats.DedupBytesSaved, int64(len(body)))
+			return bodyHash
+		}
+	}
+
+	txn, err := cache.NewSetTxn(key, len(body), ttl)
+	if err != nil {
+		return ""
+	}
+	if _, err = txn.Write(body); err != nil {
+		txn.Rollback()
+		return ""
+	}
+	if err = txn.Commit(); err != nil {
+		return ""
+	}
+	atomic.AddInt64(&stats.DedupBlobsCount, 1)
+	return bodyHash
+}
+
+// Unmarshals item header from the item.
+//
+// Returns the item with the deduplicated body if the header refers to it.
+// The original item is closed in this case. The original item is returned
+// on error.
+func unmarshalItem(item *ybc.Item, ih *itemHeader) (*ybc.Item, error) {
+	if err := ih.unmarshal(item); err != nil {
+		return item, err
+	}
+	if ih.bodyHash == "" {
+		return item, checkItemContentLength(item, ih)
+	}
+	blob, err := cache.GetItem(dedupBlobKey(ih.bodyHash))
+	if err != nil {
+		return item, fmt.Errorf("cannot obtain deduplicated body with hash=%s: [%s]", ih.bodyHash, err)
+	}
+	item.Close()
+	return blob, checkItemContentLength(blob, ih)
+}
+
+// Verifies the item body size matches the stored Content-Length.
+func checkItemContentLength(item *ybc.Item, ih *itemHeader) error {
+	if ih.contentLength > 0 && item.Available() != ih.contentLength {
+		return fmt.Errorf("unexpected body size=%d. Expected Content-Length=%d", item.Available(), ih.contentLength)
+	}
+	return nil
+}
+
+func writeDedupStats(w io.Writer) {
+	fmt.Fprintf(w, "Deduplicated bodies stored: %d\n", atomic.LoadInt64(&stats.DedupBlobsCount))
+	fmt.Fprintf(w, "Responses sharing already stored bodies: %d\n", atomic.LoadInt64(&stats.DedupHitsCount))
+	fmt.Fprintf(w, "Cache space saved by deduplication: %.3f MBytes\n", float64(atomic.LoadInt64(&stats.DedupBytesSaved))/1000000)
+}
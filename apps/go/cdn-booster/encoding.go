@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	varyAcceptEncoding = flag.Bool("varyAcceptEncoding", false, "Whether to cache distinct response variants per client Accept-Encoding. "+
+		"Accept-Encoding values are normalized into a small set of canonical variants - br, gzip and identity - so exotic values don't fragment the cache. "+
+		"The normalized value is sent to upstream, so it may return compressed responses")
+)
+
+// Canonical Accept-Encoding variants in the order of preference.
+var canonicalEncodings = []string{"br", "gzip"}
+
+const identityEncoding = "identity"
+
+// Returns canonical encoding variant for the given Accept-Encoding value.
+//
+// The most preferred canonical encoding accepted by the client is returned.
+// Encodings with q=0 aren't accepted. Quality values are otherwise ignored,
+// since clients rarely prefer gzip over br.
+func normalizeAcceptEncoding(acceptEncoding []byte) string {
+	var accepted [2]bool
+	acceptsAny := false
+	for _, v := range bytes.Split(acceptEncoding, []byte(",")) {
+		name := v
+		if n := bytes.IndexByte(v, ';'); n >= 0 {
+			name = v[:n]
+			if isZeroQuality(v[n+1:]) {
+				continue
+			}
+		}
+		name = bytes.ToLower(bytes.TrimSpace(name))
+		if string(name) == "*" {
+			acceptsAny = true
+			continue
+		}
+		for i, e := range canonicalEncodings {
+			if string(name) == e {
+				accepted[i] = true
+			}
+		}
+	}
+	for i, e := range canonicalEncodings {
+		if accepted[i] || acceptsAny {
+			return e
+		}
+	}
+	return identityEncoding
+}
+
+func isZeroQuality(params []byte) bool {
+	for _, p := range bytes.Split(params, []byte(";")) {
+		p = bytes.TrimSpace(p)
+		if len(p) < 2 || (p[0] != 'q' && p[0] != 'Q') || p[1] != '=' {
+			continue
+		}
+		q, err := strconv.ParseFloat(string(p[2:]), 64)
+		return err == nil && q == 0
+	}
+	return false
+}
+
+// Appends canonical encoding variant for the request to the cache key
+// if varyAcceptEncoding is set.
+//
+// Keys for identity variant aren't modified, so cached items remain valid
+// after enabling varyAcceptEncoding.
+func appendEncodingVariant(key []byte, h *fasthttp.RequestHeader) []byte {
+	if !*varyAcceptEncoding {
+		return key
+	}
+	e := normalizeAcceptEncoding(h.Peek("Accept-Encoding"))
+	if e == identityEncoding {
+		return key
+	}
+	// '#' cannot occur in request uri, so variant keys don't clash
+	// with keys for other objects.
+	key = append(key, "#enc="...)
+	return append(key, e...)
+}
+
+// Sets normalized Accept-Encoding for the upstream request
+// if varyAcceptEncoding is set.
+func setUpstreamAcceptEncoding(h *fasthttp.RequestHeader, upstreamHeader *fasthttp.RequestHeader) {
+	if !*varyAcceptEncoding {
+		return
+	}
+	upstreamHeader.Set("Accept-Encoding", normalizeAcceptEncoding(h.Peek("Accept-Encoding")))
+}
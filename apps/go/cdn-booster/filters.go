@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	responseFilters = flag.String("responseFilters", "", "Comma-separated list of response filters to apply in the given order. Filters must be compiled in via RegisterResponseFilter(). "+
+		"Leave empty for serving responses as is")
+)
+
+// ResponseFilter transforms responses, for instance, rewrites html,
+// adds watermarks or injects tokens.
+//
+// Custom filters may be compiled into go-cdn-booster by adding a file
+// to this package, which registers the filter in init():
+//
+//	type myFilter struct{}
+//
+//	func (f *myFilter) FilterUpstreamResponse(h *fasthttp.RequestHeader, resp *fasthttp.Response) error {
+//	  resp.SetBody(bytes.Replace(resp.Body(), []byte("foo"), []byte("bar"), -1))
+//	  return nil
+//	}
+//
+//	func (f *myFilter) FilterClientResponse(ctx *fasthttp.RequestCtx) {}
+//
+//	func init() {
+//	  RegisterResponseFilter("my", &myFilter{})
+//	}
+//
+// Then the filter is enabled with -responseFilters=my .
+type ResponseFilter interface {
+	// Called for each upstream response before it is cached or passed
+	// through to the client.
+	//
+	// The filter may modify both body and headers of resp. Content-Type,
+	// Etag, Last-Modified and Location headers are cached together
+	// with the body. The Etag is generated from the filtered body
+	// if it is missing.
+	//
+	// The response isn't cached and the client receives
+	// 503 Service Unavailable if an error is returned.
+	FilterUpstreamResponse(h *fasthttp.RequestHeader, resp *fasthttp.Response) error
+
+	// Called for each response before it is sent to the client.
+	//
+	// The filter may modify ctx.Response. The response may have
+	// non-200 status code for conditional and range requests, so filters
+	// modifying the body must check the status code.
+	//
+	// Keep in mind that this method is called for each cache hit, so it
+	// must be fast. Prefer transforming responses
+	// in FilterUpstreamResponse(), so they are transformed only once
+	// before caching.
+	FilterClientResponse(ctx *fasthttp.RequestCtx)
+}
+
+// Response filters keyed by name.
+var registeredResponseFilters = map[string]ResponseFilter{}
+
+// Registers response filter with the given name.
+//
+// Must be called from init(), since filters are enabled via responseFilters
+// flag at startup.
+func RegisterResponseFilter(name string, f ResponseFilter) {
+	if _, ok := registeredResponseFilters[name]; ok {
+		panic("BUG: duplicate response filter " + name)
+	}
+	registeredResponseFilters[name] = f
+}
+
+// Filters enabled via responseFilters flag.
+var activeResponseFilters []ResponseFilter
+
+func initResponseFilters() {
+	if *responseFilters == "" {
+		return
+	}
+	for _, name := range strings.Split(*responseFilters, ",") {
+		name = strings.TrimSpace(name)
+		f, ok := registeredResponseFilters[name]
+		if !ok {
+			var names []string
+			for n := range registeredResponseFilters {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			logFatal("Unknown filter [%s] in responseFilters=[%s]. Registered filters: [%s]", name, *responseFilters, strings.Join(names, ", "))
+		}
+		activeResponseFilters = append(activeResponseFilters, f)
+	}
+	logMessage("Enabled response filters [%s]", *responseFilters)
+}
+
+func filterUpstreamResponse(h *fasthttp.RequestHeader, resp *fasthttp.Response) error {
+	if activeResponseFilters == nil {
+		return nil
+	}
+	for _, f := range activeResponseFilters {
+		if err := f.FilterUpstreamResponse(h, resp); err != nil {
+			return err
+		}
+	}
+	// Filters may change the body without updating Content-Length,
+	// while storeResponse() verifies the body size against it.
+	resp.Header.SetContentLength(len(resp.Body()))
+	return nil
+}
+
+// Applies filters to the response and returns the size of the body
+// sent to the client.
+//
+// n is the body size before filtering.
+func filterClientResponse(ctx *fasthttp.RequestCtx, n int) int {
+	if activeResponseFilters == nil {
+		return n
+	}
+	for _, f := range activeResponseFilters {
+		f.FilterClientResponse(ctx)
+	}
+	return len(ctx.Response.Body())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamHedgePercentile = flag.Float64("upstreamHedgePercentile", 0, "Percentile of upstream response times in the range (0..100) for hedging upstream requests, for instance, 95. "+
+		"If the upstream address doesn't respond within this percentile of recent response times, the request is sent to another upstream address "+
+		"and the response received first is used. Hedging works only if upstreamHost resolves to multiple addresses. See upstreamResolver. Leave zero for disabling hedging")
+	upstreamHedgeMinDelay = flag.Duration("upstreamHedgeMinDelay", 10*time.Millisecond, "The minimum delay before sending hedged request to another upstream address. See upstreamHedgePercentile")
+)
+
+const (
+	// The number of recent upstream response times used for calculating
+	// hedging delay.
+	hedgeSamplesCount = 1024
+
+	// Hedging delay is recalculated after this number of new samples.
+	hedgeRecalcInterval = 64
+)
+
+// Tracks recent upstream response times for calculating hedging delay.
+type upstreamLatencies struct {
+	mu      sync.Mutex
+	samples [hedgeSamplesCount]time.Duration
+	n       int
+
+	// Hedging delay in nanoseconds. Zero until enough samples are collected.
+	delay int64
+}
+
+var hedgeLatencies *upstreamLatencies
+
+func initUpstreamHedging() {
+	if *upstreamHedgePercentile == 0 {
+		return
+	}
+	if *upstreamHedgePercentile < 0 || *upstreamHedgePercentile >= 100 {
+		logFatal("upstreamHedgePercentile=%f must be in the range (0..100)", *upstreamHedgePercentile)
+	}
+	hedgeLatencies = &upstreamLatencies{}
+	logMessage("Hedging upstream requests slower than %.1f percentile of response times", *upstreamHedgePercentile)
+}
+
+func (l *upstreamLatencies) register(d time.Duration) {
+	l.mu.Lock()
+	l.samples[l.n%hedgeSamplesCount] = d
+	l.n++
+	if l.n%hedgeRecalcInterval != 0 {
+		l.mu.Unlock()
+		return
+	}
+	n := l.n
+	if n > hedgeSamplesCount {
+		n = hedgeSamplesCount
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, l.samples[:n])
+	l.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	delay := samples[int(float64(n-1)**upstreamHedgePercentile/100)]
+	if delay < *upstreamHedgeMinDelay {
+		delay = *upstreamHedgeMinDelay
+	}
+	atomic.StoreInt64(&l.delay, int64(delay))
+}
+
+// Returns zero if hedging delay isn't known yet.
+func (l *upstreamLatencies) getDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.delay))
+}
+
+// Returns two distinct clients from the pool.
+//
+// Returns nil for the second client if the pool contains a single client.
+func (p *upstreamPool) nextPair() (*fasthttp.HostClient, *fasthttp.HostClient) {
+	clients := p.clients.Load().([]*fasthttp.HostClient)
+	n := atomic.AddUint32(&p.n, 1)
+	c := clients[n%uint32(len(clients))]
+	if len(clients) < 2 {
+		return c, nil
+	}
+	return c, clients[(n+1)%uint32(len(clients))]
+}
+
+func doUpstreamClientRequest(c *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	atomic.AddInt64(&stats.UpstreamRequestsCount, 1)
+	atomic.AddInt64(&stats.UpstreamInflightRequests, 1)
+	startTime := time.Now()
+	err := injectUpstreamChaos()
+	if err == nil {
+		err = doUpstreamProtocolRequest(c, req, resp)
+	}
+	atomic.AddInt64(&stats.UpstreamInflightRequests, -1)
+	if err == nil {
+		d := time.Since(startTime)
+		if hedgeLatencies != nil {
+			hedgeLatencies.register(d)
+		}
+		registerUpstreamLatency(d)
+	}
+	return err
+}
+
+type hedgeResult struct {
+	resp   *fasthttp.Response
+	err    error
+	hedged bool
+}
+
+// Sends the request to c and then to hedgeClient if c doesn't respond
+// within hedging delay.
+//
+// The response received first is returned in resp. The slower request
+// isn't canceled, so it finishes in background.
+func doHedgedUpstreamRequest(c, hedgeClient *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	delay := hedgeLatencies.getDelay()
+	if delay == 0 {
+		return doUpstreamClientRequest(c, req, resp)
+	}
+
+	results := make(chan hedgeResult, 2)
+	send := func(c *fasthttp.HostClient, hedged bool) {
+		// The request is copied, since it may outlive the caller.
+		var r fasthttp.Request
+		req.CopyTo(&r)
+		go func() {
+			var resp fasthttp.Response
+			err := doUpstreamClientRequest(c, &r, &resp)
+			results <- hedgeResult{
+				resp:   &resp,
+				err:    err,
+				hedged: hedged,
+			}
+		}()
+	}
+
+	send(c, false)
+	t := time.NewTimer(delay)
+	var res hedgeResult
+	select {
+	case res = <-results:
+		t.Stop()
+	case <-t.C:
+		atomic.AddInt64(&stats.UpstreamHedgedRequestsCount, 1)
+		send(hedgeClient, true)
+		res = <-results
+		if res.err != nil {
+			// Wait for the other request.
+			res = <-results
+		}
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if res.hedged {
+		atomic.AddInt64(&stats.UpstreamHedgeWinsCount, 1)
+	}
+	res.resp.CopyTo(resp)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	http3ListenAddrs  = flag.String("http3ListenAddrs", "", "Experimental. A list of UDP addresses to listen to HTTP/3 (QUIC) requests. Certificates are configured via the same flags as for httpsListenAddrs. Leave empty if you don't need HTTP/3")
+	http3AltSvcMaxAge = flag.Int("http3AltSvcMaxAge", 86400, "The value for 'ma' parameter in Alt-Svc header advertising HTTP/3 listeners to clients. In seconds. "+
+		"The header is sent in HTTP/1.1 responses only, since HTTP/2 isn't supported")
+)
+
+// The value for Alt-Svc header sent to clients if HTTP/3 is enabled.
+var altSvcHeader string
+
+func initAltSvcHeader(addrs []string) {
+	var values []string
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			logFatal("Cannot parse http3 listen address [%s]: [%s]", addr, err)
+		}
+		values = append(values, fmt.Sprintf("h3=\":%s\"; ma=%d", port, *http3AltSvcMaxAge))
+	}
+	altSvcHeader = strings.Join(values, ", ")
+}
+
+func listenUDP(addr string) net.PacketConn {
+	network := "udp"
+	switch *listenNetwork {
+	case "tcp4":
+		network = "udp4"
+	case "tcp6":
+		network = "udp6"
+	}
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		logFatal("Cannot listen [%s]: [%s]", addr, err)
+	}
+	return conn
+}
+
+func serveHttp3(conn net.PacketConn, addr string, c *tls.Config) {
+	s := newHttp3Server(addr, c, requestHandler)
+	logMessage("Listening http3 on [%s]", addr)
+	if err := s.Serve(conn); err != nil {
+		logFatal("Cannot serve http3 on [%s]: [%s]", addr, err)
+	}
+}
+
+func newHttp3Server(addr string, c *tls.Config, h fasthttp.RequestHandler) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		TLSConfig: c,
+		Handler:   newHttp3Handler(h),
+	}
+}
+
+// Returns net/http handler for http3.Server, which serves requests
+// with fasthttp handler h.
+func newHttp3Handler(h fasthttp.RequestHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx fasthttp.RequestCtx
+		ctx.Init2(newHttp3Conn(r), log.Default(), false)
+		if err := initHttp3Request(&ctx.Request, r); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot read request body: [%s]", err), http.StatusBadRequest)
+			return
+		}
+		h(&ctx)
+		writeHttp3Response(w, r, &ctx.Response)
+	})
+}
+
+func initHttp3Request(req *fasthttp.Request, r *http.Request) error {
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.RequestURI)
+	req.Header.SetHost(r.Host)
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	if r.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req.SetBody(body)
+	return nil
+}
+
+func writeHttp3Response(w http.ResponseWriter, r *http.Request, resp *fasthttp.Response) {
+	h := w.Header()
+	for k, v := range resp.Header.All() {
+		if isHopByHopHeader(k) {
+			continue
+		}
+		h.Add(string(k), string(v))
+	}
+	w.WriteHeader(resp.StatusCode())
+	if r.Method == "HEAD" || resp.SkipBody {
+		resp.CloseBodyStream()
+		return
+	}
+	if err := resp.BodyWriteTo(w); err != nil {
+		logMessage("Cannot send response body to http3 client [%s]: [%s]", r.RemoteAddr, err)
+	}
+}
+
+// Returns true for connection-specific headers, which are prohibited
+// in HTTP/3. See RFC 9114, section 4.2.
+func isHopByHopHeader(k []byte) bool {
+	switch string(k) {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
+}
+
+// net.Conn passed to fasthttp.RequestCtx for requests served via HTTP/3.
+//
+// It provides client address and TLS connection state to request handlers.
+// Request and response bodies are passed via http3.Server, so reads
+// and writes aren't supported.
+type http3Conn struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tlsState   tls.ConnectionState
+}
+
+var errHttp3ConnIO = errors.New("BUG: unexpected I/O on http3 connection")
+
+func newHttp3Conn(r *http.Request) *http3Conn {
+	c := &http3Conn{
+		localAddr:  toTCPAddr(r.Context().Value(http.LocalAddrContextKey)),
+		remoteAddr: toTCPAddr(r.Context().Value(http3.RemoteAddrContextKey)),
+	}
+	if r.TLS != nil {
+		c.tlsState = *r.TLS
+	}
+	return c
+}
+
+// Converts QUIC address to *net.TCPAddr, since fasthttp.RequestCtx.RemoteIP()
+// and fasthttp.RequestCtx.LocalIP() recognize only TCP addresses.
+func toTCPAddr(v interface{}) *net.TCPAddr {
+	addr, ok := v.(*net.UDPAddr)
+	if !ok {
+		return &net.TCPAddr{}
+	}
+	return &net.TCPAddr{
+		IP:   addr.IP,
+		Port: addr.Port,
+		Zone: addr.Zone,
+	}
+}
+
+func (c *http3Conn) Read(b []byte) (int, error)         { return 0, errHttp3ConnIO }
+func (c *http3Conn) Write(b []byte) (int, error)        { return 0, errHttp3ConnIO }
+func (c *http3Conn) Close() error                       { return nil }
+func (c *http3Conn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *http3Conn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *http3Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *http3Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *http3Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Handshake and ConnectionState make fasthttp.RequestCtx.IsTLS() return true.
+func (c *http3Conn) Handshake() error                     { return nil }
+func (c *http3Conn) ConnectionState() tls.ConnectionState { return c.tlsState }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
+)
+
+func TestHttp3Server(t *testing.T) {
+	cert, pool := newTestTLSCertificate(t)
+	conn := listenUDP("127.0.0.1:0")
+	addr := conn.LocalAddr().String()
+	s := newHttp3Server(addr, &tls.Config{Certificates: []tls.Certificate{cert}}, func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsTLS() {
+			ctx.Error("expecting TLS connection", fasthttp.StatusInternalServerError)
+			return
+		}
+		if !ctx.RemoteIP().Equal(net.ParseIP("127.0.0.1")) {
+			ctx.Error(fmt.Sprintf("unexpected remote ip=[%s]", ctx.RemoteIP()), fasthttp.StatusInternalServerError)
+			return
+		}
+		if string(ctx.Path()) == "/stream" {
+			ctx.Response.Header.Set("Keep-Alive", "timeout=5")
+			ctx.Response.Header.Set("Proxy-Connection", "keep-alive")
+			ctx.Response.Header.Set("Upgrade", "h2c")
+			ctx.SetBodyStream(strings.NewReader("streamed body"), -1)
+			return
+		}
+		ctx.Response.Header.Set("X-Test", string(ctx.Request.Header.Peek("X-Test")))
+		ctx.Response.Header.SetCookie(newTestCookie())
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		fmt.Fprintf(ctx, "%s %s %s %s", ctx.Method(), ctx.RequestURI(), ctx.Host(), ctx.PostBody())
+	})
+	go s.Serve(conn)
+	defer s.Close()
+
+	tr := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	defer tr.Close()
+	c := &http.Client{
+		Transport: tr,
+		Timeout:   10 * time.Second,
+	}
+
+	req, err := http.NewRequest("POST", "https://"+addr+"/foo/bar?baz", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatalf("Cannot create request: [%s]", err)
+	}
+	req.Header.Set("X-Test", "header value")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot send request: [%s]", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Cannot read response body: [%s]", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected status code=%d. Expected %d. Body=[%s]", resp.StatusCode, http.StatusCreated, body)
+	}
+	expectedBody := "POST /foo/bar?baz " + addr + " request body"
+	if string(body) != expectedBody {
+		t.Fatalf("Unexpected body=[%s]. Expected [%s]", body, expectedBody)
+	}
+	if v := resp.Header.Get("X-Test"); v != "header value" {
+		t.Fatalf("Unexpected X-Test header=[%s]. Expected [header value]", v)
+	}
+	if v := resp.Header.Get("Set-Cookie"); v != "foo=bar" {
+		t.Fatalf("Unexpected Set-Cookie header=[%s]. Expected [foo=bar]", v)
+	}
+	if v := resp.Header.Get("Connection"); v != "" {
+		t.Fatalf("Unexpected Connection header=[%s]", v)
+	}
+
+	// Responses with unknown body size are sent with Transfer-Encoding
+	// over HTTP/1.1, which mustn't leak into HTTP/3 response.
+	resp, err = c.Get("https://" + addr + "/stream")
+	if err != nil {
+		t.Fatalf("Cannot send request: [%s]", err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Cannot read response body: [%s]", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code=%d. Expected %d. Body=[%s]", resp.StatusCode, http.StatusOK, body)
+	}
+	if string(body) != "streamed body" {
+		t.Fatalf("Unexpected body=[%s]. Expected [streamed body]", body)
+	}
+	for _, k := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"} {
+		if v := resp.Header.Get(k); v != "" {
+			t.Fatalf("Unexpected %s header=[%s]", k, v)
+		}
+	}
+	if len(resp.TransferEncoding) > 0 {
+		t.Fatalf("Unexpected Transfer-Encoding=%v", resp.TransferEncoding)
+	}
+}
+
+func newTestCookie() *fasthttp.Cookie {
+	var c fasthttp.Cookie
+	c.SetKey("foo")
+	c.SetValue("bar")
+	return &c
+}
+
+func newTestTLSCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: [%s]", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: [%s]", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Cannot parse certificate: [%s]", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	maxRequestUrlLength = flag.Int("maxRequestUrlLength", 0, "The maximum length of request url in bytes. Requests with longer urls are rejected with 414 Request-URI Too Long. "+
+		"Leave zero for allowing urls of any length")
+	rejectUnsafeUrls = flag.Bool("rejectUnsafeUrls", false, "Whether to reject requests with 400 Bad Request if their urls contain null bytes, control chars or path traversal sequences such as '/../', "+
+		"including percent-encoded ones in url path. Such requests are rejected before the cache key is built and before they reach upstream")
+	disallowedUrlChars = flag.String("disallowedUrlChars", "", "Chars, which mustn't be present in request urls, for instance, '<>\"'. Requests with such chars in urls, "+
+		"including percent-encoded ones in url path, are rejected with 400 Bad Request. Leave empty for allowing all the chars")
+	blockedUserAgentsRegexp = flag.String("blockedUserAgentsRegexp", "", "Regular expression for User-Agent request header values, which are rejected with 403 Forbidden, for instance, '(?i)sqlmap|nikto'. "+
+		"Leave empty for allowing all the user agents")
+)
+
+// Non-nil if requests are checked for hygiene.
+var requestHygiene *hygieneRules
+
+type hygieneRules struct {
+	maxUrlLength      int
+	rejectUnsafe      bool
+	disallowedChars   string
+	blockedUserAgents *regexp.Regexp
+}
+
+// Path traversal sequences rejected by rejectUnsafeUrls.
+var pathTraversalSequences = [][]byte{
+	[]byte("/../"),
+	[]byte("\\..\\"),
+	[]byte("/..\\"),
+	[]byte("\\../"),
+}
+
+func initRequestHygiene() {
+	if *maxRequestUrlLength < 0 {
+		logFatal("maxRequestUrlLength=%d cannot be negative", *maxRequestUrlLength)
+	}
+	r := &hygieneRules{
+		maxUrlLength:    *maxRequestUrlLength,
+		rejectUnsafe:    *rejectUnsafeUrls,
+		disallowedChars: *disallowedUrlChars,
+	}
+	if *blockedUserAgentsRegexp != "" {
+		re, err := regexp.Compile(*blockedUserAgentsRegexp)
+		if err != nil {
+			logFatal("Cannot compile blockedUserAgentsRegexp=[%s]: [%s]", *blockedUserAgentsRegexp, err)
+		}
+		r.blockedUserAgents = re
+	}
+	if r.maxUrlLength == 0 && !r.rejectUnsafe && r.disallowedChars == "" && r.blockedUserAgents == nil {
+		return
+	}
+	requestHygiene = r
+}
+
+// Returns true if the given url is safe according to rejectUnsafeUrls
+// and disallowedUrlChars.
+func (r *hygieneRules) isSafeUrl(uri []byte) bool {
+	if r.disallowedChars != "" && bytes.ContainsAny(uri, r.disallowedChars) {
+		return false
+	}
+	if r.rejectUnsafe {
+		for _, c := range uri {
+			if c < 0x20 || c == 0x7f {
+				return false
+			}
+		}
+		// The url may end with '/..' if the query string is missing.
+		if n := bytes.IndexByte(uri, '?'); n >= 0 {
+			uri = uri[:n]
+		}
+		if bytes.HasSuffix(uri, []byte("/..")) || bytes.HasSuffix(uri, []byte("\\..")) {
+			return false
+		}
+		for _, seq := range pathTraversalSequences {
+			if bytes.Contains(uri, seq) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns true if the given raw request uri is safe according
+// to rejectUnsafeUrls and disallowedUrlChars.
+//
+// Percent-encoded url path is checked after decoding, so percent-encoding
+// cannot be used for bypassing the checks. The query string isn't decoded,
+// since it may contain arbitrary data such as 'q=100%'.
+func (r *hygieneRules) isSafeRequestURI(uri []byte) bool {
+	if !r.isSafeUrl(uri) {
+		return false
+	}
+	if !r.rejectUnsafe && r.disallowedChars == "" {
+		return true
+	}
+	path := uri
+	if n := bytes.IndexByte(path, '?'); n >= 0 {
+		path = path[:n]
+	}
+	if bytes.IndexByte(path, '%') < 0 {
+		return true
+	}
+	decoded, err := url.PathUnescape(string(path))
+	return err == nil && r.isSafeUrl([]byte(decoded))
+}
+
+// Responds with an error and returns false if the request doesn't pass
+// hygiene checks.
+//
+// Always returns true if hygiene checks are disabled.
+func checkRequestHygiene(ctx *fasthttp.RequestCtx) bool {
+	r := requestHygiene
+	if r == nil {
+		return true
+	}
+	// Check the raw url, since ctx.Path() is already normalized.
+	uri := ctx.Request.Header.RequestURI()
+	if r.maxUrlLength > 0 && len(uri) > r.maxUrlLength {
+		rejectUnhygienicRequest(ctx, "Request-URI Too Long", fasthttp.StatusRequestURITooLong)
+		return false
+	}
+	if !r.isSafeRequestURI(uri) {
+		rejectUnhygienicRequest(ctx, "Bad Request", fasthttp.StatusBadRequest)
+		return false
+	}
+	if r.blockedUserAgents != nil && r.blockedUserAgents.Match(ctx.Request.Header.UserAgent()) {
+		rejectUnhygienicRequest(ctx, "Forbidden", fasthttp.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func rejectUnhygienicRequest(ctx *fasthttp.RequestCtx, msg string, statusCode int) {
+	atomic.AddInt64(&stats.UnhygienicRequestsCount, 1)
+	ctx.Error(msg, statusCode)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHygieneRules_IsSafeRequestURI(t *testing.T) {
+	r := &hygieneRules{
+		rejectUnsafe:    true,
+		disallowedChars: "<>",
+	}
+	testURI := func(uri string, expectedSafe bool) {
+		if safe := r.isSafeRequestURI([]byte(uri)); safe != expectedSafe {
+			t.Fatalf("Unexpected isSafeRequestURI(%q)=%v. Expected %v", uri, safe, expectedSafe)
+		}
+	}
+
+	testURI("/foo/bar.jpg", true)
+	testURI("/foo%20bar.jpg", true)
+	testURI("/foo/..bar", true)
+
+	// The query string isn't decoded.
+	testURI("/search?q=100%", true)
+	testURI("/search?q=%zz", true)
+	testURI("/search?q=%3C", true)
+
+	// Path traversal.
+	testURI("/foo/../bar", false)
+	testURI("/foo/..", false)
+	testURI("/foo/..?bar", false)
+	testURI("/foo/%2e%2e/bar", false)
+	testURI("/foo%2f..%2fbar", false)
+
+	// Control chars.
+	testURI("/foo\x00bar", false)
+	testURI("/foo%00bar", false)
+	testURI("/foo%0abar", false)
+
+	// Disallowed chars.
+	testURI("/foo<bar", false)
+	testURI("/foo%3Cbar", false)
+	testURI("/search?q=<", false)
+
+	// Malformed percent-encoding in the path.
+	testURI("/foo%zzbar", false)
+	testURI("/foo%", false)
+}
+
+func TestHygieneRules_IsSafeRequestURI_ChecksDisabled(t *testing.T) {
+	// The url isn't decoded if only maxUrlLength is set.
+	r := &hygieneRules{
+		maxUrlLength: 100,
+	}
+	for _, uri := range []string{"/foo%zzbar", "/foo/%2e%2e/bar", "/search?q=100%"} {
+		if !r.isSafeRequestURI([]byte(uri)) {
+			t.Fatalf("Unexpected unsafe uri %q", uri)
+		}
+	}
+}
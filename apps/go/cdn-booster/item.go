@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Cached items have the following layout:
+//
+//	[itemFormatMarker][itemFormatVersion][fields][itemFieldEnd][body]
+//
+// Each field has the form [tag][uvarint length][value]. Fields with unknown
+// tags are skipped, so new fields may be added without bumping
+// itemFormatVersion.
+//
+// Items stored by older go-cdn-booster versions have the layout
+// [content-type length][content-type][body]. They are still readable,
+// since content-type is never empty, i.e. its' length never equals
+// to itemFormatMarker.
+const (
+	itemFormatMarker  = 0
+	itemFormatVersion = 1
+)
+
+// Tags for item header fields.
+const (
+	itemFieldEnd = iota
+	itemFieldContentType
+	itemFieldLastModified
+	itemFieldETag
+	itemFieldFetchTime
+	itemFieldStatusCode
+	itemFieldLocation
+	itemFieldTtl
+	itemFieldContentEncoding
+	itemFieldUrl
+	itemFieldBodyHash
+	itemFieldContentLength
+)
+
+// The maximum length of a single item header field value.
+const maxItemFieldSize = 64 * 1024
+
+// Metadata stored in front of the response body in the cache.
+type itemHeader struct {
+	contentType  string
+	lastModified time.Time
+	etag         string
+	fetchTime    time.Time
+
+	// Upstream response status code. Zero means 200.
+	statusCode int
+
+	// Location header for redirect responses.
+	location string
+
+	// Cache ttl chosen for the response. Zero for items stored
+	// by older go-cdn-booster versions.
+	ttl time.Duration
+
+	// Content-Encoding of the upstream response. See varyAcceptEncoding.
+	contentEncoding string
+
+	// The original url for items stored under hashed keys.
+	// See maxCacheKeyLength.
+	url string
+
+	// Hex-encoded SHA-256 hash of the body stored separately
+	// from the item header. See dedupMinSize.
+	bodyHash string
+
+	// Body size. It is used for detecting truncated items. Zero for empty
+	// bodies and for items stored by older go-cdn-booster versions.
+	contentLength int
+}
+
+func (ih *itemHeader) marshal(dst []byte) []byte {
+	dst = append(dst, itemFormatMarker, itemFormatVersion)
+	dst = appendItemField(dst, itemFieldContentType, []byte(ih.contentType))
+	if !ih.lastModified.IsZero() {
+		dst = appendItemTimeField(dst, itemFieldLastModified, ih.lastModified)
+	}
+	if ih.etag != "" {
+		dst = appendItemField(dst, itemFieldETag, []byte(ih.etag))
+	}
+	if !ih.fetchTime.IsZero() {
+		dst = appendItemTimeField(dst, itemFieldFetchTime, ih.fetchTime)
+	}
+	if ih.statusCode != 0 && ih.statusCode != fasthttp.StatusOK {
+		var buf [2]byte
+		binary.LittleEndian.PutUint16(buf[:], uint16(ih.statusCode))
+		dst = appendItemField(dst, itemFieldStatusCode, buf[:])
+	}
+	if ih.location != "" {
+		dst = appendItemField(dst, itemFieldLocation, []byte(ih.location))
+	}
+	if ih.ttl > 0 {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(ih.ttl))
+		dst = appendItemField(dst, itemFieldTtl, buf[:])
+	}
+	if ih.contentEncoding != "" {
+		dst = appendItemField(dst, itemFieldContentEncoding, []byte(ih.contentEncoding))
+	}
+	if ih.url != "" {
+		dst = appendItemField(dst, itemFieldUrl, []byte(ih.url))
+	}
+	if ih.bodyHash != "" {
+		dst = appendItemField(dst, itemFieldBodyHash, []byte(ih.bodyHash))
+	}
+	if ih.contentLength > 0 {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(ih.contentLength))
+		dst = appendItemField(dst, itemFieldContentLength, buf[:])
+	}
+	return append(dst, itemFieldEnd)
+}
+
+func (ih *itemHeader) unmarshal(r io.ByteReader) error {
+	c, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("cannot read item format marker: [%s]", err)
+	}
+	if c != itemFormatMarker {
+		// Legacy item without version.
+		buf, err := readItemBytes(r, int(c))
+		if err != nil {
+			return fmt.Errorf("cannot read legacy content-type with length=%d: [%s]", c, err)
+		}
+		*ih = itemHeader{
+			contentType: string(buf),
+		}
+		return nil
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("cannot read item format version: [%s]", err)
+	}
+	if version != itemFormatVersion {
+		return fmt.Errorf("unsupported item format version=%d. Expected %d", version, itemFormatVersion)
+	}
+
+	*ih = itemHeader{}
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("cannot read item field tag: [%s]", err)
+		}
+		if tag == itemFieldEnd {
+			return nil
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("cannot read length of item field with tag=%d: [%s]", tag, err)
+		}
+		if size > maxItemFieldSize {
+			return fmt.Errorf("too long item field with tag=%d: %d bytes. Max %d bytes", tag, size, maxItemFieldSize)
+		}
+		buf, err := readItemBytes(r, int(size))
+		if err != nil {
+			return fmt.Errorf("cannot read item field with tag=%d, length=%d: [%s]", tag, size, err)
+		}
+		switch tag {
+		case itemFieldContentType:
+			ih.contentType = string(buf)
+		case itemFieldLastModified:
+			ih.lastModified = unmarshalItemTime(buf)
+		case itemFieldETag:
+			ih.etag = string(buf)
+		case itemFieldFetchTime:
+			ih.fetchTime = unmarshalItemTime(buf)
+		case itemFieldStatusCode:
+			if len(buf) == 2 {
+				ih.statusCode = int(binary.LittleEndian.Uint16(buf))
+			}
+		case itemFieldLocation:
+			ih.location = string(buf)
+		case itemFieldTtl:
+			if len(buf) == 8 {
+				ih.ttl = time.Duration(binary.LittleEndian.Uint64(buf))
+			}
+		case itemFieldContentEncoding:
+			ih.contentEncoding = string(buf)
+		case itemFieldUrl:
+			ih.url = string(buf)
+		case itemFieldBodyHash:
+			ih.bodyHash = string(buf)
+		case itemFieldContentLength:
+			if len(buf) == 8 {
+				ih.contentLength = int(binary.LittleEndian.Uint64(buf))
+			}
+		}
+	}
+}
+
+func appendItemField(dst []byte, tag byte, value []byte) []byte {
+	var sizeBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(sizeBuf[:], uint64(len(value)))
+	dst = append(dst, tag)
+	dst = append(dst, sizeBuf[:n]...)
+	return append(dst, value...)
+}
+
+func appendItemTimeField(dst []byte, tag byte, t time.Time) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(t.Unix()))
+	return appendItemField(dst, tag, buf[:])
+}
+
+func unmarshalItemTime(buf []byte) time.Time {
+	if len(buf) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint64(buf)), 0)
+}
+
+func readItemBytes(r io.ByteReader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	for i := range buf {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf[i] = c
+	}
+	return buf, nil
+}
+
+// Returns strong ETag for the given response body.
+//
+// It is used for responses without ETag from upstream.
+func generateETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf("\"%016x\"", h.Sum64())
+}
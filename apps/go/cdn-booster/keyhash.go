@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"sync/atomic"
+)
+
+var (
+	maxCacheKeyLength = flag.Int("maxCacheKeyLength", 1024, "The maximum length of cache keys in bytes. Longer keys, which are usually built from very long urls, "+
+		"are replaced by their SHA-256 hash, while the original url is stored in the cached item header for debugging. Leave zero for disabling key hashing")
+)
+
+// Hashed keys start with this prefix. '#' cannot occur at the beginning
+// of keys built from request host and uri, so hashed keys don't clash
+// with other keys.
+const hashedKeyPrefix = "#sha256="
+
+// Replaces the key by its' SHA-256 hash if it exceeds maxCacheKeyLength.
+//
+// The key is hashed in place, so the returned key shares the buffer
+// with the given key.
+func limitKeyLength(key []byte) []byte {
+	if *maxCacheKeyLength <= 0 || len(key) <= *maxCacheKeyLength {
+		return key
+	}
+	atomic.AddInt64(&stats.HashedKeysCount, 1)
+	h := sha256.Sum256(key)
+	key = append(key[:0], hashedKeyPrefix...)
+	n := len(key)
+	key = append(key, make([]byte, hex.EncodedLen(len(h)))...)
+	hex.Encode(key[n:], h[:])
+	return key
+}
+
+func isHashedKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(hashedKeyPrefix))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	listenersConfigFile = flag.String("listenersConfigFile", "", "Path to config file with per-listener settings. These listeners are started in addition to listenAddrs and httpsListenAddrs. The file consists of [listener] sections with the following keys:\n"+
+		"  addr - TCP address to listen to. Required\n"+
+		"  tls - whether to serve https on the listener. Certificates are set up via httpsCert* flags. Default is false\n"+
+		"  allowedNetworks - a list of CIDR networks delimited by comma, which may connect to the listener. Default is any network\n"+
+		"  readBufferSize, writeBufferSize - per-connection buffer sizes in bytes. readBufferSize limits request header size. Default readBufferSize is clientMaxHeaderSize, default writeBufferSize is 4096\n"+
+		"  hosts - a list of virtual hosts delimited by comma served by the listener. Hosts may start with '*.' for wildcard matching. Default is any host")
+)
+
+// Settings for a single listener from listenersConfigFile.
+type listenerConfig struct {
+	addr            string
+	tls             bool
+	allowedNetworks []*net.IPNet
+	readBufferSize  int
+	writeBufferSize int
+	hosts           []string
+}
+
+// Reads listener configs from ini-style file.
+//
+// The file uses the same ini syntax as config files for iniflags, since
+// iniflags supports neither TOML nor YAML. Unlike iniflags config files,
+// sections may be repeated, so each listener has its own section.
+func readListenersConfig(path string) ([]*listenerConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseListenersConfig(f)
+}
+
+// Parses listener configs.
+//
+// Lines starting with '#' or ';' are comments. Each [listener] section
+// starts a new listener config.
+func parseListenersConfig(r io.Reader) ([]*listenerConfig, error) {
+	var lcs []*listenerConfig
+	var lc *listenerConfig
+	var err error
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line != "[listener]" {
+				return nil, fmt.Errorf("unsupported section %s at line %d. Expected [listener]", line, lineNum)
+			}
+			lc = &listenerConfig{}
+			lcs = append(lcs, lc)
+			continue
+		}
+		if lc == nil {
+			return nil, fmt.Errorf("missing [listener] section before line %d", lineNum)
+		}
+		n := strings.Index(line, "=")
+		if n < 0 {
+			return nil, fmt.Errorf("cannot parse line %d: [%s]. Expected 'key = value'", lineNum, line)
+		}
+		key := strings.TrimSpace(line[:n])
+		value := strings.TrimSpace(line[n+1:])
+		if err = lc.set(key, value); err != nil {
+			return nil, fmt.Errorf("cannot parse line %d: [%s]", lineNum, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, lc := range lcs {
+		if lc.addr == "" {
+			return nil, fmt.Errorf("missing addr in listener #%d", i+1)
+		}
+	}
+	return lcs, nil
+}
+
+func (lc *listenerConfig) set(key, value string) error {
+	var err error
+	switch key {
+	case "addr":
+		lc.addr = value
+	case "tls":
+		lc.tls, err = strconv.ParseBool(value)
+	case "allowedNetworks":
+		for _, s := range splitList(value) {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return err
+			}
+			lc.allowedNetworks = append(lc.allowedNetworks, ipnet)
+		}
+	case "readBufferSize":
+		lc.readBufferSize, err = strconv.Atoi(value)
+	case "writeBufferSize":
+		lc.writeBufferSize, err = strconv.Atoi(value)
+	case "hosts":
+		for _, host := range splitList(value) {
+			lc.hosts = append(lc.hosts, strings.ToLower(host))
+		}
+	default:
+		return fmt.Errorf("unknown key [%s]", key)
+	}
+	return err
+}
+
+func splitList(s string) []string {
+	var a []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			a = append(a, v)
+		}
+	}
+	return a
+}
+
+func startConfiguredListeners(tlsConfig *tls.Config) {
+	lcs, err := readListenersConfig(*listenersConfigFile)
+	if err != nil {
+		logFatal("Cannot read listenersConfigFile=[%s]: [%s]", *listenersConfigFile, err)
+	}
+	for _, lc := range lcs {
+		if lc.tls && tlsConfig == nil {
+			tlsConfig = newTLSConfig()
+		}
+		go serveListener(lc, listen(lc.addr), tlsConfig)
+	}
+}
+
+func serveListener(lc *listenerConfig, ln net.Listener, tlsConfig *tls.Config) {
+	if len(lc.allowedNetworks) > 0 {
+		ln = &netFilterListener{
+			Listener:        ln,
+			allowedNetworks: lc.allowedNetworks,
+		}
+	}
+	proto := "http"
+	if lc.tls {
+		ln = tls.NewListener(ln, tlsConfig)
+		proto = "https"
+	}
+	s := newClientServer(requestHandler)
+	if lc.readBufferSize > 0 {
+		s.ReadBufferSize = lc.readBufferSize
+	}
+	s.WriteBufferSize = lc.writeBufferSize
+	if len(lc.hosts) > 0 {
+		s.Handler = virtualHostsHandler(lc.hosts, requestHandler)
+	}
+	logMessage("Listening %s on [%s]", proto, lc.addr)
+	s.Serve(ln)
+}
+
+// Returns handler, which passes to h only requests for the given hosts.
+func virtualHostsHandler(hosts []string, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !hostMatches(hosts, ctx.Host()) {
+			ctx.Error("Misdirected request", fasthttp.StatusMisdirectedRequest)
+			return
+		}
+		h(ctx)
+	}
+}
+
+func hostMatches(hosts []string, host []byte) bool {
+	name := strings.ToLower(string(host))
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	for _, h := range hosts {
+		if h == name {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(name, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener, which accepts connections only from allowedNetworks.
+type netFilterListener struct {
+	net.Listener
+	allowedNetworks []*net.IPNet
+}
+
+func (ln *netFilterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && ln.isAllowed(addr.IP) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func (ln *netFilterListener) isAllowed(ip net.IP) bool {
+	for _, ipnet := range ln.allowedNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
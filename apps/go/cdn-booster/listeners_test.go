@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseListenersConfig(t *testing.T) {
+	lcs, err := parseListenersConfig(strings.NewReader(`
+# comment
+; another comment
+[listener]
+addr = :8080
+hosts = Example.com, *.example.org
+
+[listener]
+addr=:8443
+tls=true
+allowedNetworks = 10.0.0.0/8,192.168.0.0/16
+readBufferSize = 8192
+writeBufferSize = 16384
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if len(lcs) != 2 {
+		t.Fatalf("Unexpected number of listeners: %d. Expected 2", len(lcs))
+	}
+
+	lc := lcs[0]
+	if lc.addr != ":8080" || lc.tls || len(lc.allowedNetworks) != 0 || lc.readBufferSize != 0 || lc.writeBufferSize != 0 {
+		t.Fatalf("Unexpected first listener config: %+v", lc)
+	}
+	if strings.Join(lc.hosts, ",") != "example.com,*.example.org" {
+		t.Fatalf("Unexpected hosts=%q. Expected [example.com *.example.org]", lc.hosts)
+	}
+
+	lc = lcs[1]
+	if lc.addr != ":8443" || !lc.tls || lc.readBufferSize != 8192 || lc.writeBufferSize != 16384 || len(lc.hosts) != 0 {
+		t.Fatalf("Unexpected second listener config: %+v", lc)
+	}
+	if len(lc.allowedNetworks) != 2 || lc.allowedNetworks[0].String() != "10.0.0.0/8" || lc.allowedNetworks[1].String() != "192.168.0.0/16" {
+		t.Fatalf("Unexpected allowedNetworks=%s", lc.allowedNetworks)
+	}
+}
+
+func TestParseListenersConfig_Error(t *testing.T) {
+	testError := func(config, expectedErr string) {
+		_, err := parseListenersConfig(strings.NewReader(config))
+		if err == nil {
+			t.Fatalf("Expecting error for config %q", config)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("Unexpected error=[%s] for config %q. Expected error containing [%s]", err, config, expectedErr)
+		}
+	}
+
+	// Malformed sections.
+	testError("[listeners]\naddr = :80", "unsupported section [listeners] at line 1")
+	testError("[listener\naddr = :80", "unsupported section [listener at line 1")
+	testError("addr = :80", "missing [listener] section before line 1")
+	testError("[listener]\naddr = :80\n[listener]\ntls = true", "missing addr in listener #2")
+
+	// Unknown keys.
+	testError("[listener]\naddr = :80\nfoo = bar", "cannot parse line 3: [unknown key [foo]]")
+	testError("[listener]\nAddr = :80", "unknown key [Addr]")
+
+	// Malformed lines and values.
+	testError("[listener]\naddr :80", "cannot parse line 2: [addr :80]. Expected 'key = value'")
+	testError("[listener]\naddr = :80\ntls = maybe", "cannot parse line 3")
+	testError("[listener]\naddr = :80\nallowedNetworks = 10.0.0.0", "cannot parse line 3")
+	testError("[listener]\naddr = :80\nreadBufferSize = big", "cannot parse line 3")
+}
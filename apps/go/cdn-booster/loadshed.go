@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	maxConcurrentRequests = flag.Int("maxConcurrentRequests", 0, "The maximum number of concurrently processed client requests. Excess requests are queued up to maxQueuedRequests. "+
+		"Requests, which cannot be queued, are rejected with 503 Service Unavailable and Retry-After header, so an overloaded proxy keeps serving admitted requests fast "+
+		"instead of degrading latency for everyone. Leave zero for disabling the limit")
+	maxQueuedRequests       = flag.Int("maxQueuedRequests", 1000, "The maximum number of requests waiting for processing when maxConcurrentRequests requests are already processed. See maxConcurrentRequests")
+	maxQueueWait            = flag.Duration("maxQueueWait", time.Second, "The maximum duration a request may wait in the queue. Requests waiting longer are rejected. See maxConcurrentRequests")
+	loadShedUpstreamLatency = flag.Duration("loadShedUpstreamLatency", 0, "Requests aren't queued while the average upstream response time exceeds this value, "+
+		"i.e. requests exceeding maxConcurrentRequests are rejected immediately while upstream is saturated. Leave zero for queueing requests regardless of upstream latency")
+	loadShedRetryAfter = flag.Int("loadShedRetryAfter", 1, "The value in seconds for Retry-After header sent with rejected requests. See maxConcurrentRequests")
+)
+
+type requestLimiter struct {
+	// Contains a token per processed request.
+	sem chan struct{}
+
+	// The number of requests waiting in the queue.
+	queued int64
+
+	// Exponentially weighted moving average of upstream response times
+	// in nanoseconds.
+	avgUpstreamLatency int64
+
+	retryAfter string
+}
+
+// Nil if maxConcurrentRequests isn't set.
+var requestLimits *requestLimiter
+
+func initLoadShedding() {
+	if *maxConcurrentRequests <= 0 {
+		return
+	}
+	if *maxQueuedRequests < 0 {
+		logFatal("maxQueuedRequests=%d cannot be negative", *maxQueuedRequests)
+	}
+	requestLimits = &requestLimiter{
+		sem:        make(chan struct{}, *maxConcurrentRequests),
+		retryAfter: strconv.Itoa(*loadShedRetryAfter),
+	}
+	logMessage("Limiting the number of concurrent requests to %d with up to %d queued requests", *maxConcurrentRequests, *maxQueuedRequests)
+}
+
+// Waits until the request may be processed.
+//
+// Responds with 503 Service Unavailable and returns false if the request
+// is shed. releaseRequestSlot() must be called after processing the request
+// if true is returned.
+func acquireRequestSlot(ctx *fasthttp.RequestCtx) bool {
+	l := requestLimits
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if !l.isUpstreamSaturated() {
+		if n := atomic.AddInt64(&l.queued, 1); n <= int64(*maxQueuedRequests) {
+			atomic.AddInt64(&stats.QueuedRequestsCount, 1)
+			t := time.NewTimer(*maxQueueWait)
+			select {
+			case l.sem <- struct{}{}:
+				t.Stop()
+				atomic.AddInt64(&l.queued, -1)
+				return true
+			case <-t.C:
+			}
+		}
+		atomic.AddInt64(&l.queued, -1)
+	}
+
+	atomic.AddInt64(&stats.ShedRequestsCount, 1)
+	ctx.Response.Header.Set("Retry-After", l.retryAfter)
+	ctx.Error("Service unavailable", fasthttp.StatusServiceUnavailable)
+	return false
+}
+
+func releaseRequestSlot() {
+	if requestLimits != nil {
+		<-requestLimits.sem
+	}
+}
+
+func (l *requestLimiter) isUpstreamSaturated() bool {
+	return *loadShedUpstreamLatency > 0 && time.Duration(atomic.LoadInt64(&l.avgUpstreamLatency)) > *loadShedUpstreamLatency
+}
+
+// Updates the average upstream response time used by loadShedUpstreamLatency.
+func registerUpstreamLatency(d time.Duration) {
+	l := requestLimits
+	if l == nil || *loadShedUpstreamLatency <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&l.avgUpstreamLatency)
+		n := old + (int64(d)-old)/8
+		if atomic.CompareAndSwapInt64(&l.avgUpstreamLatency, old, n) {
+			return
+		}
+	}
+}
+
+func writeLoadSheddingStats(w io.Writer) {
+	l := requestLimits
+	fmt.Fprintf(w, "Requests in progress: %d\n", len(l.sem))
+	fmt.Fprintf(w, "Requests waiting in the queue: %d\n", atomic.LoadInt64(&l.queued))
+	fmt.Fprintf(w, "Requests queued due to maxConcurrentRequests: %d\n", atomic.LoadInt64(&stats.QueuedRequestsCount))
+	fmt.Fprintf(w, "Requests rejected due to overload: %d\n", atomic.LoadInt64(&stats.ShedRequestsCount))
+	if *loadShedUpstreamLatency > 0 {
+		fmt.Fprintf(w, "Average upstream response time: %s\n", time.Duration(atomic.LoadInt64(&l.avgUpstreamLatency)))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	localPaths = flag.String("localPaths", "", "Comma-separated list of 'path=source' pairs for request paths served locally without hitting the cache and upstream, "+
+		"for instance, '/robots.txt=/etc/cdn/robots.txt,/favicon.ico=/etc/cdn/favicon.ico,/ping=inline:pong'. "+
+		"The source is either a path to local file, which is read at startup, or 'inline:' followed by the response body without commas. "+
+		"Content-Type is determined by the request path extension. Local paths are served without authentication, so they mustn't contain sensitive data")
+)
+
+const inlineLocalPathPrefix = "inline:"
+
+type localContent struct {
+	contentType string
+	body        []byte
+}
+
+// Locally served contents keyed by request path.
+var localContents map[string]*localContent
+
+func initLocalPaths() {
+	if *localPaths == "" {
+		return
+	}
+	localContents = make(map[string]*localContent)
+	for _, s := range strings.Split(*localPaths, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n := strings.IndexByte(s, '=')
+		if n <= 0 || !strings.HasPrefix(s, "/") {
+			logFatal("Cannot parse localPaths entry [%s]. Expected 'path=source', where path starts with '/'", s)
+		}
+		p, source := s[:n], s[n+1:]
+		lc := &localContent{
+			contentType: mime.TypeByExtension(path.Ext(p)),
+		}
+		if strings.HasPrefix(source, inlineLocalPathPrefix) {
+			lc.body = []byte(source[len(inlineLocalPathPrefix):])
+		} else {
+			data, err := ioutil.ReadFile(source)
+			if err != nil {
+				logFatal("Cannot read file for localPaths entry [%s]: [%s]", s, err)
+			}
+			lc.body = data
+		}
+		if lc.contentType == "" {
+			lc.contentType = "text/plain; charset=utf-8"
+		}
+		localContents[p] = lc
+	}
+	logMessage("Serving %d paths locally", len(localContents))
+}
+
+// Serves the request from localPaths and returns true if the request path
+// is served locally.
+//
+// Only GET and HEAD requests are served locally. Responses to HEAD requests
+// contain the same headers as responses to GET requests without the body.
+func serveLocalPath(ctx *fasthttp.RequestCtx) bool {
+	if localContents == nil || !(ctx.IsGet() || ctx.IsHead()) {
+		return false
+	}
+	lc, ok := localContents[string(ctx.Path())]
+	if !ok {
+		return false
+	}
+	atomic.AddInt64(&stats.LocalPathsServedCount, 1)
+	ctx.Success(lc.contentType, lc.body)
+	return true
+}
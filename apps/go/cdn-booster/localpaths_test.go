@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestServeLocalPath(t *testing.T) {
+	contents := localContents
+	defer func() {
+		localContents = contents
+	}()
+	localContents = map[string]*localContent{
+		"/ping": {
+			contentType: "text/plain; charset=utf-8",
+			body:        []byte("pong"),
+		},
+	}
+
+	testRequest := func(method, requestURI string, expectedServed bool) {
+		var req fasthttp.Request
+		req.Header.SetMethod(method)
+		req.SetRequestURI(requestURI)
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, nil)
+		if served := serveLocalPath(&ctx); served != expectedServed {
+			t.Fatalf("Unexpected served=%v for %s %s. Expected %v", served, method, requestURI, expectedServed)
+		}
+		if !expectedServed {
+			return
+		}
+		if string(ctx.Response.Body()) != "pong" {
+			t.Fatalf("Unexpected body=[%s] for %s %s. Expected [pong]", ctx.Response.Body(), method, requestURI)
+		}
+		if contentType := string(ctx.Response.Header.ContentType()); contentType != "text/plain; charset=utf-8" {
+			t.Fatalf("Unexpected Content-Type=[%s] for %s %s", contentType, method, requestURI)
+		}
+	}
+
+	testRequest("GET", "/ping", true)
+	testRequest("GET", "/ping?foo=bar", true)
+	testRequest("HEAD", "/ping", true)
+	testRequest("POST", "/ping", false)
+	testRequest("GET", "/pong", false)
+	testRequest("HEAD", "/pong", false)
+}
@@ -1,28 +1,35 @@
 // CDN booster
 //
-// This is a dumb HTTP proxy, which caches files obtained from upstreamHost.
+// This is a caching HTTP proxy for files obtained from upstreamHost.
 //
 // Currently go-cdn-booster has the following limitations:
-//   * Supports only GET requests.
-//   * Doesn't respect HTTP headers received from both the client and
-//     the upstream host.
-//   * Optimized for small static files aka images, js and css with sizes
+//   - Serves only GET requests besides CORS preflight requests.
+//     Requests with other methods are rejected.
+//   - Optimized for small static files aka images, js and css with sizes
 //     not exceeding few Mb each.
-//   * It caches all files without expiration time.
-//     Actually this is a feature :)
+//   - Successful responses and permanent redirects are cached forever
+//     by default, i.e. Cache-Control and Expires headers from the upstream
+//     are respected only for error responses and temporary redirects.
+//     Cache ttls may be configured per upstream status code or via caching
+//     rules.
 //
-// Thanks to YBC it has the following features:
-//   * Should be extremely fast.
-//   * Cached items survive CDN booster restart if backed by cacheFilesPath.
-//   * Cache size isn't limited by RAM size.
-//   * Optimized for SSDs and HDDs.
-//   * Performance shouldn't depend on the number of cached items.
-//   * It is deadly simple in configuration and maintenance.
+// Cached responses respect conditional (If-Match, If-None-Match,
+// If-Modified-Since, If-Unmodified-Since) and single-range request headers
+// from clients. Upstream status codes, ETag and Last-Modified headers
+// are stored together with cached files and are replayed to clients.
 //
+// Thanks to YBC it has the following features:
+//   - Should be extremely fast.
+//   - Cached items survive CDN booster restart if backed by cacheFilesPath.
+//   - Cache size isn't limited by RAM size.
+//   - Optimized for SSDs and HDDs.
+//   - Performance shouldn't depend on the number of cached items.
+//   - It is deadly simple in configuration and maintenance.
 package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -37,6 +44,8 @@ import (
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/ybc/bindings/go/ybc"
 	"github.com/vharitonsky/iniflags"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -47,116 +56,205 @@ var (
 			"and each cache file is located on a distinct physical storage.")
 	cacheSize            = flag.Int("cacheSize", 100, "The total cache size in Mbytes")
 	httpsCertFile        = flag.String("httpsCertFile", "/etc/ssl/certs/ssl-cert-snakeoil.pem", "Path to HTTPS server certificate. Used only if listenHttpsAddr is set")
+	httpsCerts           = flag.String("httpsCerts", "", "A list of additional HTTPS certificates in the form 'domain:certFile:keyFile' delimited by comma. The certificate is selected by the server name (SNI) sent by the client. Domain may start with '*.' for wildcard matching. Clients without SNI or with unknown server names get the certificate from httpsCertFile")
+	httpsCertsDir        = flag.String("httpsCertsDir", "", "Path to a directory with additional HTTPS certificates. Each certificate file must have .crt or .pem extension and must be accompanied by a key file with the same name and .key extension. Certificates are selected by SNI using DNS names from the certificate")
 	httpsKeyFile         = flag.String("httpsKeyFile", "/etc/ssl/private/ssl-cert-snakeoil.key", "Path to HTTPS server key. Used only if listenHttpsAddr is set")
 	httpsListenAddrs     = flag.String("httpsListenAddrs", "", "A list of TCP addresses to listen to HTTPS requests. Leave empty if you don't need https")
 	listenAddrs          = flag.String("listenAddrs", ":8098", "A list of TCP addresses to listen to HTTP requests. Leave empty if you don't need http")
-	maxIdleUpstreamConns = flag.Int("maxIdleUpstreamConns", 50, "The maximum idle connections to upstream host")
+	maxIdleUpstreamConns = flag.Int("maxIdleUpstreamConns", 50, "The maximum number of connections to upstream host")
 	maxItemsCount        = flag.Int("maxItemsCount", 100*1000, "The maximum number of items in the cache")
 	statsRequestPath     = flag.String("statsRequestPath", "/static_proxy_stats", "Path to page with statistics")
 	upstreamHost         = flag.String("upstreamHost", "www.google.com", "Upstream host to proxy data from. May include port in the form 'host:port'")
-	upstreamProtocol     = flag.String("upstreamProtocol", "http", "Use this protocol when talking to the upstream")
+	upstreamProtocol     = flag.String("upstreamProtocol", "http", "Use this protocol when talking to the upstream. Supported values:\n"+
+		"\t'http', 'https' - fetch responses from upstreamHost\n"+
+		"\t'file' - serve files from upstreamFileRoot directory\n"+
+		"\t's3' - fetch objects from upstreamS3Bucket at S3-compatible endpoint upstreamHost\n"+
+		"\t'ftp', 'sftp' - fetch files from upstreamFTPRoot directory at upstreamHost")
 	useClientRequestHost = flag.Bool("useClientRequestHost", false, "If set to true, then use 'Host' header from client requests in requests to upstream host. Otherwise use upstreamHost as a 'Host' header in upstream requests")
 )
 
 var (
-	cache          ybc.Cacher
-	stats          Stats
-	upstreamClient *fasthttp.HostClient
+	cache           ybc.Cacher
+	stats           Stats
+	upstreamClients *upstreamPool
 )
 
 func main() {
 	iniflags.Parse()
 
+	if *benchUrlsFile != "" {
+		runSelfBenchmark()
+		return
+	}
+
 	upstreamHostBytes = []byte(*upstreamHost)
 
-	cache = createCache()
+	initNetwork()
+	initUpstreamProtocol()
+	initSocketActivation()
+	initRequestIds()
+	initClientConns()
+	initTracing()
+	initRedirectPolicy()
+	initStatusTtls()
+	initCacheRules()
+	initMirror()
+	initCors()
+	initAuth()
+	initPathAllowlist()
+	initRequestHygiene()
+	initLocalPaths()
+	initPrecompressed()
+	initRevalidation()
+	initAdmission()
+	initLoadShedding()
+	initTopUrls()
+	initResponseFilters()
+	initChaos()
+
+	cache = newTieredCache(newCompactableCache(createCache()))
 	defer cache.Close()
+	initPersistentStats()
+	initNamespaces()
+	initCacheInfo()
+	initSnapshots()
 
-	upstreamClient = &fasthttp.HostClient{
-		Addr:     *upstreamHost,
-		MaxConns: *maxIdleUpstreamConns,
+	initOrigins()
+	initShield()
+	initUpstreamHedging()
+	initRoutingScript()
+	initPrefetch()
+	if r := newUpstreamResolver(); r != nil {
+		startUpstreamDiscovery(upstreamClients, r)
 	}
 
 	var addr string
-	for _, addr = range strings.Split(*httpsListenAddrs, ",") {
-		go serveHttps(addr)
+	var tlsConfig *tls.Config
+	if *httpsListenAddrs != "" || *http3ListenAddrs != "" {
+		tlsConfig = newTLSConfig()
+	}
+	if *httpsListenAddrs != "" {
+		for _, addr = range strings.Split(*httpsListenAddrs, ",") {
+			if addr != "" {
+				go serveHttps(listen(addr), addr, tlsConfig)
+			}
+		}
+	}
+	if *http3ListenAddrs != "" {
+		http3Addrs := strings.Split(*http3ListenAddrs, ",")
+		initAltSvcHeader(http3Addrs)
+		for _, addr = range http3Addrs {
+			if addr != "" {
+				go serveHttp3(listenUDP(addr), addr, tlsConfig)
+			}
+		}
 	}
 	for _, addr = range strings.Split(*listenAddrs, ",") {
-		go serveHttp(addr)
+		if addr != "" {
+			go serveHttp(listen(addr), addr)
+		}
+	}
+	if *listenersConfigFile != "" {
+		startConfiguredListeners(tlsConfig)
+	}
+	if *adminListenAddr != "" {
+		go serveAdmin(listen(*adminListenAddr), *adminListenAddr)
 	}
 
+	// Listeners and cache files are opened above, so privileges
+	// aren't needed anymore.
+	dropPrivileges()
+
 	waitForeverCh := make(chan int)
 	<-waitForeverCh
 }
 
 func createCache() ybc.Cacher {
+	logMessage("Opening data files. This can take a while for the first time if files are big")
+	configs := cacheConfigs("")
+	restoreSnapshot(configs)
+	if len(configs) > 1 {
+		// Keys must be distributed among cache files in the same way
+		// after restart.
+		seedFile := keyHashSeedFile()
+		if err := configs.PinKeyHashSeed(seedFile); err != nil {
+			logFatal("Cannot pin key hash seed to [%s]: [%s]", seedFile, err)
+		}
+		cacheKeyHash = configs[0].KeyHash
+	}
+	cache, err := openCacheFiles(configs)
+	if err != nil {
+		if len(configs) > 1 {
+			logFatal("Cannot open cache cluster: [%s]", err)
+		}
+		logFatal("Cannot open cache: [%s]", err)
+	}
+	logMessage("Data files have been opened")
+	return cache
+}
+
+// Returns configs for cache files from cacheFilesPath. fileSuffix is appended
+// to file names.
+//
+// Returns a single config for anonymous cache if cacheFilesPath is empty.
+func cacheConfigs(fileSuffix string) ybc.ClusterConfig {
 	config := ybc.Config{
 		MaxItemsCount: ybc.SizeT(*maxItemsCount),
 		DataFileSize:  ybc.SizeT(*cacheSize) * ybc.SizeT(1024*1024),
 	}
 
-	var err error
-	var cache ybc.Cacher
-
 	cacheFilesPath_ := strings.Split(*cacheFilesPath, ",")
 	cacheFilesCount := len(cacheFilesPath_)
-	logMessage("Opening data files. This can take a while for the first time if files are big")
 	if cacheFilesCount < 2 {
 		if cacheFilesPath_[0] != "" {
-			config.DataFile = cacheFilesPath_[0] + ".cdn-booster.data"
-			config.IndexFile = cacheFilesPath_[0] + ".cdn-booster.index"
-		}
-		cache, err = config.OpenCache(true)
-		if err != nil {
-			logFatal("Cannot open cache: [%s]", err)
-		}
-	} else if cacheFilesCount > 1 {
-		config.MaxItemsCount /= ybc.SizeT(cacheFilesCount)
-		config.DataFileSize /= ybc.SizeT(cacheFilesCount)
-		var configs ybc.ClusterConfig
-		configs = make([]*ybc.Config, cacheFilesCount)
-		for i := 0; i < cacheFilesCount; i++ {
-			cfg := config
-			cfg.DataFile = cacheFilesPath_[i] + ".cdn-booster.data"
-			cfg.IndexFile = cacheFilesPath_[i] + ".cdn-booster.index"
-			configs[i] = &cfg
-		}
-		cache, err = configs.OpenCluster(true)
-		if err != nil {
-			logFatal("Cannot open cache cluster: [%s]", err)
+			config.DataFile = cacheFilesPath_[0] + ".cdn-booster.data" + fileSuffix
+			config.IndexFile = cacheFilesPath_[0] + ".cdn-booster.index" + fileSuffix
 		}
-	}
-	logMessage("Data files have been opened")
-	return cache
+		return ybc.ClusterConfig{&config}
+	}
+	config.MaxItemsCount /= ybc.SizeT(cacheFilesCount)
+	config.DataFileSize /= ybc.SizeT(cacheFilesCount)
+	configs := make(ybc.ClusterConfig, cacheFilesCount)
+	for i := 0; i < cacheFilesCount; i++ {
+		cfg := config
+		cfg.DataFile = cacheFilesPath_[i] + ".cdn-booster.data" + fileSuffix
+		cfg.IndexFile = cacheFilesPath_[i] + ".cdn-booster.index" + fileSuffix
+		configs[i] = &cfg
+	}
+	configs[0].KeyHash = cacheKeyHash
+	return configs
 }
 
-func serveHttps(addr string) {
-	if addr == "" {
-		return
-	}
-	cert, err := tls.LoadX509KeyPair(*httpsCertFile, *httpsKeyFile)
-	if err != nil {
-		logFatal("Cannot load certificate: [%s]", err)
-	}
-	c := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+// The key hash pinned for the cache cluster on startup.
+//
+// Compacted cluster must distribute keys in the same way.
+var cacheKeyHash ybc.KeyHashFunc
+
+// Opens either a cache or a cluster of caches depending on the number
+// of configs.
+func openCacheFiles(configs ybc.ClusterConfig) (ybc.Cacher, error) {
+	if len(configs) == 1 {
+		return configs[0].OpenCache(true)
 	}
-	ln := tls.NewListener(listen(addr), c)
+	return configs.OpenCluster(true)
+}
+
+func serveHttps(ln net.Listener, addr string, c *tls.Config) {
+	ln = tls.NewListener(ln, c)
 	logMessage("Listening https on [%s]", addr)
 	serve(ln)
 }
 
-func serveHttp(addr string) {
-	if addr == "" {
-		return
-	}
-	ln := listen(addr)
+func serveHttp(ln net.Listener, addr string) {
 	logMessage("Listening http on [%s]", addr)
 	serve(ln)
 }
 
 func listen(addr string) net.Listener {
-	ln, err := net.Listen("tcp4", addr)
+	if ln := takeActivatedListener(addr); ln != nil {
+		return ln
+	}
+	ln, err := net.Listen(*listenNetwork, addr)
 	if err != nil {
 		logFatal("Cannot listen [%s]: [%s]", addr, err)
 	}
@@ -164,10 +262,7 @@ func listen(addr string) net.Listener {
 }
 
 func serve(ln net.Listener) {
-	s := &fasthttp.Server{
-		Handler: requestHandler,
-		Name:    "go-cdn-booster",
-	}
+	s := newClientServer(requestHandler)
 	s.Serve(ln)
 }
 
@@ -175,6 +270,27 @@ var keyPool sync.Pool
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
 	h := &ctx.Request.Header
+	setupRequestId(ctx)
+	setupTLSInfo(ctx)
+	defer acquireCacheGen().release()
+	if *accessLog {
+		defer logAccess(ctx, time.Now())
+	}
+	if altSvcHeader != "" {
+		ctx.Response.Header.Set("Alt-Svc", altSvcHeader)
+	}
+	if !checkRequestHygiene(ctx) {
+		return
+	}
+	if handleCorsPreflight(ctx) {
+		return
+	}
+	if serveLocalPath(ctx) {
+		return
+	}
+	if !checkAuth(ctx) {
+		return
+	}
 	if !ctx.IsGet() {
 		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
 		return
@@ -186,12 +302,32 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 		ctx.Success("text/plain", w.Bytes())
 		return
 	}
+	if !checkPathAllowed(ctx) {
+		return
+	}
+	if !acquireRequestSlot(ctx) {
+		return
+	}
+	defer releaseRequestSlot()
+	setCorsHeaders(ctx)
 
-	if len(h.Peek("If-None-Match")) > 0 {
-		resp := &ctx.Response
-		resp.SetStatusCode(fasthttp.StatusNotModified)
-		resp.Header.Set("Etag", "W/\"CacheForever\"")
-		atomic.AddInt64(&stats.IfNoneMatchHitsCount, 1)
+	tctx, span := startRequestSpan(ctx)
+	defer span.End()
+
+	origin := selectOrigin(ctx)
+	rd := routeRequest(ctx)
+	if rd.origin != nil {
+		origin = rd.origin
+	}
+	if rd.bypass || getCacheRules().isBypassed(ctx.RequestURI()) || hasForwardedClientSubject(h) {
+		atomic.AddInt64(&stats.BypassedRequestsCount, 1)
+		_, resp := fetchFromUpstream(tctx, h, ctx.RequestURI(), origin, true)
+		if resp == nil {
+			failSpan(span, "cannot obtain response from upstream")
+			ctx.Error("Service unavailable", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		servePassthroughResponse(ctx, resp)
 		return
 	}
 
@@ -199,73 +335,262 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 	if v == nil {
 		v = make([]byte, 128)
 	}
-	key := v.([]byte)
-	key = append(key[:0], getRequestHost(h)...)
-	key = append(key, ctx.RequestURI()...)
+	key := v.([]byte)[:0]
+	key = appendCacheNamespace(key, ctx.RequestURI())
+	if *cacheKeyIncludesOrigin {
+		key = append(key, origin.host...)
+		key = append(key, '|')
+	}
+	if rd.key != nil {
+		key = append(key, rd.key...)
+	} else {
+		key = append(key, getRequestHost(h)...)
+		key = append(key, ctx.RequestURI()...)
+	}
+	key = appendEncodingVariant(key, h)
+	key = appendTLSInfoVariant(key, h)
+	key = limitKeyLength(key)
+	if *varyAcceptEncoding {
+		ctx.Response.Header.Add("Vary", "Accept-Encoding")
+	}
+	if item, ih := getPrecompressedItem(tctx, ctx, key, origin); item != nil {
+		keyPool.Put(v)
+		serveItem(tctx, ctx, item, ih)
+		return
+	}
+	_, lookupSpan := startSpan(tctx, "cache.lookup", trace.SpanKindInternal)
 	item, err := cache.GetDeItem(key, time.Second)
+	lookupSpan.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	lookupSpan.End()
+	if err == nil && isChaosCacheMiss() {
+		item.Close()
+		err = ybc.ErrCacheMiss
+	}
+	var ih itemHeader
+	if err == nil {
+		if item, err = unmarshalItem(item, &ih); err != nil {
+			// The item may be stored by incompatible go-cdn-booster version
+			// or its' deduplicated body may be evicted from the cache.
+			// Re-fetch it from upstream.
+			logRequestError(h, "Cannot load cached item [%s]: [%s]", key, err)
+			item.Close()
+			err = ybc.ErrCacheMiss
+		}
+	}
 	if err != nil {
 		if err != ybc.ErrCacheMiss {
 			logFatal("Unexpected error when obtaining cache value by key=[%s]: [%s]", key, err)
 		}
 
 		atomic.AddInt64(&stats.CacheMissesCount, 1)
-		item = fetchFromUpstream(h, key)
+		mirrorRequest(h)
+		var resp *fasthttp.Response
+		if canStreamResponse(h) {
+			var streamed bool
+			if streamed, item, resp = streamFromUpstream(tctx, ctx, key, origin); streamed {
+				keyPool.Put(v)
+				return
+			}
+		} else if *shieldMode {
+			item, resp = fetchCollapsed(tctx, h, key, origin)
+		} else {
+			item, resp = fetchFromUpstream(tctx, h, key, origin, false)
+		}
+		if resp != nil {
+			keyPool.Put(v)
+			servePassthroughResponse(ctx, resp)
+			return
+		}
 		if item == nil {
+			failSpan(span, "cannot obtain response from upstream")
 			ctx.Error("Service unavailable", fasthttp.StatusServiceUnavailable)
 			return
 		}
+		if item, err = unmarshalItem(item, &ih); err != nil {
+			logRequestError(h, "Cannot load just stored item [%s]: [%s]", key, err)
+			item.Close()
+			failSpan(span, "cannot load cached item")
+			ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+			return
+		}
 	} else {
 		atomic.AddInt64(&stats.CacheHitsCount, 1)
+		registerHitTtl(ih.ttl)
+		scheduleRevalidation(h, key, &ih, origin)
 	}
-	defer item.Close()
 	keyPool.Put(v)
+	serveItem(tctx, ctx, item, &ih)
+}
 
-	contentType, err := loadContentType(h, item)
-	if err != nil {
-		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
-		return
-	}
+// Sends the cached item to the client and closes it.
+func serveItem(tctx context.Context, ctx *fasthttp.RequestCtx, item *ybc.Item, ih *itemHeader) {
+	defer item.Close()
 
-	rh := &ctx.Response.Header
-	rh.Set("Etag", "W/\"CacheForever\"")
-	rh.Set("Cache-Control", "public, max-age=31536000")
-	buf := item.Value()
-	buf = buf[len(buf)-item.Available():]
-	ctx.Success(contentType, buf)
-	atomic.AddInt64(&stats.BytesSentToClients, int64(len(buf)))
+	_, writeSpan := startSpan(tctx, "client.write", trace.SpanKindInternal)
+	body := item.Peek()
+	body = body[len(body)-item.Available():]
+	n := serveCachedContent(ctx, ih, body)
+	n = filterClientResponse(ctx, n)
+	writeSpan.SetAttributes(attribute.Int("http.status_code", ctx.Response.StatusCode()))
+	writeSpan.SetAttributes(attribute.Int("http.response_content_length", n))
+	writeSpan.End()
+	registerBytesSent(ctx.Response.Header.ContentType(), n)
+	registerTopUrl(ctx.RequestURI(), n)
+}
+
+// Fetches the response from upstream and stores it in the cache.
+//
+// Returns the upstream response instead of cached item if the response
+// must be passed through to the client without caching. This is the case
+// for bypassed requests, for redirects with upstreamRedirectPolicy=passthrough,
+// for responses with uncacheable status codes,
+// for responses with non-positive ttl override from caching rules,
+// for responses rejected by admission filter and for responses,
+// which cannot be stored in the cache, e.g. due to their size.
+func fetchFromUpstream(tctx context.Context, h *fasthttp.RequestHeader, key []byte, origin *upstreamOrigin, bypass bool) (*ybc.Item, *fasthttp.Response) {
+	tctx, span := startSpan(tctx, "upstream.fetch", trace.SpanKindClient)
+	defer span.End()
+
+	if !bypass {
+		origin = shieldedOrigin(origin)
+	}
+	origin.registerRequest()
+	req := newUpstreamRequest(tctx, h, origin)
+	var resp fasthttp.Response
+	if err := doResumableUpstreamRequest(origin, req, &resp); err != nil {
+		failUpstreamRequest(span, h, key, err)
+		return nil, nil
+	}
+	return handleUpstreamResponse(tctx, span, h, key, &resp, bypass)
 }
 
-func fetchFromUpstream(h *fasthttp.RequestHeader, key []byte) *ybc.Item {
-	upstreamUrl := fmt.Sprintf("%s://%s%s", *upstreamProtocol, *upstreamHost, h.RequestURI())
+func newUpstreamRequest(tctx context.Context, h *fasthttp.RequestHeader, origin *upstreamOrigin) *fasthttp.Request {
+	upstreamUrl := upstreamRequestURL(origin.host, h.RequestURI())
 	var req fasthttp.Request
 	req.SetRequestURI(upstreamUrl)
+	injectTraceContext(tctx, h, &req.Header)
+	forwardRequestId(h, &req.Header)
+	forwardTLSInfoHeaders(h, &req.Header)
+	setUpstreamAcceptEncoding(h, &req.Header)
+	return &req
+}
 
-	var resp fasthttp.Response
-	err := upstreamClient.Do(&req, &resp)
-	if err != nil {
-		logRequestError(h, "Cannot make request for [%s]: [%s]", key, err)
-		return nil
+func failUpstreamRequest(span trace.Span, h *fasthttp.RequestHeader, key []byte, err error) {
+	if isUpstreamResponseTooLargeError(err) {
+		atomic.AddInt64(&stats.UpstreamOversizedCount, 1)
+		logRequestError(h, "Aborted oversized upstream response for [%s]: [%s]", key, err)
+		failSpan(span, "upstream response is too large")
+		return
 	}
+	logRequestError(h, "Cannot make request for [%s]: [%s]", key, err)
+	span.RecordError(err)
+	failSpan(span, "upstream request failed")
+}
 
-	if resp.StatusCode() != fasthttp.StatusOK {
-		logRequestError(h, "Unexpected status code=%d for the response [%s]", resp.StatusCode(), key)
-		return nil
+// Stores the upstream response in the cache.
+//
+// See fetchFromUpstream() for details.
+func handleUpstreamResponse(tctx context.Context, span trace.Span, h *fasthttp.RequestHeader, key []byte, resp *fasthttp.Response, bypass bool) (*ybc.Item, *fasthttp.Response) {
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode()))
+	if err := filterUpstreamResponse(h, resp); err != nil {
+		logRequestError(h, "Cannot filter response [%s]: [%s]", key, err)
+		span.RecordError(err)
+		failSpan(span, "response filter failed")
+		return nil, nil
+	}
+
+	if bypass {
+		return nil, resp
+	}
+	if isOversizedUpstreamResponse(len(resp.Body())) {
+		atomic.AddInt64(&stats.UpstreamOversizedCount, 1)
+		if !*oversizedResponsePassthrough {
+			logRequestError(h, "Upstream response for [%s] with size=%d exceeds maxUpstreamResponseSize=%d", key, len(resp.Body()), *maxUpstreamResponseSize)
+			failSpan(span, "upstream response is too large")
+			return nil, nil
+		}
+		return nil, resp
+	}
+	if *upstreamRedirectPolicy == redirectPolicyPassthrough && isRedirectStatusCode(resp.StatusCode()) {
+		atomic.AddInt64(&stats.RedirectsPassedThroughCount, 1)
+		return nil, resp
+	}
+
+	ttl, ok := cacheableTtl(resp)
+	if !ok {
+		// Pass the upstream response with uncacheable status code
+		// to the client as is instead of replacing it with 503.
+		atomic.AddInt64(&stats.UncacheableStatusCount, 1)
+		return nil, resp
+	}
+	if t, ok := getCacheRules().ttlOverride(h.RequestURI()); ok {
+		if t <= 0 {
+			return nil, resp
+		}
+		ttl = t
+	}
+	if !admitToCache(key) {
+		atomic.AddInt64(&stats.AdmissionRejectedCount, 1)
+		return nil, resp
 	}
 
-	contentType := string(resp.Header.ContentType())
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	_, storeSpan := startSpan(tctx, "cache.store", trace.SpanKindInternal)
+	item := storeResponse(h, key, resp, ttl)
+	if item == nil {
+		// The upstream response is fine, so serve it without caching
+		// instead of failing the request.
+		failSpan(storeSpan, "cannot store response in cache")
+		storeSpan.End()
+		return nil, resp
+	}
+	storeSpan.End()
+	return item, nil
+}
+
+func servePassthroughResponse(ctx *fasthttp.RequestCtx, resp *fasthttp.Response) {
+	if location := resp.Header.Peek("Location"); len(location) > 0 {
+		ctx.Response.Header.SetBytesV("Location", location)
+	}
+	if contentEncoding := resp.Header.Peek("Content-Encoding"); len(contentEncoding) > 0 {
+		ctx.Response.Header.SetBytesV("Content-Encoding", contentEncoding)
 	}
 	body := resp.Body()
+	if !statusCodeAllowsBody(resp.StatusCode()) {
+		body = nil
+	}
+	ctx.SetStatusCode(resp.StatusCode())
+	ctx.SetContentType(string(resp.Header.ContentType()))
+	ctx.SetBody(body)
+	n := filterClientResponse(ctx, len(body))
+	registerBytesSent(ctx.Response.Header.ContentType(), n)
+	registerTopUrl(ctx.RequestURI(), n)
+}
+
+func storeResponse(h *fasthttp.RequestHeader, key []byte, resp *fasthttp.Response, ttl time.Duration) *ybc.Item {
+	body := resp.Body()
+	if n := resp.Header.ContentLength(); n >= 0 && n != len(body) {
+		logRequestError(h, "Unexpected body size=%d for response [%s]. Expected Content-Length=%d", len(body), key, n)
+		return nil
+	}
+	ih := newItemHeader(h, key, resp, ttl)
+	ih.contentLength = len(body)
+	if ih.etag == "" {
+		ih.etag = generateETag(body)
+	}
+	if ih.bodyHash = storeDedupBody(body, ttl); ih.bodyHash != "" {
+		body = nil
+	}
+	headerBuf := ih.marshal(nil)
+
 	contentLength := len(body)
-	itemSize := contentLength + len(contentType) + 1
-	txn, err := cache.NewSetTxn(key, itemSize, ybc.MaxTtl)
-	if err != nil {
-		logRequestError(h, "Cannot start set txn for response [%s], itemSize=%d: [%s]", key, itemSize, err)
+	itemSize := contentLength + len(headerBuf)
+	txn := startStoreTxn(h, key, itemSize, ttl)
+	if txn == nil {
 		return nil
 	}
 
-	if err = storeContentType(h, txn, contentType); err != nil {
+	if _, err := txn.Write(headerBuf); err != nil {
+		logRequestError(h, "Cannot store item header with size=%d for response [%s] in cache: [%s]", len(headerBuf), key, err)
 		txn.Rollback()
 		return nil
 	}
@@ -286,45 +611,61 @@ func fetchFromUpstream(h *fasthttp.RequestHeader, key []byte) *ybc.Item {
 		logRequestError(h, "Cannot commit set txn for response [%s], size=%d: [%s]", key, contentLength, err)
 		return nil
 	}
-	atomic.AddInt64(&stats.BytesReadFromUpstream, int64(n))
+	registerBytesRead(resp.Header.ContentType(), len(resp.Body()))
+	registerStoredTtl(ttl)
 	return item
 }
 
-func storeContentType(h *fasthttp.RequestHeader, w io.Writer, contentType string) (err error) {
-	strBuf := []byte(contentType)
-	strSize := len(strBuf)
-	if strSize > 255 {
-		logRequestError(h, "Too long content-type=[%s]. Its' length=%d should fit one byte", contentType, strSize)
-		err = fmt.Errorf("Too long content-type")
-		return
+// Returns item header for the given upstream response.
+//
+// Etag is left empty if the response has no Etag header.
+func newItemHeader(h *fasthttp.RequestHeader, key []byte, resp *fasthttp.Response, ttl time.Duration) itemHeader {
+	ih := itemHeader{
+		contentType: string(resp.Header.ContentType()),
+		etag:        string(resp.Header.Peek("Etag")),
+		fetchTime:   time.Now(),
+		statusCode:  resp.StatusCode(),
+		location:    string(resp.Header.Peek("Location")),
+		ttl:         ttl,
+
+		contentEncoding: string(resp.Header.Peek("Content-Encoding")),
+	}
+	if isHashedKey(key) {
+		ih.url = string(getRequestHost(h)) + string(h.RequestURI())
+		if len(ih.url) > maxItemFieldSize {
+			ih.url = ih.url[:maxItemFieldSize]
+		}
 	}
-	var sizeBuf [1]byte
-	sizeBuf[0] = byte(strSize)
-	if _, err = w.Write(sizeBuf[:]); err != nil {
-		logRequestError(h, "Cannot store content-type length in cache: [%s]", err)
-		return
+	if ih.contentType == "" {
+		ih.contentType = "application/octet-stream"
 	}
-	if _, err = w.Write(strBuf); err != nil {
-		logRequestError(h, "Cannot store content-type string with length=%d in cache: [%s]", strSize, err)
-		return
+	if v := resp.Header.Peek("Last-Modified"); len(v) > 0 {
+		t, err := fasthttp.ParseHTTPDate(v)
+		if err != nil {
+			logRequestError(h, "Cannot parse Last-Modified=[%s] for the response [%s]: [%s]", v, key, err)
+		} else {
+			ih.lastModified = t
+		}
 	}
-	return
+	if ih.lastModified.IsZero() {
+		ih.lastModified = ih.fetchTime
+	}
+	return ih
 }
 
-func loadContentType(h *fasthttp.RequestHeader, r io.Reader) (contentType string, err error) {
-	var sizeBuf [1]byte
-	if _, err = r.Read(sizeBuf[:]); err != nil {
-		logRequestError(h, "Cannot read content-type length from cache: [%s]", err)
-		return
-	}
-	strSize := int(sizeBuf[0])
-	strBuf := make([]byte, strSize)
-	if _, err = r.Read(strBuf); err != nil {
-		logRequestError(h, "Cannot read content-type string with length=%d from cache: [%s]", strSize, err)
-		return
+func startStoreTxn(h *fasthttp.RequestHeader, key []byte, itemSize int, ttl time.Duration) *ybc.SetTxn {
+	txn, err := cache.NewSetTxn(key, itemSize, ttl)
+	if err != nil {
+		switch err {
+		case ybc.ErrItemTooLarge:
+			atomic.AddInt64(&stats.UncacheableTooLargeCount, 1)
+		case ybc.ErrNoSpace:
+			atomic.AddInt64(&stats.UncacheableNoSpaceCount, 1)
+		}
+		logRequestError(h, "Cannot start set txn for response [%s], itemSize=%d: [%s]", key, itemSize, err)
+		return nil
 	}
-	contentType = string(strBuf)
-	return
+	return txn
 }
 
 var upstreamHostBytes []byte
@@ -336,9 +677,26 @@ func getRequestHost(h *fasthttp.RequestHeader) []byte {
 	return upstreamHostBytes
 }
 
+// Appends cache key for the request with the given header to dst.
+//
+// The key is built in the same way as for client requests, but the routing
+// script isn't applied.
+func urlCacheKey(dst []byte, h *fasthttp.RequestHeader, origin *upstreamOrigin) []byte {
+	dst = appendCacheNamespace(dst, h.RequestURI())
+	if *cacheKeyIncludesOrigin {
+		dst = append(dst, origin.host...)
+		dst = append(dst, '|')
+	}
+	dst = append(dst, getRequestHost(h)...)
+	dst = append(dst, h.RequestURI()...)
+	dst = appendEncodingVariant(dst, h)
+	dst = appendTLSInfoVariant(dst, h)
+	return limitKeyLength(dst)
+}
+
 func logRequestError(h *fasthttp.RequestHeader, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	logMessage("%s - %s - %s. %s", h.RequestURI(), h.Referer(), h.UserAgent(), msg)
+	logMessage("%s - %s - %s - %s. %s", getRequestId(h), h.RequestURI(), h.Referer(), h.UserAgent(), msg)
 }
 
 func logMessage(format string, args ...interface{}) {
@@ -354,30 +712,250 @@ func logFatal(format string, args ...interface{}) {
 type Stats struct {
 	CacheHitsCount        int64
 	CacheMissesCount      int64
-	IfNoneMatchHitsCount  int64
 	BytesReadFromUpstream int64
 	BytesSentToClients    int64
-}
 
-func (s *Stats) WriteToStream(w io.Writer) {
-	fmt.Fprintf(w, "Command-line flags\n")
-	flag.VisitAll(func(f *flag.Flag) {
-		fmt.Fprintf(w, "%s=%v\n", f.Name, f.Value)
-	})
-	fmt.Fprintf(w, "\n")
+	// Traffic breakdown by content type families.
+	BytesSentImage int64
+	BytesSentJs    int64
+	BytesSentCss   int64
+	BytesSentHtml  int64
+	BytesSentOther int64
+	BytesReadImage int64
+	BytesReadJs    int64
+	BytesReadCss   int64
+	BytesReadHtml  int64
+	BytesReadOther int64
+
+	NotModifiedCount        int64
+	PartialContentCount     int64
+	PreconditionFailedCount int64
+
+	UpstreamRequestsCount    int64
+	UpstreamInflightRequests int64
+	UpstreamDialsCount       int64
+	UpstreamDialErrorsCount  int64
+
+	UpstreamHedgedRequestsCount int64
+	UpstreamHedgeWinsCount      int64
+	UpstreamRangeRetriesCount   int64
+
+	UpstreamRedirectsFollowed   int64
+	RedirectsPassedThroughCount int64
+	BypassedRequestsCount       int64
+
+	MirrorRequestsCount int64
+	MirrorErrorsCount   int64
+	MirrorDroppedCount  int64
+	MirrorLatencyTotal  int64
+
+	RevalidationsQueuedCount  int64
+	RevalidationsDroppedCount int64
+	RevalidationsCount        int64
+	RevalidationErrorsCount   int64
+
+	AdmissionRejectedCount   int64
+	CorsPreflightsCount      int64
+	UncacheableTooLargeCount int64
+	UncacheableNoSpaceCount  int64
+	UncacheableStatusCount   int64
+	UpstreamOversizedCount   int64
+	AuthFailuresCount        int64
+	ForbiddenPathsCount      int64
+	LocalPathsServedCount    int64
+	UnhygienicRequestsCount  int64
+	HashedKeysCount          int64
+
+	DedupBlobsCount int64
+	DedupHitsCount  int64
+	DedupBytesSaved int64
+
+	PrecompressedServedCount  int64
+	RoutingScriptMatchesCount int64
+
+	PrefetchedCount     int64
+	PrefetchErrorsCount int64
+
+	QueuedRequestsCount int64
+	ShedRequestsCount   int64
+
+	NamespaceClearsCount int64
+
+	StreamedResponsesCount int64
+
+	ShieldCollapsedRequestsCount int64
+	ShieldCollapseTimeoutsCount  int64
+
+	ChaosUpstreamDelaysCount int64
+	ChaosUpstreamErrorsCount int64
+	ChaosCacheMissesCount    int64
+}
 
-	requestsCount := s.CacheHitsCount + s.CacheMissesCount + s.IfNoneMatchHitsCount
+// Writes cache hit ratio and traffic counters.
+func (s *Stats) writeTrafficStats(w io.Writer) {
+	requestsCount := s.CacheHitsCount + s.CacheMissesCount
 	var cacheHitRatio float64
 	if requestsCount > 0 {
-		cacheHitRatio = float64(s.CacheHitsCount+s.IfNoneMatchHitsCount) / float64(requestsCount) * 100.0
+		cacheHitRatio = float64(s.CacheHitsCount) / float64(requestsCount) * 100.0
 	}
 	fmt.Fprintf(w, "Requests count: %d\n", requestsCount)
 	fmt.Fprintf(w, "Cache hit ratio: %.3f%%\n", cacheHitRatio)
 	fmt.Fprintf(w, "Cache hits: %d\n", s.CacheHitsCount)
 	fmt.Fprintf(w, "Cache misses: %d\n", s.CacheMissesCount)
-	fmt.Fprintf(w, "If-None-Match hits: %d\n", s.IfNoneMatchHitsCount)
+	fmt.Fprintf(w, "Not modified responses: %d\n", s.NotModifiedCount)
+	fmt.Fprintf(w, "Partial content responses: %d\n", s.PartialContentCount)
+	fmt.Fprintf(w, "Precondition failed responses: %d\n", s.PreconditionFailedCount)
 	fmt.Fprintf(w, "Read from upstream: %.3f MBytes\n", float64(s.BytesReadFromUpstream)/1000000)
 	fmt.Fprintf(w, "Sent to clients: %.3f MBytes\n", float64(s.BytesSentToClients)/1000000)
 	fmt.Fprintf(w, "Upstream traffic saved: %.3f MBytes\n", float64(s.BytesSentToClients-s.BytesReadFromUpstream)/1000000)
-	fmt.Fprintf(w, "Upstream requests saved: %d\n", s.CacheHitsCount+s.IfNoneMatchHitsCount)
+	s.writeContentTypeStats(w)
+	fmt.Fprintf(w, "Upstream requests saved: %d\n", s.CacheHitsCount)
+}
+
+func (s *Stats) WriteToStream(w io.Writer) {
+	fmt.Fprintf(w, "Command-line flags\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "%s=%v\n", f.Name, f.Value)
+	})
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Stats since start at %s\n", startTime.Format(time.RFC3339))
+	s.writeTrafficStats(w)
+	fmt.Fprintf(w, "\n")
+	writeLifetimeStats(w)
+
+	upstreamRequestsCount := atomic.LoadInt64(&s.UpstreamRequestsCount)
+	dialsCount := atomic.LoadInt64(&s.UpstreamDialsCount)
+	openConns := int64(upstreamClients.connsCount())
+	busyConns := atomic.LoadInt64(&s.UpstreamInflightRequests)
+	idleConns := openConns - busyConns
+	if idleConns < 0 {
+		idleConns = 0
+	}
+	reusedConns := upstreamRequestsCount - dialsCount
+	if reusedConns < 0 {
+		reusedConns = 0
+	}
+	fmt.Fprintf(w, "Upstream addresses: %s\n", strings.Join(upstreamClients.addrs(), ", "))
+	fmt.Fprintf(w, "Upstream requests: %d\n", upstreamRequestsCount)
+	fmt.Fprintf(w, "Upstream open connections: %d\n", openConns)
+	fmt.Fprintf(w, "Upstream idle connections: %d\n", idleConns)
+	fmt.Fprintf(w, "Upstream connections dialed: %d\n", dialsCount)
+	fmt.Fprintf(w, "Upstream dial errors: %d\n", atomic.LoadInt64(&s.UpstreamDialErrorsCount))
+	fmt.Fprintf(w, "Upstream requests over reused connections: %d\n", reusedConns)
+	if hedgeLatencies != nil {
+		fmt.Fprintf(w, "Upstream hedging delay: %s\n", hedgeLatencies.getDelay())
+		fmt.Fprintf(w, "Upstream hedged requests: %d\n", atomic.LoadInt64(&s.UpstreamHedgedRequestsCount))
+		fmt.Fprintf(w, "Upstream hedged requests answered first: %d\n", atomic.LoadInt64(&s.UpstreamHedgeWinsCount))
+	}
+	if *upstreamRangeChunkSize > 0 {
+		fmt.Fprintf(w, "Upstream byte range retries: %d\n", atomic.LoadInt64(&s.UpstreamRangeRetriesCount))
+	}
+	fmt.Fprintf(w, "Upstream redirects followed: %d\n", atomic.LoadInt64(&s.UpstreamRedirectsFollowed))
+	fmt.Fprintf(w, "Redirects passed through to clients: %d\n", atomic.LoadInt64(&s.RedirectsPassedThroughCount))
+	fmt.Fprintf(w, "Requests bypassing the cache: %d\n", atomic.LoadInt64(&s.BypassedRequestsCount))
+	if shieldOrigin != nil {
+		fmt.Fprintf(w, "Shield address: %s\n", *shieldHost)
+		fmt.Fprintf(w, "Shield requests: %d\n", atomic.LoadInt64(&shieldOrigin.requestsCount))
+	}
+	if *shieldMode {
+		fmt.Fprintf(w, "Collapsed cache misses: %d\n", atomic.LoadInt64(&s.ShieldCollapsedRequestsCount))
+		fmt.Fprintf(w, "Collapsed cache misses timed out: %d\n", atomic.LoadInt64(&s.ShieldCollapseTimeoutsCount))
+	}
+	if *streamUpstreamResponses {
+		fmt.Fprintf(w, "Responses streamed from upstream: %d\n", atomic.LoadInt64(&s.StreamedResponsesCount))
+	}
+	fmt.Fprintf(w, "Cache namespace clears: %d\n", atomic.LoadInt64(&s.NamespaceClearsCount))
+	s.writeChaosStats(w)
+	if *maxCacheKeyLength > 0 {
+		fmt.Fprintf(w, "Cache keys hashed due to maxCacheKeyLength: %d\n", atomic.LoadInt64(&s.HashedKeysCount))
+	}
+	fmt.Fprintf(w, "Responses not cached due to their size: %d\n", atomic.LoadInt64(&s.UncacheableTooLargeCount))
+	fmt.Fprintf(w, "Responses not cached due to lack of cache space: %d\n", atomic.LoadInt64(&s.UncacheableNoSpaceCount))
+	fmt.Fprintf(w, "Responses not cached due to their status code: %d\n", atomic.LoadInt64(&s.UncacheableStatusCount))
+	if *maxUpstreamResponseSize > 0 {
+		fmt.Fprintf(w, "Upstream responses exceeding maxUpstreamResponseSize: %d\n", atomic.LoadInt64(&s.UpstreamOversizedCount))
+	}
+	if admission != nil {
+		fmt.Fprintf(w, "Responses not cached due to admissionMinRequests: %d\n", atomic.LoadInt64(&s.AdmissionRejectedCount))
+	}
+	if auth != nil {
+		fmt.Fprintf(w, "Requests rejected due to missing or invalid credentials: %d\n", atomic.LoadInt64(&s.AuthFailuresCount))
+	}
+	if requestHygiene != nil {
+		fmt.Fprintf(w, "Requests rejected by url and user agent checks: %d\n", atomic.LoadInt64(&s.UnhygienicRequestsCount))
+	}
+	if pathAllowlist != nil {
+		fmt.Fprintf(w, "Requests rejected due to disallowed paths: %d\n", atomic.LoadInt64(&s.ForbiddenPathsCount))
+	}
+	if localContents != nil {
+		fmt.Fprintf(w, "Requests served from localPaths: %d\n", atomic.LoadInt64(&s.LocalPathsServedCount))
+	}
+	if corsRules != nil {
+		fmt.Fprintf(w, "CORS preflight requests answered: %d\n", atomic.LoadInt64(&s.CorsPreflightsCount))
+	}
+	if precompressed != nil {
+		fmt.Fprintf(w, "Responses served from pre-compressed siblings: %d\n", atomic.LoadInt64(&s.PrecompressedServedCount))
+	}
+	if currentRoutingScript != nil {
+		fmt.Fprintf(w, "Requests matched by routing script: %d\n", atomic.LoadInt64(&s.RoutingScriptMatchesCount))
+	}
+	if *prefetchSitemapPath != "" {
+		fmt.Fprintf(w, "Urls prefetched from sitemap: %d\n", atomic.LoadInt64(&s.PrefetchedCount))
+		fmt.Fprintf(w, "Sitemap prefetch errors: %d\n", atomic.LoadInt64(&s.PrefetchErrorsCount))
+	}
+
+	if tiers != nil {
+		fmt.Fprintf(w, "\n")
+		writeTierStats(w)
+	}
+	if *dedupMinSize > 0 {
+		fmt.Fprintf(w, "\n")
+		writeDedupStats(w)
+	}
+	if requestLimits != nil {
+		fmt.Fprintf(w, "\n")
+		writeLoadSheddingStats(w)
+	}
+
+	if secondaryOrigin != nil {
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "Primary origin: %s\n", primaryOrigin.host)
+		fmt.Fprintf(w, "Primary origin requests: %d\n", atomic.LoadInt64(&primaryOrigin.requestsCount))
+		fmt.Fprintf(w, "Secondary origin: %s\n", secondaryOrigin.host)
+		fmt.Fprintf(w, "Secondary origin weight: %d%%\n", *secondaryUpstreamWeight)
+		fmt.Fprintf(w, "Secondary origin requests: %d\n", atomic.LoadInt64(&secondaryOrigin.requestsCount))
+		fmt.Fprintf(w, "Secondary origin open connections: %d\n", secondaryOrigin.clients.connsCount())
+	}
+
+	if mirrorClient != nil {
+		mirrorRequestsCount := atomic.LoadInt64(&s.MirrorRequestsCount)
+		var mirrorAvgLatency time.Duration
+		if mirrorRequestsCount > 0 {
+			mirrorAvgLatency = time.Duration(atomic.LoadInt64(&s.MirrorLatencyTotal) / mirrorRequestsCount)
+		}
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "Mirror upstream: %s\n", *mirrorUpstreamHost)
+		fmt.Fprintf(w, "Mirror requests: %d\n", mirrorRequestsCount)
+		fmt.Fprintf(w, "Mirror errors: %d\n", atomic.LoadInt64(&s.MirrorErrorsCount))
+		fmt.Fprintf(w, "Mirror requests dropped due to mirrorMaxConcurrency: %d\n", atomic.LoadInt64(&s.MirrorDroppedCount))
+		fmt.Fprintf(w, "Mirror average latency: %s\n", mirrorAvgLatency)
+	}
+
+	if revalidations != nil {
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "Revalidations queued: %d\n", atomic.LoadInt64(&s.RevalidationsQueuedCount))
+		fmt.Fprintf(w, "Revalidations dropped due to revalidationQueueSize: %d\n", atomic.LoadInt64(&s.RevalidationsDroppedCount))
+		fmt.Fprintf(w, "Revalidations done: %d\n", atomic.LoadInt64(&s.RevalidationsCount))
+		fmt.Fprintf(w, "Revalidation errors: %d\n", atomic.LoadInt64(&s.RevalidationErrorsCount))
+		fmt.Fprintf(w, "Revalidation queue length: %d\n", revalidations.len())
+	}
+
+	fmt.Fprintf(w, "\n")
+	writeTtlDistribution(w)
+
+	if topHits != nil {
+		fmt.Fprintf(w, "\n")
+		writeTopUrls(w)
+	}
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	mirrorUpstreamHost     = flag.String("mirrorUpstreamHost", "", "Secondary upstream host for mirroring cache miss requests to. May include port in the form 'host:port'. Responses from this host are discarded. Leave empty for disabling mirroring")
+	mirrorPercent          = flag.Float64("mirrorPercent", 100, "Percentage of cache miss requests to mirror to mirrorUpstreamHost")
+	mirrorMaxConcurrency   = flag.Int("mirrorMaxConcurrency", 100, "The maximum number of concurrent requests to mirrorUpstreamHost. Requests exceeding this limit aren't mirrored")
+	mirrorRequestTimeout   = flag.Duration("mirrorRequestTimeout", 10*time.Second, "Timeout for requests to mirrorUpstreamHost")
+	mirrorUpstreamProtocol = flag.String("mirrorUpstreamProtocol", "", "Protocol for talking to mirrorUpstreamHost. Either http or https. Defaults to the scheme of upstream requests, i.e. to upstreamProtocol for http and https")
+)
+
+var (
+	mirrorClient *fasthttp.HostClient
+	mirrorSem    chan struct{}
+)
+
+func initMirror() {
+	if *mirrorUpstreamHost == "" {
+		return
+	}
+	if *mirrorPercent <= 0 || *mirrorPercent > 100 {
+		logFatal("mirrorPercent=%v must be in the range (0..100]", *mirrorPercent)
+	}
+	if *mirrorMaxConcurrency <= 0 {
+		logFatal("mirrorMaxConcurrency=%d must be positive", *mirrorMaxConcurrency)
+	}
+	if *mirrorUpstreamProtocol == "" {
+		*mirrorUpstreamProtocol = upstreamScheme()
+	}
+	if *mirrorUpstreamProtocol != "http" && *mirrorUpstreamProtocol != "https" {
+		logFatal("Unsupported mirrorUpstreamProtocol=[%s]. Supported values: http, https", *mirrorUpstreamProtocol)
+	}
+	addr := *mirrorUpstreamHost
+	isTLS := *mirrorUpstreamProtocol == "https"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if isTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	mirrorClient = &fasthttp.HostClient{
+		Addr: addr,
+		Dial: func(addr string) (net.Conn, error) {
+			return dialUpstreamTCP(addr, *upstreamDialTimeout)
+		},
+		IsTLS:    isTLS,
+		MaxConns: *mirrorMaxConcurrency,
+	}
+	mirrorSem = make(chan struct{}, *mirrorMaxConcurrency)
+	logMessage("Mirroring %.3f%% of cache miss requests to [%s://%s]", *mirrorPercent, *mirrorUpstreamProtocol, *mirrorUpstreamHost)
+}
+
+// Asynchronously sends a copy of the given request to mirrorUpstreamHost
+// if the request falls into mirrorPercent.
+//
+// The response is discarded. The request isn't mirrored if there are
+// already mirrorMaxConcurrency requests in flight.
+func mirrorRequest(h *fasthttp.RequestHeader) {
+	if mirrorClient == nil {
+		return
+	}
+	if *mirrorPercent < 100 && rand.Float64()*100 >= *mirrorPercent {
+		return
+	}
+	select {
+	case mirrorSem <- struct{}{}:
+	default:
+		atomic.AddInt64(&stats.MirrorDroppedCount, 1)
+		return
+	}
+
+	req := fasthttp.AcquireRequest()
+	req.SetRequestURI(fmt.Sprintf("%s://%s%s", *mirrorUpstreamProtocol, *mirrorUpstreamHost, h.RequestURI()))
+	forwardRequestId(h, &req.Header)
+	forwardTLSInfoHeaders(h, &req.Header)
+	go func() {
+		resp := fasthttp.AcquireResponse()
+		startTime := time.Now()
+		err := mirrorClient.DoTimeout(req, resp, *mirrorRequestTimeout)
+		atomic.AddInt64(&stats.MirrorRequestsCount, 1)
+		atomic.AddInt64(&stats.MirrorLatencyTotal, int64(time.Since(startTime)))
+		if err != nil {
+			atomic.AddInt64(&stats.MirrorErrorsCount, 1)
+		}
+		fasthttp.ReleaseResponse(resp)
+		fasthttp.ReleaseRequest(req)
+		<-mirrorSem
+	}()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	httpsClientCAFile = flag.String("httpsClientCAFile", "", "Path to PEM file with CA certificates for verifying HTTPS client certificates (mTLS). Client certificates aren't requested if empty")
+	httpsClientAuth   = flag.String("httpsClientAuth", "verifyIfGiven", "Client certificate verification mode for HTTPS listeners. Used only if httpsClientCAFile is set. Supported modes:\n"+
+		"  verifyIfGiven - clients may connect without certificates, while presented certificates must be valid\n"+
+		"  require - clients without valid certificates are rejected")
+	httpsClientCRLFile           = flag.String("httpsClientCRLFile", "", "Path to file with certificate revocation lists (CRL) in PEM or DER format for CAs from httpsClientCAFile. Revoked client certificates are rejected. CRLs aren't checked if empty")
+	httpsClientCRLReloadInterval = flag.Duration("httpsClientCRLReloadInterval", time.Hour, "Interval for re-reading httpsClientCRLFile. Zero value disables re-reading")
+)
+
+const (
+	clientAuthVerifyIfGiven = "verifyIfGiven"
+	clientAuthRequire       = "require"
+)
+
+var errClientCertRevoked = errors.New("client certificate is revoked")
+
+// Enables verification of client certificates on HTTPS listeners
+// if httpsClientCAFile is set.
+func setupClientAuth(c *tls.Config) {
+	if *httpsClientCAFile == "" {
+		return
+	}
+	cas := readCertificates(*httpsClientCAFile)
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	c.ClientCAs = pool
+
+	switch *httpsClientAuth {
+	case clientAuthVerifyIfGiven:
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		logFatal("Unsupported httpsClientAuth=[%s]. Supported values are [%s], [%s]", *httpsClientAuth, clientAuthVerifyIfGiven, clientAuthRequire)
+	}
+
+	if *httpsClientCRLFile != "" {
+		crls := &revocationLists{
+			cas: cas,
+		}
+		if err := crls.load(*httpsClientCRLFile); err != nil {
+			logFatal("Cannot load httpsClientCRLFile=[%s]: [%s]", *httpsClientCRLFile, err)
+		}
+		if *httpsClientCRLReloadInterval > 0 {
+			go crls.reloader(*httpsClientCRLFile, *httpsClientCRLReloadInterval)
+		}
+		c.VerifyPeerCertificate = crls.verifyPeerCertificate
+	}
+	logMessage("Client certificates are verified in [%s] mode", *httpsClientAuth)
+}
+
+func readCertificates(path string) []*x509.Certificate {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logFatal("Cannot read httpsClientCAFile=[%s]: [%s]", path, err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			logFatal("Cannot parse certificate in httpsClientCAFile=[%s]: [%s]", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		logFatal("Cannot find PEM certificates in httpsClientCAFile=[%s]", path)
+	}
+	return certs
+}
+
+// Revoked certificates from CRLs for client CAs.
+//
+// The set may be replaced on the fly by reloader().
+type revocationLists struct {
+	cas     []*x509.Certificate
+	revoked atomic.Value
+}
+
+// Keys are issuer's raw subject followed by certificate serial number.
+type revokedSet map[string]struct{}
+
+func revokedKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
+
+// Loads CRLs from the given file. Each CRL must be signed by one
+// of client CAs.
+func (crls *revocationLists) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		// Assume a single DER-encoded CRL.
+		ders = append(ders, data)
+	}
+
+	revoked := make(revokedSet)
+	for _, der := range ders {
+		rl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+		if err = crls.checkIssuer(rl); err != nil {
+			return err
+		}
+		if !rl.NextUpdate.IsZero() && time.Now().After(rl.NextUpdate) {
+			logMessage("CRL issued by [%s] in [%s] is outdated since [%s]", rl.Issuer, path, rl.NextUpdate)
+		}
+		for _, e := range rl.RevokedCertificateEntries {
+			revoked[revokedKey(rl.RawIssuer, e.SerialNumber.String())] = struct{}{}
+		}
+	}
+	crls.revoked.Store(revoked)
+	return nil
+}
+
+func (crls *revocationLists) checkIssuer(rl *x509.RevocationList) error {
+	for _, ca := range crls.cas {
+		if string(ca.RawSubject) == string(rl.RawIssuer) && rl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL issued by [%s] isn't signed by any CA from httpsClientCAFile", rl.Issuer)
+}
+
+func (crls *revocationLists) reloader(path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := crls.load(path); err != nil {
+			logMessage("Cannot reload httpsClientCRLFile=[%s]: [%s]. Using the previously loaded CRLs", path, err)
+		}
+	}
+}
+
+func (crls *revocationLists) isRevoked(cert *x509.Certificate) bool {
+	revoked := crls.revoked.Load().(revokedSet)
+	_, ok := revoked[revokedKey(cert.RawIssuer, cert.SerialNumber.String())]
+	return ok
+}
+
+// Rejects client certificates if all their verified chains contain
+// revoked certificates.
+//
+// It is called by TLS stack after the client certificate is verified
+// against httpsClientCAFile.
+func (crls *revocationLists) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		// The client didn't present certificate in verifyIfGiven mode.
+		return nil
+	}
+	for _, chain := range verifiedChains {
+		if !crls.isChainRevoked(chain) {
+			return nil
+		}
+	}
+	return errClientCertRevoked
+}
+
+func (crls *revocationLists) isChainRevoked(chain []*x509.Certificate) bool {
+	// The last certificate in the chain is a trusted CA, which cannot
+	// be revoked by CRLs.
+	for i := 0; i < len(chain)-1; i++ {
+		if crls.isRevoked(chain[i]) {
+			return true
+		}
+	}
+	return false
+}
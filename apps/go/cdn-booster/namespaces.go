@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// Cache namespaces group cached items by url patterns from caching rules,
+// so all the items in a namespace may be purged at once.
+//
+// Cache keys for items in a namespace are prefixed by the namespace name
+// and the namespace version. Clearing the namespace bumps its version,
+// so items stored under the previous version become unreachable and are
+// eventually evicted from the cache. The version is stored in the cache
+// itself, so it survives restarts for persistent caches.
+
+const (
+	namespaceKeyPrefix        = "\x00ns|"
+	namespaceVersionKeyPrefix = "\x00ns.version|"
+)
+
+var (
+	// Namespace versions keyed by namespace name.
+	namespaceVersions     = make(map[string]uint64)
+	namespaceVersionsLock sync.Mutex
+)
+
+func initNamespaces() {
+	registerAdminHandler("/namespaces", namespacesHandler)
+	registerAdminHandler("/namespaces/clear", namespaceClearHandler)
+}
+
+func isValidNamespaceName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			continue
+		}
+		if c == '-' || c == '_' || c == '.' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Appends namespace prefix for the given requestURI to the key.
+//
+// The key is left untouched if the requestURI doesn't belong
+// to any namespace.
+func appendCacheNamespace(key, requestURI []byte) []byte {
+	name := getCacheRules().namespace(requestURI)
+	if name == "" {
+		return key
+	}
+	key = append(key, namespaceKeyPrefix...)
+	key = append(key, name...)
+	key = append(key, '|')
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], getNamespaceVersion(name))
+	key = append(key, buf[:]...)
+	return append(key, '|')
+}
+
+func namespaceVersionKey(name string) []byte {
+	return []byte(namespaceVersionKeyPrefix + name)
+}
+
+// Returns the current version for the namespace with the given name.
+//
+// The version is created if it is missing.
+func getNamespaceVersion(name string) uint64 {
+	namespaceVersionsLock.Lock()
+	defer namespaceVersionsLock.Unlock()
+
+	if version, ok := namespaceVersions[name]; ok {
+		return version
+	}
+	value, err := cache.Get(namespaceVersionKey(name))
+	if err == nil && len(value) == 8 {
+		version := binary.BigEndian.Uint64(value)
+		namespaceVersions[name] = version
+		return version
+	}
+	if err != nil && err != ybc.ErrCacheMiss {
+		logMessage("Cannot read version for cache namespace [%s]: [%s]", name, err)
+	}
+	// A missing version means items stored under the previous version,
+	// if any, are unreachable, so a new version may be safely created.
+	return setNamespaceVersion(name)
+}
+
+// Sets new version for the namespace with the given name.
+//
+// namespaceVersionsLock must be held.
+func setNamespaceVersion(name string) uint64 {
+	version := uint64(time.Now().UnixNano())
+	if old, ok := namespaceVersions[name]; ok && version <= old {
+		version = old + 1
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], version)
+	if err := cache.Set(namespaceVersionKey(name), buf[:], ybc.MaxTtl); err != nil {
+		logMessage("Cannot store version for cache namespace [%s]: [%s]", name, err)
+	}
+	namespaceVersions[name] = version
+	return version
+}
+
+// Makes all the items in the namespace with the given name unreachable.
+func clearNamespace(name string) uint64 {
+	namespaceVersionsLock.Lock()
+	version := setNamespaceVersion(name)
+	namespaceVersionsLock.Unlock()
+
+	atomic.AddInt64(&stats.NamespaceClearsCount, 1)
+	return version
+}
+
+type namespaceInfo struct {
+	Name    string `json:"name"`
+	Version uint64 `json:"version"`
+}
+
+// Admin API handler returning namespaces from caching rules
+// with their current versions.
+func namespacesHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	names := make(map[string]struct{})
+	for _, name := range getCacheRules().nsNames {
+		names[name] = struct{}{}
+	}
+	infos := []namespaceInfo{}
+	for name := range names {
+		infos = append(infos, namespaceInfo{
+			Name:    name,
+			Version: getNamespaceVersion(name),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		logFatal("BUG: cannot marshal namespaces: [%s]", err)
+	}
+	ctx.Success("application/json", data)
+}
+
+// Admin API handler clearing the namespace passed in name query arg.
+func namespaceClearHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("Method not allowed. Use POST for clearing the namespace", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	name := string(ctx.QueryArgs().Peek("name"))
+	if !isValidNamespaceName(name) {
+		ctx.Error(fmt.Sprintf("Invalid namespace name [%s]", name), fasthttp.StatusBadRequest)
+		return
+	}
+	version := clearNamespace(name)
+	logMessage("Cache namespace [%s] has been cleared. New version is %d", name, version)
+	ctx.Success("text/plain", []byte(fmt.Sprintf("Namespace [%s] has been cleared\n", name)))
+}
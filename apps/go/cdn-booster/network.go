@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	listenNetwork = flag.String("listenNetwork", "tcp", "Network for listening to client connections at listenAddrs, httpsListenAddrs, adminListenAddr and listenersConfigFile addresses. "+
+		"Supported values: 'tcp' for dual-stack IPv4/IPv6 listening, 'tcp4' for IPv4 only, 'tcp6' for IPv6 only")
+	upstreamNetwork = flag.String("upstreamNetwork", "tcp", "Network for connections to upstream hosts. Supported values: 'tcp' for trying both IPv4 and IPv6, "+
+		"'tcp4' for IPv4 only, 'tcp6' for IPv6 only. With 'tcp' the address family of the last successful connection is tried first")
+)
+
+func initNetwork() {
+	if !isValidNetwork(*listenNetwork) {
+		logFatal("Unsupported listenNetwork=[%s]. Supported values: tcp, tcp4, tcp6", *listenNetwork)
+	}
+	if !isValidNetwork(*upstreamNetwork) {
+		logFatal("Unsupported upstreamNetwork=[%s]. Supported values: tcp, tcp4, tcp6", *upstreamNetwork)
+	}
+}
+
+func isValidNetwork(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// Non-zero if the last successful upstream connection used IPv6.
+var preferUpstreamIPv6 uint32
+
+// Establishes TCP connection to the given upstream address
+// in upstreamNetwork.
+//
+// If upstreamNetwork is 'tcp', then both IPv4 and IPv6 are tried,
+// starting from the address family of the last successful connection.
+// The first attempt is limited by a half of the timeout, so a broken
+// address family doesn't consume the whole timeout.
+func dialUpstreamTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	if *upstreamNetwork != "tcp" {
+		return net.DialTimeout(*upstreamNetwork, addr, timeout)
+	}
+	networks := [2]string{"tcp4", "tcp6"}
+	if atomic.LoadUint32(&preferUpstreamIPv6) != 0 {
+		networks[0], networks[1] = networks[1], networks[0]
+	}
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout(networks[0], addr, timeout/2)
+	if err == nil {
+		return conn, nil
+	}
+	conn, err1 := net.DialTimeout(networks[1], addr, time.Until(deadline))
+	if err1 != nil {
+		if isNoSuitableAddressError(err1) {
+			// The address has no addresses in the second family,
+			// so the first error is more relevant.
+			return nil, err
+		}
+		return nil, err1
+	}
+	var preferIPv6 uint32
+	if networks[1] == "tcp6" {
+		preferIPv6 = 1
+	}
+	atomic.StoreUint32(&preferUpstreamIPv6, preferIPv6)
+	return conn, nil
+}
+
+func isNoSuitableAddressError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	addrErr, ok := opErr.Err.(*net.AddrError)
+	return ok && addrErr.Err == "no suitable address found"
+}
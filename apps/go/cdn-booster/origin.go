@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	secondaryUpstreamHost   = flag.String("secondaryUpstreamHost", "", "Secondary upstream host for gradual origin migrations. May include port in the form 'host:port'. Cache misses are split between upstreamHost and secondaryUpstreamHost according to secondaryUpstreamWeight. Leave empty for disabling traffic splitting")
+	secondaryUpstreamWeight = flag.Int("secondaryUpstreamWeight", 0, "Percentage of clients in the range [0..100], whose cache misses are sent to secondaryUpstreamHost. Clients are assigned to origins by their IP hash, so each client sticks to the same origin")
+	cacheKeyIncludesOrigin  = flag.Bool("cacheKeyIncludesOrigin", false, "Whether to include origin host into cache keys. This prevents mixing responses from upstreamHost and secondaryUpstreamHost in the cache at the cost of lower hit ratio")
+)
+
+// Upstream origin, i.e. either upstreamHost or secondaryUpstreamHost.
+type upstreamOrigin struct {
+	// Origin host in the form 'host[:port]'.
+	host string
+
+	clients *upstreamPool
+
+	// The number of upstream requests made to the origin.
+	requestsCount int64
+}
+
+var (
+	primaryOrigin   *upstreamOrigin
+	secondaryOrigin *upstreamOrigin
+)
+
+func newUpstreamOrigin(host string) *upstreamOrigin {
+	return &upstreamOrigin{
+		host:    host,
+		clients: newUpstreamPool(hostname(host), []string{host}),
+	}
+}
+
+func initOrigins() {
+	primaryOrigin = newUpstreamOrigin(*upstreamHost)
+	upstreamClients = primaryOrigin.clients
+	if *secondaryUpstreamHost == "" {
+		return
+	}
+	if *secondaryUpstreamWeight < 0 || *secondaryUpstreamWeight > 100 {
+		logFatal("secondaryUpstreamWeight=%d must be in the range [0..100]", *secondaryUpstreamWeight)
+	}
+	secondaryOrigin = newUpstreamOrigin(*secondaryUpstreamHost)
+	logMessage("Sending cache misses for %d%% of clients to secondaryUpstreamHost=[%s]", *secondaryUpstreamWeight, *secondaryUpstreamHost)
+}
+
+// Selects the origin for the given request.
+//
+// The selection depends only on client IP, so clients are sticky
+// to origins unless secondaryUpstreamWeight changes.
+func selectOrigin(ctx *fasthttp.RequestCtx) *upstreamOrigin {
+	if secondaryOrigin == nil || *secondaryUpstreamWeight == 0 {
+		return primaryOrigin
+	}
+	h := fnv.New32a()
+	h.Write(ctx.RemoteIP())
+	if int(h.Sum32()%100) < *secondaryUpstreamWeight {
+		return secondaryOrigin
+	}
+	return primaryOrigin
+}
+
+func (o *upstreamOrigin) registerRequest() {
+	atomic.AddInt64(&o.requestsCount, 1)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	statsPersistInterval = flag.Duration("statsPersistInterval", 0, "Interval for persisting stats counters, so lifetime stats survive restarts. Counters are stored in the cache backed by cacheFilesPath or in statsFile if it is set. "+
+		"Counters collected since the last persisting are lost on restart. Leave zero for disabling persistent stats")
+	statsFile = flag.String("statsFile", "", "Path to file for persisting stats counters. See statsPersistInterval. Leave empty for persisting stats counters in the cache")
+)
+
+// The key for persisted stats in the cache.
+//
+// Cache keys for responses start with host, which cannot contain zero byte,
+// so the key doesn't clash with them.
+var persistentStatsKey = []byte("\x00go-cdn-booster-stats")
+
+// Stats counters persisted across restarts.
+type persistentStats struct {
+	// The time when stats counting started for the first time.
+	StartTime time.Time `json:"startTime"`
+
+	Stats Stats `json:"stats"`
+}
+
+// Stats fields, which reflect the current state instead of counting events,
+// so they aren't accumulated across restarts.
+var nonCumulativeStatsFields = map[string]bool{
+	"UpstreamInflightRequests": true,
+}
+
+var (
+	// Lifetime counters persisted by the previous runs.
+	lifetimeStatsBase *persistentStats
+
+	startTime = time.Now()
+)
+
+func initPersistentStats() {
+	if *statsPersistInterval <= 0 {
+		return
+	}
+	ps, err := loadPersistentStats()
+	if err != nil {
+		logMessage("Cannot load persisted stats, so starting lifetime stats from scratch: [%s]", err)
+		ps = nil
+	}
+	if ps == nil {
+		ps = &persistentStats{
+			StartTime: startTime,
+		}
+	}
+	lifetimeStatsBase = ps
+	logMessage("Persisting stats every %s. Lifetime stats are collected since %s", *statsPersistInterval, ps.StartTime.Format(time.RFC3339))
+	go func() {
+		for {
+			time.Sleep(*statsPersistInterval)
+			if err := storePersistentStats(getLifetimeStats()); err != nil {
+				logMessage("Cannot persist stats: [%s]", err)
+			}
+		}
+	}()
+}
+
+// Returns nil if stats weren't persisted yet.
+func loadPersistentStats() (*persistentStats, error) {
+	var data []byte
+	var err error
+	if *statsFile != "" {
+		data, err = ioutil.ReadFile(*statsFile)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	} else {
+		data, err = cache.Get(persistentStatsKey)
+		if err == ybc.ErrCacheMiss {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ps persistentStats
+	if err = json.Unmarshal(data, &ps); err != nil {
+		return nil, fmt.Errorf("cannot parse persisted stats: [%s]", err)
+	}
+	return &ps, nil
+}
+
+func storePersistentStats(ps *persistentStats) error {
+	data, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+	if *statsFile == "" {
+		return cache.Set(persistentStatsKey, data, ybc.MaxTtl)
+	}
+	// Write to temporary file at first, so the crash in the middle
+	// of writing doesn't corrupt persisted stats.
+	tmpPath := *statsFile + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, *statsFile)
+}
+
+// Returns persisted counters plus counters collected since start.
+func getLifetimeStats() *persistentStats {
+	ps := *lifetimeStatsBase
+	ps.Stats.add(&stats)
+	return &ps
+}
+
+// Adds cumulative counters from src to s.
+//
+// src may be concurrently updated, while s mustn't.
+func (s *Stats) add(src *Stats) {
+	dst := reflect.ValueOf(s).Elem()
+	v := reflect.ValueOf(src).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if nonCumulativeStatsFields[t.Field(i).Name] {
+			continue
+		}
+		n := atomic.LoadInt64(v.Field(i).Addr().Interface().(*int64))
+		*dst.Field(i).Addr().Interface().(*int64) += n
+	}
+}
+
+func writeLifetimeStats(w io.Writer) {
+	if lifetimeStatsBase == nil {
+		return
+	}
+	ps := getLifetimeStats()
+	fmt.Fprintf(w, "Lifetime stats since %s\n", ps.StartTime.Format(time.RFC3339))
+	ps.Stats.writeTrafficStats(w)
+	fmt.Fprintf(w, "\n")
+}
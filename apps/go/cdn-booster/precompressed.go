@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	precompressedEncodings = flag.String("precompressedEncodings", "", "Comma-separated list of content encodings in the order of preference, for which pre-compressed siblings are requested from upstream. "+
+		"Supported encodings are br and gzip. For instance, if the client accepts br encoding, then /app.js is served from /app.js.br upstream sibling if it exists. "+
+		"Missing siblings are remembered for precompressedMissingTtl. Leave empty for disabling pre-compressed siblings")
+	precompressedPathPattern = flag.String("precompressedPathPattern", `\.(js|css|html|svg|json|txt|xml|wasm)$`, "Regular expression for request paths, which may have pre-compressed siblings. See precompressedEncodings")
+	precompressedMissingTtl  = flag.Duration("precompressedMissingTtl", time.Minute, "Cache duration for missing pre-compressed siblings if upstream responses for them aren't cacheable on their own, "+
+		"for instance, due to 'Cache-Control: no-cache' or zero negativeCacheTtl. Set to zero for requesting missing siblings from upstream on each request. See precompressedEncodings")
+)
+
+// Content encoding with pre-compressed sibling file extension.
+type precompressedEncoding struct {
+	name string
+	ext  string
+}
+
+var precompressedFileExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+var (
+	precompressed       []precompressedEncoding
+	precompressedPathRe *regexp.Regexp
+)
+
+func initPrecompressed() {
+	if *precompressedEncodings == "" {
+		return
+	}
+	for _, name := range strings.Split(*precompressedEncodings, ",") {
+		name = strings.TrimSpace(name)
+		ext, ok := precompressedFileExts[name]
+		if !ok {
+			logFatal("Unsupported encoding [%s] in precompressedEncodings=[%s]. Supported encodings: br, gzip", name, *precompressedEncodings)
+		}
+		precompressed = append(precompressed, precompressedEncoding{
+			name: name,
+			ext:  ext,
+		})
+	}
+	re, err := regexp.Compile(*precompressedPathPattern)
+	if err != nil {
+		logFatal("Cannot compile precompressedPathPattern=[%s]: [%s]", *precompressedPathPattern, err)
+	}
+	precompressedPathRe = re
+	logMessage("Serving pre-compressed siblings for encodings [%s]", *precompressedEncodings)
+}
+
+// Returns cached pre-compressed sibling for the requested object if the client
+// accepts its' encoding. The sibling is fetched from upstream on cache miss.
+//
+// Sets Content-Encoding response header if the sibling is returned.
+// Returns nil if the sibling doesn't exist, so the original object
+// must be served.
+func getPrecompressedItem(tctx context.Context, ctx *fasthttp.RequestCtx, key []byte, origin *upstreamOrigin) (*ybc.Item, *itemHeader) {
+	if precompressed == nil {
+		return nil, nil
+	}
+	requestPath := ctx.Path()
+	if !precompressedPathRe.Match(requestPath) {
+		return nil, nil
+	}
+	rh := &ctx.Response.Header
+	if !*varyAcceptEncoding {
+		// Otherwise Vary is already set for all the responses.
+		rh.Add("Vary", "Accept-Encoding")
+	}
+
+	h := &ctx.Request.Header
+	for _, e := range precompressed {
+		if !h.HasAcceptEncoding(e.name) {
+			continue
+		}
+		item, ih := getPrecompressedSibling(tctx, h, key, origin, e.ext)
+		if item == nil {
+			continue
+		}
+		// Upstream usually sets content-type by sibling file extension,
+		// i.e. application/x-brotli or application/gzip.
+		if contentType := mime.TypeByExtension(path.Ext(string(requestPath))); contentType != "" {
+			ih.contentType = contentType
+		}
+		rh.Set("Content-Encoding", e.name)
+		atomic.AddInt64(&stats.PrecompressedServedCount, 1)
+		return item, ih
+	}
+	return nil, nil
+}
+
+func getPrecompressedSibling(tctx context.Context, h *fasthttp.RequestHeader, key []byte, origin *upstreamOrigin, ext string) (*ybc.Item, *itemHeader) {
+	// '#' cannot occur in request uri, so sibling keys don't clash
+	// with keys for the original objects.
+	siblingKey := make([]byte, 0, len(key)+1+len(ext))
+	siblingKey = append(siblingKey, key...)
+	siblingKey = append(siblingKey, '#')
+	siblingKey = append(siblingKey, ext...)
+
+	var ih itemHeader
+	item, err := cache.GetDeItem(siblingKey, time.Second)
+	if err == nil {
+		if item, err = unmarshalItem(item, &ih); err != nil {
+			logRequestError(h, "Cannot load cached item [%s]: [%s]", siblingKey, err)
+			item.Close()
+			item = nil
+		}
+	} else if err != ybc.ErrCacheMiss {
+		logFatal("Unexpected error when obtaining cache value by key=[%s]: [%s]", siblingKey, err)
+	}
+	if item == nil {
+		var sh fasthttp.RequestHeader
+		h.CopyTo(&sh)
+		sh.SetRequestURIBytes(siblingRequestURI(h.RequestURI(), ext))
+		var resp *fasthttp.Response
+		item, resp = fetchFromUpstream(tctx, &sh, siblingKey, origin, false)
+		if item == nil {
+			if resp != nil {
+				rememberMissingSibling(&sh, siblingKey, resp)
+			}
+			return nil, nil
+		}
+		if item, err = unmarshalItem(item, &ih); err != nil {
+			logRequestError(h, "Cannot load just stored item [%s]: [%s]", siblingKey, err)
+			item.Close()
+			return nil, nil
+		}
+	}
+	if ih.statusCode != 0 && ih.statusCode != fasthttp.StatusOK {
+		// Negatively cached missing sibling.
+		item.Close()
+		return nil, nil
+	}
+	return item, &ih
+}
+
+// Caches the upstream response for missing sibling for precompressedMissingTtl,
+// so the sibling isn't requested from upstream on each request for the original
+// object.
+//
+// Only client error responses such as 404 are cached, since other responses
+// may be passed through due to other reasons such as admission filter.
+func rememberMissingSibling(h *fasthttp.RequestHeader, key []byte, resp *fasthttp.Response) {
+	if *precompressedMissingTtl <= 0 {
+		return
+	}
+	if statusCode := resp.StatusCode(); statusCode < 400 || statusCode >= 500 {
+		return
+	}
+	// Only the status code is needed for missing siblings.
+	resp.ResetBody()
+	resp.Header.SetContentLength(0)
+	if item := storeResponse(h, key, resp, *precompressedMissingTtl); item != nil {
+		item.Close()
+	}
+}
+
+// Appends ext to the path part of requestURI.
+func siblingRequestURI(requestURI []byte, ext string) []byte {
+	n := bytes.IndexByte(requestURI, '?')
+	if n < 0 {
+		n = len(requestURI)
+	}
+	uri := make([]byte, 0, len(requestURI)+len(ext))
+	uri = append(uri, requestURI[:n]...)
+	uri = append(uri, ext...)
+	return append(uri, requestURI[n:]...)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	prefetchSitemapPath = flag.String("prefetchSitemapPath", "", "Path to sitemap on upstreamHost, for instance, /sitemap.xml. Urls listed in the sitemap are periodically prefetched into the cache, so they are kept warm. "+
+		"Sitemap indexes and gzipped sitemaps are supported. Leave empty for disabling prefetching")
+	prefetchInterval  = flag.Duration("prefetchInterval", time.Hour, "Interval for prefetching urls from the sitemap. Cached items fetched earlier than this interval are refreshed. See prefetchSitemapPath")
+	prefetchBandwidth = flag.Int("prefetchBandwidth", 1024*1024, "The maximum bandwidth in bytes per second for prefetching urls from the sitemap, so prefetching doesn't overload upstream. See prefetchSitemapPath")
+	prefetchMaxUrls   = flag.Int("prefetchMaxUrls", 10000, "The maximum number of urls to prefetch from the sitemap per prefetchInterval. See prefetchSitemapPath")
+)
+
+// Sitemap in the format described at https://www.sitemaps.org/protocol.html .
+//
+// Contains either urls for urlset sitemap or nested sitemaps
+// for sitemapindex.
+type sitemap struct {
+	Urls     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// Must be called after initOrigins(), since sitemap urls are prefetched
+// from the primary origin.
+func initPrefetch() {
+	if *prefetchSitemapPath == "" {
+		return
+	}
+	if *prefetchInterval <= 0 {
+		logFatal("prefetchInterval=%s must be positive", *prefetchInterval)
+	}
+	if *prefetchBandwidth <= 0 {
+		logFatal("prefetchBandwidth=%d must be positive", *prefetchBandwidth)
+	}
+	logMessage("Prefetching urls from sitemap [%s] every %s", *prefetchSitemapPath, *prefetchInterval)
+	go func() {
+		for {
+			startTime := time.Now()
+			prefetchSitemap()
+			if d := *prefetchInterval - time.Since(startTime); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}()
+}
+
+func prefetchSitemap() {
+	urls, err := fetchSitemapUrls(*prefetchSitemapPath)
+	if err != nil {
+		logMessage("Cannot fetch sitemap [%s]: [%s]", *prefetchSitemapPath, err)
+		return
+	}
+	if len(urls) > *prefetchMaxUrls {
+		urls = urls[:*prefetchMaxUrls]
+	}
+	var fetchedCount int
+	for _, u := range urls {
+		n := prefetchUrl(u)
+		if n == 0 {
+			continue
+		}
+		fetchedCount++
+		// Stay within bandwidth budget.
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(*prefetchBandwidth))
+	}
+	logMessage("Fetched %d out of %d urls from sitemap [%s]", fetchedCount, len(urls), *prefetchSitemapPath)
+}
+
+// Returns urls from the sitemap at the given path.
+//
+// Nested sitemaps from sitemap index are fetched as well.
+func fetchSitemapUrls(path string) ([]*url.URL, error) {
+	sm, err := fetchSitemap(path)
+	if err != nil {
+		return nil, err
+	}
+	urls := parseSitemapUrls(sm.Urls)
+	for _, s := range sm.Sitemaps {
+		u, err := url.Parse(s.Loc)
+		if err != nil {
+			logMessage("Cannot parse nested sitemap url [%s] in [%s]: [%s]", s.Loc, path, err)
+			continue
+		}
+		// Sitemap index mustn't refer to other sitemap indexes,
+		// so nested sitemaps aren't followed.
+		nested, err := fetchSitemap(u.RequestURI())
+		if err != nil {
+			logMessage("Cannot fetch nested sitemap [%s]: [%s]", s.Loc, err)
+			continue
+		}
+		urls = append(urls, parseSitemapUrls(nested.Urls)...)
+		if len(urls) >= *prefetchMaxUrls {
+			break
+		}
+	}
+	return urls, nil
+}
+
+func parseSitemapUrls(locs []sitemapLoc) []*url.URL {
+	var urls []*url.URL
+	for _, l := range locs {
+		u, err := url.Parse(l.Loc)
+		if err != nil {
+			logMessage("Cannot parse sitemap url [%s]: [%s]", l.Loc, err)
+			continue
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func fetchSitemap(path string) (*sitemap, error) {
+	var req fasthttp.Request
+	req.SetRequestURI(upstreamRequestURL(primaryOrigin.host, []byte(path)))
+	var resp fasthttp.Response
+	if err := doUpstreamRequestWithRedirects(primaryOrigin, &req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("unexpected status code=%d", resp.StatusCode())
+	}
+	body := resp.Body()
+	if bytes.HasPrefix(body, []byte("\x1f\x8b")) {
+		// Gzipped sitemap such as sitemap.xml.gz.
+		var err error
+		if body, err = fasthttp.AppendGunzipBytes(nil, body); err != nil {
+			return nil, fmt.Errorf("cannot ungzip sitemap: [%s]", err)
+		}
+	}
+	var sm sitemap
+	if err := xml.Unmarshal(body, &sm); err != nil {
+		return nil, fmt.Errorf("cannot parse sitemap: [%s]", err)
+	}
+	return &sm, nil
+}
+
+// Fetches the url into the cache unless it is already cached
+// and fresh enough.
+//
+// Returns the number of bytes fetched from upstream.
+//
+// Cache keys are built from the url in the same way as for client requests,
+// but the routing script isn't applied to them.
+func prefetchUrl(u *url.URL) int {
+	defer acquireCacheGen().release()
+
+	var h fasthttp.RequestHeader
+	h.SetRequestURI(u.RequestURI())
+	h.SetHost(u.Host)
+	if *requestIdHeader != "" {
+		h.Set(*requestIdHeader, newRequestId())
+	}
+	origin := primaryOrigin
+	key := urlCacheKey(nil, &h, origin)
+
+	if item, err := cache.GetItem(key); err == nil {
+		var ih itemHeader
+		item, err = unmarshalItem(item, &ih)
+		item.Close()
+		if err == nil && time.Since(ih.fetchTime) < *prefetchInterval {
+			return 0
+		}
+	} else if err != ybc.ErrCacheMiss {
+		logFatal("Unexpected error when obtaining cache value by key=[%s]: [%s]", key, err)
+	}
+
+	item, resp := fetchFromUpstream(context.Background(), &h, key, origin, false)
+	if item == nil {
+		if resp == nil {
+			atomic.AddInt64(&stats.PrefetchErrorsCount, 1)
+			return 0
+		}
+		// The response isn't cacheable, but it consumed bandwidth.
+		return len(resp.Body())
+	}
+	n := item.Size()
+	item.Close()
+	atomic.AddInt64(&stats.PrefetchedCount, 1)
+	return n
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+var (
+	runAsUser = flag.String("runAsUser", "", "User name or uid to switch to after opening listeners and cache files. "+
+		"This allows binding privileged ports such as :80 and :443 when started as root without serving requests as root. "+
+		"The user's primary group is used unless runAsGroup is set. The user must be able to create files in snapshotPath, in the directory for statsFile "+
+		"and in directories for cacheFilesPath if cache compaction is available via adminListenAddr. Leave empty for running as the current user")
+	runAsGroup = flag.String("runAsGroup", "", "Group name or gid to switch to after opening listeners and cache files. See runAsUser. "+
+		"Leave empty for running as the current group or the primary group of runAsUser")
+)
+
+// Switches the process to runAsUser and runAsGroup.
+//
+// Must be called after opening listeners and cache files, since they
+// may require privileges.
+func dropPrivileges() {
+	if *runAsUser == "" && *runAsGroup == "" {
+		return
+	}
+	uid, gid := -1, -1
+	var groups []int
+	if *runAsUser != "" {
+		u, err := lookupUser(*runAsUser)
+		if err != nil {
+			logFatal("Cannot find runAsUser=[%s]: [%s]", *runAsUser, err)
+		}
+		uid = mustParseId(u.Uid)
+		gid = mustParseId(u.Gid)
+		gids, err := u.GroupIds()
+		if err != nil {
+			logFatal("Cannot obtain groups for runAsUser=[%s]: [%s]", *runAsUser, err)
+		}
+		for _, g := range gids {
+			groups = append(groups, mustParseId(g))
+		}
+	}
+	if *runAsGroup != "" {
+		g, err := lookupGroup(*runAsGroup)
+		if err != nil {
+			logFatal("Cannot find runAsGroup=[%s]: [%s]", *runAsGroup, err)
+		}
+		gid = mustParseId(g.Gid)
+		if uid < 0 {
+			groups = nil
+		}
+	}
+	if len(groups) == 0 {
+		groups = []int{gid}
+	}
+
+	// Groups must be changed before the user, since an unprivileged user
+	// cannot change groups.
+	if err := syscall.Setgroups(groups); err != nil {
+		logFatal("Cannot set supplementary groups %v: [%s]", groups, err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		logFatal("Cannot switch to gid=%d: [%s]", gid, err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			logFatal("Cannot switch to uid=%d: [%s]", uid, err)
+		}
+	}
+	logMessage("Switched to uid=%d, gid=%d", os.Getuid(), os.Getgid())
+	checkWritableDirs()
+}
+
+// Verifies that directories for files created after the start are writable
+// after switching to runAsUser and runAsGroup.
+//
+// Otherwise snapshots, stats persistence and cache compaction would fail
+// long after the start.
+func checkWritableDirs() {
+	var dirs []string
+	if *snapshotPath != "" {
+		dirs = append(dirs, *snapshotPath)
+	}
+	if *statsFile != "" {
+		dirs = append(dirs, filepath.Dir(*statsFile))
+	}
+	if *adminListenAddr != "" {
+		// Compaction creates new cache files next to the current files.
+		for _, cfg := range cacheConfigs("") {
+			if cfg.DataFile == "" {
+				break
+			}
+			dirs = append(dirs, filepath.Dir(cfg.IndexFile), filepath.Dir(cfg.DataFile))
+		}
+	}
+	for _, dir := range dirs {
+		f, err := ioutil.TempFile(dir, ".go-cdn-booster-check-")
+		if err != nil {
+			logFatal("Directory [%s] isn't writable by uid=%d, gid=%d. Grant write access to runAsUser=[%s] or runAsGroup=[%s]: [%s]",
+				dir, os.Getuid(), os.Getgid(), *runAsUser, *runAsGroup, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func lookupUser(s string) (*user.User, error) {
+	if _, err := strconv.Atoi(s); err == nil {
+		return user.LookupId(s)
+	}
+	return user.Lookup(s)
+}
+
+func lookupGroup(s string) (*user.Group, error) {
+	if _, err := strconv.Atoi(s); err == nil {
+		return user.LookupGroupId(s)
+	}
+	return user.LookupGroup(s)
+}
+
+func mustParseId(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		logFatal("Cannot parse uid or gid [%s]: [%s]", s, err)
+	}
+	return n
+}
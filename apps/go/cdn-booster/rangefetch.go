@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamRangeChunkSize = flag.Int("upstreamRangeChunkSize", 0, "Size in bytes of byte ranges for fetching objects from upstream, for instance, 16777216. "+
+		"Objects bigger than this size are fetched by consecutive Range requests, so a failed request is resumed from the last received offset "+
+		"instead of restarting the whole fetch. Objects are cached only after all the ranges are received. Leave zero for fetching objects by a single request")
+	upstreamRangeRetries = flag.Int("upstreamRangeRetries", 3, "The maximum number of retries for each failed byte range. See upstreamRangeChunkSize")
+)
+
+// Performs the given request to the origin by consecutive byte ranges
+// if upstreamRangeChunkSize is set.
+//
+// The assembled object is returned in resp as 200 response. Responses
+// from upstreams ignoring Range requests are returned as is.
+//
+// Ranges after the first one are requested with If-Range, so the fetch
+// fails if the object changes in the middle.
+func doResumableUpstreamRequest(o *upstreamOrigin, req *fasthttp.Request, resp *fasthttp.Response) error {
+	chunkSize := *upstreamRangeChunkSize
+	if chunkSize <= 0 {
+		return doUpstreamRequestWithRedirects(o, req, resp)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", chunkSize-1))
+	err := doUpstreamRequestWithRedirects(o, req, resp)
+	for retries := 0; err != nil && retries < *upstreamRangeRetries; retries++ {
+		atomic.AddInt64(&stats.UpstreamRangeRetriesCount, 1)
+		err = doUpstreamRequestWithRedirects(o, req, resp)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == fasthttp.StatusRequestedRangeNotSatisfiable {
+		// Empty objects have no byte ranges.
+		req.Header.Del("Range")
+		return doUpstreamRequestWithRedirects(o, req, resp)
+	}
+	if resp.StatusCode() != fasthttp.StatusPartialContent {
+		return nil
+	}
+	start, total, ok := parseContentRange(resp.Header.Peek("Content-Range"))
+	if !ok || start != 0 {
+		return fmt.Errorf("unexpected Content-Range=[%s] in response to the first byte range", resp.Header.Peek("Content-Range"))
+	}
+
+	if isOversizedUpstreamResponse(total) && !*oversizedResponsePassthrough {
+		// Do not fetch the remaining ranges for the response,
+		// which cannot be served anyway.
+		return errUpstreamResponseTooLarge
+	}
+
+	validator := resp.Header.Peek("Etag")
+	if len(validator) == 0 || bytes.HasPrefix(validator, []byte("W/")) {
+		// Weak etags cannot be used in If-Range.
+		validator = resp.Header.Peek("Last-Modified")
+	}
+	if len(validator) > 0 {
+		req.Header.SetBytesV("If-Range", validator)
+	}
+
+	var chunk fasthttp.Response
+	for offset := len(resp.Body()); offset < total; offset += len(chunk.Body()) {
+		end := offset + chunkSize
+		if end > total {
+			end = total
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+		for retries := 0; ; retries++ {
+			if err = doUpstreamRangeRequest(o, req, &chunk); err == nil {
+				err = checkRangeResponse(&chunk, offset, total)
+			}
+			if err == nil {
+				break
+			}
+			if retries >= *upstreamRangeRetries {
+				return fmt.Errorf("cannot fetch byte range starting at offset %d out of %d bytes: [%s]", offset, total, err)
+			}
+			atomic.AddInt64(&stats.UpstreamRangeRetriesCount, 1)
+		}
+		resp.AppendBody(chunk.Body())
+	}
+	resp.SetStatusCode(fasthttp.StatusOK)
+	resp.Header.Del("Content-Range")
+	// Content-Length of the first range doesn't match the assembled body.
+	resp.Header.SetContentLength(len(resp.Body()))
+	return nil
+}
+
+// Requests the next byte range from the host the first range
+// has been obtained from, i.e. redirects aren't followed again.
+func doUpstreamRangeRequest(o *upstreamOrigin, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if string(req.URI().Host()) == o.host {
+		return doUpstreamRequest(o.clients, req, resp)
+	}
+	return fasthttp.DoTimeout(req, resp, redirectRequestTimeout)
+}
+
+func checkRangeResponse(resp *fasthttp.Response, offset, total int) error {
+	if resp.StatusCode() != fasthttp.StatusPartialContent {
+		// The object has been changed, so If-Range condition failed.
+		return fmt.Errorf("unexpected status code=%d. Expected %d", resp.StatusCode(), fasthttp.StatusPartialContent)
+	}
+	start, n, ok := parseContentRange(resp.Header.Peek("Content-Range"))
+	if !ok || start != offset || n != total || len(resp.Body()) == 0 {
+		return fmt.Errorf("unexpected Content-Range=[%s] with body size %d. Expected range starting at %d out of %d bytes",
+			resp.Header.Peek("Content-Range"), len(resp.Body()), offset, total)
+	}
+	return nil
+}
+
+// Parses Content-Range header value in the form 'bytes start-end/total'.
+func parseContentRange(v []byte) (start, total int, ok bool) {
+	if !bytes.HasPrefix(v, []byte("bytes ")) {
+		return 0, 0, false
+	}
+	v = v[len("bytes "):]
+	n := bytes.IndexByte(v, '-')
+	m := bytes.IndexByte(v, '/')
+	if n < 0 || m < n {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(string(v[:n]))
+	if err != nil {
+		return 0, 0, false
+	}
+	total, err = strconv.Atoi(string(v[m+1:]))
+	if err != nil || start < 0 || total <= start {
+		// Unknown total size '*' isn't supported.
+		return 0, 0, false
+	}
+	return start, total, true
+}
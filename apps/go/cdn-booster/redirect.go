@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamRedirectPolicy = flag.String("upstreamRedirectPolicy", "cache", "What to do with redirect responses from upstream. Supported values:\n"+
+		"  cache - cache cacheable redirects and replay them to clients\n"+
+		"  follow - follow redirects up to upstreamMaxRedirects hops and cache the final response under the original url\n"+
+		"  passthrough - send redirects to clients verbatim without caching")
+	upstreamMaxRedirects = flag.Int("upstreamMaxRedirects", 5, "The maximum number of redirect hops to follow for a single upstream request. Used only if upstreamRedirectPolicy=follow")
+)
+
+const (
+	redirectPolicyCache       = "cache"
+	redirectPolicyFollow      = "follow"
+	redirectPolicyPassthrough = "passthrough"
+)
+
+// Timeout for requests to redirect locations outside upstreamHost.
+const redirectRequestTimeout = 10 * time.Second
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+func initRedirectPolicy() {
+	switch *upstreamRedirectPolicy {
+	case redirectPolicyCache, redirectPolicyFollow, redirectPolicyPassthrough:
+	default:
+		logFatal("Unsupported upstreamRedirectPolicy=[%s]. Supported values: %s, %s, %s",
+			*upstreamRedirectPolicy, redirectPolicyCache, redirectPolicyFollow, redirectPolicyPassthrough)
+	}
+	if *upstreamMaxRedirects < 0 {
+		logFatal("upstreamMaxRedirects=%d cannot be negative", *upstreamMaxRedirects)
+	}
+}
+
+func isRedirectStatusCode(statusCode int) bool {
+	switch statusCode {
+	case fasthttp.StatusMovedPermanently, fasthttp.StatusFound, fasthttp.StatusSeeOther,
+		fasthttp.StatusTemporaryRedirect, fasthttp.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Performs the given request to the origin according to upstreamRedirectPolicy.
+//
+// Redirects are followed only if upstreamRedirectPolicy=follow.
+// Redirect locations at the origin host are requested via origin clients,
+// while other locations are requested directly.
+func doUpstreamRequestWithRedirects(o *upstreamOrigin, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if err := doUpstreamRequest(o.clients, req, resp); err != nil {
+		return err
+	}
+	if *upstreamRedirectPolicy != redirectPolicyFollow {
+		return nil
+	}
+	for hops := 0; isRedirectStatusCode(resp.StatusCode()); hops++ {
+		location := resp.Header.Peek("Location")
+		if len(location) == 0 {
+			return nil
+		}
+		if hops >= *upstreamMaxRedirects {
+			return errTooManyRedirects
+		}
+		req.URI().Update(string(location))
+		atomic.AddInt64(&stats.UpstreamRedirectsFollowed, 1)
+
+		var err error
+		if string(req.URI().Host()) == o.host {
+			err = doUpstreamRequest(o.clients, req, resp)
+		} else {
+			err = fasthttp.DoTimeout(req, resp, redirectRequestTimeout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
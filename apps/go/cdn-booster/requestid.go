@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	requestIdHeader = flag.String("requestIdHeader", "X-Request-ID", "Request header with request id. The id from incoming request is propagated as is, otherwise a new id is generated. "+
+		"The id is returned to the client, forwarded to upstream and included in access and error logs. Leave empty for disabling request ids")
+	accessLog = flag.Bool("accessLog", false, "Whether to log each served request")
+)
+
+// The maximum length of request id accepted from clients.
+// Longer ids are replaced by generated ones.
+const maxRequestIdLen = 128
+
+// Random per-process prefix for generated request ids,
+// so ids generated by distinct go-cdn-booster instances don't clash.
+var requestIdPrefix string
+
+// Counter for generated request ids.
+var requestIdCounter uint64
+
+func initRequestIds() {
+	if *requestIdHeader == "" {
+		return
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		logFatal("Cannot generate request id prefix: [%s]", err)
+	}
+	requestIdPrefix = hex.EncodeToString(b[:]) + "-"
+}
+
+// Makes sure the request has request id and returns it to the client.
+func setupRequestId(ctx *fasthttp.RequestCtx) {
+	if *requestIdHeader == "" {
+		return
+	}
+	h := &ctx.Request.Header
+	id := h.Peek(*requestIdHeader)
+	if !isValidRequestId(id) {
+		h.Set(*requestIdHeader, newRequestId())
+		id = h.Peek(*requestIdHeader)
+	}
+	ctx.Response.Header.SetBytesV(*requestIdHeader, id)
+}
+
+func newRequestId() string {
+	n := atomic.AddUint64(&requestIdCounter, 1)
+	return requestIdPrefix + strconv.FormatUint(n, 16)
+}
+
+// Returns false for empty ids, overly long ids and ids with characters,
+// which may break logs.
+func isValidRequestId(id []byte) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func getRequestId(h *fasthttp.RequestHeader) []byte {
+	if *requestIdHeader == "" {
+		return nil
+	}
+	return h.Peek(*requestIdHeader)
+}
+
+// Forwards request id from the client request to the upstream request.
+func forwardRequestId(h, upstreamHeader *fasthttp.RequestHeader) {
+	if id := getRequestId(h); len(id) > 0 {
+		upstreamHeader.SetBytesV(*requestIdHeader, id)
+	}
+}
+
+func logAccess(ctx *fasthttp.RequestCtx, startTime time.Time) {
+	h := &ctx.Request.Header
+	logMessage("%s - %s - %s %s - %d %d - %s - %s - %s", ctx.RemoteIP(), getRequestId(h), ctx.Method(), ctx.RequestURI(),
+		ctx.Response.StatusCode(), ctx.Response.Header.ContentLength(), time.Since(startTime), h.Referer(), h.UserAgent())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	revalidateAfter         = flag.Duration("revalidateAfter", 0, "Cached items older than this duration are re-fetched from upstream in background after being served to the client. Leave zero for disabling background revalidation")
+	revalidationConcurrency = flag.Int("revalidationConcurrency", 4, "The maximum number of concurrent background revalidation requests to upstream")
+	revalidationRps         = flag.Float64("revalidationRps", 10, "The maximum number of background revalidation requests per second to upstream. Set to zero for disabling rate limiting")
+	revalidationQueueSize   = flag.Int("revalidationQueueSize", 10000, "The maximum number of items awaiting background revalidation. Least recently requested items are dropped from the queue when it is full")
+)
+
+// Item awaiting background revalidation.
+type revalidationEntry struct {
+	key        string
+	requestURI string
+	origin     *upstreamOrigin
+
+	// Normalized client Accept-Encoding if varyAcceptEncoding is set.
+	//
+	// The revalidated response must have the same encoding variant
+	// as the cached item it replaces.
+	acceptEncoding string
+
+	// X-Forwarded-Proto of the client request if forwardTLSInfo is set.
+	// It is a part of the cache key, so it must be forwarded to upstream.
+	forwardedProto string
+}
+
+// Queue of items awaiting background revalidation.
+//
+// Recently requested items are revalidated first, since they are more
+// likely to be requested again soon.
+type revalidationQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Entries ordered by the last request time.
+	// The most recently requested entry is at the back.
+	entries *list.List
+
+	// Keys of queued entries.
+	queued map[string]*list.Element
+
+	// Keys of entries being revalidated at the moment.
+	inflight map[string]struct{}
+
+	maxSize int
+}
+
+var revalidations *revalidationQueue
+
+func initRevalidation() {
+	if *revalidateAfter <= 0 {
+		return
+	}
+	if *revalidationConcurrency <= 0 {
+		logFatal("revalidationConcurrency=%d must be positive", *revalidationConcurrency)
+	}
+	if *revalidationQueueSize <= 0 {
+		logFatal("revalidationQueueSize=%d must be positive", *revalidationQueueSize)
+	}
+	if *revalidationRps < 0 {
+		logFatal("revalidationRps=%v cannot be negative", *revalidationRps)
+	}
+	q := &revalidationQueue{
+		entries:  list.New(),
+		queued:   make(map[string]*list.Element),
+		inflight: make(map[string]struct{}),
+		maxSize:  *revalidationQueueSize,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	revalidations = q
+
+	var throttle <-chan time.Time
+	if *revalidationRps > 0 {
+		throttle = time.Tick(time.Duration(float64(time.Second) / *revalidationRps))
+	}
+	for i := 0; i < *revalidationConcurrency; i++ {
+		go q.worker(throttle)
+	}
+	logMessage("Revalidating cached items older than %s in background with concurrency=%d, rps=%v",
+		*revalidateAfter, *revalidationConcurrency, *revalidationRps)
+}
+
+// Schedules background revalidation for the cached item if it is older
+// than revalidateAfter.
+func scheduleRevalidation(h *fasthttp.RequestHeader, key []byte, ih *itemHeader, origin *upstreamOrigin) {
+	if revalidations == nil {
+		return
+	}
+	if !ih.fetchTime.IsZero() && time.Since(ih.fetchTime) < *revalidateAfter {
+		return
+	}
+	e := &revalidationEntry{
+		key:        string(key),
+		requestURI: string(h.RequestURI()),
+		origin:     origin,
+	}
+	if *varyAcceptEncoding {
+		e.acceptEncoding = normalizeAcceptEncoding(h.Peek("Accept-Encoding"))
+	}
+	if *forwardTLSInfo {
+		e.forwardedProto = string(h.Peek(forwardedProtoHeader))
+	}
+	revalidations.push(e)
+}
+
+func (q *revalidationQueue) push(e *revalidationEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.inflight[e.key]; ok {
+		return
+	}
+	if el, ok := q.queued[e.key]; ok {
+		q.entries.MoveToBack(el)
+		return
+	}
+	if q.entries.Len() >= q.maxSize {
+		el := q.entries.Front()
+		delete(q.queued, el.Value.(*revalidationEntry).key)
+		q.entries.Remove(el)
+		atomic.AddInt64(&stats.RevalidationsDroppedCount, 1)
+	}
+	q.queued[e.key] = q.entries.PushBack(e)
+	atomic.AddInt64(&stats.RevalidationsQueuedCount, 1)
+	q.cond.Signal()
+}
+
+// Returns the most recently requested entry. Blocks until the queue
+// becomes non-empty.
+func (q *revalidationQueue) pop() *revalidationEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.entries.Len() == 0 {
+		q.cond.Wait()
+	}
+	el := q.entries.Back()
+	q.entries.Remove(el)
+	e := el.Value.(*revalidationEntry)
+	delete(q.queued, e.key)
+	q.inflight[e.key] = struct{}{}
+	return e
+}
+
+func (q *revalidationQueue) done(e *revalidationEntry) {
+	q.mu.Lock()
+	delete(q.inflight, e.key)
+	q.mu.Unlock()
+}
+
+func (q *revalidationQueue) len() int {
+	q.mu.Lock()
+	n := q.entries.Len()
+	q.mu.Unlock()
+	return n
+}
+
+func (q *revalidationQueue) worker(throttle <-chan time.Time) {
+	for {
+		if throttle != nil {
+			<-throttle
+		}
+		e := q.pop()
+		revalidate(e)
+		q.done(e)
+	}
+}
+
+// Re-fetches the item from upstream and stores it in the cache.
+func revalidate(e *revalidationEntry) {
+	defer acquireCacheGen().release()
+
+	var h fasthttp.RequestHeader
+	h.SetRequestURI(e.requestURI)
+	if e.acceptEncoding != "" {
+		// The upstream request obtains it via setUpstreamAcceptEncoding().
+		h.Set("Accept-Encoding", e.acceptEncoding)
+	}
+	if e.forwardedProto != "" {
+		h.Set(forwardedProtoHeader, e.forwardedProto)
+	}
+	if *requestIdHeader != "" {
+		h.Set(*requestIdHeader, newRequestId())
+	}
+	item, resp := fetchFromUpstream(context.Background(), &h, []byte(e.key), e.origin, false)
+	if item == nil {
+		if resp == nil {
+			atomic.AddInt64(&stats.RevalidationErrorsCount, 1)
+		}
+		return
+	}
+	item.Close()
+	atomic.AddInt64(&stats.RevalidationsCount, 1)
+}
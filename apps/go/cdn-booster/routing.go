@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	routingScriptFile = flag.String("routingScriptFile", "", "Path to file with routing script evaluated for each request. The script may bypass the cache, choose upstream origin and rewrite the cache key. "+
+		"See routing.go for the script syntax. Leave empty for disabling the routing script")
+)
+
+// Routing script consists of rules - one rule per line. Empty lines
+// and lines starting with # are ignored. Each rule has the form:
+//
+//	condition => action, ..., action
+//
+// Rules are evaluated in the order they are defined. Actions of all
+// the matching rules are applied, so later actions override earlier ones.
+//
+// Condition is either true or a comparison of string expressions via ==, !=,
+// =~ (regexp match) and !~ (regexp mismatch). Regexps must be string literals.
+// Conditions may be combined via &&, || and !, and grouped via parentheses.
+//
+// String expression is a concatenation of string literals and variables
+// via +. String literals are double-quoted in Go syntax. Supported variables:
+//
+//	method, host, path, uri, query, ip - the corresponding request parts.
+//	header.Name - the value of Name request header.
+//	arg.name - the value of name query arg.
+//	cookie.name - the value of name cookie.
+//
+// Supported actions:
+//
+//	bypass - proxy the request to upstream without caching.
+//	origin = primary|secondary - send cache misses to upstreamHost
+//	  or secondaryUpstreamHost.
+//	key = expression - use the expression value as a cache key instead
+//	  of host and request uri. Keys for distinct objects must differ.
+//	stop - stop evaluating subsequent rules.
+//
+// For instance:
+//
+//	# Don't cache responses for logged in users.
+//	cookie.session != "" => bypass
+//	# Ignore tracking args in the cache key.
+//	path =~ "^/static/" => key = host + path + "?v=" + arg.v
+//	header.X-Canary == "1" => origin = secondary, stop
+type routingScript struct {
+	rules []*routingRule
+}
+
+type routingRule struct {
+	cond    routingCond
+	actions []routingAction
+}
+
+// The result of routing script evaluation for a request.
+type routingDecision struct {
+	bypass bool
+
+	// nil means the origin selected by selectOrigin().
+	origin *upstreamOrigin
+
+	// nil means the default cache key.
+	key []byte
+}
+
+type routingCond func(ctx *fasthttp.RequestCtx) bool
+
+// Appends string expression value for the request to dst.
+type routingExpr func(dst []byte, ctx *fasthttp.RequestCtx) []byte
+
+// Applies the action to the decision. Returns false if subsequent
+// rules mustn't be evaluated.
+type routingAction func(rd *routingDecision, ctx *fasthttp.RequestCtx) bool
+
+var currentRoutingScript *routingScript
+
+// Must be called after initOrigins(), since the script may refer
+// to secondary origin.
+func initRoutingScript() {
+	if *routingScriptFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*routingScriptFile)
+	if err != nil {
+		logFatal("Cannot read routingScriptFile=[%s]: [%s]", *routingScriptFile, err)
+	}
+	rs, err := parseRoutingScript(string(data))
+	if err != nil {
+		logFatal("Cannot parse routingScriptFile=[%s]: %s", *routingScriptFile, err)
+	}
+	currentRoutingScript = rs
+	logMessage("Loaded %d routing rules from routingScriptFile=[%s]", len(rs.rules), *routingScriptFile)
+}
+
+// Evaluates routing script for the request.
+func routeRequest(ctx *fasthttp.RequestCtx) (rd routingDecision) {
+	if currentRoutingScript == nil {
+		return
+	}
+	matched := false
+	for _, r := range currentRoutingScript.rules {
+		if !r.cond(ctx) {
+			continue
+		}
+		matched = true
+		for _, a := range r.actions {
+			if !a(&rd, ctx) {
+				return
+			}
+		}
+	}
+	if matched {
+		atomic.AddInt64(&stats.RoutingScriptMatchesCount, 1)
+	}
+	return
+}
+
+func parseRoutingScript(s string) (*routingScript, error) {
+	rs := &routingScript{}
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseRoutingRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: [%s]: %s", i+1, line, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+func parseRoutingRule(s string) (*routingRule, error) {
+	tokens, err := tokenizeRoutingRule(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &routingParser{
+		tokens: tokens,
+	}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.skip("=>") {
+		return nil, fmt.Errorf("missing => after condition")
+	}
+	r := &routingRule{
+		cond: cond,
+	}
+	for {
+		a, err := p.parseAction()
+		if err != nil {
+			return nil, err
+		}
+		r.actions = append(r.actions, a)
+		if !p.skip(",") {
+			break
+		}
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q after actions", p.tokens[p.pos])
+	}
+	return r, nil
+}
+
+var routingOperators = []string{"=>", "==", "!=", "=~", "!~", "&&", "||", "!", "(", ")", "+", ",", "="}
+
+// Splits the rule into tokens. String literals are returned with quotes,
+// so they can be distinguished from identifiers.
+func tokenizeRoutingRule(s string) ([]string, error) {
+	var tokens []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return tokens, nil
+		}
+		if s[0] == '"' {
+			n := 1
+			for n < len(s) && s[n] != '"' {
+				if s[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			if n >= len(s) {
+				return nil, fmt.Errorf("unterminated string literal %s", s)
+			}
+			tokens = append(tokens, s[:n+1])
+			s = s[n+1:]
+			continue
+		}
+		op := ""
+		for _, o := range routingOperators {
+			if strings.HasPrefix(s, o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			tokens = append(tokens, op)
+			s = s[len(op):]
+			continue
+		}
+		n := strings.IndexFunc(s, func(c rune) bool {
+			return !(c == '.' || c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+		})
+		if n == 0 {
+			return nil, fmt.Errorf("unexpected char %q", s[0])
+		}
+		if n < 0 {
+			n = len(s)
+		}
+		tokens = append(tokens, s[:n])
+		s = s[n:]
+	}
+}
+
+type routingParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *routingParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *routingParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *routingParser) skip(token string) bool {
+	if p.peek() != token {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *routingParser) parseOr() (routingCond, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.skip("||") {
+		left := c
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		c = func(ctx *fasthttp.RequestCtx) bool {
+			return left(ctx) || right(ctx)
+		}
+	}
+	return c, nil
+}
+
+func (p *routingParser) parseAnd() (routingCond, error) {
+	c, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.skip("&&") {
+		left := c
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		c = func(ctx *fasthttp.RequestCtx) bool {
+			return left(ctx) && right(ctx)
+		}
+	}
+	return c, nil
+}
+
+func (p *routingParser) parseUnary() (routingCond, error) {
+	if p.skip("!") {
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *fasthttp.RequestCtx) bool {
+			return !c(ctx)
+		}, nil
+	}
+	if p.skip("(") {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.skip(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return c, nil
+	}
+	if p.skip("true") {
+		return func(ctx *fasthttp.RequestCtx) bool {
+			return true
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *routingParser) parseComparison() (routingCond, error) {
+	left, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "==", "!=":
+		right, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		eq := op == "=="
+		return func(ctx *fasthttp.RequestCtx) bool {
+			return bytes.Equal(left(nil, ctx), right(nil, ctx)) == eq
+		}, nil
+	case "=~", "!~":
+		s, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile regexp %q: %s", s, err)
+		}
+		match := op == "=~"
+		return func(ctx *fasthttp.RequestCtx) bool {
+			return re.Match(left(nil, ctx)) == match
+		}, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q instead of comparison operator", op)
+	}
+}
+
+func (p *routingParser) parseStringLiteral() (string, error) {
+	t := p.next()
+	if !strings.HasPrefix(t, "\"") {
+		return "", fmt.Errorf("unexpected %q instead of string literal", t)
+	}
+	s, err := strconv.Unquote(t)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse string literal %s: %s", t, err)
+	}
+	return s, nil
+}
+
+func (p *routingParser) parseExpr() (routingExpr, error) {
+	var terms []routingExpr
+	for {
+		t, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+		if !p.skip("+") {
+			break
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+		for _, t := range terms {
+			dst = t(dst, ctx)
+		}
+		return dst
+	}, nil
+}
+
+func (p *routingParser) parseTerm() (routingExpr, error) {
+	if strings.HasPrefix(p.peek(), "\"") {
+		s, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, s...)
+		}, nil
+	}
+	name := p.next()
+	switch name {
+	case "method":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.Method()...)
+		}, nil
+	case "host":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.Request.Header.Host()...)
+		}, nil
+	case "path":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.Path()...)
+		}, nil
+	case "uri":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.RequestURI()...)
+		}, nil
+	case "query":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.URI().QueryString()...)
+		}, nil
+	case "ip":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.RemoteIP().String()...)
+		}, nil
+	}
+	n := strings.IndexByte(name, '.')
+	if n <= 0 || n == len(name)-1 {
+		return nil, fmt.Errorf("unknown variable %q", name)
+	}
+	key := name[n+1:]
+	switch name[:n] {
+	case "header":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.Request.Header.Peek(key)...)
+		}, nil
+	case "arg":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.QueryArgs().Peek(key)...)
+		}, nil
+	case "cookie":
+		return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+			return append(dst, ctx.Request.Header.Cookie(key)...)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", name)
+}
+
+func (p *routingParser) parseAction() (routingAction, error) {
+	name := p.next()
+	switch name {
+	case "bypass":
+		return func(rd *routingDecision, ctx *fasthttp.RequestCtx) bool {
+			rd.bypass = true
+			return true
+		}, nil
+	case "stop":
+		return func(rd *routingDecision, ctx *fasthttp.RequestCtx) bool {
+			return false
+		}, nil
+	case "origin":
+		if !p.skip("=") {
+			return nil, fmt.Errorf("missing = after origin")
+		}
+		var o *upstreamOrigin
+		switch v := p.next(); v {
+		case "primary":
+			o = primaryOrigin
+		case "secondary":
+			if secondaryOrigin == nil {
+				return nil, fmt.Errorf("secondary origin requires secondaryUpstreamHost")
+			}
+			o = secondaryOrigin
+		default:
+			return nil, fmt.Errorf("unexpected origin %q. Supported origins: primary, secondary", v)
+		}
+		return func(rd *routingDecision, ctx *fasthttp.RequestCtx) bool {
+			rd.origin = o
+			return true
+		}, nil
+	case "key":
+		if !p.skip("=") {
+			return nil, fmt.Errorf("missing = after key")
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return func(rd *routingDecision, ctx *fasthttp.RequestCtx) bool {
+			rd.key = e(rd.key[:0], ctx)
+			return true
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown action %q. Supported actions: bypass, origin, key, stop", name)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newRoutingTestCtx(host, requestURI string, headers ...string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.Header.SetRequestURI(requestURI)
+	req.Header.SetHost(host)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, nil)
+	return &ctx
+}
+
+func setTestRoutingScript(t *testing.T, s string) {
+	rs, err := parseRoutingScript(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	currentRoutingScript = rs
+}
+
+func TestRouteRequest(t *testing.T) {
+	primary, secondary := primaryOrigin, secondaryOrigin
+	defer func() {
+		primaryOrigin, secondaryOrigin = primary, secondary
+		currentRoutingScript = nil
+	}()
+	primaryOrigin = &upstreamOrigin{host: "primary"}
+	secondaryOrigin = &upstreamOrigin{host: "secondary"}
+
+	setTestRoutingScript(t, `
+# Don't cache responses for logged in users.
+cookie.session != "" => bypass
+
+   # Ignore tracking args in the cache key.
+path =~ "^/static/" => key = host + path + "?v=" + arg.v
+header.X-Canary == "1" => origin = secondary, stop
+header.X-Canary == "1" => bypass
+`)
+	if len(currentRoutingScript.rules) != 4 {
+		t.Fatalf("Unexpected number of rules: %d. Expected 4", len(currentRoutingScript.rules))
+	}
+
+	// No matching rules.
+	rd := routeRequest(newRoutingTestCtx("example.com", "/foo/bar"))
+	if rd.bypass || rd.origin != nil || rd.key != nil {
+		t.Fatalf("Unexpected routing decision for non-matching request: %+v", rd)
+	}
+
+	rd = routeRequest(newRoutingTestCtx("example.com", "/foo/bar", "Cookie", "session=abc"))
+	if !rd.bypass || rd.origin != nil || rd.key != nil {
+		t.Fatalf("Unexpected routing decision for logged in user: %+v", rd)
+	}
+
+	rd = routeRequest(newRoutingTestCtx("example.com", "/static/app.js?utm_source=foo&v=123"))
+	if rd.bypass || rd.origin != nil || string(rd.key) != "example.com/static/app.js?v=123" {
+		t.Fatalf("Unexpected routing decision for static file: %+v", rd)
+	}
+
+	// Actions of all the matching rules are applied until stop.
+	rd = routeRequest(newRoutingTestCtx("example.com", "/static/app.js", "X-Canary", "1", "Cookie", "session=abc"))
+	if !rd.bypass || rd.origin != secondaryOrigin || string(rd.key) != "example.com/static/app.js?v=" {
+		t.Fatalf("Unexpected routing decision for canary request: %+v", rd)
+	}
+	rd = routeRequest(newRoutingTestCtx("example.com", "/foo", "X-Canary", "1"))
+	if rd.bypass || rd.origin != secondaryOrigin || rd.key != nil {
+		t.Fatalf("Unexpected routing decision after stop: %+v", rd)
+	}
+}
+
+func TestRoutingConditions(t *testing.T) {
+	ctx := newRoutingTestCtx("example.com", "/foo/bar.jpg?a=1&b=x%20y", "X-Foo", "foo", "Cookie", "c=bar")
+	testCond := func(cond string, expected bool) {
+		r, err := parseRoutingRule(cond + " => bypass")
+		if err != nil {
+			t.Fatalf("Unexpected error for condition [%s]: [%s]", cond, err)
+		}
+		if v := r.cond(ctx); v != expected {
+			t.Fatalf("Unexpected result=%v for condition [%s]. Expected %v", v, cond, expected)
+		}
+	}
+
+	testCond("true", true)
+	testCond("!true", false)
+
+	// Variables.
+	testCond(`method == "GET"`, true)
+	testCond(`host == "example.com"`, true)
+	testCond(`path == "/foo/bar.jpg"`, true)
+	testCond(`uri == "/foo/bar.jpg?a=1&b=x%20y"`, true)
+	testCond(`query == "a=1&b=x%20y"`, true)
+	testCond(`ip == "10.1.2.3"`, true)
+	testCond(`header.X-Foo == "foo"`, true)
+	testCond(`header.x-foo == "foo"`, true)
+	testCond(`header.X-Missing == ""`, true)
+	testCond(`arg.a == "1"`, true)
+	testCond(`arg.b == "x y"`, true)
+	testCond(`arg.missing == ""`, true)
+	testCond(`cookie.c == "bar"`, true)
+	testCond(`cookie.missing != ""`, false)
+
+	// Concatenation.
+	testCond(`host + path == "example.com/foo/bar.jpg"`, true)
+	testCond(`"[" + arg.a + "]" == "[1]"`, true)
+	testCond(`header.X-Foo + cookie.c == "foo" + "bar"`, true)
+
+	// Regexps.
+	testCond(`path =~ "\\.jpg$"`, true)
+	testCond(`path =~ "^/bar"`, false)
+	testCond(`path !~ "^/bar"`, true)
+	testCond(`path !~ "bar"`, false)
+
+	// Logical operators and their precedence.
+	testCond(`method == "GET" && path == "/foo/bar.jpg"`, true)
+	testCond(`method == "POST" && path == "/foo/bar.jpg"`, false)
+	testCond(`method == "POST" || path == "/foo/bar.jpg"`, true)
+	testCond(`method == "POST" || path == "/bar"`, false)
+	testCond(`method == "GET" || method == "POST" && path == "/bar"`, true)
+	testCond(`(method == "GET" || method == "POST") && path == "/bar"`, false)
+	testCond(`!(method == "POST") && !path =~ "^/bar"`, true)
+	testCond(`!!true`, true)
+}
+
+func TestParseRoutingScript_Error(t *testing.T) {
+	secondary := secondaryOrigin
+	defer func() {
+		secondaryOrigin = secondary
+	}()
+	secondaryOrigin = nil
+
+	testError := func(script, expectedErr string) {
+		if _, err := parseRoutingScript(script); err == nil {
+			t.Fatalf("Expecting error for script %q", script)
+		} else if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("Unexpected error=[%s] for script %q. Expected error containing [%s]", err, script, expectedErr)
+		}
+	}
+
+	// The line number is reported.
+	testError("true => bypass\n\nfoo", "line 3: [foo]")
+
+	// Malformed conditions.
+	testError(`true`, "missing => after condition")
+	testError(`=> bypass`, "unknown variable \"=>\"")
+	testError(`path => bypass`, "unexpected \"=>\" instead of comparison operator")
+	testError(`path = "/" => bypass`, "unexpected \"=\" instead of comparison operator")
+	testError(`foo == "" => bypass`, "unknown variable \"foo\"")
+	testError(`header. == "" => bypass`, "unknown variable \"header.\"")
+	testError(`.foo == "" => bypass`, "unknown variable \".foo\"")
+	testError(`bar.foo == "" => bypass`, "unknown variable \"bar.foo\"")
+	testError(`(true => bypass`, "missing closing parenthesis")
+	testError(`path =~ host => bypass`, "unexpected \"host\" instead of string literal")
+	testError(`path =~ "(" => bypass`, "cannot compile regexp")
+	testError(`path == "foo => bypass`, "unterminated string literal")
+	testError(`path == "\q" => bypass`, "cannot parse string literal")
+	testError(`path == 'foo' => bypass`, "unexpected char '\\''")
+
+	// Malformed actions.
+	testError(`true =>`, "unknown action \"\"")
+	testError(`true => cache`, "unknown action \"cache\"")
+	testError(`true => bypass stop`, "unexpected \"stop\" after actions")
+	testError(`true => bypass,`, "unknown action \"\"")
+	testError(`true => origin secondary`, "missing = after origin")
+	testError(`true => origin = tertiary`, "unexpected origin \"tertiary\"")
+	testError(`true => origin = secondary`, "secondary origin requires secondaryUpstreamHost")
+	testError(`true => key host`, "missing = after key")
+	testError(`true => key =`, "unknown variable \"\"")
+}
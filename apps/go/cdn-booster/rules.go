@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	cacheRulesFile = flag.String("cacheRulesFile", "", "Path to JSON file with caching rules. Rules may be modified at runtime via /rules admin API endpoint. Modified rules are persisted to this file. See adminListenAddr")
+)
+
+// Caching rules, which may be modified at runtime via admin API.
+//
+// Patterns are regular expressions matched against request uri.
+type cacheRules struct {
+	// Version is incremented on each update. Updates must contain
+	// the current version, so concurrent updates don't overwrite each other.
+	Version int64 `json:"version"`
+
+	// Requests matching these patterns are proxied to upstream without caching.
+	BypassPatterns []string `json:"bypassPatterns,omitempty"`
+
+	// Overrides cache ttl for cacheable responses to matching requests.
+	// The first matching override wins.
+	TtlOverrides []ttlOverride `json:"ttlOverrides,omitempty"`
+
+	// Overrides negativeCacheTtl flag if not empty.
+	NegativeCacheTtl string `json:"negativeCacheTtl,omitempty"`
+
+	// Cache ttls by status code or class such as "404" or "5xx".
+	// Overrides statusTtls flag if not empty.
+	StatusTtls map[string]string `json:"statusTtls,omitempty"`
+
+	// Maps matching requests to named cache namespaces, which may be
+	// cleared at once via /namespaces/clear admin API endpoint.
+	// The first matching namespace wins.
+	Namespaces []namespaceRule `json:"namespaces,omitempty"`
+}
+
+type ttlOverride struct {
+	Pattern string `json:"pattern"`
+	Ttl     string `json:"ttl"`
+}
+
+type namespaceRule struct {
+	Pattern string `json:"pattern"`
+	Name    string `json:"name"`
+
+	// Optional cache ttl for the namespace. TtlOverrides take precedence.
+	Ttl string `json:"ttl,omitempty"`
+}
+
+// Compiled form of cacheRules.
+type compiledCacheRules struct {
+	rules            *cacheRules
+	bypass           []*regexp.Regexp
+	ttlPatterns      []*regexp.Regexp
+	ttls             []time.Duration
+	negativeCacheTtl time.Duration
+	statusTtls       *statusTtlTable
+	nsPatterns       []*regexp.Regexp
+	nsNames          []string
+	nsTtls           []time.Duration
+}
+
+func (r *cacheRules) compile() (*compiledCacheRules, error) {
+	cr := &compiledCacheRules{
+		rules:            r,
+		negativeCacheTtl: *negativeCacheTtl,
+	}
+	for _, p := range r.BypassPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile bypass pattern [%s]: [%s]", p, err)
+		}
+		cr.bypass = append(cr.bypass, re)
+	}
+	for _, o := range r.TtlOverrides {
+		re, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile ttl override pattern [%s]: [%s]", o.Pattern, err)
+		}
+		ttl, err := time.ParseDuration(o.Ttl)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ttl=[%s] for pattern [%s]: [%s]", o.Ttl, o.Pattern, err)
+		}
+		cr.ttlPatterns = append(cr.ttlPatterns, re)
+		cr.ttls = append(cr.ttls, ttl)
+	}
+	for _, ns := range r.Namespaces {
+		if !isValidNamespaceName(ns.Name) {
+			return nil, fmt.Errorf("invalid namespace name [%s] for pattern [%s]. The name may contain only letters, digits, '-', '_' and '.'", ns.Name, ns.Pattern)
+		}
+		re, err := regexp.Compile(ns.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile namespace pattern [%s]: [%s]", ns.Pattern, err)
+		}
+		var ttl time.Duration
+		if ns.Ttl != "" {
+			if ttl, err = time.ParseDuration(ns.Ttl); err != nil {
+				return nil, fmt.Errorf("cannot parse ttl=[%s] for namespace [%s]: [%s]", ns.Ttl, ns.Name, err)
+			}
+		}
+		cr.nsPatterns = append(cr.nsPatterns, re)
+		cr.nsNames = append(cr.nsNames, ns.Name)
+		cr.nsTtls = append(cr.nsTtls, ttl)
+	}
+	if r.NegativeCacheTtl != "" {
+		ttl, err := time.ParseDuration(r.NegativeCacheTtl)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse negativeCacheTtl=[%s]: [%s]", r.NegativeCacheTtl, err)
+		}
+		cr.negativeCacheTtl = ttl
+	}
+	statusTtls := r.StatusTtls
+	if len(statusTtls) == 0 {
+		statusTtls = statusTtlsFromFlag
+	}
+	var err error
+	if cr.statusTtls, err = compileStatusTtls(statusTtls); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *compiledCacheRules) isBypassed(requestURI []byte) bool {
+	for _, re := range cr.bypass {
+		if re.Match(requestURI) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns ttl override for the given requestURI if any.
+//
+// Falls back to the ttl of the matching namespace.
+func (cr *compiledCacheRules) ttlOverride(requestURI []byte) (time.Duration, bool) {
+	for i, re := range cr.ttlPatterns {
+		if re.Match(requestURI) {
+			return cr.ttls[i], true
+		}
+	}
+	if i := cr.namespaceIndex(requestURI); i >= 0 && cr.nsTtls[i] != 0 {
+		return cr.nsTtls[i], true
+	}
+	return 0, false
+}
+
+// Returns the namespace name for the given requestURI.
+//
+// Returns empty string if the requestURI doesn't belong to any namespace.
+func (cr *compiledCacheRules) namespace(requestURI []byte) string {
+	if i := cr.namespaceIndex(requestURI); i >= 0 {
+		return cr.nsNames[i]
+	}
+	return ""
+}
+
+func (cr *compiledCacheRules) namespaceIndex(requestURI []byte) int {
+	for i, re := range cr.nsPatterns {
+		if re.Match(requestURI) {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	// Contains *compiledCacheRules.
+	currentRules atomic.Value
+
+	// Serializes rules' updates.
+	rulesLock sync.Mutex
+)
+
+func getCacheRules() *compiledCacheRules {
+	return currentRules.Load().(*compiledCacheRules)
+}
+
+func initCacheRules() {
+	r := &cacheRules{}
+	if *cacheRulesFile != "" {
+		data, err := ioutil.ReadFile(*cacheRulesFile)
+		if err != nil && !os.IsNotExist(err) {
+			logFatal("Cannot read cacheRulesFile=[%s]: [%s]", *cacheRulesFile, err)
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, r); err != nil {
+				logFatal("Cannot parse cacheRulesFile=[%s]: [%s]", *cacheRulesFile, err)
+			}
+		}
+	}
+	cr, err := r.compile()
+	if err != nil {
+		logFatal("Invalid rules in cacheRulesFile=[%s]: %s", *cacheRulesFile, err)
+	}
+	currentRules.Store(cr)
+	registerAdminHandler("/rules", rulesHandler)
+}
+
+// Admin API handler for caching rules.
+//
+// GET returns the current rules. PUT replaces the rules. The version
+// of the replaced rules must be passed either in If-Match header
+// or in the version field of the request body.
+func rulesHandler(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case "GET":
+		writeCacheRules(ctx, getCacheRules().rules)
+	case "PUT":
+		updateCacheRules(ctx)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func updateCacheRules(ctx *fasthttp.RequestCtx) {
+	r := &cacheRules{}
+	if err := json.Unmarshal(ctx.PostBody(), r); err != nil {
+		ctx.Error(fmt.Sprintf("Cannot parse rules: %s", err), fasthttp.StatusBadRequest)
+		return
+	}
+	expectedVersion := r.Version
+	statusCode := fasthttp.StatusConflict
+	if v := ctx.Request.Header.Peek("If-Match"); len(v) > 0 {
+		n, err := strconv.ParseInt(string(trimQuotes(v)), 10, 64)
+		if err != nil {
+			ctx.Error(fmt.Sprintf("Cannot parse If-Match=[%s]: %s", v, err), fasthttp.StatusBadRequest)
+			return
+		}
+		expectedVersion = n
+		statusCode = fasthttp.StatusPreconditionFailed
+	}
+
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+
+	current := getCacheRules().rules
+	if expectedVersion != current.Version {
+		ctx.Error(fmt.Sprintf("Rules version mismatch: %d. Current version is %d", expectedVersion, current.Version), statusCode)
+		return
+	}
+	r.Version = current.Version + 1
+	cr, err := r.compile()
+	if err != nil {
+		ctx.Error(fmt.Sprintf("Invalid rules: %s", err), fasthttp.StatusBadRequest)
+		return
+	}
+	if *cacheRulesFile != "" {
+		if err = saveCacheRules(*cacheRulesFile, r); err != nil {
+			logMessage("Cannot save rules to cacheRulesFile=[%s]: [%s]", *cacheRulesFile, err)
+			ctx.Error("Cannot persist rules", fasthttp.StatusInternalServerError)
+			return
+		}
+	}
+	currentRules.Store(cr)
+	logMessage("Caching rules have been updated to version %d", r.Version)
+	writeCacheRules(ctx, r)
+}
+
+func writeCacheRules(ctx *fasthttp.RequestCtx, r *cacheRules) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		logFatal("BUG: cannot marshal rules: [%s]", err)
+	}
+	ctx.Response.Header.Set("Etag", fmt.Sprintf("\"%d\"", r.Version))
+	ctx.Success("application/json", data)
+}
+
+// Atomically replaces the file at path with the given rules.
+func saveCacheRules(path string, r *cacheRules) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func trimQuotes(b []byte) []byte {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return b[1 : len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc/bench"
+)
+
+var (
+	benchUrlsFile = flag.String("benchUrlsFile", "", "Path to file with urls for load testing a running go-cdn-booster at benchTarget. "+
+		"The file may contain either a url or a request path per line or access log lines written by go-cdn-booster with accessLog. "+
+		"go-cdn-booster replays the requests, prints the report and exits instead of serving requests if this flag is set")
+	benchTarget        = flag.String("benchTarget", "http://localhost:8098", "Base url of go-cdn-booster to load test. See benchUrlsFile")
+	benchConcurrency   = flag.Int("benchConcurrency", 16, "The number of concurrent connections for load testing. See benchUrlsFile")
+	benchRequestsCount = flag.Int("benchRequestsCount", 0, "The number of requests to send during load testing. Urls from benchUrlsFile are replayed in a loop until the given number of requests is sent. "+
+		"Leave zero for replaying each url once. See benchUrlsFile")
+	benchTimeout = flag.Duration("benchTimeout", 10*time.Second, "Timeout for each request during load testing. See benchUrlsFile")
+)
+
+type benchResult struct {
+	latency     bench.Histogram
+	errorsCount int
+	bytesRead   int64
+	statusCodes map[int]int
+}
+
+// Replays requests from benchUrlsFile against benchTarget and prints
+// the report with hit ratio and latency percentiles.
+func runSelfBenchmark() {
+	urls, err := readBenchUrls(*benchUrlsFile)
+	if err != nil {
+		logFatal("Cannot read benchUrlsFile=[%s]: [%s]", *benchUrlsFile, err)
+	}
+	if len(urls) == 0 {
+		logFatal("benchUrlsFile=[%s] contains no urls", *benchUrlsFile)
+	}
+	target, err := url.Parse(*benchTarget)
+	if err != nil {
+		logFatal("Cannot parse benchTarget=[%s]: [%s]", *benchTarget, err)
+	}
+	if *benchConcurrency <= 0 {
+		logFatal("benchConcurrency=%d must be positive", *benchConcurrency)
+	}
+	isTLS := target.Scheme == "https"
+	addr := target.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if isTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	c := &fasthttp.HostClient{
+		Addr:     addr,
+		IsTLS:    isTLS,
+		MaxConns: *benchConcurrency,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	requestsCount := *benchRequestsCount
+	if requestsCount <= 0 {
+		requestsCount = len(urls)
+	}
+	statsUrl := *benchTarget + *statsRequestPath
+	hitsBefore, missesBefore, statsOk := fetchBenchHitsMisses(c, statsUrl)
+
+	logMessage("Sending %d requests to [%s] over %d connections", requestsCount, *benchTarget, *benchConcurrency)
+	var n int64 = -1
+	results := make([]benchResult, *benchConcurrency)
+	var wg sync.WaitGroup
+	startTime := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(r *benchResult) {
+			defer wg.Done()
+			r.statusCodes = make(map[int]int)
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			// Otherwise fasthttp overwrites Host header with the host
+			// from benchTarget.
+			req.UseHostHeader = true
+			for {
+				idx := atomic.AddInt64(&n, 1)
+				if idx >= int64(requestsCount) {
+					return
+				}
+				u := urls[idx%int64(len(urls))]
+				req.SetRequestURI(*benchTarget + u.requestURI)
+				// Empty Host header is replaced by the host from benchTarget,
+				// so the host from the previous url doesn't leak here.
+				req.Header.SetHost(u.host)
+				t := time.Now()
+				if err := c.DoTimeout(&req, &resp, *benchTimeout); err != nil {
+					r.errorsCount++
+					continue
+				}
+				r.latency.Add(time.Since(t))
+				r.statusCodes[resp.StatusCode()]++
+				r.bytesRead += int64(len(resp.Body()))
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	duration := time.Since(startTime)
+
+	var total benchResult
+	total.statusCodes = make(map[int]int)
+	for i := range results {
+		r := &results[i]
+		total.latency.Merge(&r.latency)
+		total.errorsCount += r.errorsCount
+		total.bytesRead += r.bytesRead
+		for code, count := range r.statusCodes {
+			total.statusCodes[code] += count
+		}
+	}
+
+	fmt.Printf("Requests: %d\n", requestsCount)
+	fmt.Printf("Duration: %s\n", duration)
+	fmt.Printf("Requests per second: %.0f\n", float64(requestsCount)/duration.Seconds())
+	fmt.Printf("Read: %.3f MBytes\n", float64(total.bytesRead)/1000000)
+	fmt.Printf("Errors: %d\n", total.errorsCount)
+	for code, count := range total.statusCodes {
+		fmt.Printf("Status code %d: %d\n", code, count)
+	}
+	if hitsAfter, missesAfter, ok := fetchBenchHitsMisses(c, statsUrl); ok && statsOk {
+		hits := hitsAfter - hitsBefore
+		misses := missesAfter - missesBefore
+		var hitRatio float64
+		if hits+misses > 0 {
+			hitRatio = float64(hits) / float64(hits+misses) * 100
+		}
+		fmt.Printf("Cache hit ratio: %.3f%% (%d hits, %d misses)\n", hitRatio, hits, misses)
+	} else {
+		fmt.Printf("Cache hit ratio: unknown, since [%s] is unavailable\n", statsUrl)
+	}
+	h := &total.latency
+	fmt.Printf("Latency: min=%s, avg=%s, p50=%s, p90=%s, p99=%s, p99.9=%s, max=%s\n",
+		h.Min(), h.Mean(), h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Percentile(99.9), h.Max())
+}
+
+type benchUrl struct {
+	// Host header for the request. Empty means benchTarget host.
+	host string
+
+	requestURI string
+}
+
+// Reads urls from the file with urls, request paths or access log lines.
+func readBenchUrls(path string) ([]benchUrl, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []benchUrl
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if n := strings.Index(line, " - GET "); n >= 0 {
+			// Access log line. See logAccess().
+			line = line[n+len(" - GET "):]
+			if n = strings.IndexByte(line, ' '); n >= 0 {
+				line = line[:n]
+			}
+		}
+		var u benchUrl
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			pu, err := url.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse url [%s]: [%s]", line, err)
+			}
+			u.host = pu.Host
+			u.requestURI = pu.RequestURI()
+		} else {
+			u.requestURI = line
+		}
+		if !strings.HasPrefix(u.requestURI, "/") {
+			u.requestURI = "/" + u.requestURI
+		}
+		urls = append(urls, u)
+	}
+	return urls, s.Err()
+}
+
+// Returns cache hits and misses from go-cdn-booster stats page.
+func fetchBenchHitsMisses(c *fasthttp.HostClient, statsUrl string) (hits, misses int64, ok bool) {
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI(statsUrl)
+	if err := c.DoTimeout(&req, &resp, *benchTimeout); err != nil || resp.StatusCode() != fasthttp.StatusOK {
+		return 0, 0, false
+	}
+	body := resp.Body()
+	hits, okHits := parseStatsCounter(body, "Cache hits: ")
+	misses, okMisses := parseStatsCounter(body, "Cache misses: ")
+	return hits, misses, okHits && okMisses
+}
+
+// Returns the value of the first counter with the given prefix
+// on the stats page.
+func parseStatsCounter(body []byte, prefix string) (int64, bool) {
+	n := bytes.Index(body, []byte(prefix))
+	if n < 0 {
+		return 0, false
+	}
+	body = body[n+len(prefix):]
+	if n = bytes.IndexByte(body, '\n'); n >= 0 {
+		body = body[:n]
+	}
+	v, err := strconv.ParseInt(string(body), 10, 64)
+	return v, err == nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// Sends the cached body to the client with respect to conditional
+// and Range request headers.
+//
+// Conditional headers are evaluated in the order defined in RFC 9110,
+// section 13.2.2. Only single-range requests are supported. Requests
+// with multiple ranges get the whole body.
+//
+// Responses with status codes other than 200 are replayed verbatim.
+//
+// Returns the number of body bytes sent to the client.
+func serveCachedContent(ctx *fasthttp.RequestCtx, ih *itemHeader, body []byte) int {
+	h := &ctx.Request.Header
+	rh := &ctx.Response.Header
+	if ih.contentEncoding != "" {
+		rh.Set("Content-Encoding", ih.contentEncoding)
+	}
+	if ih.statusCode != 0 && ih.statusCode != fasthttp.StatusOK {
+		if ih.location != "" {
+			rh.Set("Location", ih.location)
+		}
+		if !statusCodeAllowsBody(ih.statusCode) {
+			body = nil
+		}
+		ctx.SetStatusCode(ih.statusCode)
+		ctx.SetContentType(ih.contentType)
+		ctx.SetBody(body)
+		return len(body)
+	}
+
+	if ih.etag != "" {
+		rh.Set("Etag", ih.etag)
+	}
+	if !ih.lastModified.IsZero() {
+		rh.SetLastModified(ih.lastModified)
+	}
+	rh.Set("Cache-Control", cacheControlHeader(ih))
+	rh.Set("Accept-Ranges", "bytes")
+
+	if v := h.Peek("If-Match"); len(v) > 0 {
+		if !etagMatches(v, ih.etag, false) {
+			ctx.SetStatusCode(fasthttp.StatusPreconditionFailed)
+			atomic.AddInt64(&stats.PreconditionFailedCount, 1)
+			return 0
+		}
+	} else if isModifiedSince(h.Peek("If-Unmodified-Since"), ih.lastModified) {
+		ctx.SetStatusCode(fasthttp.StatusPreconditionFailed)
+		atomic.AddInt64(&stats.PreconditionFailedCount, 1)
+		return 0
+	}
+
+	if v := h.Peek("If-None-Match"); len(v) > 0 {
+		if etagMatches(v, ih.etag, true) {
+			ctx.NotModified()
+			atomic.AddInt64(&stats.NotModifiedCount, 1)
+			return 0
+		}
+	} else if v := h.Peek("If-Modified-Since"); len(v) > 0 && !ih.lastModified.IsZero() && !isModifiedSince(v, ih.lastModified) {
+		ctx.NotModified()
+		atomic.AddInt64(&stats.NotModifiedCount, 1)
+		return 0
+	}
+
+	byteRange := h.Peek("Range")
+	if len(byteRange) == 0 || bytes.IndexByte(byteRange, ',') >= 0 || !ifRangeMatches(h.Peek("If-Range"), ih) {
+		ctx.Success(ih.contentType, body)
+		return len(body)
+	}
+
+	startPos, endPos, err := fasthttp.ParseByteRange(byteRange, len(body))
+	if err != nil {
+		rh.Set("Content-Range", fmt.Sprintf("bytes */%d", len(body)))
+		ctx.SetStatusCode(fasthttp.StatusRequestedRangeNotSatisfiable)
+		return 0
+	}
+	rh.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", startPos, endPos, len(body)))
+	ctx.SetStatusCode(fasthttp.StatusPartialContent)
+	ctx.SetContentType(ih.contentType)
+	ctx.SetBody(body[startPos : endPos+1])
+	atomic.AddInt64(&stats.PartialContentCount, 1)
+	return endPos + 1 - startPos
+}
+
+// The max-age for items cached forever. One year is the maximum
+// recommended by RFC 9111.
+const maxCacheControlAge = 365 * 24 * time.Hour
+
+// Returns Cache-Control header value for the cached item.
+//
+// Clients may cache the item until it expires in go-cdn-booster cache.
+func cacheControlHeader(ih *itemHeader) string {
+	maxAge := maxCacheControlAge
+	if ih.ttl > 0 && ih.ttl < ybc.MaxTtl {
+		maxAge = ih.ttl
+		if !ih.fetchTime.IsZero() {
+			maxAge -= time.Since(ih.fetchTime)
+		}
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		if maxAge > maxCacheControlAge {
+			maxAge = maxCacheControlAge
+		}
+	}
+	return fmt.Sprintf("public, max-age=%d", int64(maxAge.Round(time.Second)/time.Second))
+}
+
+// Returns true if responses with the given status code may contain body.
+//
+// See RFC 9110, section 6.4.1.
+func statusCodeAllowsBody(statusCode int) bool {
+	return statusCode >= 200 && statusCode != fasthttp.StatusNoContent && statusCode != fasthttp.StatusNotModified
+}
+
+// Returns true if the If-Match or If-None-Match header value contains etag.
+//
+// Weak comparison is used for If-None-Match, while If-Match requires
+// strong comparison. See RFC 9110, section 8.8.3.2.
+func etagMatches(headerValue []byte, etag string, weak bool) bool {
+	if bytes.Equal(bytes.TrimSpace(headerValue), []byte("*")) {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	if !weak && isWeakETag(etag) {
+		return false
+	}
+	etag = trimWeakETagPrefix(etag)
+	for _, v := range bytes.Split(headerValue, []byte(",")) {
+		v = bytes.TrimSpace(v)
+		if isWeakETag(string(v)) {
+			if !weak {
+				continue
+			}
+			v = v[2:]
+		}
+		if string(v) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the If-Range header value allows serving the requested range.
+func ifRangeMatches(headerValue []byte, ih *itemHeader) bool {
+	if len(headerValue) == 0 {
+		return true
+	}
+	if headerValue[0] == '"' || isWeakETag(string(headerValue)) {
+		return etagMatches(headerValue, ih.etag, false)
+	}
+	t, err := fasthttp.ParseHTTPDate(headerValue)
+	if err != nil || ih.lastModified.IsZero() {
+		return false
+	}
+	return ih.lastModified.Unix() == t.Unix()
+}
+
+// Returns true if lastModified is later than the date in the given
+// If-Modified-Since or If-Unmodified-Since header value.
+//
+// Returns false for empty or invalid header values and for unknown
+// lastModified, i.e. the corresponding header is ignored.
+func isModifiedSince(headerValue []byte, lastModified time.Time) bool {
+	if len(headerValue) == 0 || lastModified.IsZero() {
+		return false
+	}
+	t, err := fasthttp.ParseHTTPDate(headerValue)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have one-second resolution.
+	return lastModified.Unix() > t.Unix()
+}
+
+func isWeakETag(etag string) bool {
+	return len(etag) >= 2 && etag[:2] == "W/"
+}
+
+func trimWeakETagPrefix(etag string) string {
+	if isWeakETag(etag) {
+		return etag[2:]
+	}
+	return etag
+}
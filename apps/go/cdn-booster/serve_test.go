@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+func TestServeCachedContent_CacheControl(t *testing.T) {
+	testCacheControl := func(ih *itemHeader, expected string) {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI("http://example.com/foo")
+		serveCachedContent(&ctx, ih, []byte("foobar"))
+		if v := string(ctx.Response.Header.Peek("Cache-Control")); v != expected {
+			t.Fatalf("Unexpected Cache-Control=[%s] for ttl=%s. Expected [%s]", v, ih.ttl, expected)
+		}
+	}
+
+	// Items cached forever.
+	testCacheControl(&itemHeader{}, "public, max-age=31536000")
+	testCacheControl(&itemHeader{ttl: ybc.MaxTtl, fetchTime: time.Now().Add(-time.Hour)}, "public, max-age=31536000")
+
+	// Items with finite ttl.
+	testCacheControl(&itemHeader{ttl: time.Minute}, "public, max-age=60")
+	testCacheControl(&itemHeader{ttl: 24 * time.Hour, fetchTime: time.Now().Add(-time.Hour)}, "public, max-age=82800")
+	testCacheControl(&itemHeader{ttl: time.Minute, fetchTime: time.Now().Add(-time.Hour)}, "public, max-age=0")
+	testCacheControl(&itemHeader{ttl: 2 * maxCacheControlAge, fetchTime: time.Now()}, "public, max-age=31536000")
+}
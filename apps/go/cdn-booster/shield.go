@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	shieldHost = flag.String("shieldHost", "", "Address of go-cdn-booster acting as origin shield in the form 'host[:port]'. "+
+		"Cache misses are forwarded to the shield instead of upstreamHost, so the origin receives a single request per url from multiple edge go-cdn-booster instances. "+
+		"The shield must be started with shieldMode and it must accept requests via upstreamProtocol. Requests bypassing the cache and requests for secondaryUpstreamHost are sent directly to the origin. "+
+		"Leave empty for sending cache misses directly to the origin")
+	shieldMode = flag.Bool("shieldMode", false, "Whether to act as origin shield for edge go-cdn-booster instances. "+
+		"Concurrent cache misses for the same url are collapsed into a single upstream request, while the remaining requests wait for its' result. "+
+		"See shieldHost and shieldCollapseTimeout")
+	shieldCollapseTimeout = flag.Duration("shieldCollapseTimeout", 30*time.Second, "The maximum duration requests wait for the collapsed upstream request in shieldMode. "+
+		"Requests are sent to upstream on their own after the timeout")
+)
+
+var shieldOrigin *upstreamOrigin
+
+func initShield() {
+	if *shieldHost != "" {
+		shieldOrigin = newUpstreamOrigin(*shieldHost)
+		logMessage("Forwarding cache misses to shieldHost=[%s]", *shieldHost)
+	}
+	if *shieldMode {
+		if *shieldCollapseTimeout <= 0 {
+			logFatal("shieldCollapseTimeout=%s must be positive", *shieldCollapseTimeout)
+		}
+		logMessage("Acting as origin shield. Concurrent cache misses are collapsed for up to %s", *shieldCollapseTimeout)
+	}
+}
+
+// Returns the origin for fetching cache misses from.
+//
+// The shield is used instead of the primary origin if shieldHost is set.
+// The shield fetches cache misses from its' own upstreamHost, so requests
+// for the secondary origin are sent directly to the secondary origin.
+func shieldedOrigin(origin *upstreamOrigin) *upstreamOrigin {
+	if shieldOrigin != nil && origin == primaryOrigin {
+		return shieldOrigin
+	}
+	return origin
+}
+
+// Upstream request, which is shared among concurrent cache misses
+// for the same key.
+type collapsedFetch struct {
+	done chan struct{}
+
+	// Set if the response has been stored in the cache.
+	stored bool
+
+	// A copy of the response, which must be passed through to clients
+	// without caching.
+	resp *fasthttp.Response
+}
+
+var (
+	collapsedFetches     = make(map[string]*collapsedFetch)
+	collapsedFetchesLock sync.Mutex
+)
+
+// The same as fetchFromUpstream(), but concurrent calls for the same key
+// result in a single upstream request.
+//
+// The remaining calls wait for up to shieldCollapseTimeout for the result
+// of the first call and then obtain the stored item from the cache.
+func fetchCollapsed(tctx context.Context, h *fasthttp.RequestHeader, key []byte, origin *upstreamOrigin) (*ybc.Item, *fasthttp.Response) {
+	k := string(key)
+	collapsedFetchesLock.Lock()
+	cf, ok := collapsedFetches[k]
+	if !ok {
+		cf = &collapsedFetch{
+			done: make(chan struct{}),
+		}
+		collapsedFetches[k] = cf
+	}
+	collapsedFetchesLock.Unlock()
+
+	if !ok {
+		item, resp := fetchFromUpstream(tctx, h, key, origin, false)
+		cf.stored = item != nil
+		if resp != nil {
+			cf.resp = &fasthttp.Response{}
+			resp.CopyTo(cf.resp)
+		}
+		collapsedFetchesLock.Lock()
+		delete(collapsedFetches, k)
+		collapsedFetchesLock.Unlock()
+		close(cf.done)
+		return item, resp
+	}
+
+	atomic.AddInt64(&stats.ShieldCollapsedRequestsCount, 1)
+	t := time.NewTimer(*shieldCollapseTimeout)
+	select {
+	case <-cf.done:
+		t.Stop()
+	case <-t.C:
+		atomic.AddInt64(&stats.ShieldCollapseTimeoutsCount, 1)
+		logRequestError(h, "Timeout when waiting for collapsed upstream request for [%s]", key)
+		return fetchFromUpstream(tctx, h, key, origin, false)
+	}
+
+	if cf.resp != nil {
+		var resp fasthttp.Response
+		cf.resp.CopyTo(&resp)
+		return nil, &resp
+	}
+	if !cf.stored {
+		// Do not hammer the origin if the collapsed request failed.
+		return nil, nil
+	}
+	item, err := cache.GetItem(key)
+	if err == nil {
+		return item, nil
+	}
+	if err != ybc.ErrCacheMiss {
+		logFatal("Unexpected error when obtaining cache value by key=[%s]: [%s]", key, err)
+	}
+	// The item has been already evicted from the cache.
+	return fetchFromUpstream(tctx, h, key, origin, false)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	snapshotPath = flag.String("snapshotPath", "", "Directory for periodic snapshots of cache files. Each snapshot is stored in a new subdirectory named after the snapshot time. "+
+		"Snapshots are taken without stopping the server, so they may be copied to backup storage at any time. See snapshotInterval and restoreFrom")
+	snapshotInterval  = flag.Duration("snapshotInterval", time.Hour, "Interval between cache snapshots stored in snapshotPath")
+	snapshotKeepCount = flag.Int("snapshotKeepCount", 3, "The number of the most recent snapshots to keep in snapshotPath. Older snapshots are removed after taking a new snapshot. Leave zero for keeping all the snapshots")
+	restoreFrom       = flag.String("restoreFrom", "", "Snapshot directory to restore cache files from on startup, so the cache is warm after hardware replacement. "+
+		"The most recent snapshot is used if the directory contains multiple snapshots, i.e. restoreFrom may point to snapshotPath. "+
+		"Cache files are restored only if they are missing, so existing cache isn't overwritten on restart")
+)
+
+// Snapshot subdirectory names. They sort in chronological order.
+const snapshotNameFormat = "20060102T150405.000Z"
+
+// The suffix for cache files being restored.
+const restoredFilesSuffix = ".restoring"
+
+func initSnapshots() {
+	if *snapshotPath == "" {
+		return
+	}
+	if *cacheFilesPath == "" {
+		logFatal("snapshotPath requires cacheFilesPath, since anonymous cache cannot be restored from snapshots")
+	}
+	if *snapshotInterval <= 0 {
+		logFatal("snapshotInterval=%s must be positive", *snapshotInterval)
+	}
+	if *snapshotKeepCount < 0 {
+		logFatal("snapshotKeepCount=%d cannot be negative", *snapshotKeepCount)
+	}
+	if err := os.MkdirAll(*snapshotPath, 0700); err != nil {
+		logFatal("Cannot create snapshotPath=[%s]: [%s]", *snapshotPath, err)
+	}
+	logMessage("Taking cache snapshots every %s into [%s]", *snapshotInterval, *snapshotPath)
+	go func() {
+		for {
+			time.Sleep(*snapshotInterval)
+			startTime := time.Now()
+			dir, err := takeSnapshot()
+			if err != nil {
+				logMessage("Cannot take cache snapshot: [%s]", err)
+				continue
+			}
+			logMessage("Cache snapshot has been stored in [%s] in %s", dir, time.Since(startTime))
+			removeOldSnapshots()
+		}
+	}()
+}
+
+// Returns the path to cache files of the i-th file from cacheFilesPath
+// in the snapshot dir.
+func snapshotFilePath(dir string, i int, file string) string {
+	return filepath.Join(dir, strconv.Itoa(i), filepath.Base(file))
+}
+
+// Copies cache files into a new subdirectory of snapshotPath without
+// stopping the server.
+//
+// Returns the path to the subdirectory.
+func takeSnapshot() (string, error) {
+	dir := filepath.Join(*snapshotPath, time.Now().UTC().Format(snapshotNameFormat))
+	configs := cacheConfigs("")
+	snapshotConfigs := make(ybc.ClusterConfig, len(configs))
+	for i, c := range configs {
+		if err := os.MkdirAll(filepath.Join(dir, strconv.Itoa(i)), 0700); err != nil {
+			return "", fmt.Errorf("cannot create snapshot directory: [%s]", err)
+		}
+		cfg := *c
+		cfg.IndexFile = snapshotFilePath(dir, i, c.IndexFile)
+		cfg.DataFile = snapshotFilePath(dir, i, c.DataFile)
+		snapshotConfigs[i] = &cfg
+	}
+
+	// The cache generation cannot be closed by compaction
+	// until it is released.
+	g := acquireCacheGen()
+	var err error
+	switch c := g.Cacher.(type) {
+	case *ybc.Cache:
+		err = c.Snapshot(snapshotConfigs[0])
+	case *ybc.Cluster:
+		err = c.Snapshot(snapshotConfigs)
+	default:
+		err = fmt.Errorf("unsupported cache type %T", g.Cacher)
+	}
+	g.release()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	if seedFile := keyHashSeedFile(); len(configs) > 1 && fileExists(seedFile) {
+		// Keys must be distributed among cache files in the same way
+		// after restoring the snapshot. Clusters created before key hash
+		// seeding have no seed file.
+		if err = copyFile(seedFile, snapshotFilePath(dir, 0, seedFile)); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Returns snapshot names in dir in chronological order.
+func listSnapshots(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(snapshotNameFormat, fi.Name()); err != nil {
+			// Skip unrelated directories.
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Removes all the snapshots except the last snapshotKeepCount ones.
+func removeOldSnapshots() {
+	if *snapshotKeepCount == 0 {
+		return
+	}
+	names, err := listSnapshots(*snapshotPath)
+	if err != nil {
+		logMessage("Cannot list snapshots in snapshotPath=[%s]: [%s]", *snapshotPath, err)
+		return
+	}
+	for len(names) > *snapshotKeepCount {
+		dir := filepath.Join(*snapshotPath, names[0])
+		if err = os.RemoveAll(dir); err != nil {
+			logMessage("Cannot remove old snapshot [%s]: [%s]", dir, err)
+		}
+		names = names[1:]
+	}
+}
+
+// Copies cache files for the given configs from restoreFrom snapshot
+// if they are missing.
+func restoreSnapshot(configs ybc.ClusterConfig) {
+	if *restoreFrom == "" {
+		return
+	}
+	if configs[0].DataFile == "" {
+		logFatal("restoreFrom requires cacheFilesPath, since anonymous cache cannot be restored from snapshots")
+	}
+	for _, cfg := range configs {
+		if fileExists(cfg.IndexFile) || fileExists(cfg.DataFile) {
+			logMessage("Skipping restoring cache files from restoreFrom=[%s], since cache file [%s] already exists", *restoreFrom, cfg.DataFile)
+			return
+		}
+	}
+
+	dir := *restoreFrom
+	if !fileExists(filepath.Join(dir, "0")) {
+		names, err := listSnapshots(dir)
+		if err != nil {
+			logFatal("Cannot read restoreFrom=[%s]: [%s]", dir, err)
+		}
+		if len(names) == 0 {
+			logFatal("restoreFrom=[%s] contains no snapshots", dir)
+		}
+		dir = filepath.Join(dir, names[len(names)-1])
+	}
+	if fileExists(filepath.Join(dir, strconv.Itoa(len(configs)))) {
+		logFatal("The snapshot [%s] contains more cache files than cacheFilesPath=[%s]", dir, *cacheFilesPath)
+	}
+
+	logMessage("Restoring cache files from the snapshot [%s]. This can take a while if files are big", dir)
+	startTime := time.Now()
+	for i, cfg := range configs {
+		restoreFile(snapshotFilePath(dir, i, cfg.IndexFile), cfg.IndexFile)
+		restoreFile(snapshotFilePath(dir, i, cfg.DataFile), cfg.DataFile)
+	}
+	if seedFile := keyHashSeedFile(); len(configs) > 1 && fileExists(snapshotFilePath(dir, 0, seedFile)) {
+		restoreFile(snapshotFilePath(dir, 0, seedFile), seedFile)
+	}
+	logMessage("Cache files have been restored from the snapshot [%s] in %s", dir, time.Since(startTime))
+}
+
+// Copies the snapshot file src to dst.
+//
+// The file is copied under temporary name, so partially copied files
+// aren't left under dst name if the copy fails.
+func restoreFile(src, dst string) {
+	tmpFile := dst + restoredFilesSuffix
+	if err := copyFile(src, tmpFile); err != nil {
+		os.Remove(tmpFile)
+		logFatal("Cannot restore cache file [%s]: [%s]", dst, err)
+	}
+	if err := os.Rename(tmpFile, dst); err != nil {
+		logFatal("Cannot restore cache file [%s]: [%s]", dst, err)
+	}
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open [%s]: [%s]", src, err)
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create [%s]: [%s]", dst, err)
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("cannot copy [%s] to [%s]: [%s]", src, dst, err)
+	}
+	if err = w.Sync(); err != nil {
+		w.Close()
+		return fmt.Errorf("cannot sync [%s]: [%s]", dst, err)
+	}
+	return w.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Returns the file with key hash seed for the cache cluster.
+func keyHashSeedFile() string {
+	return strings.Split(*cacheFilesPath, ",")[0] + ".cdn-booster.keyseed"
+}
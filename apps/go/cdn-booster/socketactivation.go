@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The first file descriptor passed via systemd socket activation.
+const listenFdsStart = 3
+
+var (
+	// Listeners obtained via socket activation, which aren't used yet.
+	activatedListeners     []net.Listener
+	activatedListenersLock sync.Mutex
+)
+
+// Obtains listening sockets passed by systemd via LISTEN_FDS
+// and LISTEN_PID environment variables.
+//
+// This allows systemd owning listening sockets, so they may be bound
+// to privileged ports and survive restarts without dropping incoming
+// connections. Listeners are matched to listenAddrs, httpsListenAddrs,
+// adminListenAddr and listenersConfigFile addresses by their local address.
+// Addresses without matching activated listener are listened as usual.
+func initSocketActivation() {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return
+	}
+	pid := os.Getenv("LISTEN_PID")
+
+	// Do not pass the variables to child processes.
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		logMessage("Ignoring LISTEN_FDS=[%s], since LISTEN_PID=[%s] doesn't match the current process", fds, pid)
+		return
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		logFatal("Cannot parse LISTEN_FDS=[%s]", fds)
+	}
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logFatal("Cannot use file descriptor %d passed via socket activation as TCP listener: [%s]", fd, err)
+		}
+		logMessage("Obtained listener on [%s] via socket activation", ln.Addr())
+		activatedListeners = append(activatedListeners, ln)
+	}
+}
+
+// Returns activated listener matching the given addr.
+//
+// Returns nil if there is no matching listener.
+func takeActivatedListener(addr string) net.Listener {
+	activatedListenersLock.Lock()
+	defer activatedListenersLock.Unlock()
+
+	if len(activatedListeners) == 0 {
+		return nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	for i, ln := range activatedListeners {
+		lnAddr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || !isSameListenAddr(tcpAddr, lnAddr) {
+			continue
+		}
+		activatedListeners = append(activatedListeners[:i], activatedListeners[i+1:]...)
+		return ln
+	}
+	return nil
+}
+
+func isSameListenAddr(addr, lnAddr *net.TCPAddr) bool {
+	if addr.Port != lnAddr.Port {
+		return false
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return lnAddr.IP == nil || lnAddr.IP.IsUnspecified()
+	}
+	return addr.IP.Equal(lnAddr.IP)
+}
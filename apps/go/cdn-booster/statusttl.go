@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	statusTtls = flag.String("statusTtls", "", "Comma-separated list of status=ttl pairs for caching upstream responses, for instance, '200=forever,301=1d,404=60s,5xx=no-cache'. "+
+		"Status may be either exact status code or status class such as 4xx. Exact status codes take precedence over status classes. "+
+		"Ttl may be a duration such as 60s or 2h, a number of days such as 1d, 'forever' or 'no-cache'. "+
+		"Listed statuses override the default caching of responses by status code, including Cache-Control and Expires headers, and negativeCacheTtl. "+
+		"The list may be overridden by statusTtls in cacheRulesFile")
+)
+
+// Status ttls from statusTtls flag.
+var statusTtlsFromFlag map[string]string
+
+// Must be called before initCacheRules(), since caching rules fall back
+// to statusTtls flag.
+func initStatusTtls() {
+	m, err := parseStatusTtlsList(*statusTtls)
+	if err == nil {
+		_, err = compileStatusTtls(m)
+	}
+	if err != nil {
+		logFatal("Cannot parse statusTtls=[%s]: %s", *statusTtls, err)
+	}
+	statusTtlsFromFlag = m
+}
+
+// Cache ttls for upstream responses by status code.
+type statusTtlTable struct {
+	codes   map[int]time.Duration
+	classes map[int]time.Duration
+}
+
+// Parses comma-separated status=ttl pairs into a map suitable
+// for compileStatusTtls().
+func parseStatusTtlsList(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		n := strings.IndexByte(pair, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing '=' in status ttl [%s]", pair)
+		}
+		m[strings.TrimSpace(pair[:n])] = strings.TrimSpace(pair[n+1:])
+	}
+	return m, nil
+}
+
+// Returns nil if m is empty.
+func compileStatusTtls(m map[string]string) (*statusTtlTable, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	t := &statusTtlTable{
+		codes:   make(map[int]time.Duration),
+		classes: make(map[int]time.Duration),
+	}
+	for status, s := range m {
+		ttl, err := parseStatusTtl(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ttl=[%s] for status [%s]: [%s]", s, status, err)
+		}
+		if len(status) == 3 && strings.ToLower(status[1:]) == "xx" && status[0] >= '1' && status[0] <= '5' {
+			t.classes[int(status[0]-'0')] = ttl
+			continue
+		}
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status [%s]. Expected status code such as 404 or status class such as 4xx", status)
+		}
+		t.codes[code] = ttl
+	}
+	return t, nil
+}
+
+// Zero ttl means the response mustn't be cached.
+func parseStatusTtl(s string) (time.Duration, error) {
+	switch s {
+	case "forever":
+		return ybc.MaxTtl, nil
+	case "no-cache":
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("cannot parse the number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("ttl cannot be negative")
+	}
+	return ttl, nil
+}
+
+// Returns ttl for the given status code.
+//
+// Returns false if the status code isn't listed in the table.
+// Does nothing if t is nil.
+func (t *statusTtlTable) lookup(statusCode int) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	if ttl, ok := t.codes[statusCode]; ok {
+		return ttl, true
+	}
+	ttl, ok := t.classes[statusCode/100]
+	return ttl, ok
+}
+
+// Ttl distribution buckets for the stats page.
+var ttlBuckets = [...]struct {
+	name   string
+	maxTtl time.Duration
+}{
+	{"up to 1 minute", time.Minute},
+	{"up to 1 hour", time.Hour},
+	{"up to 1 day", 24 * time.Hour},
+	{"up to 30 days", 30 * 24 * time.Hour},
+	{"longer than 30 days", ybc.MaxTtl - 1},
+	{"forever", ybc.MaxTtl},
+}
+
+var (
+	// The number of responses stored in the cache per ttl bucket.
+	storedTtlCounts [len(ttlBuckets)]int64
+
+	// The number of cache hits per ttl bucket of the served item.
+	hitTtlCounts [len(ttlBuckets)]int64
+)
+
+func ttlBucketIndex(ttl time.Duration) int {
+	return sort.Search(len(ttlBuckets)-1, func(i int) bool {
+		return ttl <= ttlBuckets[i].maxTtl
+	})
+}
+
+// Registers the response stored in the cache with the given ttl.
+func registerStoredTtl(ttl time.Duration) {
+	atomic.AddInt64(&storedTtlCounts[ttlBucketIndex(ttl)], 1)
+}
+
+// Registers the cache hit for the item with the given ttl.
+//
+// Items stored by older go-cdn-booster versions have no ttl,
+// so they aren't registered.
+func registerHitTtl(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	atomic.AddInt64(&hitTtlCounts[ttlBucketIndex(ttl)], 1)
+}
+
+func writeTtlDistribution(w io.Writer) {
+	fmt.Fprintf(w, "Cache ttl distribution\n")
+	for i, b := range ttlBuckets {
+		fmt.Fprintf(w, "Ttl %s: stored responses %d, cache hits %d\n", b.name,
+			atomic.LoadInt64(&storedTtlCounts[i]), atomic.LoadInt64(&hitTtlCounts[i]))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+func TestStatusTtlTable_Lookup(t *testing.T) {
+	m, err := parseStatusTtlsList(" 200=forever, 301=1d,404=60s ,5xx=no-cache,4XX=2h,,503=10s")
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	table, err := compileStatusTtls(m)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	testLookup := func(statusCode int, expectedTtl time.Duration, expectedOk bool) {
+		ttl, ok := table.lookup(statusCode)
+		if ttl != expectedTtl || ok != expectedOk {
+			t.Fatalf("Unexpected ttl=%s, ok=%v for status code %d. Expected ttl=%s, ok=%v", ttl, ok, statusCode, expectedTtl, expectedOk)
+		}
+	}
+
+	testLookup(200, ybc.MaxTtl, true)
+	testLookup(301, 24*time.Hour, true)
+
+	// Exact status codes take precedence over status classes.
+	testLookup(404, time.Minute, true)
+	testLookup(410, 2*time.Hour, true)
+	testLookup(503, 10*time.Second, true)
+
+	// no-cache is returned as zero ttl.
+	testLookup(500, 0, true)
+	testLookup(502, 0, true)
+
+	// Unlisted status codes.
+	testLookup(201, 0, false)
+	testLookup(302, 0, false)
+	testLookup(100, 0, false)
+}
+
+func TestStatusTtlTable_Empty(t *testing.T) {
+	m, err := parseStatusTtlsList("")
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	table, err := compileStatusTtls(m)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if table != nil {
+		t.Fatalf("Expecting nil table for empty list")
+	}
+	if ttl, ok := table.lookup(200); ok {
+		t.Fatalf("Unexpected ttl=%s found in nil table", ttl)
+	}
+}
+
+func TestStatusTtlTable_Error(t *testing.T) {
+	testError := func(s, expectedErr string) {
+		m, err := parseStatusTtlsList(s)
+		if err == nil {
+			_, err = compileStatusTtls(m)
+		}
+		if err == nil {
+			t.Fatalf("Expecting error for statusTtls=[%s]", s)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("Unexpected error=[%s] for statusTtls=[%s]. Expected error containing [%s]", err, s, expectedErr)
+		}
+	}
+
+	// Malformed pairs.
+	testError("200", "missing '='")
+	testError("200=1d,404", "missing '='")
+
+	// Invalid statuses.
+	testError("foo=1d", "invalid status [foo]")
+	testError("99=1d", "invalid status [99]")
+	testError("600=1d", "invalid status [600]")
+	testError("6xx=1d", "invalid status [6xx]")
+	testError("0xx=1d", "invalid status [0xx]")
+	testError("2x=1d", "invalid status [2x]")
+
+	// Invalid ttls.
+	testError("200=", "cannot parse ttl=[] for status [200]")
+	testError("200=foo", "cannot parse ttl=[foo] for status [200]")
+	testError("200=xd", "cannot parse the number of days")
+	testError("200=-1d", "cannot parse the number of days")
+	testError("200=-5s", "ttl cannot be negative")
+	testError("200=Forever", "cannot parse ttl=[Forever]")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	streamUpstreamResponses = flag.Bool("streamUpstreamResponses", false, "Whether to stream responses for cache misses to clients while they are fetched from upstream and stored in the cache. "+
+		"This cuts time to first byte for big files. Responses are streamed with Content-Length received from upstream. Only 200 responses with known Content-Length "+
+		"not smaller than streamMinSize for requests without Range and conditional headers are streamed. Streaming is disabled "+
+		"in shieldMode and if upstreamRangeChunkSize, upstreamRedirectPolicy=follow or response filters are used. Streamed requests aren't hedged")
+	streamMinSize = flag.Int("streamMinSize", 1024*1024, "The minimum Content-Length in bytes for upstream responses to be streamed to clients. See streamUpstreamResponses")
+)
+
+// Request headers, which require the whole response for serving it.
+var nonStreamableRequestHeaders = []string{
+	"Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// Returns true if the response for the given request may be streamed
+// from upstream to the client.
+func canStreamResponse(h *fasthttp.RequestHeader) bool {
+	if !*streamUpstreamResponses || *shieldMode || *upstreamRangeChunkSize > 0 || *upstreamRedirectPolicy == redirectPolicyFollow || activeResponseFilters != nil {
+		return false
+	}
+	for _, k := range nonStreamableRequestHeaders {
+		if len(h.Peek(k)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetches the response for cache miss from upstream and streams it
+// to the client while storing it in the cache.
+//
+// Returns true if the response is streamed to the client. Otherwise
+// the whole response is read from upstream and the returned item and resp
+// have the same meaning as for fetchFromUpstream().
+func streamFromUpstream(tctx context.Context, ctx *fasthttp.RequestCtx, key []byte, origin *upstreamOrigin) (bool, *ybc.Item, *fasthttp.Response) {
+	h := &ctx.Request.Header
+	tctx, span := startSpan(tctx, "upstream.fetch", trace.SpanKindClient)
+	defer span.End()
+
+	origin = shieldedOrigin(origin)
+	origin.registerRequest()
+	req := newUpstreamRequest(tctx, h, origin)
+	if *upstreamDisableKeepalive {
+		req.SetConnectionClose()
+	}
+	resp := &fasthttp.Response{}
+	if err := doUpstreamClientRequest(origin.clients.nextStream(), req, resp); err != nil {
+		failUpstreamRequest(span, h, key, err)
+		return false, nil, nil
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode()))
+	contentLength := resp.Header.ContentLength()
+	ttl, ok := cacheableTtl(resp)
+	if resp.StatusCode() != fasthttp.StatusOK || contentLength <= 0 || contentLength < *streamMinSize ||
+		isOversizedUpstreamResponse(contentLength) || !ok ||
+		(*dedupMinSize > 0 && contentLength >= *dedupMinSize) {
+		// Read the whole body from the stream, so the upstream connection
+		// is released, and then handle the response as usual.
+		resp.Body()
+		item, passthroughResp := handleUpstreamResponse(tctx, span, h, key, resp, false)
+		return false, item, passthroughResp
+	}
+	if t, ok := getCacheRules().ttlOverride(h.RequestURI()); ok {
+		ttl = t
+	}
+
+	sb := &streamingBody{
+		h:    h,
+		key:  string(key),
+		resp: resp,
+		r:    resp.BodyStream(),
+		size: contentLength,
+		ttl:  ttl,
+
+		contentType: append([]byte(nil), resp.Header.ContentType()...),
+	}
+	ih := newItemHeader(h, key, resp, ttl)
+	ih.contentLength = contentLength
+	if ih.etag == "" {
+		// The body isn't known yet, so generate etag from the body size
+		// and modification time like nginx does.
+		ih.etag = fmt.Sprintf("\"%x-%x\"", ih.lastModified.Unix(), contentLength)
+	}
+	if ttl > 0 {
+		if admitToCache(key) {
+			sb.startTxn(key, &ih)
+		} else {
+			atomic.AddInt64(&stats.AdmissionRejectedCount, 1)
+		}
+	}
+
+	// The request has no conditional and Range headers, so the whole
+	// body is served with proper headers. The body is then replaced
+	// by the stream.
+	serveCachedContent(ctx, &ih, nil)
+	ctx.SetBodyStream(sb, contentLength)
+	atomic.AddInt64(&stats.StreamedResponsesCount, 1)
+	return true, nil, nil
+}
+
+// Response body, which is stored in the cache while it is read
+// by the client.
+//
+// The response body is fully read and stored in the cache even if
+// the client goes away.
+type streamingBody struct {
+	// The client request header. It remains valid until the response
+	// body is closed.
+	h   *fasthttp.RequestHeader
+	key string
+
+	resp        *fasthttp.Response
+	r           io.Reader
+	size        int
+	ttl         time.Duration
+	contentType []byte
+
+	// Cache generation for txn.
+	gen *cacheGen
+	txn *ybc.SetTxn
+
+	// The number of body bytes read so far.
+	n int
+}
+
+func (sb *streamingBody) startTxn(key []byte, ih *itemHeader) {
+	headerBuf := ih.marshal(nil)
+	sb.gen = acquireCacheGen()
+	if sb.txn = startStoreTxn(sb.h, key, len(headerBuf)+sb.size, sb.ttl); sb.txn == nil {
+		return
+	}
+	if _, err := sb.txn.Write(headerBuf); err != nil {
+		sb.rollback("Cannot store item header with size=%d for response [%s] in cache: [%s]", len(headerBuf), sb.key, err)
+	}
+}
+
+func (sb *streamingBody) Read(p []byte) (int, error) {
+	n, err := sb.r.Read(p)
+	sb.store(p[:n])
+	if err == io.EOF && sb.n < sb.size {
+		err = io.ErrUnexpectedEOF
+	}
+	switch {
+	case err == io.EOF || (err == nil && sb.n == sb.size):
+		// The client stops reading after Content-Length bytes,
+		// so the body may be complete before io.EOF is read.
+		sb.commit()
+	case err != nil:
+		sb.rollback("Cannot read response [%s] body from upstream after %d bytes out of %d: [%s]", sb.key, sb.n, sb.size, err)
+	}
+	return n, err
+}
+
+func (sb *streamingBody) store(p []byte) {
+	sb.n += len(p)
+	if sb.txn == nil || len(p) == 0 {
+		return
+	}
+	if _, err := sb.txn.Write(p); err != nil {
+		sb.rollback("Cannot write response [%s] body with size=%d to cache: [%s]", sb.key, sb.size, err)
+	}
+}
+
+func (sb *streamingBody) commit() {
+	if sb.txn == nil {
+		return
+	}
+	err := sb.txn.Commit()
+	sb.txn = nil
+	if err != nil {
+		logRequestError(sb.h, "Cannot commit set txn for response [%s], size=%d: [%s]", sb.key, sb.size, err)
+		return
+	}
+	registerBytesRead(sb.contentType, sb.size)
+	registerStoredTtl(sb.ttl)
+}
+
+func (sb *streamingBody) rollback(format string, args ...interface{}) {
+	if sb.txn == nil {
+		return
+	}
+	logRequestError(sb.h, format, args...)
+	sb.txn.Rollback()
+	sb.txn = nil
+}
+
+// Is called after the response is sent to the client or the client
+// goes away.
+func (sb *streamingBody) Close() error {
+	sent := sb.n
+	if sb.txn != nil && sb.n < sb.size {
+		// The client went away. Read the remaining body into the cache,
+		// so subsequent requests are served from the cache.
+		buf := make([]byte, 64*1024)
+		var err error
+		for sb.txn != nil && err == nil {
+			_, err = sb.Read(buf)
+		}
+	}
+	sb.resp.CloseBodyStream()
+	if sb.gen != nil {
+		sb.gen.release()
+	}
+	registerBytesSent(sb.contentType, sent)
+	registerTopUrl(sb.h.RequestURI(), sent)
+	return nil
+}
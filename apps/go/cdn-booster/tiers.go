@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+var (
+	ramCacheSize = flag.Int("ramCacheSize", 0, "The size in Mbytes of in-memory cache in front of the cache backed by cacheFilesPath. "+
+		"Items are promoted to the in-memory cache after ramCachePromoteHits hits and are written through to it when fetched from upstream. Leave zero for disabling in-memory cache tier")
+	ramCacheMaxItemsCount = flag.Int("ramCacheMaxItemsCount", 10*1000, "The maximum number of items in the in-memory cache tier. See ramCacheSize")
+	ramCacheMaxItemSize   = flag.Int("ramCacheMaxItemSize", 1024*1024, "The maximum size in bytes of items stored in the in-memory cache tier. Bigger items are served only from the cache backed by cacheFilesPath. See ramCacheSize")
+	ramCachePromoteHits   = flag.Int("ramCachePromoteHits", 2, "The number of hits in the cache backed by cacheFilesPath after which the item is promoted to the in-memory cache tier. See ramCacheSize")
+)
+
+// Non-nil if the in-memory cache tier is enabled.
+var tiers *ybc.TieredCacher
+
+// Returns the cache with in-memory tier in front of c
+// if ramCacheSize is set. Otherwise returns c.
+func newTieredCache(c ybc.Cacher) ybc.Cacher {
+	if *ramCacheSize <= 0 {
+		return c
+	}
+	if *ramCachePromoteHits <= 0 {
+		logFatal("ramCachePromoteHits=%d must be positive", *ramCachePromoteHits)
+	}
+	config := ybc.Config{
+		MaxItemsCount: ybc.SizeT(*ramCacheMaxItemsCount),
+		DataFileSize:  ybc.SizeT(*ramCacheSize) * ybc.SizeT(1024*1024),
+	}
+	ram, err := config.OpenCache(true)
+	if err != nil {
+		logFatal("Cannot open in-memory cache tier: [%s]", err)
+	}
+	logMessage("Using in-memory cache tier with size %d Mbytes", *ramCacheSize)
+	tiers = ybc.NewTieredCacher(ram, c, &ybc.PromotePolicy{
+		Hits:        *ramCachePromoteHits,
+		MaxItemSize: *ramCacheMaxItemSize,
+	})
+	return tiers
+}
+
+func writeTierStats(w io.Writer) {
+	s := tiers.Stats()
+	var ramHitRatio float64
+	if s.L1Hits+s.L2Hits > 0 {
+		ramHitRatio = float64(s.L1Hits) / float64(s.L1Hits+s.L2Hits) * 100.0
+	}
+	fmt.Fprintf(w, "In-memory tier hits: %d\n", s.L1Hits)
+	fmt.Fprintf(w, "File tier hits: %d\n", s.L2Hits)
+	fmt.Fprintf(w, "In-memory tier hit ratio: %.3f%%\n", ramHitRatio)
+	fmt.Fprintf(w, "Items promoted to in-memory tier: %d\n", s.Promotions)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	httpsOCSPStapling                      = flag.Bool("httpsOCSPStapling", true, "Whether to staple OCSP responses to HTTPS certificates. OCSP responses are obtained from responders mentioned in certificates and are refreshed periodically")
+	httpsSessionTicketKeysRotationInterval = flag.Duration("httpsSessionTicketKeysRotationInterval", 12*time.Hour, "Interval for TLS session ticket keys' rotation. Zero value falls back to the default rotation in Go TLS stack")
+)
+
+// Certificate, which may be replaced on the fly, for instance when a fresh
+// OCSP response is stapled to it.
+type tlsCertificate struct {
+	v        atomic.Value
+	certFile string
+}
+
+func (c *tlsCertificate) get() *tls.Certificate {
+	return c.v.Load().(*tls.Certificate)
+}
+
+func (c *tlsCertificate) set(cert *tls.Certificate) {
+	c.v.Store(cert)
+}
+
+// Certificates for HTTPS listeners.
+//
+// Certificates in sni are selected by the server name (SNI) sent
+// by the client. Keys are lowercased domain names, which may start with '*.'.
+// defaultCert is used for clients without SNI or with unknown server names.
+type tlsCertificates struct {
+	defaultCert *tlsCertificate
+	sni         map[string]*tlsCertificate
+	all         []*tlsCertificate
+}
+
+func newTLSConfig() *tls.Config {
+	certs := &tlsCertificates{
+		sni: make(map[string]*tlsCertificate),
+	}
+	certs.defaultCert = certs.load(*httpsCertFile, *httpsKeyFile)
+	if *httpsCerts != "" {
+		certs.loadFromList(*httpsCerts)
+	}
+	if *httpsCertsDir != "" {
+		certs.loadFromDir(*httpsCertsDir)
+	}
+	if len(certs.sni) > 0 {
+		logMessage("Loaded [%d] SNI certificates", len(certs.sni))
+	}
+	if *httpsOCSPStapling {
+		for _, cert := range certs.all {
+			go staplerOCSP(cert)
+		}
+	}
+
+	c := &tls.Config{
+		GetCertificate: certs.getCertificate,
+	}
+	setupClientAuth(c)
+	if *httpsSessionTicketKeysRotationInterval > 0 {
+		go sessionTicketKeysRotator(c, *httpsSessionTicketKeysRotationInterval)
+	}
+	return c
+}
+
+func (certs *tlsCertificates) load(certFile, keyFile string) *tlsCertificate {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		logFatal("Cannot load certificate from certFile=[%s], keyFile=[%s]: [%s]", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		logFatal("Cannot parse certificate [%s]: [%s]", certFile, err)
+	}
+	cert.Leaf = leaf
+	c := &tlsCertificate{
+		certFile: certFile,
+	}
+	c.set(&cert)
+	certs.all = append(certs.all, c)
+	return c
+}
+
+func (certs *tlsCertificates) loadFromList(list string) {
+	for _, entry := range strings.Split(list, ",") {
+		n := strings.Index(entry, ":")
+		if n < 0 {
+			logFatal("Cannot parse httpsCerts entry [%s]. Expected 'domain:certFile:keyFile'", entry)
+		}
+		domain := entry[:n]
+		files := entry[n+1:]
+		n = strings.LastIndex(files, ":")
+		if n < 0 || domain == "" {
+			logFatal("Cannot parse httpsCerts entry [%s]. Expected 'domain:certFile:keyFile'", entry)
+		}
+		certs.add(domain, certs.load(files[:n], files[n+1:]))
+	}
+}
+
+func (certs *tlsCertificates) loadFromDir(dir string) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logFatal("Cannot read httpsCertsDir=[%s]: [%s]", dir, err)
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		ext := filepath.Ext(name)
+		if fi.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		certFile := filepath.Join(dir, name)
+		keyFile := filepath.Join(dir, strings.TrimSuffix(name, ext)+".key")
+		cert := certs.load(certFile, keyFile)
+		leaf := cert.get().Leaf
+		domains := leaf.DNSNames
+		if len(domains) == 0 && leaf.Subject.CommonName != "" {
+			domains = []string{leaf.Subject.CommonName}
+		}
+		if len(domains) == 0 {
+			logMessage("Skipping certificate [%s] without DNS names", certFile)
+			continue
+		}
+		for _, domain := range domains {
+			certs.add(domain, cert)
+		}
+	}
+}
+
+func (certs *tlsCertificates) add(domain string, cert *tlsCertificate) {
+	domain = strings.ToLower(domain)
+	if _, ok := certs.sni[domain]; ok {
+		logMessage("Overriding duplicate certificate for domain [%s]", domain)
+	}
+	certs.sni[domain] = cert
+}
+
+func (certs *tlsCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name != "" {
+		if cert, ok := certs.sni[name]; ok {
+			return cert.get(), nil
+		}
+		if n := strings.Index(name, "."); n > 0 {
+			if cert, ok := certs.sni["*"+name[n:]]; ok {
+				return cert.get(), nil
+			}
+		}
+	}
+	return certs.defaultCert.get(), nil
+}
+
+const (
+	ocspRequestTimeout = 10 * time.Second
+	ocspRetryInterval  = 5 * time.Minute
+	ocspMinInterval    = time.Minute
+)
+
+// Periodically obtains OCSP response for the given certificate from
+// the responder mentioned in the certificate and staples it to the certificate.
+//
+// Certificates without OCSP responder or without issuer certificate
+// in the chain are skipped.
+func staplerOCSP(c *tlsCertificate) {
+	cert := c.get()
+	if len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		logMessage("OCSP stapling is disabled for certificate [%s]: missing OCSP responder or issuer certificate", c.certFile)
+		return
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		logMessage("OCSP stapling is disabled for certificate [%s]: cannot parse issuer certificate: [%s]", c.certFile, err)
+		return
+	}
+	for {
+		interval := ocspRetryInterval
+		resp, raw, err := fetchOCSPResponse(cert.Leaf, issuer)
+		if err != nil {
+			logMessage("Cannot obtain OCSP response for certificate [%s]: [%s]", c.certFile, err)
+		} else if resp.Status != ocsp.Good {
+			logMessage("Unexpected OCSP status=[%d] for certificate [%s]", resp.Status, c.certFile)
+		} else {
+			newCert := *cert
+			newCert.OCSPStaple = raw
+			c.set(&newCert)
+			if !resp.NextUpdate.IsZero() {
+				// Refresh the response in the middle of its validity period.
+				interval = resp.NextUpdate.Sub(time.Now()) / 2
+				if interval < ocspMinInterval {
+					interval = ocspMinInterval
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func fetchOCSPResponse(leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	reqBody, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(leaf.OCSPServer[0])
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/ocsp-request")
+	req.SetBody(reqBody)
+	if err = fasthttp.DoTimeout(req, resp, ocspRequestTimeout); err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected response status code from OCSP responder [%s]: %d", leaf.OCSPServer[0], resp.StatusCode())
+	}
+	raw := append([]byte(nil), resp.Body()...)
+	ocspResp, err := ocsp.ParseResponse(raw, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ocspResp, raw, nil
+}
+
+// The number of session ticket keys to keep. Tickets encrypted with
+// older keys are rejected, so clients must perform full handshake.
+const sessionTicketKeysCount = 3
+
+// Rotates session ticket keys for c on every interval, so a compromised key
+// may be used for decrypting only a limited number of sessions.
+func sessionTicketKeysRotator(c *tls.Config, interval time.Duration) {
+	var keys [][32]byte
+	for {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			logFatal("Cannot generate session ticket key: [%s]", err)
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > sessionTicketKeysCount {
+			keys = keys[:sessionTicketKeysCount]
+		}
+		c.SetSessionTicketKeys(keys)
+		time.Sleep(interval)
+	}
+}
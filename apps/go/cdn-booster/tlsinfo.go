@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	forwardTLSInfo = flag.Bool("forwardTLSInfo", false, "Whether to forward TLS termination info to upstream. "+
+		"X-Forwarded-Proto header is set to http or https depending on the client connection. Requests received over https additionally get "+
+		"X-Forwarded-TLS-Version and X-Forwarded-TLS-Cipher headers with the negotiated TLS version and cipher suite, and "+
+		"X-Forwarded-TLS-Client-Subject header with the subject of the client certificate if the client presented it. See httpsClientCAFile. "+
+		"These headers from clients are always dropped, so they cannot be spoofed. Responses are cached separately for http and https requests, "+
+		"since upstream may return distinct responses for them. Requests with client certificate subject bypass the cache, since upstream may "+
+		"return per-client responses for them")
+)
+
+const (
+	forwardedProtoHeader            = "X-Forwarded-Proto"
+	forwardedTLSVersionHeader       = "X-Forwarded-TLS-Version"
+	forwardedTLSCipherHeader        = "X-Forwarded-TLS-Cipher"
+	forwardedTLSClientSubjectHeader = "X-Forwarded-TLS-Client-Subject"
+)
+
+var tlsInfoHeaders = []string{
+	forwardedProtoHeader,
+	forwardedTLSVersionHeader,
+	forwardedTLSCipherHeader,
+	forwardedTLSClientSubjectHeader,
+}
+
+// Replaces TLS info headers in the client request with the info
+// for the client connection.
+//
+// The headers are stored in the client request, so they may be forwarded
+// to upstream via forwardTLSInfoHeaders() like request ids.
+func setupTLSInfo(ctx *fasthttp.RequestCtx) {
+	if !*forwardTLSInfo {
+		return
+	}
+	h := &ctx.Request.Header
+	for _, k := range tlsInfoHeaders {
+		h.Del(k)
+	}
+	state := ctx.TLSConnectionState()
+	if !ctx.IsTLS() || state == nil {
+		h.Set(forwardedProtoHeader, "http")
+		return
+	}
+	h.Set(forwardedProtoHeader, "https")
+	h.Set(forwardedTLSVersionHeader, tlsVersionName(state.Version))
+	h.Set(forwardedTLSCipherHeader, tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) > 0 {
+		h.Set(forwardedTLSClientSubjectHeader, state.PeerCertificates[0].Subject.String())
+	}
+}
+
+// Appends the client connection protocol to the cache key
+// if forwardTLSInfo is set.
+//
+// Keys for http requests aren't modified, so cached items remain valid
+// after enabling forwardTLSInfo.
+func appendTLSInfoVariant(key []byte, h *fasthttp.RequestHeader) []byte {
+	if !*forwardTLSInfo {
+		return key
+	}
+	proto := h.Peek(forwardedProtoHeader)
+	if len(proto) == 0 || string(proto) == "http" {
+		return key
+	}
+	// '#' cannot occur in request uri, so variant keys don't clash
+	// with keys for other objects.
+	key = append(key, "#proto="...)
+	return append(key, proto...)
+}
+
+// Returns true if the client certificate subject is forwarded
+// to upstream for the request with the given header.
+//
+// Such requests must bypass the cache, since upstream may return
+// distinct responses for distinct clients.
+func hasForwardedClientSubject(h *fasthttp.RequestHeader) bool {
+	return *forwardTLSInfo && len(h.Peek(forwardedTLSClientSubjectHeader)) > 0
+}
+
+func forwardTLSInfoHeaders(h, upstreamHeader *fasthttp.RequestHeader) {
+	if !*forwardTLSInfo {
+		return
+	}
+	for _, k := range tlsInfoHeaders {
+		if v := h.Peek(k); len(v) > 0 {
+			upstreamHeader.SetBytesV(k, v)
+		}
+	}
+}
+
+// Returns TLS version name in the form used by popular web servers
+// such as nginx.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return "unknown"
+	}
+}
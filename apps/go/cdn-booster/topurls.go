@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	topUrlsCount      = flag.Int("topUrlsCount", 0, "The number of the hottest urls and the biggest bandwidth consumers to track. The report is available on the stats page and at /top admin API endpoint. Leave zero for disabling tracking")
+	topUrlsSketchSize = flag.Int("topUrlsSketchSize", 64*1024, "The number of counters per row in the frequency sketch used for tracking top urls. Higher values improve accuracy at the cost of higher memory usage")
+)
+
+// Tracks urls with the highest approximate counts.
+//
+// Counts are estimated by count-min sketch, while the top urls are kept
+// in a min-heap, so memory usage doesn't depend on the number of urls.
+type topTracker struct {
+	mu      sync.Mutex
+	rows    [sketchDepth][]uint64
+	top     topHeap
+	entries map[string]*topEntry
+	maxSize int
+}
+
+type topEntry struct {
+	url   string
+	count uint64
+	index int
+}
+
+var (
+	topHits  *topTracker
+	topBytes *topTracker
+)
+
+func initTopUrls() {
+	if *topUrlsCount <= 0 {
+		return
+	}
+	if *topUrlsSketchSize <= 0 {
+		logFatal("topUrlsSketchSize=%d must be positive", *topUrlsSketchSize)
+	}
+	topHits = newTopTracker(*topUrlsCount, *topUrlsSketchSize)
+	topBytes = newTopTracker(*topUrlsCount, *topUrlsSketchSize)
+	registerAdminHandler("/top", topUrlsHandler)
+}
+
+// Registers the response with the given size sent to the client.
+func registerTopUrl(url []byte, bytesSent int) {
+	if topHits == nil {
+		return
+	}
+	topHits.add(url, 1)
+	topBytes.add(url, uint64(bytesSent))
+}
+
+func newTopTracker(maxSize, sketchSize int) *topTracker {
+	t := &topTracker{
+		entries: make(map[string]*topEntry, maxSize),
+		maxSize: maxSize,
+	}
+	for i := range t.rows {
+		t.rows[i] = make([]uint64, sketchSize)
+	}
+	return t
+}
+
+func (t *topTracker) add(url []byte, delta uint64) {
+	h1, h2 := sketchHashes(url)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var count uint64
+	for i := range t.rows {
+		row := t.rows[i]
+		idx := (h1 + uint64(i)*h2) % uint64(len(row))
+		row[idx] += delta
+		if i == 0 || row[idx] < count {
+			count = row[idx]
+		}
+	}
+
+	if e, ok := t.entries[string(url)]; ok {
+		e.count = count
+		heap.Fix(&t.top, e.index)
+		return
+	}
+	if len(t.top) < t.maxSize {
+		e := &topEntry{
+			url:   string(url),
+			count: count,
+		}
+		t.entries[e.url] = e
+		heap.Push(&t.top, e)
+		return
+	}
+	if e := t.top[0]; count > e.count {
+		delete(t.entries, e.url)
+		e.url = string(url)
+		e.count = count
+		t.entries[e.url] = e
+		heap.Fix(&t.top, 0)
+	}
+}
+
+// Returns approximate count for the given url.
+func (t *topTracker) estimate(url []byte) uint64 {
+	h1, h2 := sketchHashes(url)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var count uint64
+	for i := range t.rows {
+		row := t.rows[i]
+		idx := (h1 + uint64(i)*h2) % uint64(len(row))
+		if i == 0 || row[idx] < count {
+			count = row[idx]
+		}
+	}
+	return count
+}
+
+// Returns the tracked urls ordered by count in descending order.
+func (t *topTracker) snapshot() []topEntry {
+	t.mu.Lock()
+	entries := make([]topEntry, len(t.top))
+	for i, e := range t.top {
+		entries[i] = *e
+	}
+	t.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].count > entries[j].count
+	})
+	return entries
+}
+
+// Min-heap of topEntry by count.
+type topHeap []*topEntry
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	e := x.(*topEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func writeTopUrls(w io.Writer) {
+	fmt.Fprintf(w, "Top %d hottest urls (approximate requests count):\n", *topUrlsCount)
+	for _, e := range topHits.snapshot() {
+		fmt.Fprintf(w, "%d %s\n", e.count, e.url)
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Top %d bandwidth consumers (approximate bytes sent):\n", *topUrlsCount)
+	for _, e := range topBytes.snapshot() {
+		fmt.Fprintf(w, "%d %s\n", e.count, e.url)
+	}
+}
+
+func topUrlsHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	ctx.SetContentType("text/plain")
+	writeTopUrls(ctx)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	otlpEndpoint     = flag.String("otlpEndpoint", "", "OTLP/HTTP collector address in the form 'host:port' for exporting per-request traces. Leave empty for disabling tracing")
+	otlpInsecure     = flag.Bool("otlpInsecure", false, "Whether to use plain HTTP instead of HTTPS when exporting traces to otlpEndpoint")
+	traceSampleRatio = flag.Float64("traceSampleRatio", 1.0, "The ratio of traced requests without incoming trace context. Requests with incoming 'traceparent' header follow its sampling decision")
+)
+
+// Tracer for request spans. Tracing is disabled if it is nil.
+var tracer trace.Tracer
+
+// Headers propagating trace context to the upstream as is
+// when tracing is disabled.
+var traceContextHeaders = []string{"traceparent", "tracestate"}
+
+func initTracing() {
+	if *otlpEndpoint == "" {
+		return
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(*otlpEndpoint),
+	}
+	if *otlpInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		logFatal("Cannot create OTLP exporter for otlpEndpoint=[%s]: [%s]", *otlpEndpoint, err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "go-cdn-booster"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = tp.Tracer("go-cdn-booster")
+	logMessage("Exporting traces to [%s]", *otlpEndpoint)
+}
+
+// Starts the root span for the incoming request. The span becomes a child
+// of the trace context passed in the request headers if any.
+func startRequestSpan(ctx *fasthttp.RequestCtx) (context.Context, trace.Span) {
+	if tracer == nil {
+		return context.Background(), trace.SpanFromContext(context.Background())
+	}
+	tctx := otel.GetTextMapPropagator().Extract(context.Background(), requestHeaderCarrier{&ctx.Request.Header})
+	tctx, span := tracer.Start(tctx, "cdn-booster.request", trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(
+		attribute.String("http.method", string(ctx.Method())),
+		attribute.String("http.target", string(ctx.RequestURI())),
+		attribute.String("http.host", string(ctx.Host())),
+	)
+	return tctx, span
+}
+
+// Starts a child span for the given parent context.
+// Returns no-op span if tracing is disabled.
+func startSpan(parent context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	if tracer == nil {
+		return parent, trace.SpanFromContext(context.Background())
+	}
+	return tracer.Start(parent, name, trace.WithSpanKind(kind))
+}
+
+func failSpan(span trace.Span, msg string) {
+	span.SetStatus(codes.Error, msg)
+}
+
+// Propagates trace context from the client request h
+// (or from the span in tctx if tracing is enabled) to the upstream request.
+func injectTraceContext(tctx context.Context, h, upstreamHeader *fasthttp.RequestHeader) {
+	if tracer != nil {
+		otel.GetTextMapPropagator().Inject(tctx, requestHeaderCarrier{upstreamHeader})
+		return
+	}
+	for _, k := range traceContextHeaders {
+		if v := h.Peek(k); len(v) > 0 {
+			upstreamHeader.SetBytesV(k, v)
+		}
+	}
+}
+
+// Adapts fasthttp request headers to propagation.TextMapCarrier.
+type requestHeaderCarrier struct {
+	h *fasthttp.RequestHeader
+}
+
+func (c requestHeaderCarrier) Get(key string) string {
+	return string(c.h.Peek(key))
+}
+
+func (c requestHeaderCarrier) Set(key, value string) {
+	c.h.Set(key, value)
+}
+
+func (c requestHeaderCarrier) Keys() []string {
+	var keys []string
+	c.h.VisitAll(func(k, v []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
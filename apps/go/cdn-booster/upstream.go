@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamDialTimeout         = flag.Duration("upstreamDialTimeout", 3*time.Second, "Timeout for establishing TCP connections to upstream host")
+	upstreamDisableKeepalive    = flag.Bool("upstreamDisableKeepalive", false, "Whether to close connections to upstream host after each request")
+	upstreamMaxIdleConnDuration = flag.Duration("upstreamMaxIdleConnDuration", 10*time.Second, "Idle keep-alive connections to upstream host are closed after this duration")
+	upstreamTLSHandshakeTimeout = flag.Duration("upstreamTLSHandshakeTimeout", 5*time.Second, "Timeout for TLS handshake with upstream host. Used only if upstreamProtocol is https")
+)
+
+func initUpstreamProtocol() {
+	switch *upstreamProtocol {
+	case "http", "https":
+		return
+	case "file":
+		initFileUpstream()
+	case "s3":
+		initS3Upstream()
+	case "ftp":
+		initFTPUpstream()
+	case "sftp":
+		initSFTPUpstream()
+	default:
+		logFatal("Unsupported upstreamProtocol=[%s]. Supported values: http, https, file, s3, ftp, sftp", *upstreamProtocol)
+	}
+	if *shieldHost != "" {
+		logFatal("shieldHost cannot be used with upstreamProtocol=%s. Set upstreamProtocol=%s on the shield instead", *upstreamProtocol, *upstreamProtocol)
+	}
+}
+
+// Returns true if upstream connections must use TLS.
+func upstreamUsesTLS() bool {
+	return *upstreamProtocol == "https" || (*upstreamProtocol == "s3" && !*upstreamS3DisableTLS)
+}
+
+// Returns url scheme for upstream requests.
+func upstreamScheme() string {
+	if upstreamUsesTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// Returns url for the upstream request to the given host
+// for the given client request uri.
+func upstreamRequestURL(host string, requestURI []byte) string {
+	if *upstreamProtocol == "s3" {
+		return s3ObjectURL(host, requestURI)
+	}
+	return fmt.Sprintf("%s://%s%s", upstreamScheme(), host, requestURI)
+}
+
+// Performs the request to upstream via c according to upstreamProtocol.
+func doUpstreamProtocolRequest(c *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	switch *upstreamProtocol {
+	case "file":
+		return doUpstreamFileRequest(c, req, resp)
+	case "ftp":
+		return doUpstreamFTPRequest(c, req, resp)
+	case "sftp":
+		return doUpstreamSFTPRequest(c, req, resp)
+	case "s3":
+		signS3Request(req)
+	}
+	return c.Do(req, resp)
+}
+
+// Pool of clients for upstream addresses.
+//
+// Requests are spread among the clients in round-robin manner.
+// The list of addresses may be updated on the fly via update().
+type upstreamPool struct {
+	// Contains []*fasthttp.HostClient.
+	clients atomic.Value
+	n       uint32
+
+	// Contains []*fasthttp.HostClient with streamed response bodies
+	// if streamUpstreamResponses is set.
+	streamClients atomic.Value
+
+	// Server name for TLS handshake with upstream addresses.
+	serverName string
+
+	// Serializes update() calls.
+	mu sync.Mutex
+}
+
+func newUpstreamPool(serverName string, addrs []string) *upstreamPool {
+	p := &upstreamPool{
+		serverName: serverName,
+	}
+	p.clients.Store([]*fasthttp.HostClient(nil))
+	p.streamClients.Store([]*fasthttp.HostClient(nil))
+	p.update(addrs)
+	return p
+}
+
+func (p *upstreamPool) next() *fasthttp.HostClient {
+	clients := p.clients.Load().([]*fasthttp.HostClient)
+	n := atomic.AddUint32(&p.n, 1)
+	return clients[n%uint32(len(clients))]
+}
+
+// Returns the next client, which doesn't read response bodies,
+// so they may be read via Response.BodyStream().
+func (p *upstreamPool) nextStream() *fasthttp.HostClient {
+	clients := p.streamClients.Load().([]*fasthttp.HostClient)
+	n := atomic.AddUint32(&p.n, 1)
+	return clients[n%uint32(len(clients))]
+}
+
+// Replaces pool addresses with the given addrs.
+//
+// Clients for addresses already present in the pool are preserved
+// together with their keep-alive connections. Empty addrs are ignored,
+// so the pool continues using the previous addresses.
+func (p *upstreamPool) update(addrs []string) {
+	if len(addrs) == 0 {
+		logMessage("Ignoring empty list of upstream addresses")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	oldClients := clientsByAddr(p.clients.Load().([]*fasthttp.HostClient))
+	oldStreamClients := clientsByAddr(p.streamClients.Load().([]*fasthttp.HostClient))
+	var clients, streamClients []*fasthttp.HostClient
+	for _, addr := range addrs {
+		c, ok := oldClients[addr]
+		if !ok {
+			c = newUpstreamClient(addr, p.serverName, false)
+			logMessage("Adding upstream address [%s]", addr)
+		}
+		delete(oldClients, addr)
+		clients = append(clients, c)
+
+		if *streamUpstreamResponses {
+			sc, ok := oldStreamClients[addr]
+			if !ok {
+				sc = newUpstreamClient(addr, p.serverName, true)
+			}
+			streamClients = append(streamClients, sc)
+		}
+	}
+	for addr := range oldClients {
+		logMessage("Removing upstream address [%s]", addr)
+	}
+	p.clients.Store(clients)
+	p.streamClients.Store(streamClients)
+}
+
+func clientsByAddr(clients []*fasthttp.HostClient) map[string]*fasthttp.HostClient {
+	m := make(map[string]*fasthttp.HostClient, len(clients))
+	for _, c := range clients {
+		m[c.Addr] = c
+	}
+	return m
+}
+
+func (p *upstreamPool) addrs() []string {
+	var addrs []string
+	for _, c := range p.clients.Load().([]*fasthttp.HostClient) {
+		addrs = append(addrs, c.Addr)
+	}
+	return addrs
+}
+
+func (p *upstreamPool) connsCount() int {
+	n := 0
+	for _, c := range p.clients.Load().([]*fasthttp.HostClient) {
+		n += c.ConnsCount()
+	}
+	for _, c := range p.streamClients.Load().([]*fasthttp.HostClient) {
+		n += c.ConnsCount()
+	}
+	return n
+}
+
+// Returns client for the given upstream address.
+//
+// Response bodies are read by the returned client only if streamBody is false.
+//
+// IsTLS is set so the client uses the https scheme and default port. It doesn't
+// perform TLS handshake on its own, since upstreamDial returns TLS connections.
+func newUpstreamClient(addr, serverName string, streamBody bool) *fasthttp.HostClient {
+	return &fasthttp.HostClient{
+		Addr: addr,
+		Dial: func(addr string) (net.Conn, error) {
+			return upstreamDial(addr, serverName)
+		},
+		IsTLS:               upstreamUsesTLS(),
+		MaxConns:            *maxIdleUpstreamConns,
+		MaxIdleConnDuration: *upstreamMaxIdleConnDuration,
+		MaxResponseBodySize: upstreamClientMaxBodySize(),
+		StreamResponseBody:  streamBody,
+	}
+}
+
+// Dials the upstream and performs TLS handshake with the given timeout
+// if upstreamProtocol is https.
+//
+// TLS handshake is performed here instead of HostClient, since the latter
+// doesn't limit handshake duration.
+func upstreamDial(addr, serverName string) (net.Conn, error) {
+	isTLS := upstreamUsesTLS()
+	if isTLS {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "443")
+		}
+	}
+	conn, err := dialUpstreamTCP(addr, *upstreamDialTimeout)
+	if err != nil {
+		atomic.AddInt64(&stats.UpstreamDialErrorsCount, 1)
+		return nil, err
+	}
+	if isTLS {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         serverName,
+			ClientSessionCache: upstreamTLSSessionCache,
+		})
+		tlsConn.SetDeadline(time.Now().Add(*upstreamTLSHandshakeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			atomic.AddInt64(&stats.UpstreamDialErrorsCount, 1)
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	atomic.AddInt64(&stats.UpstreamDialsCount, 1)
+	return conn, nil
+}
+
+var upstreamTLSSessionCache = tls.NewLRUClientSessionCache(0)
+
+func doUpstreamRequest(p *upstreamPool, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if *upstreamDisableKeepalive {
+		req.SetConnectionClose()
+	}
+	if hedgeLatencies != nil {
+		if c, hedgeClient := p.nextPair(); hedgeClient != nil {
+			return doHedgedUpstreamRequest(c, hedgeClient, req, resp)
+		}
+	}
+	return doUpstreamClientRequest(p.next(), req, resp)
+}
+
+// Returns upstreamHost without port.
+func upstreamHostname() string {
+	return hostname(*upstreamHost)
+}
+
+// Returns the given 'host:port' address without port.
+func hostname(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Returns upstreamHost port or the default port for upstreamProtocol.
+func upstreamPort() string {
+	_, port, err := net.SplitHostPort(*upstreamHost)
+	if err != nil {
+		switch {
+		case *upstreamProtocol == "ftp":
+			return "21"
+		case *upstreamProtocol == "sftp":
+			return "22"
+		case upstreamUsesTLS():
+			return "443"
+		}
+		return "80"
+	}
+	return port
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Consul returns the response for blocking query after this duration
+// if the service instances didn't change.
+const consulWaitTime = 5 * time.Minute
+
+// Watches healthy instances of the service registered in Consul
+// via blocking queries.
+type consulResolver struct {
+	baseURL string
+	service string
+	index   uint64
+	client  *http.Client
+}
+
+func newConsulResolver(u string) *consulResolver {
+	baseURL, service := splitDiscoveryURL("consul", u)
+	return &consulResolver{
+		baseURL: baseURL,
+		service: service,
+		client: &http.Client{
+			Timeout: consulWaitTime + time.Minute,
+		},
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Blocks until instances change or consulWaitTime elapses,
+// so the returned ttl is always zero.
+func (r *consulResolver) Resolve() ([]string, time.Duration, error) {
+	u := fmt.Sprintf("%s/v1/health/service/%s?passing=true&wait=%ds", r.baseURL, url.PathEscape(r.service), int(consulWaitTime.Seconds()))
+	if r.index > 0 {
+		u += "&index=" + strconv.FormatUint(r.index, 10)
+	}
+	resp, err := r.client.Get(u)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status code=%d for [%s]", resp.StatusCode, u)
+	}
+	var entries []consulServiceEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("cannot parse response for [%s]: %s", u, err)
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index < r.index {
+		// Consul docs recommend resetting the index if it goes backwards.
+		index = 0
+	}
+	r.index = index
+
+	var addrs []string
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, 0, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	upstreamDNSDiscovery = flag.Bool("upstreamDNSDiscovery", false, "Whether to spread upstream requests among all the A and AAAA records for upstreamHost. DNS records are re-resolved periodically according to their TTL, so upstream IP changes are picked up without restart. This is a shortcut for upstreamResolver=dns")
+	upstreamDNSMinTTL    = flag.Duration("upstreamDNSMinTTL", 5*time.Second, "The minimum interval between DNS re-resolutions of upstream addresses")
+	upstreamDNSMaxTTL    = flag.Duration("upstreamDNSMaxTTL", 5*time.Minute, "The maximum interval between DNS re-resolutions of upstream addresses")
+	resolvConfFile       = flag.String("resolvConfFile", "/etc/resolv.conf", "Path to resolv.conf with DNS servers used for upstream discovery")
+)
+
+const dnsQueryTimeout = 5 * time.Second
+
+// Resolves host into addresses from A and AAAA records.
+type dnsResolver struct {
+	host string
+	port string
+}
+
+func (r *dnsResolver) Resolve() ([]string, time.Duration, error) {
+	addrs, ttl, err := resolveHost(r.host, r.port)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, clampDNSTTL(ttl), nil
+}
+
+// Resolves DNS SRV records for name into target addresses.
+type srvResolver struct {
+	name string
+}
+
+func (r *srvResolver) Resolve() ([]string, time.Duration, error) {
+	config, err := readDNSConfig()
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := queryDNS(config, r.name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var addrs []string
+	minTTL := *upstreamDNSMaxTTL
+	for _, rr := range answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		port := fmt.Sprintf("%d", srv.Port)
+		targetAddrs, ttl, err := resolveHost(strings.TrimSuffix(srv.Target, "."), port)
+		if err != nil {
+			logMessage("Cannot resolve SRV target [%s] for [%s]: [%s]", srv.Target, r.name, err)
+			continue
+		}
+		addrs = append(addrs, targetAddrs...)
+		if ttl < minTTL {
+			minTTL = ttl
+		}
+		if ttl = time.Duration(srv.Hdr.Ttl) * time.Second; ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no resolvable SRV records found for [%s]", r.name)
+	}
+	return addrs, clampDNSTTL(minTTL), nil
+}
+
+func clampDNSTTL(ttl time.Duration) time.Duration {
+	if ttl < *upstreamDNSMinTTL {
+		return *upstreamDNSMinTTL
+	}
+	if ttl > *upstreamDNSMaxTTL {
+		return *upstreamDNSMaxTTL
+	}
+	return ttl
+}
+
+// Returns 'ip:port' addresses for all the A and AAAA records for the given
+// host together with the minimum TTL among the records.
+func resolveHost(host, port string) ([]string, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{net.JoinHostPort(host, port)}, *upstreamDNSMaxTTL, nil
+	}
+
+	config, err := readDNSConfig()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []string
+	minTTL := *upstreamDNSMaxTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := queryDNS(config, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				// Skip CNAME and other records.
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+			if ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no A or AAAA records found for [%s]", host)
+	}
+	return addrs, minTTL, nil
+}
+
+func readDNSConfig() (*dns.ClientConfig, error) {
+	config, err := dns.ClientConfigFromFile(*resolvConfFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read DNS config from resolvConfFile=[%s]: %s", *resolvConfFile, err)
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("missing DNS servers in resolvConfFile=[%s]", *resolvConfFile)
+	}
+	return config, nil
+}
+
+// Sends DNS query to the servers from config until the first successful
+// response. Returns answer records from the response.
+func queryDNS(config *dns.ClientConfig, name string, qtype uint16) ([]dns.RR, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	c := &dns.Client{
+		Timeout: dnsQueryTimeout,
+	}
+	var lastErr error
+	for _, server := range config.Servers {
+		r, _, err := c.Exchange(m, net.JoinHostPort(server, config.Port))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("unexpected response code for [%s] from DNS server [%s]: %s", name, server, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		return r.Answer, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The maximum duration for a single etcd watch request.
+// Addresses are re-read after the timeout even if nothing changed.
+const etcdWatchTimeout = 10 * time.Minute
+
+const etcdRequestTimeout = 10 * time.Second
+
+// Watches keys with the given prefix in etcd v3 via its JSON gateway.
+// Each key value must contain a single 'host:port' address.
+type etcdResolver struct {
+	baseURL  string
+	key      string
+	rangeEnd string
+	revision int64
+	client   *http.Client
+}
+
+func newEtcdResolver(u string) *etcdResolver {
+	baseURL, prefix := splitDiscoveryURL("etcd", u)
+	prefix = "/" + prefix
+	return &etcdResolver{
+		baseURL:  baseURL,
+		key:      base64.StdEncoding.EncodeToString([]byte(prefix)),
+		rangeEnd: base64.StdEncoding.EncodeToString(etcdPrefixRangeEnd(prefix)),
+		client:   &http.Client{},
+	}
+}
+
+// Returns range end covering all the keys with the given prefix.
+func etcdPrefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix consists of 0xff bytes, so range all the keys.
+	return []byte{0}
+}
+
+// Blocks until keys change, so the returned ttl is always zero.
+func (r *etcdResolver) Resolve() ([]string, time.Duration, error) {
+	if r.revision > 0 {
+		if err := r.watch(); err != nil {
+			return nil, 0, err
+		}
+	}
+	var resp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	req := map[string]interface{}{
+		"key":       r.key,
+		"range_end": r.rangeEnd,
+	}
+	if err := r.post(context.Background(), "/v3/kv/range", req, func(d *json.Decoder) error {
+		return d.Decode(&resp)
+	}); err != nil {
+		return nil, 0, err
+	}
+	revision, err := strconv.ParseInt(resp.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot parse etcd revision [%s]: %s", resp.Header.Revision, err)
+	}
+	r.revision = revision
+
+	var addrs []string
+	for _, kv := range resp.Kvs {
+		if addr := strings.TrimSpace(string(kv.Value)); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, 0, nil
+}
+
+// Waits for changes in the watched keys after the last seen revision.
+func (r *etcdResolver) watch() error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdWatchTimeout)
+	defer cancel()
+	req := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            r.key,
+			"range_end":      r.rangeEnd,
+			"start_revision": strconv.FormatInt(r.revision+1, 10),
+		},
+	}
+	err := r.post(ctx, "/v3/watch", req, func(d *json.Decoder) error {
+		for {
+			var resp struct {
+				Result struct {
+					Events []json.RawMessage `json:"events"`
+				} `json:"result"`
+			}
+			if err := d.Decode(&resp); err != nil {
+				return err
+			}
+			if len(resp.Result.Events) > 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// Nothing changed during etcdWatchTimeout.
+		return nil
+	}
+	return err
+}
+
+func (r *etcdResolver) post(ctx context.Context, path string, req interface{}, f func(d *json.Decoder) error) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	u := r.baseURL + path
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, etcdRequestTimeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code=%d for [%s]", resp.StatusCode, u)
+	}
+	if err = f(json.NewDecoder(resp.Body)); err != nil {
+		return fmt.Errorf("cannot parse response for [%s]: %s", u, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamFileRoot = flag.String("upstreamFileRoot", "", "Directory with files served as upstream responses if upstreamProtocol is file. "+
+		"Request path '/foo/bar.jpg' is mapped to the file 'upstreamFileRoot/foo/bar.jpg'. Missing files and directories result in 404 responses")
+)
+
+func initFileUpstream() {
+	if *upstreamFileRoot == "" {
+		logFatal("upstreamFileRoot must be set if upstreamProtocol=file")
+	}
+	fi, err := os.Stat(*upstreamFileRoot)
+	if err != nil {
+		logFatal("Cannot access upstreamFileRoot=[%s]: [%s]", *upstreamFileRoot, err)
+	}
+	if !fi.IsDir() {
+		logFatal("upstreamFileRoot=[%s] must be a directory", *upstreamFileRoot)
+	}
+	logMessage("Serving upstream files from [%s]", *upstreamFileRoot)
+}
+
+// Fills resp with the contents of the file under upstreamFileRoot
+// for the request path.
+//
+// The file is passed to resp as body stream if c streams response bodies.
+// Range requests are answered with the whole file. Requests with
+// If-Modified-Since are answered with 304 if the file isn't modified since.
+func doUpstreamFileRequest(c *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	resp.Reset()
+
+	// The cleaned path cannot escape upstreamFileRoot via '..'.
+	p := path.Clean("/" + string(req.URI().Path()))
+	f, err := os.Open(filepath.Join(*upstreamFileRoot, filepath.FromSlash(p)))
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			resp.SetStatusCode(fasthttp.StatusNotFound)
+			return nil
+		}
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fi.IsDir() {
+		f.Close()
+		resp.SetStatusCode(fasthttp.StatusNotFound)
+		return nil
+	}
+	// HTTP dates have one-second resolution.
+	if t, err := fasthttp.ParseHTTPDate(req.Header.Peek("If-Modified-Since")); err == nil && fi.ModTime().Unix() <= t.Unix() {
+		f.Close()
+		resp.SetStatusCode(fasthttp.StatusNotModified)
+		resp.Header.SetLastModified(fi.ModTime())
+		return nil
+	}
+	return setUpstreamFileResponse(c, resp, p, f, int(fi.Size()), fi.ModTime())
+}
+
+// Fills resp with the file contents read from r.
+//
+// r is passed to resp as body stream if c streams response bodies,
+// otherwise it is read and closed. size may be negative if the file size
+// is unknown. Zero modTime means the modification time is unknown.
+func setUpstreamFileResponse(c *fasthttp.HostClient, resp *fasthttp.Response, p string, r io.ReadCloser, size int, modTime time.Time) error {
+	maxSize := c.MaxResponseBodySize
+	if maxSize > 0 && size > maxSize {
+		r.Close()
+		return fasthttp.ErrBodyTooLarge
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(p))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resp.SetStatusCode(fasthttp.StatusOK)
+	resp.Header.SetContentType(contentType)
+	if !modTime.IsZero() {
+		resp.Header.SetLastModified(modTime)
+	}
+	if c.StreamResponseBody {
+		// r is closed when the body stream is read or closed.
+		resp.SetBodyStream(r, size)
+		return nil
+	}
+	defer r.Close()
+	lr := io.Reader(r)
+	if maxSize > 0 {
+		lr = io.LimitReader(r, int64(maxSize)+1)
+	}
+	data, err := ioutil.ReadAll(lr)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && len(data) > maxSize {
+		return fasthttp.ErrBodyTooLarge
+	}
+	resp.SetBody(data)
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDoUpstreamFileRequest_IfModifiedSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdn-booster-upstream-file")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: [%s]", err)
+	}
+	defer os.RemoveAll(dir)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileName := filepath.Join(dir, "foo.txt")
+	if err := ioutil.WriteFile(fileName, []byte("foobar"), 0644); err != nil {
+		t.Fatalf("Cannot write test file: [%s]", err)
+	}
+	if err := os.Chtimes(fileName, modTime, modTime.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("Cannot set test file times: [%s]", err)
+	}
+
+	root := *upstreamFileRoot
+	defer func() {
+		*upstreamFileRoot = root
+	}()
+	*upstreamFileRoot = dir
+
+	var c fasthttp.HostClient
+	testRequest := func(ifModifiedSince string, expectedStatusCode int, expectedBody string) {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://upstream/foo.txt")
+		if ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+		if err := doUpstreamFileRequest(&c, &req, &resp); err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if resp.StatusCode() != expectedStatusCode {
+			t.Fatalf("Unexpected status code=%d for If-Modified-Since=[%s]. Expected %d", resp.StatusCode(), ifModifiedSince, expectedStatusCode)
+		}
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("Unexpected body=[%s] for If-Modified-Since=[%s]. Expected [%s]", resp.Body(), ifModifiedSince, expectedBody)
+		}
+		if lm := string(resp.Header.Peek("Last-Modified")); lm != "Thu, 02 Jan 2020 03:04:05 GMT" {
+			t.Fatalf("Unexpected Last-Modified=[%s] for If-Modified-Since=[%s]", lm, ifModifiedSince)
+		}
+	}
+
+	testRequest("", fasthttp.StatusOK, "foobar")
+	testRequest("Thu, 02 Jan 2020 03:04:04 GMT", fasthttp.StatusOK, "foobar")
+	testRequest("foobar", fasthttp.StatusOK, "foobar")
+
+	// The sub-second part of the modification time is ignored.
+	testRequest("Thu, 02 Jan 2020 03:04:05 GMT", fasthttp.StatusNotModified, "")
+	testRequest("Fri, 03 Jan 2020 00:00:00 GMT", fasthttp.StatusNotModified, "")
+}
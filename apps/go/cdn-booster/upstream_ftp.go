@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/textproto"
+	"path"
+	"sync"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamFTPUser     = flag.String("upstreamFTPUser", "anonymous", "User name for logging into upstreamHost if upstreamProtocol is ftp or sftp")
+	upstreamFTPPassword = flag.String("upstreamFTPPassword", "", "Password for upstreamFTPUser. May be empty for sftp if upstreamSFTPKeyFile is set")
+	upstreamFTPRoot     = flag.String("upstreamFTPRoot", "/", "Directory on upstreamHost with files served if upstreamProtocol is ftp or sftp. "+
+		"Request path '/foo/bar.jpg' is mapped to the file 'upstreamFTPRoot/foo/bar.jpg'. Missing files result in 404 responses")
+	upstreamFTPMaxIdleConns = flag.Int("upstreamFTPMaxIdleConns", 10, "The maximum number of idle connections per upstream address if upstreamProtocol is ftp. "+
+		"FTP connections transfer a single file at a time, so the number of open connections may exceed this limit under load")
+)
+
+func initFTPUpstream() {
+	if *upstreamFTPMaxIdleConns < 0 {
+		logFatal("upstreamFTPMaxIdleConns=%d cannot be negative", *upstreamFTPMaxIdleConns)
+	}
+	logMessage("Fetching upstream files from ftp://%s%s", *upstreamHost, *upstreamFTPRoot)
+}
+
+// Returns the path on FTP or SFTP server for the given request.
+func upstreamFTPPath(req *fasthttp.Request) string {
+	// The cleaned path cannot escape upstreamFTPRoot via '..'.
+	return path.Join(*upstreamFTPRoot, path.Clean("/"+string(req.URI().Path())))
+}
+
+// Pool of logged in connections to FTP server.
+type ftpConnPool struct {
+	addr  string
+	conns chan *ftp.ServerConn
+}
+
+var (
+	ftpConnPools     = make(map[string]*ftpConnPool)
+	ftpConnPoolsLock sync.Mutex
+)
+
+func getFTPConnPool(addr string) *ftpConnPool {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "21")
+	}
+	ftpConnPoolsLock.Lock()
+	defer ftpConnPoolsLock.Unlock()
+	p, ok := ftpConnPools[addr]
+	if !ok {
+		p = &ftpConnPool{
+			addr:  addr,
+			conns: make(chan *ftp.ServerConn, *upstreamFTPMaxIdleConns),
+		}
+		ftpConnPools[addr] = p
+	}
+	return p
+}
+
+// Returns idle connection from the pool or a new connection.
+//
+// The second returned value is true for idle connections,
+// which may be already closed by the server.
+func (p *ftpConnPool) get() (*ftp.ServerConn, bool, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, true, nil
+	default:
+	}
+	conn, err := p.dial()
+	return conn, false, err
+}
+
+func (p *ftpConnPool) dial() (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(p.addr, ftp.DialWithDialFunc(func(network, addr string) (net.Conn, error) {
+		// Data connections are dialed via this func too.
+		return dialUpstreamTCP(addr, *upstreamDialTimeout)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Login(*upstreamFTPUser, *upstreamFTPPassword); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *ftpConnPool) put(conn *ftp.ServerConn) {
+	select {
+	case p.conns <- conn:
+	default:
+		conn.Quit()
+	}
+}
+
+// Body of the file retrieved from FTP server.
+//
+// The connection is returned to the pool when the body is closed.
+type ftpBody struct {
+	*ftp.Response
+	pool *ftpConnPool
+	conn *ftp.ServerConn
+}
+
+func (b *ftpBody) Close() error {
+	err := b.Response.Close()
+	if err != nil {
+		b.conn.Quit()
+		return err
+	}
+	b.pool.put(b.conn)
+	return nil
+}
+
+// Fills resp with the file for the request path from FTP server at c.Addr.
+func doUpstreamFTPRequest(c *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	resp.Reset()
+	p := upstreamFTPPath(req)
+	pool := getFTPConnPool(c.Addr)
+	conn, idle, err := pool.get()
+	if err != nil {
+		return err
+	}
+	if idle && conn.NoOp() != nil {
+		// The idle connection has been closed by the server.
+		conn.Quit()
+		if conn, err = pool.dial(); err != nil {
+			return err
+		}
+	}
+
+	size := -1
+	if n, err := conn.FileSize(p); err == nil {
+		size = int(n)
+	}
+	// Modification time is optional, since not all the servers support MDTM.
+	modTime, _ := conn.GetTime(p)
+	r, err := conn.Retr(p)
+	if err != nil {
+		if isFTPFileUnavailableError(err) {
+			pool.put(conn)
+			resp.SetStatusCode(fasthttp.StatusNotFound)
+			return nil
+		}
+		conn.Quit()
+		return err
+	}
+	body := &ftpBody{
+		Response: r,
+		pool:     pool,
+		conn:     conn,
+	}
+	return setUpstreamFileResponse(c, resp, p, body, size, modTime)
+}
+
+func isFTPFileUnavailableError(err error) bool {
+	e, ok := err.(*textproto.Error)
+	return ok && e.Code == ftp.StatusFileUnavailable
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+var (
+	upstreamResolver = flag.String("upstreamResolver", "", "Source of upstream addresses. Requests are spread among the obtained addresses. Supported values:\n"+
+		"\t'' - use upstreamHost\n"+
+		"\t'static:host1:port1,...,hostN:portN' - static list of addresses\n"+
+		"\t'dns' - A and AAAA records for upstreamHost\n"+
+		"\t'srv:_service._proto.name' - DNS SRV records\n"+
+		"\t'consul:http://consul-host:8500/service' - healthy instances of the given service registered in Consul\n"+
+		"\t'etcd:http://etcd-host:2379/prefix' - values of etcd v3 keys starting with '/prefix'. Each value must contain a single 'host:port' address")
+	upstreamResolverRetryInterval = flag.Duration("upstreamResolverRetryInterval", 5*time.Second, "Interval between attempts to obtain upstream addresses after upstreamResolver errors")
+)
+
+// UpstreamResolver obtains upstream addresses.
+type UpstreamResolver interface {
+	// Resolve returns upstream addresses in the form 'host:port'
+	// together with the duration after which addresses must be re-resolved.
+	//
+	// Resolvers based on watches may block in Resolve until addresses change
+	// and return zero duration.
+	Resolve() (addrs []string, ttl time.Duration, err error)
+}
+
+// Returns resolver for upstreamResolver and upstreamDNSDiscovery flags
+// or nil if upstream addresses don't need discovery.
+func newUpstreamResolver() UpstreamResolver {
+	spec := *upstreamResolver
+	if spec == "" && *upstreamDNSDiscovery {
+		spec = "dns"
+	}
+	if spec == "" {
+		return nil
+	}
+	kind := spec
+	var arg string
+	if n := strings.Index(spec, ":"); n >= 0 {
+		kind = spec[:n]
+		arg = spec[n+1:]
+	}
+	switch kind {
+	case "static":
+		return newStaticResolver(arg)
+	case "dns":
+		return &dnsResolver{
+			host: upstreamHostname(),
+			port: upstreamPort(),
+		}
+	case "srv":
+		return &srvResolver{
+			name: arg,
+		}
+	case "consul":
+		return newConsulResolver(arg)
+	case "etcd":
+		return newEtcdResolver(arg)
+	}
+	logFatal("Unsupported upstreamResolver=[%s]", spec)
+	return nil
+}
+
+// Obtains addresses from r, updates pool with them and starts updating
+// the pool in background.
+func startUpstreamDiscovery(pool *upstreamPool, r UpstreamResolver) {
+	addrs, ttl, err := r.Resolve()
+	if err != nil {
+		logFatal("Cannot obtain upstream addresses from upstreamResolver=[%s]: [%s]", *upstreamResolver, err)
+	}
+	pool.update(addrs)
+	go func() {
+		for {
+			time.Sleep(ttl)
+			addrs, ttl, err = r.Resolve()
+			if err != nil {
+				logMessage("Cannot obtain upstream addresses: [%s]. Using the previous addresses", err)
+				ttl = *upstreamResolverRetryInterval
+				continue
+			}
+			pool.update(addrs)
+		}
+	}()
+}
+
+// Returns the same list of addresses forever.
+type staticResolver struct {
+	addrs []string
+}
+
+func newStaticResolver(list string) *staticResolver {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		logFatal("Static upstreamResolver must contain at least one address")
+	}
+	return &staticResolver{
+		addrs: addrs,
+	}
+}
+
+// The list of addresses never changes, so re-resolution interval
+// may be arbitrary large.
+const staticResolverTTL = 24 * time.Hour
+
+func (r *staticResolver) Resolve() ([]string, time.Duration, error) {
+	return r.addrs, staticResolverTTL, nil
+}
+
+// Splits 'http://host:port/path' into base url and path without leading slash.
+func splitDiscoveryURL(kind, u string) (string, string) {
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		logFatal("Unexpected %s url=[%s]. Expected 'http://host:port/path'", kind, u)
+	}
+	n := strings.Index(u, "://")
+	m := strings.Index(u[n+3:], "/")
+	if m < 0 || m+n+4 == len(u) {
+		logFatal("Missing path in %s url=[%s]", kind, u)
+	}
+	m += n + 3
+	return u[:m], u[m+1:]
+}
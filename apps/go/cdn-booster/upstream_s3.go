@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	upstreamS3Bucket = flag.String("upstreamS3Bucket", "", "S3 bucket to fetch objects from if upstreamProtocol is s3. upstreamHost must contain S3 endpoint, for instance, 's3.eu-west-1.amazonaws.com' or 'minio-host:9000'. "+
+		"Request path '/foo/bar.jpg' is mapped to the object 'foo/bar.jpg' in the bucket. Query strings aren't sent to S3")
+	upstreamS3Region          = flag.String("upstreamS3Region", "us-east-1", "Region of upstreamS3Bucket used for signing S3 requests")
+	upstreamS3AccessKeyID     = flag.String("upstreamS3AccessKeyID", "", "Access key id for upstreamS3Bucket. Read from AWS_ACCESS_KEY_ID environment variable if empty")
+	upstreamS3SecretAccessKey = flag.String("upstreamS3SecretAccessKey", "", "Secret access key for upstreamS3Bucket. Read from AWS_SECRET_ACCESS_KEY environment variable if empty")
+	upstreamS3SessionToken    = flag.String("upstreamS3SessionToken", "", "Optional session token for temporary credentials. Read from AWS_SESSION_TOKEN environment variable if empty")
+	upstreamS3DisableTLS      = flag.Bool("upstreamS3DisableTLS", false, "Whether to talk to S3 endpoint over plain http instead of https, for instance, to local S3-compatible storage")
+)
+
+const (
+	s3DateFormat      = "20060102T150405Z"
+	s3ShortDateFormat = "20060102"
+
+	// sha256 of empty request body.
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func initS3Upstream() {
+	if *upstreamS3Bucket == "" {
+		logFatal("upstreamS3Bucket must be set if upstreamProtocol=s3")
+	}
+	if strings.Contains(*upstreamS3Bucket, "/") {
+		logFatal("upstreamS3Bucket=[%s] cannot contain '/'", *upstreamS3Bucket)
+	}
+	if *upstreamS3AccessKeyID == "" {
+		*upstreamS3AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if *upstreamS3SecretAccessKey == "" {
+		*upstreamS3SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if *upstreamS3SessionToken == "" {
+		*upstreamS3SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if *upstreamS3AccessKeyID == "" || *upstreamS3SecretAccessKey == "" {
+		logFatal("S3 credentials must be set via upstreamS3AccessKeyID and upstreamS3SecretAccessKey flags or via AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+	logMessage("Fetching upstream objects from S3 bucket [%s] at [%s]", *upstreamS3Bucket, *upstreamHost)
+}
+
+// Returns url for the S3 object for the given request uri.
+//
+// Path-style urls are used, since they work with S3-compatible storages
+// and with buckets containing dots.
+func s3ObjectURL(host string, requestURI []byte) string {
+	var u fasthttp.URI
+	u.Parse(nil, requestURI)
+	return fmt.Sprintf("%s://%s%s", upstreamScheme(), host, s3EscapePath("/"+*upstreamS3Bucket+string(u.Path())))
+}
+
+// Signs the request to S3 with AWS signature version 4.
+//
+// The request must be signed before each attempt, since the signature
+// is valid only for a limited time.
+func signS3Request(req *fasthttp.Request) {
+	// The path is sent as is, so it matches the signed path.
+	req.URI().DisablePathNormalizing = true
+
+	now := time.Now().UTC()
+	date := now.Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URI().Host(), s3EmptyPayloadHash, date)
+	if *upstreamS3SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", *upstreamS3SessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + *upstreamS3SessionToken + "\n"
+	}
+
+	canonicalRequest := s3CanonicalRequest(s3EscapePath(string(req.URI().Path())), canonicalHeaders, signedHeaders)
+	scope, signature := s3Signature(canonicalRequest, now, *upstreamS3Region, "s3", *upstreamS3SecretAccessKey)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		*upstreamS3AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Returns canonical request for GET request with the given escaped path,
+// empty query string and empty body.
+//
+// canonicalHeaders must contain lowercase 'name:value\n' lines sorted
+// by name, while signedHeaders must contain their names delimited by ';'.
+func s3CanonicalRequest(escapedPath, canonicalHeaders, signedHeaders string) string {
+	// Query string is always empty, since it isn't sent to S3.
+	return strings.Join([]string{
+		"GET",
+		escapedPath,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+}
+
+// Returns credential scope and AWS signature version 4 for the canonical
+// request made at t.
+func s3Signature(canonicalRequest string, t time.Time, region, service, secretKey string) (scope, signature string) {
+	shortDate := t.Format(s3ShortDateFormat)
+	scope = shortDate + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format(s3DateFormat) + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), shortDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Escapes the given path according to S3 rules, i.e. all the bytes
+// except unreserved chars and '/' are percent-encoded.
+func s3EscapePath(p string) string {
+	var b []byte
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if isS3UnreservedChar(c) || c == '/' {
+			b = append(b, c)
+			continue
+		}
+		b = append(b, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+	}
+	return string(b)
+}
+
+func isS3UnreservedChar(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	upstreamSFTPKeyFile        = flag.String("upstreamSFTPKeyFile", "", "Path to private key file in PEM format for logging into upstreamHost as upstreamFTPUser if upstreamProtocol is sftp")
+	upstreamSFTPKnownHostsFile = flag.String("upstreamSFTPKnownHostsFile", "", "Path to known_hosts file with upstreamHost keys if upstreamProtocol is sftp. "+
+		"Connections to hosts with unknown keys are rejected")
+)
+
+var sftpClientConfig *ssh.ClientConfig
+
+func initSFTPUpstream() {
+	if *upstreamSFTPKnownHostsFile == "" {
+		logFatal("upstreamSFTPKnownHostsFile must be set if upstreamProtocol=sftp")
+	}
+	hostKeyCallback, err := knownhosts.New(*upstreamSFTPKnownHostsFile)
+	if err != nil {
+		logFatal("Cannot read upstreamSFTPKnownHostsFile=[%s]: [%s]", *upstreamSFTPKnownHostsFile, err)
+	}
+	var auth []ssh.AuthMethod
+	if *upstreamSFTPKeyFile != "" {
+		data, err := ioutil.ReadFile(*upstreamSFTPKeyFile)
+		if err != nil {
+			logFatal("Cannot read upstreamSFTPKeyFile=[%s]: [%s]", *upstreamSFTPKeyFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			logFatal("Cannot parse private key from upstreamSFTPKeyFile=[%s]: [%s]", *upstreamSFTPKeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if *upstreamFTPPassword != "" {
+		auth = append(auth, ssh.Password(*upstreamFTPPassword))
+	}
+	if len(auth) == 0 {
+		logFatal("Either upstreamSFTPKeyFile or upstreamFTPPassword must be set if upstreamProtocol=sftp")
+	}
+	sftpClientConfig = &ssh.ClientConfig{
+		User:            *upstreamFTPUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         *upstreamDialTimeout,
+	}
+	logMessage("Fetching upstream files from sftp://%s%s", *upstreamHost, *upstreamFTPRoot)
+}
+
+// SFTP client together with the underlying SSH connection.
+type sftpConn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *sftpConn) close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+// SFTP connections keyed by upstream address.
+//
+// A single connection per address is enough, since SFTP multiplexes
+// concurrent requests over a single connection.
+var (
+	sftpConns     = make(map[string]*sftpConn)
+	sftpConnsLock sync.Mutex
+)
+
+// Returns the connection for the given addr, establishing it if needed.
+//
+// The connection is established without holding sftpConnsLock, so a slow
+// or unreachable server doesn't block requests to other addresses.
+// Concurrently established connections to the same addr are closed except
+// the first installed one.
+func getSFTPConn(addr string) (*sftpConn, error) {
+	sftpConnsLock.Lock()
+	c, ok := sftpConns[addr]
+	sftpConnsLock.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	newC, err := dialSFTPConn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sftpConnsLock.Lock()
+	c, ok = sftpConns[addr]
+	if !ok {
+		sftpConns[addr] = newC
+	}
+	sftpConnsLock.Unlock()
+	if ok {
+		newC.close()
+		return c, nil
+	}
+	return newC, nil
+}
+
+func dialSFTPConn(addr string) (*sftpConn, error) {
+	dialAddr := addr
+	if _, _, err := net.SplitHostPort(dialAddr); err != nil {
+		dialAddr = net.JoinHostPort(dialAddr, "22")
+	}
+	conn, err := dialUpstreamTCP(dialAddr, *upstreamDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// ssh.ClientConfig.Timeout doesn't limit handshake duration
+	// for already established connections.
+	conn.SetDeadline(time.Now().Add(*upstreamDialTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, dialAddr, sftpClientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpConn{
+		ssh:  sshClient,
+		sftp: sftpClient,
+	}, nil
+}
+
+// Closes the connection for the given addr, so the next request
+// establishes a new connection.
+func dropSFTPConn(addr string, c *sftpConn) {
+	sftpConnsLock.Lock()
+	if sftpConns[addr] == c {
+		delete(sftpConns, addr)
+	}
+	sftpConnsLock.Unlock()
+	c.close()
+}
+
+// Fills resp with the file for the request path from SFTP server at c.Addr.
+func doUpstreamSFTPRequest(c *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) error {
+	resp.Reset()
+	p := upstreamFTPPath(req)
+	sc, err := getSFTPConn(c.Addr)
+	if err != nil {
+		return err
+	}
+	f, err := sc.sftp.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			resp.SetStatusCode(fasthttp.StatusNotFound)
+			return nil
+		}
+		dropSFTPConn(c.Addr, sc)
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		dropSFTPConn(c.Addr, sc)
+		return err
+	}
+	if fi.IsDir() {
+		f.Close()
+		resp.SetStatusCode(fasthttp.StatusNotFound)
+		return nil
+	}
+	return setUpstreamFileResponse(c, resp, p, f, int(fi.Size()), fi.ModTime())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	maxUpstreamResponseSize = flag.Int("maxUpstreamResponseSize", 0, "The maximum size in bytes of upstream response body, which may be cached. "+
+		"Bigger responses are never cached, so a single huge file cannot flood the cache. See oversizedResponsePassthrough. Leave zero for disabling the limit")
+	oversizedResponsePassthrough = flag.Bool("oversizedResponsePassthrough", true, "Whether to pass upstream responses exceeding maxUpstreamResponseSize to clients without caching. "+
+		"Otherwise reading of such responses from upstream is aborted as soon as the limit is exceeded and clients receive 503 Service Unavailable")
+)
+
+var errUpstreamResponseTooLarge = errors.New("upstream response size exceeds maxUpstreamResponseSize")
+
+// Returns the limit for response bodies read by upstream clients.
+//
+// Reading is aborted with fasthttp.ErrBodyTooLarge when the limit
+// is exceeded, so oversized responses aren't buffered in memory
+// if they cannot be passed through to clients.
+func upstreamClientMaxBodySize() int {
+	if *oversizedResponsePassthrough {
+		return 0
+	}
+	return *maxUpstreamResponseSize
+}
+
+// Returns true if the upstream response of the given size exceeds
+// maxUpstreamResponseSize.
+func isOversizedUpstreamResponse(size int) bool {
+	return *maxUpstreamResponseSize > 0 && size > *maxUpstreamResponseSize
+}
+
+// Returns true if err means the upstream response has been aborted
+// due to maxUpstreamResponseSize.
+func isUpstreamResponseTooLargeError(err error) bool {
+	return err == errUpstreamResponseTooLarge || err == fasthttp.ErrBodyTooLarge
+}
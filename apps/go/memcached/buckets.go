@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	bucketsFile = flag.String("bucketsFile", "", "Path to file with virtual buckets, which allow sharing the server among multiple teams. Each bucket has its own cache with distinct items count and size quotas. "+
+		"See README for the file format. Leave empty for disabling buckets")
+	bucketKeyDelimiter = flag.String("bucketKeyDelimiter", ":", "Delimiter between bucket name and key. Keys starting with bucket name followed by the delimiter are stored in the corresponding bucket. See bucketsFile")
+)
+
+// Virtual bucket with its own cache.
+//
+// Bucket quotas are enforced by the cache capacity, i.e. the oldest items
+// in the bucket are evicted when the bucket is full.
+type bucket struct {
+	ybc.Cacher
+
+	name     string
+	password string
+
+	maxItemsCount uint64
+
+	// Bucket cache size in Megabytes.
+	cacheSize uint64
+
+	stats bucketStats
+}
+
+// Per-bucket statistics. All the counters are cumulative.
+type bucketStats struct {
+	GetHits   uint64
+	GetMisses uint64
+	Sets      uint64
+	SetBytes  uint64
+	Deletes   uint64
+}
+
+var (
+	// Buckets in the order they are defined in bucketsFile.
+	buckets       []*bucket
+	bucketsByName map[string]*bucket
+
+	// Whether connections must authenticate with bucket name and password
+	// instead of selecting buckets via key prefix.
+	bucketsRequireAuth bool
+
+	// bucketKeyDelimiter as byte slice.
+	bucketKeyDelimiterBytes []byte
+)
+
+var validBucketName = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// Opens caches for buckets defined in bucketsFile.
+//
+// Bucket caches inherit all the settings from config except quotas.
+func openBuckets(config ybc.Config) {
+	if *bucketsFile == "" {
+		return
+	}
+	if *bucketKeyDelimiter == "" {
+		log.Fatalf("bucketKeyDelimiter cannot be empty")
+	}
+	bucketKeyDelimiterBytes = []byte(*bucketKeyDelimiter)
+	f, err := os.Open(*bucketsFile)
+	if err != nil {
+		log.Fatalf("Cannot open bucketsFile=[%s]: [%s]", *bucketsFile, err)
+	}
+	buckets, err = parseBuckets(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Cannot parse bucketsFile=[%s]: [%s]", *bucketsFile, err)
+	}
+
+	bucketsByName = make(map[string]*bucket, len(buckets))
+	for _, b := range buckets {
+		bucketsByName[b.name] = b
+		cfg := config
+		cfg.MaxItemsCount = ybc.SizeT(b.maxItemsCount)
+		cfg.DataFileSize = ybc.SizeT(b.cacheSize) * ybc.SizeT(1024*1024)
+		b.Cacher = openCache(cfg, ".bucket-"+b.name)
+	}
+	bucketsRequireAuth = buckets[0].password != ""
+
+	expvar.Publish("memcached_buckets", expvar.Func(func() interface{} {
+		m := make(map[string]bucketStats, len(buckets))
+		for _, b := range buckets {
+			m[b.name] = b.Stats()
+		}
+		return m
+	}))
+	log.Printf("Opened %d buckets from bucketsFile=[%s]", len(buckets), *bucketsFile)
+}
+
+// Parses bucket definitions.
+//
+// Each line contains bucket name, the maximum number of items in the bucket,
+// the bucket size in Megabytes and optional password delimited by whitespace.
+// Empty lines and lines starting with # are ignored.
+func parseBuckets(r io.Reader) ([]*bucket, error) {
+	var bs []*bucket
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: unexpected number of fields in [%s]. Expected 'name maxItemsCount cacheSize [password]'", lineNum, line)
+		}
+		b := &bucket{
+			name: fields[0],
+		}
+		if !validBucketName.MatchString(b.name) {
+			return nil, fmt.Errorf("line %d: invalid bucket name [%s]. It may contain only letters, digits, underscores and dashes", lineNum, b.name)
+		}
+		if names[b.name] {
+			return nil, fmt.Errorf("line %d: duplicate bucket name [%s]", lineNum, b.name)
+		}
+		names[b.name] = true
+		var err error
+		if b.maxItemsCount, err = strconv.ParseUint(fields[1], 10, 64); err != nil || b.maxItemsCount == 0 {
+			return nil, fmt.Errorf("line %d: invalid maxItemsCount=[%s] for bucket [%s]", lineNum, fields[1], b.name)
+		}
+		if b.cacheSize, err = strconv.ParseUint(fields[2], 10, 64); err != nil || b.cacheSize == 0 {
+			return nil, fmt.Errorf("line %d: invalid cacheSize=[%s] for bucket [%s]", lineNum, fields[2], b.name)
+		}
+		if len(fields) == 4 {
+			b.password = fields[3]
+		}
+		if len(bs) > 0 && (b.password == "") != (bs[0].password == "") {
+			// Buckets without password would be either inaccessible
+			// or accessible by anyone.
+			return nil, fmt.Errorf("line %d: either all the buckets or none of them must have password", lineNum)
+		}
+		bs = append(bs, b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		return nil, fmt.Errorf("no buckets defined")
+	}
+	return bs, nil
+}
+
+// Sets up bucket selection for the server.
+//
+// Connections are bound to buckets via authentication if buckets have
+// passwords. Otherwise buckets are selected via key prefix, while keys
+// without bucket prefix are stored in s.Cache.
+func initBucketsServer(s *memcache.Server) {
+	if buckets == nil {
+		return
+	}
+	if bucketsRequireAuth {
+		s.Authenticate = authenticateBucket
+		log.Printf("Connections must authenticate with bucket name and password")
+		return
+	}
+	s.Cache = &bucketRouter{
+		defaultCache: s.Cache,
+	}
+	log.Printf("Buckets are selected via key prefix delimited by [%s]", *bucketKeyDelimiter)
+}
+
+func authenticateBucket(username, password []byte) ybc.Cacher {
+	b := bucketsByName[string(username)]
+	if b == nil {
+		log.Printf("Authentication failed: unknown bucket [%s]", username)
+		return nil
+	}
+	if subtle.ConstantTimeCompare(password, []byte(b.password)) != 1 {
+		log.Printf("Authentication failed: invalid password for bucket [%s]", b.name)
+		return nil
+	}
+	return b
+}
+
+func closeBuckets() {
+	for _, b := range buckets {
+		b.Close()
+	}
+}
+
+// Returns a snapshot of bucket statistics.
+func (b *bucket) Stats() bucketStats {
+	return bucketStats{
+		GetHits:   atomic.LoadUint64(&b.stats.GetHits),
+		GetMisses: atomic.LoadUint64(&b.stats.GetMisses),
+		Sets:      atomic.LoadUint64(&b.stats.Sets),
+		SetBytes:  atomic.LoadUint64(&b.stats.SetBytes),
+		Deletes:   atomic.LoadUint64(&b.stats.Deletes),
+	}
+}
+
+func (b *bucket) countGet(err error) {
+	if err == nil {
+		atomic.AddUint64(&b.stats.GetHits, 1)
+	} else if err == ybc.ErrCacheMiss {
+		atomic.AddUint64(&b.stats.GetMisses, 1)
+	}
+}
+
+func (b *bucket) countSet(size int) {
+	atomic.AddUint64(&b.stats.Sets, 1)
+	atomic.AddUint64(&b.stats.SetBytes, uint64(size))
+}
+
+func (b *bucket) Set(key []byte, value []byte, ttl time.Duration) error {
+	b.countSet(len(value))
+	return b.Cacher.Set(key, value, ttl)
+}
+
+func (b *bucket) Get(key []byte) ([]byte, error) {
+	value, err := b.Cacher.Get(key)
+	b.countGet(err)
+	return value, err
+}
+
+func (b *bucket) AppendGet(dst, key []byte) ([]byte, error) {
+	dst, err := b.Cacher.AppendGet(dst, key)
+	b.countGet(err)
+	return dst, err
+}
+
+func (b *bucket) Delete(key []byte) bool {
+	atomic.AddUint64(&b.stats.Deletes, 1)
+	return b.Cacher.Delete(key)
+}
+
+func (b *bucket) GetDe(key []byte, graceDuration time.Duration) ([]byte, error) {
+	value, err := b.Cacher.GetDe(key, graceDuration)
+	b.countGet(err)
+	return value, err
+}
+
+func (b *bucket) GetDeAsync(key []byte, graceDuration time.Duration) ([]byte, error) {
+	value, err := b.Cacher.GetDeAsync(key, graceDuration)
+	b.countGet(err)
+	return value, err
+}
+
+func (b *bucket) SetItem(key []byte, value []byte, ttl time.Duration) (*ybc.Item, error) {
+	b.countSet(len(value))
+	return b.Cacher.SetItem(key, value, ttl)
+}
+
+func (b *bucket) GetItem(key []byte) (*ybc.Item, error) {
+	item, err := b.Cacher.GetItem(key)
+	b.countGet(err)
+	return item, err
+}
+
+func (b *bucket) GetDeItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	item, err := b.Cacher.GetDeItem(key, graceDuration)
+	b.countGet(err)
+	return item, err
+}
+
+func (b *bucket) GetDeAsyncItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	item, err := b.Cacher.GetDeAsyncItem(key, graceDuration)
+	b.countGet(err)
+	return item, err
+}
+
+func (b *bucket) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (*ybc.SetTxn, error) {
+	b.countSet(valueSize)
+	return b.Cacher.NewSetTxn(key, valueSize, ttl)
+}
+
+// Cache, which routes keys with bucket prefix to the corresponding buckets.
+//
+// The bucket prefix is stripped from keys, so the key 'foo' in the bucket
+// 'team' is accessed via 'team:foo' key. Keys without bucket prefix
+// are routed to the default cache.
+type bucketRouter struct {
+	defaultCache ybc.Cacher
+}
+
+func (r *bucketRouter) route(key []byte) (ybc.Cacher, []byte) {
+	n := bytes.Index(key, bucketKeyDelimiterBytes)
+	if n < 0 {
+		return r.defaultCache, key
+	}
+	b := bucketsByName[string(key[:n])]
+	if b == nil {
+		return r.defaultCache, key
+	}
+	return b, key[n+len(bucketKeyDelimiterBytes):]
+}
+
+func (r *bucketRouter) Set(key []byte, value []byte, ttl time.Duration) error {
+	c, key := r.route(key)
+	return c.Set(key, value, ttl)
+}
+
+func (r *bucketRouter) Get(key []byte) ([]byte, error) {
+	c, key := r.route(key)
+	return c.Get(key)
+}
+
+func (r *bucketRouter) AppendGet(dst, key []byte) ([]byte, error) {
+	c, key := r.route(key)
+	return c.AppendGet(dst, key)
+}
+
+func (r *bucketRouter) Delete(key []byte) bool {
+	c, key := r.route(key)
+	return c.Delete(key)
+}
+
+// Clears only the default cache, so flush_all command cannot wipe out
+// buckets owned by other teams.
+func (r *bucketRouter) Clear() {
+	r.defaultCache.Clear()
+}
+
+func (r *bucketRouter) Close() error {
+	return r.defaultCache.Close()
+}
+
+func (r *bucketRouter) GetDe(key []byte, graceDuration time.Duration) ([]byte, error) {
+	c, key := r.route(key)
+	return c.GetDe(key, graceDuration)
+}
+
+func (r *bucketRouter) GetDeAsync(key []byte, graceDuration time.Duration) ([]byte, error) {
+	c, key := r.route(key)
+	return c.GetDeAsync(key, graceDuration)
+}
+
+func (r *bucketRouter) SetItem(key []byte, value []byte, ttl time.Duration) (*ybc.Item, error) {
+	c, key := r.route(key)
+	return c.SetItem(key, value, ttl)
+}
+
+func (r *bucketRouter) GetItem(key []byte) (*ybc.Item, error) {
+	c, key := r.route(key)
+	return c.GetItem(key)
+}
+
+func (r *bucketRouter) GetDeItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	c, key := r.route(key)
+	return c.GetDeItem(key, graceDuration)
+}
+
+func (r *bucketRouter) GetDeAsyncItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	c, key := r.route(key)
+	return c.GetDeAsyncItem(key, graceDuration)
+}
+
+func (r *bucketRouter) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (*ybc.SetTxn, error) {
+	c, key := r.route(key)
+	return c.NewSetTxn(key, valueSize, ttl)
+}
+
+// Writes per-bucket metrics in Prometheus text format.
+func writeBucketMetrics(w io.Writer) {
+	if buckets == nil {
+		return
+	}
+	metrics := []struct {
+		name  string
+		typ   string
+		value func(b *bucket, s *bucketStats) uint64
+	}{
+		{"memcached_bucket_get_hits_total", "counter", func(b *bucket, s *bucketStats) uint64 { return s.GetHits }},
+		{"memcached_bucket_get_misses_total", "counter", func(b *bucket, s *bucketStats) uint64 { return s.GetMisses }},
+		{"memcached_bucket_sets_total", "counter", func(b *bucket, s *bucketStats) uint64 { return s.Sets }},
+		{"memcached_bucket_set_bytes_total", "counter", func(b *bucket, s *bucketStats) uint64 { return s.SetBytes }},
+		{"memcached_bucket_deletes_total", "counter", func(b *bucket, s *bucketStats) uint64 { return s.Deletes }},
+		{"ybc_bucket_max_items_count", "gauge", func(b *bucket, s *bucketStats) uint64 { return b.maxItemsCount }},
+		{"ybc_bucket_data_file_size_bytes", "gauge", func(b *bucket, s *bucketStats) uint64 { return b.cacheSize * 1024 * 1024 }},
+	}
+	stats := make([]bucketStats, len(buckets))
+	for i, b := range buckets {
+		stats[i] = b.Stats()
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for i, b := range buckets {
+			fmt.Fprintf(w, "%s{bucket=%q} %d\n", m.name, b.name, m.value(b, &stats[i]))
+		}
+	}
+}
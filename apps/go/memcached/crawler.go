@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	crawlerInterval = flag.Duration("crawlerInterval", 0, "Interval between background scans of the cache for expired items, which still occupy cache index slots. "+
+		"Scan results are reported via 'stats crawler' command. 0 disables the crawler")
+	crawlerReclaim = flag.Bool("crawlerReclaim", false, "Whether the crawler must remove found expired items from the cache, so their index slots may be reused. See crawlerInterval")
+)
+
+// Implemented by ybc.Cache and ybc.Cluster.
+type expiredItemsScanner interface {
+	CountExpired() (itemsCount int, bytes int64)
+	RemoveExpired() (itemsCount int, bytes int64)
+}
+
+// Results of crawler scans.
+type crawlerStats struct {
+	Scans            uint64
+	LastScanTime     time.Time
+	LastScanDuration time.Duration
+
+	// Expired items found during the last scan.
+	ExpiredItems uint64
+	ExpiredBytes uint64
+
+	// Expired items removed since the start. See crawlerReclaim.
+	ReclaimedItems uint64
+	ReclaimedBytes uint64
+}
+
+type crawler struct {
+	caches []expiredItemsScanner
+
+	mu    sync.Mutex
+	stats crawlerStats
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var cacheCrawler *crawler
+
+var strCrawler = []byte("crawler")
+
+// Starts the crawler for the given cache and bucket caches.
+func startCrawler(s *memcache.Server, cache ybc.Cacher) {
+	if *crawlerInterval <= 0 {
+		return
+	}
+	c := &crawler{
+		stopCh: make(chan struct{}),
+	}
+	caches := []ybc.Cacher{cache}
+	for _, b := range buckets {
+		caches = append(caches, b.Cacher)
+	}
+	for _, cache := range caches {
+		if sc, ok := cache.(expiredItemsScanner); ok {
+			c.caches = append(c.caches, sc)
+		}
+	}
+	addStatsHandler(s, c.handleStats)
+	c.wg.Add(1)
+	go c.run()
+	cacheCrawler = c
+	log.Printf("Crawling the cache for expired items every %s", *crawlerInterval)
+}
+
+// Stops the crawler. Must be called before closing the cache.
+func stopCrawler() {
+	if cacheCrawler == nil {
+		return
+	}
+	close(cacheCrawler.stopCh)
+	cacheCrawler.wg.Wait()
+}
+
+func (c *crawler) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(*crawlerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.scan()
+		}
+	}
+}
+
+func (c *crawler) scan() {
+	startTime := time.Now()
+	var itemsCount int
+	var bytes int64
+	for _, cache := range c.caches {
+		var n int
+		var size int64
+		if *crawlerReclaim {
+			n, size = cache.RemoveExpired()
+		} else {
+			n, size = cache.CountExpired()
+		}
+		itemsCount += n
+		bytes += size
+	}
+
+	c.mu.Lock()
+	c.stats.Scans++
+	c.stats.LastScanTime = startTime
+	c.stats.LastScanDuration = time.Since(startTime)
+	c.stats.ExpiredItems = uint64(itemsCount)
+	c.stats.ExpiredBytes = uint64(bytes)
+	if *crawlerReclaim {
+		c.stats.ReclaimedItems += uint64(itemsCount)
+		c.stats.ReclaimedBytes += uint64(bytes)
+	}
+	c.mu.Unlock()
+}
+
+// Handles 'stats crawler' command.
+func (c *crawler) handleStats(args []byte, write func(name, value string)) bool {
+	if !bytes.Equal(args, strCrawler) {
+		return false
+	}
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+
+	var lastScanTime int64
+	if !stats.LastScanTime.IsZero() {
+		lastScanTime = stats.LastScanTime.Unix()
+	}
+	write("crawler_interval", strconv.FormatInt(int64(*crawlerInterval/time.Second), 10))
+	write("crawler_reclaim", strconv.FormatBool(*crawlerReclaim))
+	write("crawler_scans", strconv.FormatUint(stats.Scans, 10))
+	write("crawler_last_scan_time", strconv.FormatInt(lastScanTime, 10))
+	write("crawler_last_scan_duration_ms", strconv.FormatInt(int64(stats.LastScanDuration/time.Millisecond), 10))
+	write("crawler_expired_items", strconv.FormatUint(stats.ExpiredItems, 10))
+	write("crawler_expired_bytes", strconv.FormatUint(stats.ExpiredBytes, 10))
+	write("crawler_reclaimed_items", strconv.FormatUint(stats.ReclaimedItems, 10))
+	write("crawler_reclaimed_bytes", strconv.FormatUint(stats.ReclaimedBytes, 10))
+	return true
+}
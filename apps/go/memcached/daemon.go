@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	daemonize = flag.Bool("d", false, "Whether to run the server in background. The command returns after the background server process writes pidFile "+
+		"or after the process starts if pidFile isn't set. Logs are written to logFile")
+	logFile = flag.String("logFile", "", "Path to log file. The file is reopened on SIGHUP, so it may be rotated. Logs are written to stderr if empty")
+)
+
+// Environment variable set for the background server process started by -d.
+const daemonEnvVar = "GO_MEMCACHED_DAEMON"
+
+// Restarts the current process in background if -d is set.
+//
+// The function returns only in the background server process
+// or if -d isn't set.
+func startDaemon() {
+	if !*daemonize || os.Getenv(daemonEnvVar) != "" {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Cannot determine path to the server executable: [%s]", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnvVar+"=1")
+	if *logFile != "" {
+		// Catch panics in the log file.
+		f := openLogFile()
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+	// Detach the process from the controlling terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	if err = cmd.Start(); err != nil {
+		log.Fatalf("Cannot start the server in background: [%s]", err)
+	}
+	pid := cmd.Process.Pid
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	if *pidFile != "" {
+		// Wait until the server opens cache files, so init systems
+		// may rely on pidFile after the command returns.
+		expectedData := strconv.Itoa(pid)
+		for {
+			data, err := ioutil.ReadFile(*pidFile)
+			if err == nil && strings.TrimSpace(string(data)) == expectedData {
+				break
+			}
+			select {
+			case err := <-exited:
+				log.Fatalf("The background server process %d exited before writing pidFile=[%s]: [%v]. See logFile=[%s]", pid, *pidFile, err, *logFile)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	log.Printf("The server has been started in background with pid %d", pid)
+	os.Exit(0)
+}
+
+var (
+	logFileHandle *os.File
+	logFileLock   sync.Mutex
+)
+
+func openLogFile() *os.File {
+	f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("Cannot open logFile=[%s]: [%s]", *logFile, err)
+	}
+	return f
+}
+
+// Redirects logs to logFile if it is set.
+func initLogFile() {
+	if *logFile == "" {
+		return
+	}
+	f := openLogFile()
+	logFileLock.Lock()
+	prev := logFileHandle
+	logFileHandle = f
+	log.SetOutput(f)
+	logFileLock.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+}
+
+// Reopens logFile on SIGHUP.
+//
+// Flags from the config file are re-read by iniflags on SIGHUP,
+// so flags read at runtime such as crawlerReclaim, drainTimeout
+// and hotKeysCount are updated without restarting the server.
+func handleReloadSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Printf("Received SIGHUP. Reopening logFile=[%s]", *logFile)
+			initLogFile()
+		}
+	}()
+}
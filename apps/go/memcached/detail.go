@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	detailKeyDelimiter = flag.String("detailKeyDelimiter", ":", "Delimiter between key prefix and the rest of the key for per-prefix stats. "+
+		"Per-prefix stats are enabled via 'stats detail on' command and are obtained via 'stats detail dump' command")
+)
+
+// The maximum number of distinct key prefixes tracked by per-prefix stats.
+// Keys with new prefixes aren't counted after the limit is reached,
+// so random keys containing the delimiter cannot exhaust memory.
+const maxDetailPrefixes = 10 * 1000
+
+// Per-prefix counters. All the counters are cumulative.
+type prefixStats struct {
+	Gets    uint64
+	Hits    uint64
+	Sets    uint64
+	Deletes uint64
+}
+
+// Cache wrapper counting operations per key prefix
+// like 'stats detail' in the original memcached.
+type detailCache struct {
+	ybc.Cacher
+
+	delimiter []byte
+
+	// Non-zero if counting is enabled via 'stats detail on'.
+	enabled uint32
+
+	mu       sync.Mutex
+	prefixes map[string]*prefixStats
+}
+
+var strDetail = []byte("detail")
+
+// Wraps s.Cache for counting operations per key prefix.
+//
+// Connections bound to password-protected buckets aren't counted,
+// since they bypass s.Cache.
+func initDetailStats(s *memcache.Server) {
+	if *detailKeyDelimiter == "" {
+		log.Fatalf("detailKeyDelimiter cannot be empty")
+	}
+	c := &detailCache{
+		Cacher:    s.Cache,
+		delimiter: []byte(*detailKeyDelimiter),
+		prefixes:  make(map[string]*prefixStats),
+	}
+	s.Cache = c
+	addStatsHandler(s, c.handleStats)
+	addRawStatsHandler(s, c.handleRawStats)
+}
+
+// Handles 'stats detail on|off' commands.
+func (c *detailCache) handleStats(args []byte, write func(name, value string)) bool {
+	if !bytes.HasPrefix(args, strDetail) {
+		return false
+	}
+	switch string(bytes.TrimSpace(args[len(strDetail):])) {
+	case "on":
+		atomic.StoreUint32(&c.enabled, 1)
+		write("detail", "on")
+	case "off":
+		atomic.StoreUint32(&c.enabled, 0)
+		write("detail", "off")
+	default:
+		return false
+	}
+	return true
+}
+
+// Handles 'stats detail dump' command.
+func (c *detailCache) handleRawStats(args []byte, writeLine func(line string)) bool {
+	if !bytes.HasPrefix(args, strDetail) || string(bytes.TrimSpace(args[len(strDetail):])) != "dump" {
+		return false
+	}
+	c.dump(writeLine)
+	return true
+}
+
+// Writes per-prefix stats in the format of 'stats detail dump' command
+// of the original memcached, i.e. 'PREFIX <prefix> get <n> hit <n> set <n> del <n>'
+// lines without STAT.
+func (c *detailCache) dump(writeLine func(line string)) {
+	c.mu.Lock()
+	prefixes := make([]string, 0, len(c.prefixes))
+	stats := make(map[string]*prefixStats, len(c.prefixes))
+	for prefix, ps := range c.prefixes {
+		prefixes = append(prefixes, prefix)
+		stats[prefix] = ps
+	}
+	c.mu.Unlock()
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		ps := stats[prefix]
+		writeLine(fmt.Sprintf("PREFIX %s get %d hit %d set %d del %d", prefix,
+			atomic.LoadUint64(&ps.Gets), atomic.LoadUint64(&ps.Hits),
+			atomic.LoadUint64(&ps.Sets), atomic.LoadUint64(&ps.Deletes)))
+	}
+}
+
+// Returns stats for the key prefix.
+//
+// Returns nil if counting is disabled, the key has no prefix
+// or there are too many prefixes.
+func (c *detailCache) prefixStats(key []byte) *prefixStats {
+	if atomic.LoadUint32(&c.enabled) == 0 {
+		return nil
+	}
+	n := bytes.Index(key, c.delimiter)
+	if n < 0 {
+		return nil
+	}
+	prefix := key[:n]
+	c.mu.Lock()
+	ps := c.prefixes[string(prefix)]
+	if ps == nil && len(c.prefixes) < maxDetailPrefixes {
+		ps = &prefixStats{}
+		c.prefixes[string(prefix)] = ps
+	}
+	c.mu.Unlock()
+	return ps
+}
+
+func (c *detailCache) countGet(key []byte, err error) {
+	if ps := c.prefixStats(key); ps != nil {
+		atomic.AddUint64(&ps.Gets, 1)
+		if err == nil {
+			atomic.AddUint64(&ps.Hits, 1)
+		}
+	}
+}
+
+func (c *detailCache) countSet(key []byte) {
+	if ps := c.prefixStats(key); ps != nil {
+		atomic.AddUint64(&ps.Sets, 1)
+	}
+}
+
+func (c *detailCache) Set(key []byte, value []byte, ttl time.Duration) error {
+	c.countSet(key)
+	return c.Cacher.Set(key, value, ttl)
+}
+
+func (c *detailCache) Get(key []byte) ([]byte, error) {
+	value, err := c.Cacher.Get(key)
+	c.countGet(key, err)
+	return value, err
+}
+
+func (c *detailCache) AppendGet(dst, key []byte) ([]byte, error) {
+	dst, err := c.Cacher.AppendGet(dst, key)
+	c.countGet(key, err)
+	return dst, err
+}
+
+func (c *detailCache) Delete(key []byte) bool {
+	if ps := c.prefixStats(key); ps != nil {
+		atomic.AddUint64(&ps.Deletes, 1)
+	}
+	return c.Cacher.Delete(key)
+}
+
+func (c *detailCache) GetDe(key []byte, graceDuration time.Duration) ([]byte, error) {
+	value, err := c.Cacher.GetDe(key, graceDuration)
+	c.countGet(key, err)
+	return value, err
+}
+
+func (c *detailCache) GetDeAsync(key []byte, graceDuration time.Duration) ([]byte, error) {
+	value, err := c.Cacher.GetDeAsync(key, graceDuration)
+	c.countGet(key, err)
+	return value, err
+}
+
+func (c *detailCache) SetItem(key []byte, value []byte, ttl time.Duration) (*ybc.Item, error) {
+	c.countSet(key)
+	return c.Cacher.SetItem(key, value, ttl)
+}
+
+func (c *detailCache) GetItem(key []byte) (*ybc.Item, error) {
+	item, err := c.Cacher.GetItem(key)
+	c.countGet(key, err)
+	return item, err
+}
+
+func (c *detailCache) GetDeItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	item, err := c.Cacher.GetDeItem(key, graceDuration)
+	c.countGet(key, err)
+	return item, err
+}
+
+func (c *detailCache) GetDeAsyncItem(key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	item, err := c.Cacher.GetDeAsyncItem(key, graceDuration)
+	c.countGet(key, err)
+	return item, err
+}
+
+func (c *detailCache) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (*ybc.SetTxn, error) {
+	c.countSet(key)
+	return c.Cacher.NewSetTxn(key, valueSize, ttl)
+}
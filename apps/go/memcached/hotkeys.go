@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	hotKeysWindow     = flag.Duration("hotKeysWindow", time.Minute, "Sliding window for tracking the most frequently requested keys. Hot keys are reported via 'stats hotkeys [count]' command and via metricsListenAddr. 0 disables hot keys tracking")
+	hotKeysSampleRate = flag.Int("hotKeysSampleRate", 16, "Only every hotKeysSampleRate-th get request is tracked for finding hot keys. Lower values increase accuracy at the cost of performance. See hotKeysWindow")
+	hotKeysCount      = flag.Int("hotKeysCount", 10, "The number of hot keys to export via metricsListenAddr. See hotKeysWindow")
+)
+
+func initHotKeys(s *memcache.Server) {
+	if *hotKeysWindow <= 0 {
+		return
+	}
+	if *hotKeysSampleRate <= 0 {
+		log.Fatalf("hotKeysSampleRate=%d must be positive", *hotKeysSampleRate)
+	}
+	s.HotKeysWindow = *hotKeysWindow
+	s.HotKeysSampleRate = *hotKeysSampleRate
+}
+
+// Writes hot keys in Prometheus text format.
+func writeHotKeysMetrics(w io.Writer, s *memcache.Server) {
+	hotKeys := s.HotKeys(*hotKeysCount)
+	if hotKeys == nil {
+		return
+	}
+	fmt.Fprintf(w, "# TYPE memcached_hot_key_requests gauge\n")
+	for _, hk := range hotKeys {
+		fmt.Fprintf(w, "memcached_hot_key_requests{key=%q} %d\n", hk.Key, hk.Requests)
+	}
+}
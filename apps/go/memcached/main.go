@@ -52,6 +52,9 @@ var (
 
 func main() {
 	iniflags.Parse()
+	startDaemon()
+	initLogFile()
+	handleReloadSignals()
 
 	runtime.GOMAXPROCS(*goMaxProcs)
 
@@ -68,50 +71,121 @@ func main() {
 		SyncInterval:    syncInterval_,
 	}
 
-	var cache ybc.Cacher
-	var err error
+	listener := listenReusePort()
+	stopOldServer()
 
-	cacheFilesPath_ := strings.Split(*cacheFilesPath, ",")
-	cacheFilesCount := len(cacheFilesPath_)
 	log.Printf("Opening data files. This can take a while for the first time if files are big\n")
-	if cacheFilesCount < 2 {
-		if cacheFilesPath_[0] != "" {
-			config.DataFile = cacheFilesPath_[0] + ".go-memcached.data"
-			config.IndexFile = cacheFilesPath_[0] + ".go-memcached.index"
-		}
-		cache, err = config.OpenCache(true)
-		if err != nil {
-			log.Fatalf("Cannot open cache: [%s]", err)
-		}
-	} else if cacheFilesCount > 1 {
-		config.MaxItemsCount /= ybc.SizeT(cacheFilesCount)
-		config.DataFileSize /= ybc.SizeT(cacheFilesCount)
-		var configs ybc.ClusterConfig
-		configs = make([]*ybc.Config, cacheFilesCount)
-		for i := 0; i < cacheFilesCount; i++ {
-			cfg := config
-			cfg.DataFile = cacheFilesPath_[i] + ".go-memcached.data"
-			cfg.IndexFile = cacheFilesPath_[i] + ".go-memcached.index"
-			configs[i] = &cfg
-		}
-		cache, err = configs.OpenCluster(true)
-		if err != nil {
-			log.Fatalf("Cannot open cache cluster: [%s]", err)
-		}
-	}
-	defer cache.Close()
+	cache := openCache(config, "")
+	openBuckets(config)
 	log.Printf("Data files have been opened\n")
 
 	s := memcache.Server{
 		Cache:             cache,
 		ListenAddr:        *listenAddr,
+		Listener:          listener,
 		ReadBufferSize:    *readBufferSize,
 		WriteBufferSize:   *writeBufferSize,
 		OSReadBufferSize:  *osReadBufferSize,
 		OSWriteBufferSize: *osWriteBufferSize,
 	}
+	initBucketsServer(&s)
+	initDetailStats(&s)
+	initHotKeys(&s)
+	initProxy(&s)
+	initSlowRequestsLog(&s)
+	initSnapshots(&s)
+	startCrawler(&s, cache)
 	log.Printf("Starting the server")
-	if err := s.Serve(); err != nil {
+	s.Start()
+	writePidFile()
+	handleShutdownSignals(&s)
+	startMetricsListener(&s, cache)
+	if err := s.Wait(); err != nil && !isShuttingDown() {
 		log.Fatalf("Cannot serve traffic: [%s]", err)
 	}
+
+	// Release cache files before removing pidFile, so the new server
+	// process may open them.
+	stopProxy()
+	stopCrawler()
+	stopSnapshots()
+	cache.Close()
+	closeBuckets()
+	removePidFile()
+	log.Printf("The server has been stopped")
+}
+
+// Adds the handler for custom 'stats <args>' commands to s.
+//
+// Handlers are called in the order they were added until one of them
+// returns true.
+func addStatsHandler(s *memcache.Server, h func(args []byte, writeStat func(name, value string)) bool) {
+	prev := s.StatsHandler
+	if prev == nil {
+		s.StatsHandler = h
+		return
+	}
+	s.StatsHandler = func(args []byte, writeStat func(name, value string)) bool {
+		return prev(args, writeStat) || h(args, writeStat)
+	}
+}
+
+// Adds the handler for custom 'stats <args>' commands with responses
+// in custom format to s.
+//
+// Handlers are called in the order they were added until one of them
+// returns true.
+func addRawStatsHandler(s *memcache.Server, h func(args []byte, writeLine func(line string)) bool) {
+	prev := s.RawStatsHandler
+	if prev == nil {
+		s.RawStatsHandler = h
+		return
+	}
+	s.RawStatsHandler = func(args []byte, writeLine func(line string)) bool {
+		return prev(args, writeLine) || h(args, writeLine)
+	}
+}
+
+// Opens cache backed by files from cacheFilesPath with the given suffix.
+//
+// Opens cache cluster if cacheFilesPath contains multiple files.
+func openCache(config ybc.Config, filesSuffix string) ybc.Cacher {
+	cacheFilesPath_ := strings.Split(*cacheFilesPath, ",")
+	cacheFilesCount := len(cacheFilesPath_)
+	if cacheFilesCount < 2 {
+		if cacheFilesPath_[0] != "" {
+			config.DataFile = cacheFilesPath_[0] + filesSuffix + ".go-memcached.data"
+			config.IndexFile = cacheFilesPath_[0] + filesSuffix + ".go-memcached.index"
+		}
+		cache, err := config.OpenCache(true)
+		if err != nil {
+			log.Fatalf("Cannot open cache: [%s]", err)
+		}
+		addSnapshotSource(cache, ybc.ClusterConfig{&config}, "")
+		return cache
+	}
+
+	config.MaxItemsCount /= ybc.SizeT(cacheFilesCount)
+	config.DataFileSize /= ybc.SizeT(cacheFilesCount)
+	var configs ybc.ClusterConfig
+	configs = make([]*ybc.Config, cacheFilesCount)
+	for i := 0; i < cacheFilesCount; i++ {
+		cfg := config
+		cfg.DataFile = cacheFilesPath_[i] + filesSuffix + ".go-memcached.data"
+		cfg.IndexFile = cacheFilesPath_[i] + filesSuffix + ".go-memcached.index"
+		configs[i] = &cfg
+	}
+
+	// Keys must be distributed among cache files in the same way
+	// after restart.
+	seedFile := cacheFilesPath_[0] + filesSuffix + ".go-memcached.keyseed"
+	if err := configs.PinKeyHashSeed(seedFile); err != nil {
+		log.Fatalf("Cannot pin key hash seed to [%s]: [%s]", seedFile, err)
+	}
+	cache, err := configs.OpenCluster(true)
+	if err != nil {
+		log.Fatalf("Cannot open cache cluster: [%s]", err)
+	}
+	addSnapshotSource(cache, configs, seedFile)
+	return cache
 }
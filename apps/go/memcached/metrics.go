@@ -0,0 +1,152 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	metricsListenAddr = flag.String("metricsListenAddr", "", "TCP address for serving metrics over HTTP. Metrics in Prometheus text format are available at /metrics, expvar metrics are available at /debug/vars. Leave empty for disabling metrics listener")
+)
+
+// Server and cache for exporting metrics.
+type metricsSource struct {
+	server *memcache.Server
+	cache  ybc.Cacher
+
+	startTime time.Time
+}
+
+func startMetricsListener(s *memcache.Server, cache ybc.Cacher) {
+	if *metricsListenAddr == "" {
+		return
+	}
+	ms := &metricsSource{
+		server:    s,
+		cache:     cache,
+		startTime: time.Now(),
+	}
+	expvar.Publish("memcached", expvar.Func(func() interface{} {
+		var stats memcache.ServerStats
+		s.Stats(&stats)
+		return stats
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		ms.writePrometheusMetrics(w)
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		log.Printf("Serving metrics at [%s]", *metricsListenAddr)
+		if err := http.ListenAndServe(*metricsListenAddr, mux); err != nil {
+			log.Fatalf("Cannot serve metrics at [%s]: [%s]", *metricsListenAddr, err)
+		}
+	}()
+}
+
+// Writes metrics in Prometheus text format.
+//
+// Ops/sec per command may be obtained via rate(memcached_commands_total[1m]).
+func (ms *metricsSource) writePrometheusMetrics(w io.Writer) {
+	var stats memcache.ServerStats
+	ms.server.Stats(&stats)
+
+	fmt.Fprintf(w, "# TYPE memcached_commands_total counter\n")
+	commands := []struct {
+		name  string
+		count uint64
+	}{
+		{"get", stats.CmdGet},
+		{"gets", stats.CmdGets},
+		{"getde", stats.CmdGetDe},
+		{"cget", stats.CmdCget},
+		{"cgetde", stats.CmdCgetDe},
+		{"set", stats.CmdSet},
+		{"add", stats.CmdAdd},
+		{"cas", stats.CmdCas},
+		{"delete", stats.CmdDelete},
+		{"flush_all", stats.CmdFlushAll},
+		{"version", stats.CmdVersion},
+	}
+	for _, c := range commands {
+		fmt.Fprintf(w, "memcached_commands_total{command=%q} %d\n", c.name, c.count)
+	}
+
+	fmt.Fprintf(w, "# TYPE memcached_get_hits_total counter\n")
+	fmt.Fprintf(w, "memcached_get_hits_total %d\n", stats.GetHits)
+	fmt.Fprintf(w, "# TYPE memcached_get_misses_total counter\n")
+	fmt.Fprintf(w, "memcached_get_misses_total %d\n", stats.GetMisses)
+	hitRatio := 0.0
+	if n := stats.GetHits + stats.GetMisses; n > 0 {
+		hitRatio = float64(stats.GetHits) / float64(n)
+	}
+	fmt.Fprintf(w, "# TYPE memcached_get_hit_ratio gauge\n")
+	fmt.Fprintf(w, "memcached_get_hit_ratio %g\n", hitRatio)
+
+	fmt.Fprintf(w, "# TYPE memcached_connections_total counter\n")
+	fmt.Fprintf(w, "memcached_connections_total %d\n", stats.TotalConnections)
+	fmt.Fprintf(w, "# TYPE memcached_current_connections gauge\n")
+	fmt.Fprintf(w, "memcached_current_connections %d\n", stats.CurrConnections)
+	fmt.Fprintf(w, "# TYPE memcached_auth_errors_total counter\n")
+	fmt.Fprintf(w, "memcached_auth_errors_total %d\n", stats.AuthErrors)
+	fmt.Fprintf(w, "# TYPE memcached_slow_requests_total counter\n")
+	fmt.Fprintf(w, "memcached_slow_requests_total %d\n", stats.SlowRequests)
+	if proxyPool != nil {
+		fmt.Fprintf(w, "# TYPE memcached_proxy_hits_total counter\n")
+		fmt.Fprintf(w, "memcached_proxy_hits_total %d\n", stats.ProxyHits)
+		fmt.Fprintf(w, "# TYPE memcached_proxy_misses_total counter\n")
+		fmt.Fprintf(w, "memcached_proxy_misses_total %d\n", stats.ProxyMisses)
+		fmt.Fprintf(w, "# TYPE memcached_proxy_errors_total counter\n")
+		fmt.Fprintf(w, "memcached_proxy_errors_total %d\n", stats.ProxyErrors)
+	}
+
+	fmt.Fprintf(w, "# TYPE ybc_max_items_count gauge\n")
+	fmt.Fprintf(w, "ybc_max_items_count %d\n", *maxItemsCount)
+	fmt.Fprintf(w, "# TYPE ybc_data_file_size_bytes gauge\n")
+	fmt.Fprintf(w, "ybc_data_file_size_bytes %d\n", *cacheSize*1024*1024)
+	if es, ok := expirationStats(ms.cache); ok {
+		fmt.Fprintf(w, "# TYPE ybc_removed_expired_items_total counter\n")
+		fmt.Fprintf(w, "ybc_removed_expired_items_total %d\n", es.RemovedItems)
+		fmt.Fprintf(w, "# TYPE ybc_removed_expired_bytes_total counter\n")
+		fmt.Fprintf(w, "ybc_removed_expired_bytes_total %d\n", es.RemovedBytes)
+	}
+	writeBucketMetrics(w)
+	writeHotKeysMetrics(w, ms.server)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w, "# TYPE go_goroutines gauge\n")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "# TYPE go_memstats_heap_alloc_bytes gauge\n")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", m.HeapAlloc)
+	fmt.Fprintf(w, "# TYPE go_memstats_sys_bytes gauge\n")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", m.Sys)
+	fmt.Fprintf(w, "# TYPE go_gc_cycles_total counter\n")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", m.NumGC)
+	fmt.Fprintf(w, "# TYPE go_gc_pause_seconds_total counter\n")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", float64(m.PauseTotalNs)/1e9)
+
+	fmt.Fprintf(w, "# TYPE process_uptime_seconds gauge\n")
+	fmt.Fprintf(w, "process_uptime_seconds %g\n", time.Since(ms.startTime).Seconds())
+}
+
+func expirationStats(cache ybc.Cacher) (ybc.ExpirationStats, bool) {
+	switch c := cache.(type) {
+	case *ybc.Cache:
+		return c.ExpirationStats(), true
+	case *ybc.Cluster:
+		return c.ExpirationStats(), true
+	}
+	return ybc.ExpirationStats{}, false
+}
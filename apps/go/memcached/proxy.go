@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	proxyServers = flag.String("proxyServers", "", "Comma-separated list of memcache servers for fetching items missing in the cache. Items found on these servers are stored in the cache for proxyTtl, "+
+		"so the server acts as a disk-backed near cache in front of the existing memcache pool. Leave empty for disabling proxy mode")
+	proxyTtl = flag.Duration("proxyTtl", time.Minute, "Ttl for items fetched from proxyServers")
+)
+
+// Proxy pool client. It is nil if proxy mode is disabled.
+var proxyPool *memcache.DistributedClient
+
+func initProxy(s *memcache.Server) {
+	if *proxyServers == "" {
+		return
+	}
+	if *proxyTtl <= 0 {
+		log.Fatalf("proxyTtl=%s must be positive", *proxyTtl)
+	}
+	addrs := strings.Split(*proxyServers, ",")
+	for i, addr := range addrs {
+		addrs[i] = strings.TrimSpace(addr)
+	}
+	proxyPool = &memcache.DistributedClient{}
+	proxyPool.StartStatic(addrs)
+	s.ProxyPool = proxyPool
+	s.ProxyTtl = *proxyTtl
+	log.Printf("Fetching missing items from proxyServers=[%s]", *proxyServers)
+}
+
+func stopProxy() {
+	if proxyPool != nil {
+		proxyPool.Stop()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	reusePort      = flag.Bool("reusePort", false, "Whether to listen on listenAddr with SO_REUSEPORT socket option. This allows starting a new server process on the same listenAddr before stopping the old one. See pidFile")
+	pidFile        = flag.String("pidFile", "", "Path to file with server process id. If the file contains id of a running server process on startup, the process is asked to stop via SIGTERM and the server waits until the process releases cache files. Together with reusePort this allows zero-downtime restarts with cache contents handoff")
+	drainTimeout   = flag.Duration("drainTimeout", 10*time.Second, "The maximum duration for finishing requests on open connections after receiving SIGTERM or SIGINT. Connections still open after the timeout are closed forcibly")
+	handoffTimeout = flag.Duration("handoffTimeout", time.Minute, "The maximum duration to wait for the old server process from pidFile to release cache files")
+)
+
+// Non-zero if the server is shutting down.
+var shuttingDown uint32
+
+// Returns listener for the server if reusePort is set.
+//
+// The listener is created before opening cache files, so incoming
+// connections are queued while the old server process releases cache files.
+func listenReusePort() *net.TCPListener {
+	if !*reusePort {
+		return nil
+	}
+	ln, err := memcache.ListenReusePort(*listenAddr)
+	if err != nil {
+		log.Fatalf("Cannot listen on listenAddr=[%s] with SO_REUSEPORT: [%s]", *listenAddr, err)
+	}
+	return ln
+}
+
+// Asks the old server process from pidFile to stop and waits until it
+// removes pidFile, i.e. until it releases cache files.
+func stopOldServer() {
+	if *pidFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*pidFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Cannot read pidFile=[%s]: [%s]", *pidFile, err)
+		}
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Fatalf("Cannot parse process id from pidFile=[%s]: [%s]", *pidFile, err)
+	}
+	if pid == os.Getpid() {
+		// Stale pidFile left by the previous container incarnation.
+		return
+	}
+	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		// The process is already dead.
+		log.Printf("Cannot send SIGTERM to the old server process %d from pidFile=[%s]: [%s]", pid, *pidFile, err)
+		return
+	}
+	log.Printf("Waiting for the old server process %d to release cache files", pid)
+	deadline := time.Now().Add(*handoffTimeout)
+	for {
+		if _, err = os.Stat(*pidFile); os.IsNotExist(err) {
+			log.Printf("The old server process %d released cache files", pid)
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("The old server process %d didn't release cache files during handoffTimeout=%s", pid, *handoffTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func writePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	data := []byte(strconv.Itoa(os.Getpid()))
+	if err := ioutil.WriteFile(*pidFile, data, 0644); err != nil {
+		log.Fatalf("Cannot write pidFile=[%s]: [%s]", *pidFile, err)
+	}
+}
+
+// Removes pidFile if it still contains the current process id.
+func removePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*pidFile)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err = os.Remove(*pidFile); err != nil {
+		log.Printf("Cannot remove pidFile=[%s]: [%s]", *pidFile, err)
+	}
+}
+
+// Gracefully stops the server on SIGTERM or SIGINT.
+func handleShutdownSignals(s *memcache.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		log.Printf("Received %s. Stopping the server", sig)
+		atomic.StoreUint32(&shuttingDown, 1)
+		s.StopGracefully(*drainTimeout)
+	}()
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadUint32(&shuttingDown) != 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	slowRequestThreshold = flag.Duration("slowRequestThreshold", 0, "Requests handled for longer than the given duration are logged together with command, key, request and response sizes and client address. "+
+		"This helps diagnosing stalls on the disk-backed cache. 0 disables slow requests logging")
+	slowRequestsLogRate = flag.Int("slowRequestsLogRate", 10, "The maximum number of slow requests logged per second. The remaining slow requests are counted and the count is logged with the next logged request. See slowRequestThreshold")
+)
+
+// Logs slow requests with rate limiting.
+type slowRequestsLogger struct {
+	maxPerSecond int
+
+	mu          sync.Mutex
+	secondStart time.Time
+	logged      int
+	suppressed  int
+}
+
+func initSlowRequestsLog(s *memcache.Server) {
+	if *slowRequestThreshold <= 0 {
+		return
+	}
+	if *slowRequestsLogRate <= 0 {
+		log.Fatalf("slowRequestsLogRate=%d must be positive", *slowRequestsLogRate)
+	}
+	l := &slowRequestsLogger{
+		maxPerSecond: *slowRequestsLogRate,
+	}
+	s.SlowRequestThreshold = *slowRequestThreshold
+	s.SlowRequestHandler = l.logRequest
+	log.Printf("Logging requests slower than %s", *slowRequestThreshold)
+}
+
+func (l *slowRequestsLogger) logRequest(r *memcache.SlowRequest) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.secondStart) >= time.Second {
+		l.secondStart = now
+		l.logged = 0
+	}
+	if l.logged >= l.maxPerSecond {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	l.logged++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	log.Printf("Slow request: duration=%s, command=%s, key=[%s], requestSize=%d, responseSize=%d, client=%s, suppressedSlowRequests=%d",
+		r.Duration, r.Command, r.Key, r.RequestSize, r.ResponseSize, r.ClientAddr, suppressed)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/valyala/ybc/libs/go/memcache"
+)
+
+var (
+	snapshotDir = flag.String("snapshotDir", "", "Directory for online cache snapshots taken on SIGUSR1 or via 'stats snapshot' command. "+
+		"Each snapshot is stored in a new subdirectory named after the snapshot time. Files for the i-th file from cacheFilesPath "+
+		"are stored in the subdirectory i of the snapshot. Leave empty for disabling snapshots")
+)
+
+// Cache opened by openCache together with configs for its files.
+//
+// Snapshot files are named after cache files, so the snapshot may be
+// restored by copying its files to cacheFilesPath locations.
+type snapshotSource struct {
+	cache   ybc.Cacher
+	configs ybc.ClusterConfig
+
+	// Key hash seed file for cache cluster. Empty for a single cache.
+	seedFile string
+}
+
+var (
+	snapshotSources []snapshotSource
+
+	// Serializes snapshots and prevents from closing caches
+	// while they are copied.
+	snapshotLock     sync.Mutex
+	snapshotsStopped bool
+)
+
+var (
+	errSnapshotsDisabled = errors.New("snapshots are disabled. See snapshotDir")
+	errSnapshotsStopped  = errors.New("the server is shutting down")
+)
+
+var strSnapshot = []byte("snapshot")
+
+// Registers the cache opened by openCache for snapshots.
+func addSnapshotSource(cache ybc.Cacher, configs ybc.ClusterConfig, seedFile string) {
+	if configs[0].IndexFile == "" {
+		// Anonymous caches cannot be restored from snapshots.
+		return
+	}
+	snapshotSources = append(snapshotSources, snapshotSource{
+		cache:    cache,
+		configs:  configs,
+		seedFile: seedFile,
+	})
+}
+
+func initSnapshots(s *memcache.Server) {
+	if *snapshotDir == "" {
+		return
+	}
+	if *cacheFilesPath == "" {
+		log.Fatalf("snapshotDir requires cacheFilesPath, since anonymous caches cannot be restored from snapshots")
+	}
+	if err := os.MkdirAll(*snapshotDir, 0700); err != nil {
+		log.Fatalf("Cannot create snapshotDir=[%s]: [%s]", *snapshotDir, err)
+	}
+	addStatsHandler(s, handleSnapshotStats)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			log.Printf("Received SIGUSR1. Taking cache snapshot")
+			takeSnapshotAndLog()
+		}
+	}()
+	log.Printf("Cache snapshots are stored in [%s]", *snapshotDir)
+}
+
+// Waits for in-flight snapshot and disables new snapshots.
+//
+// Must be called before closing caches.
+func stopSnapshots() {
+	snapshotLock.Lock()
+	snapshotsStopped = true
+	snapshotLock.Unlock()
+}
+
+// Handles 'stats snapshot' command.
+//
+// The snapshot is taken synchronously, so backup pipelines may copy
+// the snapshot right after the command returns.
+func handleSnapshotStats(args []byte, write func(name, value string)) bool {
+	if !bytes.Equal(args, strSnapshot) {
+		return false
+	}
+	startTime := time.Now()
+	dir, err := takeSnapshotAndLog()
+	if err != nil {
+		write("snapshot_error", err.Error())
+		return true
+	}
+	write("snapshot_dir", dir)
+	write("snapshot_duration_ms", strconv.FormatInt(int64(time.Since(startTime)/time.Millisecond), 10))
+	return true
+}
+
+func takeSnapshotAndLog() (string, error) {
+	startTime := time.Now()
+	dir, err := takeSnapshot()
+	if err != nil {
+		log.Printf("Cannot take cache snapshot: [%s]", err)
+		return "", err
+	}
+	log.Printf("Cache snapshot has been stored in [%s] in %s", dir, time.Since(startTime))
+	return dir, nil
+}
+
+// Copies all the caches opened by openCache into a new subdirectory
+// of snapshotDir without stopping the server.
+//
+// Returns the path to the subdirectory.
+func takeSnapshot() (string, error) {
+	if *snapshotDir == "" {
+		return "", errSnapshotsDisabled
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	if snapshotsStopped {
+		return "", errSnapshotsStopped
+	}
+
+	dir := filepath.Join(*snapshotDir, time.Now().UTC().Format("20060102T150405.000Z"))
+	cacheFilesPath_ := strings.Split(*cacheFilesPath, ",")
+	for i := range cacheFilesPath_ {
+		if err := os.MkdirAll(filepath.Join(dir, strconv.Itoa(i)), 0700); err != nil {
+			return "", fmt.Errorf("cannot create snapshot directory: [%s]", err)
+		}
+	}
+	if err := snapshotCaches(dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func snapshotCaches(dir string) error {
+	for _, src := range snapshotSources {
+		configs := make(ybc.ClusterConfig, len(src.configs))
+		for i, c := range src.configs {
+			cfg := *c
+			cfg.IndexFile = filepath.Join(dir, strconv.Itoa(i), filepath.Base(c.IndexFile))
+			cfg.DataFile = filepath.Join(dir, strconv.Itoa(i), filepath.Base(c.DataFile))
+			configs[i] = &cfg
+		}
+		var err error
+		switch cache := src.cache.(type) {
+		case *ybc.Cache:
+			err = cache.Snapshot(configs[0])
+		case *ybc.Cluster:
+			err = cache.Snapshot(configs)
+		default:
+			err = fmt.Errorf("unsupported cache type %T", src.cache)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot copy cache files [%s]: [%s]", src.configs[0].DataFile, err)
+		}
+
+		// Keys must be distributed among cache files in the same way
+		// after restoring the snapshot. Clusters created before key hash
+		// seeding have no seed file.
+		if src.seedFile == "" {
+			continue
+		}
+		if _, err = os.Stat(src.seedFile); os.IsNotExist(err) {
+			continue
+		}
+		if err = copySnapshotFile(src.seedFile, filepath.Join(dir, "0", filepath.Base(src.seedFile))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copySnapshotFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("cannot read [%s]: [%s]", src, err)
+	}
+	if err = ioutil.WriteFile(dst, data, 0600); err != nil {
+		return fmt.Errorf("cannot write [%s]: [%s]", dst, err)
+	}
+	return nil
+}
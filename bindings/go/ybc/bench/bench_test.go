@@ -0,0 +1,95 @@
+package bench
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+func TestHistogram_Percentile(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Add(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 1000 {
+		t.Fatalf("Unexpected count=%d. Expected 1000", h.Count())
+	}
+	if h.Min() != time.Microsecond || h.Max() != time.Millisecond {
+		t.Fatalf("Unexpected min=%s, max=%s. Expected 1us, 1ms", h.Min(), h.Max())
+	}
+	for _, p := range []float64{50, 90, 99} {
+		expected := time.Duration(p*10) * time.Microsecond
+		d := h.Percentile(p)
+		if d < expected || d > expected+expected/10 {
+			t.Fatalf("Unexpected p%.0f=%s. Expected ~%s", p, d, expected)
+		}
+	}
+
+	var h2 Histogram
+	h2.Add(time.Second)
+	h2.Merge(&h)
+	if h2.Count() != 1001 || h2.Max() != time.Second || h2.Min() != time.Microsecond {
+		t.Fatalf("Unexpected merged histogram: count=%d, min=%s, max=%s", h2.Count(), h2.Min(), h2.Max())
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := ybc.Config{
+		MaxItemsCount: 10 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+	}
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatalf("Cannot open cache: [%s]", err)
+	}
+	defer cache.Close()
+
+	for _, distribution := range []KeyDistribution{Uniform, Zipfian} {
+		w := Workload{
+			KeysCount:       1000,
+			KeyDistribution: distribution,
+			MinValueSize:    10,
+			MaxValueSize:    100,
+			GetRatio:        0.9,
+			Prefill:         true,
+			WorkersCount:    4,
+			RequestsCount:   10000,
+		}
+		r := w.Run(cache)
+		if r.GetsCount+r.SetsCount != 10000 {
+			t.Fatalf("Unexpected number of requests: %d. Expected 10000", r.GetsCount+r.SetsCount)
+		}
+		if r.ErrorsCount != 0 {
+			t.Fatalf("Unexpected errors: %d", r.ErrorsCount)
+		}
+		if r.HitRatio() != 1 {
+			t.Fatalf("Unexpected hit ratio for prefilled cache: %f. Expected 1", r.HitRatio())
+		}
+		if r.GetLatency.Count() != r.GetsCount || r.SetLatency.Count() != r.SetsCount {
+			t.Fatalf("Latency histograms don't match requests counts")
+		}
+		var buf bytes.Buffer
+		r.WriteReport(&buf)
+		if !bytes.Contains(buf.Bytes(), []byte("Get latency: ")) {
+			t.Fatalf("Unexpected report: [%s]", buf.Bytes())
+		}
+	}
+
+	// Duration-limited workload without prefilling.
+	cache.Clear()
+	w := Workload{
+		KeysCount: 100,
+		GetRatio:  0.5,
+		SetOnMiss: true,
+		Duration:  50 * time.Millisecond,
+	}
+	r := w.Run(cache)
+	if r.GetsCount == 0 || r.SetsCount == 0 {
+		t.Fatalf("Unexpected requests counts: gets=%d, sets=%d", r.GetsCount, r.SetsCount)
+	}
+	if r.Duration < w.Duration {
+		t.Fatalf("Unexpected duration=%s. Expected at least %s", r.Duration, w.Duration)
+	}
+}
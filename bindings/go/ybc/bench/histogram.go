@@ -0,0 +1,130 @@
+package bench
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The number of histogram buckets per each doubling of latency.
+	histogramSubBuckets = 8
+
+	// Histogram covers latencies up to 2^histogramMaxLog2 nanoseconds,
+	// i.e. ~18 minutes.
+	histogramMaxLog2 = 40
+
+	histogramBucketsCount = histogramSubBuckets * histogramMaxLog2
+)
+
+// Latency histogram with logarithmic buckets.
+//
+// Each bucket covers ~9% latency range, so percentiles are estimated
+// with the same relative precision regardless of latency magnitude.
+//
+// The histogram isn't goroutine-safe. Use a histogram per goroutine
+// and merge them via Merge().
+type Histogram struct {
+	buckets [histogramBucketsCount]uint64
+	count   uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func histogramBucketIndex(d time.Duration) int {
+	if d <= 1 {
+		return 0
+	}
+	n := int(math.Log2(float64(d)) * histogramSubBuckets)
+	if n >= histogramBucketsCount {
+		n = histogramBucketsCount - 1
+	}
+	return n
+}
+
+// Returns the upper bound of latencies in the given bucket.
+func histogramBucketBound(n int) time.Duration {
+	return time.Duration(math.Exp2(float64(n+1) / histogramSubBuckets))
+}
+
+// Registers the given latency in the histogram.
+func (h *Histogram) Add(d time.Duration) {
+	h.buckets[histogramBucketIndex(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Adds latencies from src to the histogram.
+func (h *Histogram) Merge(src *Histogram) {
+	if src.count == 0 {
+		return
+	}
+	for i, n := range src.buckets {
+		h.buckets[i] += n
+	}
+	if h.count == 0 || src.min < h.min {
+		h.min = src.min
+	}
+	if src.max > h.max {
+		h.max = src.max
+	}
+	h.count += src.count
+	h.sum += src.sum
+}
+
+// Returns the number of registered latencies.
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Returns the minimum registered latency.
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+// Returns the maximum registered latency.
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Returns the average latency.
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Returns the estimated latency percentile.
+//
+// p must be in the range [0..100].
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	n := uint64(math.Ceil(float64(h.count) * p / 100))
+	if n == 0 {
+		return h.min
+	}
+	var sum uint64
+	for i, v := range h.buckets {
+		sum += v
+		if sum >= n {
+			d := histogramBucketBound(i)
+			if d > h.max {
+				d = h.max
+			}
+			if d < h.min {
+				d = h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,298 @@
+// Package bench provides workload generators and latency reporting
+// for benchmarking ybc caches.
+//
+// The package helps sizing caches and comparing cache configurations
+// (for instance, persistent vs anonymous caches) on the given hardware.
+//
+// Usage:
+//
+//   config := ybc.Config{
+//       MaxItemsCount: 1000 * 1000,
+//       DataFileSize:  1000 * 1000 * 1000,
+//       DataFile:      "/mnt/ssd/cache.data",
+//       IndexFile:     "/mnt/ssd/cache.index",
+//   }
+//   cache, err := config.OpenCache(true)
+//   if err != nil {
+//       handleError(err)
+//   }
+//   defer cache.Close()
+//
+//   w := bench.Workload{
+//       KeysCount:       1000 * 1000,
+//       KeyDistribution: bench.Zipfian,
+//       MinValueSize:    100,
+//       MaxValueSize:    10 * 1000,
+//       GetRatio:        0.9,
+//       Duration:        time.Minute,
+//   }
+//   r := w.Run(cache)
+//   r.WriteReport(os.Stdout)
+//
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// Distribution of requested keys.
+type KeyDistribution int
+
+const (
+	// All the keys are requested with equal probability.
+	Uniform = KeyDistribution(iota)
+
+	// Keys are requested according to Zipf's law, i.e. a small number
+	// of hot keys receives the majority of requests. This is typical
+	// for real-world caches.
+	Zipfian
+)
+
+const (
+	defaultKeysCount     = 100 * 1000
+	defaultZipfS         = 1.1
+	defaultValueSize     = 100
+	defaultRequestsCount = 1000 * 1000
+)
+
+// Cache workload description.
+//
+// All the fields are optional.
+type Workload struct {
+	// The number of distinct keys in the working set.
+	// 100K by default.
+	KeysCount int
+
+	// Distribution of requested keys. Uniform by default.
+	KeyDistribution KeyDistribution
+
+	// Zipf's law exponent for Zipfian distribution. Must exceed 1.
+	// Higher values concentrate requests on a smaller number of keys.
+	// 1.1 by default.
+	ZipfS float64
+
+	// Values' sizes are uniformly distributed in the range
+	// [MinValueSize..MaxValueSize]. 100 bytes by default.
+	MinValueSize int
+	MaxValueSize int
+
+	// The share of Get() requests in the range [0..1]. The rest of requests
+	// are Set() requests. Zero means write-only workload.
+	GetRatio float64
+
+	// Whether to set values for cache misses, like read-through caches do.
+	SetOnMiss bool
+
+	// Ttl for stored items. ybc.MaxTtl by default.
+	Ttl time.Duration
+
+	// Whether to store all the keys in the cache before the measurement.
+	// Prefilling isn't included in the result.
+	Prefill bool
+
+	// The number of concurrent goroutines sending requests to the cache.
+	// runtime.NumCPU() by default.
+	WorkersCount int
+
+	// The total number of requests to send. 1M by default.
+	// Ignored if Duration is set.
+	RequestsCount int
+
+	// The duration of the measurement.
+	// Optional. RequestsCount is used if Duration isn't set.
+	Duration time.Duration
+}
+
+// Benchmark result.
+type Result struct {
+	// The duration of the measurement.
+	Duration time.Duration
+
+	GetsCount   uint64
+	HitsCount   uint64
+	SetsCount   uint64
+	ErrorsCount uint64
+
+	// Latencies for Get() and Set() requests.
+	GetLatency Histogram
+	SetLatency Histogram
+}
+
+// Returns the number of requests per second.
+func (r *Result) RequestsPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.GetsCount+r.SetsCount) / r.Duration.Seconds()
+}
+
+// Returns the share of Get() requests, which hit the cache.
+func (r *Result) HitRatio() float64 {
+	if r.GetsCount == 0 {
+		return 0
+	}
+	return float64(r.HitsCount) / float64(r.GetsCount)
+}
+
+// Writes human-readable report to w.
+func (r *Result) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "Duration:            %10s\n", r.Duration)
+	fmt.Fprintf(w, "Requests per second: %10.0f\n", r.RequestsPerSecond())
+	fmt.Fprintf(w, "Get requests:        %10d\n", r.GetsCount)
+	fmt.Fprintf(w, "Set requests:        %10d\n", r.SetsCount)
+	fmt.Fprintf(w, "Errors:              %10d\n", r.ErrorsCount)
+	fmt.Fprintf(w, "Hit ratio:           %10.3f%%\n", r.HitRatio()*100)
+	writeLatencyReport(w, "Get", &r.GetLatency)
+	writeLatencyReport(w, "Set", &r.SetLatency)
+}
+
+func writeLatencyReport(w io.Writer, name string, h *Histogram) {
+	if h.Count() == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s latency: min=%s, avg=%s, p50=%s, p90=%s, p99=%s, p99.9=%s, max=%s\n", name,
+		h.Min(), h.Mean(), h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Percentile(99.9), h.Max())
+}
+
+func (w *Workload) init() {
+	if w.KeysCount <= 0 {
+		w.KeysCount = defaultKeysCount
+	}
+	if w.ZipfS <= 1 {
+		w.ZipfS = defaultZipfS
+	}
+	if w.MaxValueSize <= 0 {
+		w.MaxValueSize = defaultValueSize
+	}
+	if w.MinValueSize <= 0 || w.MinValueSize > w.MaxValueSize {
+		w.MinValueSize = w.MaxValueSize
+	}
+	if w.Ttl <= 0 {
+		w.Ttl = ybc.MaxTtl
+	}
+	if w.WorkersCount <= 0 {
+		w.WorkersCount = runtime.NumCPU()
+	}
+	if w.RequestsCount <= 0 {
+		w.RequestsCount = defaultRequestsCount
+	}
+}
+
+// Runs the workload against the given cache.
+//
+// The workload is initialized with default values for unset fields.
+func (w *Workload) Run(cache ybc.SimpleCacher) *Result {
+	w.init()
+
+	value := make([]byte, w.MaxValueSize)
+	rand.Read(value)
+
+	if w.Prefill {
+		var key [8]byte
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; i < w.KeysCount; i++ {
+			binary.BigEndian.PutUint64(key[:], uint64(i))
+			cache.Set(key[:], value[:w.valueSize(r)], w.Ttl)
+		}
+	}
+
+	var requestsLeft int64 = int64(w.RequestsCount)
+	var deadline time.Time
+	if w.Duration > 0 {
+		requestsLeft = -1
+		deadline = time.Now().Add(w.Duration)
+	}
+
+	results := make([]Result, w.WorkersCount)
+	var wg sync.WaitGroup
+	startTime := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(r *Result, seed int64) {
+			defer wg.Done()
+			w.worker(cache, value, r, seed, &requestsLeft, deadline)
+		}(&results[i], startTime.UnixNano()+int64(i))
+	}
+	wg.Wait()
+
+	var result Result
+	result.Duration = time.Since(startTime)
+	for i := range results {
+		r := &results[i]
+		result.GetsCount += r.GetsCount
+		result.HitsCount += r.HitsCount
+		result.SetsCount += r.SetsCount
+		result.ErrorsCount += r.ErrorsCount
+		result.GetLatency.Merge(&r.GetLatency)
+		result.SetLatency.Merge(&r.SetLatency)
+	}
+	return &result
+}
+
+// The number of requests between deadline checks.
+const deadlineCheckInterval = 64
+
+func (w *Workload) worker(cache ybc.SimpleCacher, value []byte, result *Result, seed int64, requestsLeft *int64, deadline time.Time) {
+	r := rand.New(rand.NewSource(seed))
+	var zipf *rand.Zipf
+	if w.KeyDistribution == Zipfian {
+		zipf = rand.NewZipf(r, w.ZipfS, 1, uint64(w.KeysCount-1))
+	}
+	var key [8]byte
+	for i := 0; ; i++ {
+		if deadline.IsZero() {
+			if atomic.AddInt64(requestsLeft, -1) < 0 {
+				return
+			}
+		} else if i%deadlineCheckInterval == 0 && time.Now().After(deadline) {
+			return
+		}
+
+		var n uint64
+		if zipf != nil {
+			n = zipf.Uint64()
+		} else {
+			n = uint64(r.Intn(w.KeysCount))
+		}
+		binary.BigEndian.PutUint64(key[:], n)
+
+		if r.Float64() < w.GetRatio {
+			startTime := time.Now()
+			_, err := cache.Get(key[:])
+			result.GetLatency.Add(time.Since(startTime))
+			result.GetsCount++
+			if err == nil {
+				result.HitsCount++
+				continue
+			}
+			if err != ybc.ErrCacheMiss {
+				result.ErrorsCount++
+				continue
+			}
+			if !w.SetOnMiss {
+				continue
+			}
+		}
+
+		startTime := time.Now()
+		err := cache.Set(key[:], value[:w.valueSize(r)], w.Ttl)
+		result.SetLatency.Add(time.Since(startTime))
+		result.SetsCount++
+		if err != nil {
+			result.ErrorsCount++
+		}
+	}
+}
+
+func (w *Workload) valueSize(r *rand.Rand) int {
+	return w.MinValueSize + r.Intn(w.MaxValueSize-w.MinValueSize+1)
+}
@@ -0,0 +1,26 @@
+// +build !windows
+
+package ybc
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns true if the given cache file is locked by an opened cache.
+//
+// See m_file_lock() in platform/linux.c.
+func isFileLocked(filename string) bool {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+	syscall.Flock(fd, syscall.LOCK_UN)
+	return false
+}
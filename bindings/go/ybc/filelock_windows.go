@@ -0,0 +1,27 @@
+package ybc
+
+import (
+	"syscall"
+)
+
+// ERROR_SHARING_VIOLATION isn't exported by syscall package.
+const errorSharingViolation = syscall.Errno(32)
+
+// Returns true if the given cache file is locked by an opened cache.
+//
+// Cache files are opened without sharing on Windows, so opening the file
+// without sharing fails while the cache is opened.
+// See platform/windows.c.
+func isFileLocked(filename string) bool {
+	name, err := syscall.UTF16PtrFromString(filename)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return err == errorSharingViolation
+	}
+	syscall.CloseHandle(h)
+	return false
+}
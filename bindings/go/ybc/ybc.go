@@ -16,18 +16,34 @@ package ybc
 #cgo !debug CFLAGS: -O2 -DNDEBUG
 #cgo linux CFLAGS: -std=gnu99 -DYBC_PLATFORM_LINUX
 #cgo linux LDFLAGS: -lrt
+#cgo windows CFLAGS: -std=gnu99 -DYBC_PLATFORM_WINDOWS
 #include "ybc_go_glue.c"
 #include <stdlib.h> // free
 */
 import "C"
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -36,9 +52,15 @@ var (
 	ErrNoSpace       = errors.New("ybc: not enough space in the cache")
 	ErrCacheMiss     = errors.New("ybc: the item is not found in the cache")
 	ErrOpenFailed    = errors.New("ybc: cannot open the cache")
+	ErrAlreadyOpen   = errors.New("ybc: the cache is already opened")
 	ErrOutOfRange    = errors.New("ybc: out of range offset")
 	ErrPartialCommit = errors.New("ybc: partial commit")
 	ErrWouldBlock    = errors.New("ybc: the operation would block")
+	ErrItemTooLarge  = errors.New("ybc: the item exceeds the maximum item size")
+	ErrTxnRolledBack = errors.New("ybc: the transaction has been rolled back")
+
+	ErrInvalidEncryptionKey = errors.New("ybc: the encryption key must be 16, 24 or 32 bytes long")
+	ErrSnapshotFailed       = errors.New("ybc: cannot create the cache snapshot")
 
 	// Errors for internal use only
 	errPanic = errors.New("ybc: panic")
@@ -59,7 +81,7 @@ var (
 	itemSize   = int(C.ybc_item_get_size())
 )
 
-// SimpleCache, Cache and Cluster implement this interface
+// SimpleCache, Cache, Cluster and EncryptedCacher implement this interface
 type SimpleCacher interface {
 	Set(key []byte, value []byte, ttl time.Duration) error
 	Get(key []byte) (value []byte, err error)
@@ -69,7 +91,7 @@ type SimpleCacher interface {
 	Close() error
 }
 
-// Cache and Cluster implement this interface
+// Cache, Cluster and TieredCacher implement this interface
 type Cacher interface {
 	SimpleCacher
 	GetDe(key []byte, graceDuration time.Duration) (value []byte, err error)
@@ -81,6 +103,21 @@ type Cacher interface {
 	NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *SetTxn, err error)
 }
 
+// Cache and Cluster implement this interface
+//
+// It isn't a part of Cacher, so monitoring code may check whether
+// the given Cacher supports size queries via type assertion.
+type Sizer interface {
+	// Returns the number of items in the cache.
+	Len() int
+
+	// Returns the total size of items' keys and values in bytes.
+	SizeBytes() int64
+
+	// Returns the cache capacity in bytes.
+	Capacity() int64
+}
+
 /*******************************************************************************
  * Config
  ******************************************************************************/
@@ -187,6 +224,105 @@ type Config struct {
 	//
 	// Leave this field empty (set to 0) if you are in doubt.
 	SyncInterval time.Duration
+
+	// Randomized jitter for item ttls in percents.
+	//
+	// Ttls passed to Set(), SetItem() and NewSetTxn() are randomly changed
+	// by up to +-TtlJitter percents. This prevents mass simultaneous
+	// expiration of items stored with identical ttls, which may result
+	// in stampedes on the underlying data source.
+	// MaxTtl is never changed.
+	//
+	// Values outside [0..100] range are clamped to the nearest bound.
+	//
+	// Leave this field empty (set to 0) for storing items with exact ttls.
+	TtlJitter int
+
+	// The maximum size of values stored in the cache (in bytes).
+	//
+	// Set(), SetItem() and NewSetTxn() return ErrItemTooLarge without
+	// touching the cache if the value size exceeds MaxItemSize.
+	// This allows rejecting oversized items before reading them
+	// from the network.
+	//
+	// Leave this field empty (set to 0) for limiting values only
+	// by the cache size.
+	MaxItemSize int
+
+	// Interval for background removal of expired items.
+	//
+	// Expired items are never returned from the cache, but they occupy
+	// index slots until overwritten by new items, so they may cause
+	// premature eviction of live items. Setting this field to non-zero value
+	// starts a goroutine, which removes expired items from the cache
+	// with the given interval. See also Cache.RemoveExpired().
+	//
+	// Leave this field empty (set to 0) if items are usually read before
+	// their expiration or if the cache contains only items with MaxTtl.
+	ExpirationScanInterval time.Duration
+
+	// Whether to load cache index lazily.
+	//
+	// By default the whole index file is loaded into RAM when opening
+	// the cache. This can take a while for big index files. If LazyIndexLoad
+	// is set, then the cache is opened immediately, while the index is loaded
+	// and validated in background. Items from not yet loaded index parts
+	// are reported as missing. See also Cache.IndexLoadPercent().
+	//
+	// Leave this field empty (set to false) unless cold start time is
+	// important for caches with big Config.MaxItemsCount.
+	LazyIndexLoad bool
+
+	// Callback for reporting progress of OpenCacheCtx().
+	//
+	// It is called with the percent of index file loaded into RAM
+	// while the cache is being opened. The last call always has
+	// percent=100 if the cache is opened successfully.
+	//
+	// Leave this field empty (set to nil) if you don't need progress
+	// reporting.
+	OpenProgress func(percent int)
+
+	// Weight of the cache in a Cluster.
+	//
+	// Keys are distributed among cluster caches proportionally to their
+	// weights. For instance, a cache with weight 2 receives twice as many
+	// keys as a cache with weight 1. This allows mixing caches with distinct
+	// capacities in a single cluster without wasting space on bigger caches.
+	// Set this field either for all caches in the cluster or for none
+	// of them.
+	//
+	// Changing weights for an existing cluster moves a part of keys
+	// to other caches, so these keys become inaccessible.
+	//
+	// Leave this field empty (set to 0) for distributing keys proportionally
+	// to Config.MaxItemsCount.
+	ClusterWeight SizeT
+
+	// Hash function for distributing keys among caches in a Cluster.
+	//
+	// Use NewSipHashKeyHash() with a secret key if keys may be controlled
+	// by untrusted parties, so they cannot flood a single cache in the cluster
+	// with specially crafted keys. Use XXHashKeyHash for matching sharding
+	// schemes based on xxhash. Set this field to the same function for all
+	// caches in the cluster, since only the function from the first config
+	// is used.
+	//
+	// Changing the function for an existing cluster moves the majority
+	// of keys to other caches, so these keys become inaccessible.
+	//
+	// Keys inside a single cache are always hashed with the internal hash
+	// function seeded by random value stored in the index file.
+	//
+	// Leave this field empty (set to nil) for using SipHash seeded
+	// with the per-process key hash seed in anonymous clusters
+	// and FNVKeyHash in persistent clusters. The per-process seed is random,
+	// so it cannot be used for persistent clusters, which must distribute
+	// keys in the same way after restart. FNVKeyHash has been used
+	// by clusters created before per-process seeding. Use
+	// ClusterConfig.PinKeyHashSeed() for setting this field to SipHash
+	// with the seed pinned to the persistent cluster.
+	KeyHash KeyHashFunc
 }
 
 type configInternal struct {
@@ -202,7 +338,9 @@ type configInternal struct {
 //   * creates missing index or data files.
 //   * fixes incorrect sizes for index or data files.
 //
-// Do not open the same cache more than once at the same time!
+// Cache files are exclusively locked while the cache is opened, so
+// ErrAlreadyOpen is returned if the cache is already opened by another
+// process or by another OpenCache() call in the current process.
 //
 // The returned cache must be closed with cache.Close() call!
 // Prefer using defer for closing opened caches:
@@ -217,6 +355,80 @@ func (cfg *Config) OpenCache(force bool) (cache *Cache, err error) {
 	return cfg.openCacheInternal(force, false)
 }
 
+// Opens Cache like OpenCache(), but allows aborting the open via ctx.
+//
+// Opening the cache with big index file can take a while, since the index
+// file is loaded into RAM before the cache is opened. The progress of index
+// file loading is reported via Config.OpenProgress callback.
+//
+// Returns ctx.Err() if ctx is done before the cache is opened. Creating
+// missing files and fixing their sizes when force is true cannot be
+// aborted.
+//
+// Index file isn't loaded if Config.LazyIndexLoad is set.
+func (cfg *Config) OpenCacheCtx(ctx context.Context, force bool) (cache *Cache, err error) {
+	if !cfg.LazyIndexLoad {
+		if err = cfg.loadIndexFile(ctx); err != nil {
+			return
+		}
+	}
+	if cache, err = cfg.OpenCache(force); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		cache.Close()
+		cache = nil
+		return
+	}
+	cfg.reportOpenProgress(100)
+	return
+}
+
+// The size of chunks for loading index file into RAM.
+const indexFileChunkSize = 4 * 1024 * 1024
+
+// Loads index file into RAM, so ybc_open() doesn't spend time on it.
+func (cfg *Config) loadIndexFile(ctx context.Context) error {
+	if cfg.IndexFile == "" {
+		return ctx.Err()
+	}
+	f, err := os.Open(cfg.IndexFile)
+	if err != nil {
+		// Missing index file is either created by OpenCache()
+		// or results in ErrOpenFailed.
+		return ctx.Err()
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return ctx.Err()
+	}
+	fileSize := fi.Size()
+	buf := make([]byte, indexFileChunkSize)
+	var bytesRead int64
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.Read(buf)
+		bytesRead += int64(n)
+		if err != nil {
+			// Let OpenCache() deal with read errors.
+			return nil
+		}
+		if bytesRead < fileSize {
+			cfg.reportOpenProgress(int(bytesRead * 100 / fileSize))
+		}
+	}
+}
+
+func (cfg *Config) reportOpenProgress(percent int) {
+	if cfg.OpenProgress != nil {
+		cfg.OpenProgress(percent)
+	}
+}
+
 // Opens SimpleCache.
 //
 // Consider using Cache instead of SimpleCache if you plan storing objects
@@ -227,7 +439,9 @@ func (cfg *Config) OpenCache(force bool) (cache *Cache, err error) {
 //   * creates missing index or data files.
 //   * fixes incorrect sizes for index or data files.
 //
-// Do not open the same cache more than once at the same time!
+// Cache files are exclusively locked while the cache is opened, so
+// ErrAlreadyOpen is returned if the cache is already opened by another
+// process or by another OpenSimpleCache() call in the current process.
 //
 // The returned cache must be closed with cache.Close() call!
 // Prefer using defer for closing opened caches:
@@ -262,8 +476,10 @@ func (cfg *Config) openCacheInternal(force, isSimpleCache bool) (cache *Cache, e
 	}()
 
 	cache = &Cache{
-		buf: make([]byte, cacheSize),
-		cg:  c.cg,
+		buf:         make([]byte, cacheSize),
+		cg:          c.cg,
+		ttlJitter:   cfg.ttlJitter(),
+		maxItemSize: cfg.MaxItemSize,
 	}
 	mForce := C.int(0)
 	if force {
@@ -272,13 +488,28 @@ func (cfg *Config) openCacheInternal(force, isSimpleCache bool) (cache *Cache, e
 	if C.ybc_open(cache.ctx(), c.ctx, mForce) == 0 {
 		cache = nil
 		err = ErrOpenFailed
+		if cfg.isLocked() {
+			err = ErrAlreadyOpen
+		}
 		return
 	}
 	cache.dg.Init()
+	if cfg.LazyIndexLoad {
+		cache.startIndexLoader()
+	}
+	if cfg.ExpirationScanInterval > 0 {
+		cache.startExpirationScanner(cfg.ExpirationScanInterval)
+	}
 	err = nil
 	return
 }
 
+// Returns true if cache files are locked by another opened cache.
+func (cfg *Config) isLocked() bool {
+	return (cfg.IndexFile != "" && isFileLocked(cfg.IndexFile)) ||
+		(cfg.DataFile != "" && isFileLocked(cfg.DataFile))
+}
+
 // Removes cache files from filesystem.
 func (cfg *Config) RemoveCache() {
 	c := cfg.internal(false)
@@ -287,6 +518,16 @@ func (cfg *Config) RemoveCache() {
 	C.ybc_remove(c.ctx)
 }
 
+func (cfg *Config) ttlJitter() int {
+	if cfg.TtlJitter < 0 {
+		return 0
+	}
+	if cfg.TtlJitter > 100 {
+		return 100
+	}
+	return cfg.TtlJitter
+}
+
 func (cfg *Config) internal(isSimpleCache bool) *configInternal {
 	c := &configInternal{
 		buf: make([]byte, configSize),
@@ -328,6 +569,9 @@ func (cfg *Config) internal(isSimpleCache bool) *configInternal {
 	if isSimpleCache {
 		C.ybc_config_disable_overwrite_protection(ctx)
 	}
+	if cfg.LazyIndexLoad {
+		C.ybc_config_enable_lazy_index_load(ctx)
+	}
 
 	c.ctx = ctx
 	return c
@@ -365,10 +609,13 @@ func (sc *SimpleCache) Close() error {
 // Stores the given (key, value) pair with the given ttl in the cache.
 func (sc *SimpleCache) Set(key, value []byte, ttl time.Duration) error {
 	sc.cache.dg.CheckLive()
+	if sc.cache.isTooLarge(len(value)) {
+		return ErrItemTooLarge
+	}
 	var k C.struct_ybc_key
 	initKey(&k, key)
 	var v C.struct_ybc_value
-	initValue(&v, value, ttl)
+	initValue(&v, value, sc.cache.jitterTtl(ttl))
 	if C.go_simple_set(sc.cache.ctx(), k.ptr, k.size, v.ptr, v.size, v.ttl) == 0 {
 		return ErrNoSpace
 	}
@@ -442,6 +689,75 @@ func (sc *SimpleCache) Clear() {
 	sc.cache.Clear()
 }
 
+// The maximum key size for SimpleCache methods accepting string keys.
+//
+// Longer keys are substituted by their hashes, so they don't waste
+// cache space.
+const maxSimpleKeySize = 250
+
+// Prefix for hashed keys. Keys cannot start with zero byte
+// in practice, so hashed keys don't clash with ordinary keys.
+const hashedKeyPrefix = "\x00sha256:"
+
+// Returns cache key for the given string key.
+func simpleKey(key string) []byte {
+	if len(key) <= maxSimpleKeySize {
+		return []byte(key)
+	}
+	h := sha256.Sum256([]byte(key))
+	return append([]byte(hashedKeyPrefix), h[:]...)
+}
+
+// Stores the given (key, value) string pair with the given ttl in the cache.
+//
+// Keys longer than 250 bytes are automatically hashed, so the value
+// must be read via SimpleCache.GetString() or SimpleCache.GetJSON().
+func (sc *SimpleCache) SetString(key, value string, ttl time.Duration) error {
+	return sc.Set(simpleKey(key), []byte(value), ttl)
+}
+
+// Returns string value associated with the given key.
+//
+// Sets err to ErrCacheMiss on cache miss.
+func (sc *SimpleCache) GetString(key string) (value string, err error) {
+	v, err := sc.Get(simpleKey(key))
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// Stores JSON representation of v with the given key and the given ttl
+// in the cache.
+//
+// Keys longer than 250 bytes are automatically hashed.
+func (sc *SimpleCache) SetJSON(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return sc.Set(simpleKey(key), value, ttl)
+}
+
+// Unmarshals JSON value associated with the given key into v.
+//
+// Returns ErrCacheMiss on cache miss.
+func (sc *SimpleCache) GetJSON(key string, v interface{}) error {
+	value, err := sc.Get(simpleKey(key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// Deletes an item stored via SimpleCache.SetString()
+// or SimpleCache.SetJSON().
+//
+// Returns true if the given item has been deleted.
+func (sc *SimpleCache) DeleteString(key string) bool {
+	return sc.Delete(simpleKey(key))
+}
+
 /*******************************************************************************
  * Cache
  ******************************************************************************/
@@ -454,9 +770,27 @@ func (sc *SimpleCache) Clear() {
 // Consider using SimpleCache for storing small objects (up to 1Kb).
 // It has better performance scalability on multi-CPU system.
 type Cache struct {
-	dg  debugGuard
-	cg  cacheGuard
-	buf []byte
+	// Expiration stats. Must be at the beginning of the struct for proper
+	// alignment of 64-bit atomic operations on 32-bit platforms.
+	removedExpiredItems uint64
+	removedExpiredBytes uint64
+	expirationScans     uint64
+
+	stopExpirationScanner chan struct{}
+	expirationScannerWg   sync.WaitGroup
+
+	stopIndexLoader chan struct{}
+	indexLoaderWg   sync.WaitGroup
+
+	// The index slot to start the next Compact() call from.
+	compactionLock sync.Mutex
+	compactionSlot C.size_t
+
+	dg          debugGuard
+	cg          cacheGuard
+	buf         []byte
+	ttlJitter   int
+	maxItemSize int
 }
 
 // Closes the cache.
@@ -464,6 +798,14 @@ type Cache struct {
 // All opened caches must be closed with this call!
 // Do not close the same cache more than once!
 func (cache *Cache) Close() error {
+	if cache.stopExpirationScanner != nil {
+		close(cache.stopExpirationScanner)
+		cache.expirationScannerWg.Wait()
+	}
+	if cache.stopIndexLoader != nil {
+		close(cache.stopIndexLoader)
+		cache.indexLoaderWg.Wait()
+	}
 	cache.dg.Close()
 	cache.cg.Release()
 	C.ybc_close(cache.ctx())
@@ -476,10 +818,13 @@ func (cache *Cache) Close() error {
 // files - use Cache.NewSetTxn() instead.
 func (cache *Cache) Set(key []byte, value []byte, ttl time.Duration) error {
 	cache.dg.CheckLive()
+	if cache.isTooLarge(len(value)) {
+		return ErrItemTooLarge
+	}
 	var k C.struct_ybc_key
 	initKey(&k, key)
 	var v C.struct_ybc_value
-	initValue(&v, value, ttl)
+	initValue(&v, value, cache.jitterTtl(ttl))
 	if C.go_item_set(cache.ctx(), k.ptr, k.size, v.ptr, v.size, v.ttl) == 0 {
 		return ErrNoSpace
 	}
@@ -504,6 +849,36 @@ func (cache *Cache) Get(key []byte) (value []byte, err error) {
 	return
 }
 
+// Obtains values for the given keys from the cache in one pass.
+//
+// Stores values for found keys in dst under string(key) and returns keys
+// missing in the cache in the order they appear in keys. This is convenient
+// for cache-aside loaders, which must fetch only missing values
+// from the underlying data source.
+//
+// dst must be non-nil.
+func (cache *Cache) GetMultiInto(keys [][]byte, dst map[string][]byte) (missing [][]byte, err error) {
+	return getMultiInto(cache, keys, dst)
+}
+
+func getMultiInto(c Cacher, keys [][]byte, dst map[string][]byte) (missing [][]byte, err error) {
+	for _, key := range keys {
+		item, err := c.GetItem(key)
+		if err != nil {
+			if err != ErrCacheMiss {
+				return missing, err
+			}
+			missing = append(missing, key)
+			continue
+		}
+		dst[string(key)] = item.Value()
+
+		// do not use defer item.close() for performance reasons
+		item.Close()
+	}
+	return missing, nil
+}
+
 // AppendGet appends value associated with the given key
 // to dst and returns the appended dst (which may be newly allocated)
 func (cache *Cache) AppendGet(dst, key []byte) ([]byte, error) {
@@ -576,11 +951,15 @@ func (cache *Cache) Delete(key []byte) bool {
 // The returned item must be closed with item.Close() call!
 func (cache *Cache) SetItem(key []byte, value []byte, ttl time.Duration) (item *Item, err error) {
 	cache.dg.CheckLive()
+	if cache.isTooLarge(len(value)) {
+		err = ErrItemTooLarge
+		return
+	}
 	item = acquireItem()
 	var k C.struct_ybc_key
 	initKey(&k, key)
 	var v C.struct_ybc_value
-	initValue(&v, value, ttl)
+	initValue(&v, value, cache.jitterTtl(ttl))
 	rv := C.go_set_item_and_value(cache.ctx(), item.ctx(), k.ptr, k.size, v.ptr, v.size, v.ttl)
 	if rv.result == 0 {
 		releaseItem(item)
@@ -592,6 +971,24 @@ func (cache *Cache) SetItem(key []byte, value []byte, ttl time.Duration) (item *
 	return
 }
 
+// Returns value size and remaining ttl for the item with the given key
+// without obtaining the item.
+//
+// exists is false if the item is missing in the cache. Only the cache index
+// is read, so this is cheaper than Cache.GetItem() followed by Item.Close().
+// Use it for existence checks and introspection. An item with different key
+// may be reported in rare cases of key digest collisions.
+func (cache *Cache) GetItemInfo(key []byte) (size int, ttl time.Duration, exists bool) {
+	cache.dg.CheckLive()
+	var k C.struct_ybc_key
+	initKey(&k, key)
+	rv := C.go_get_item_info(cache.ctx(), k.ptr, k.size)
+	if rv.result == 0 {
+		return 0, 0, false
+	}
+	return int(rv.value.size), time.Duration(rv.value.ttl) * time.Millisecond, true
+}
+
 // The same as Cache.Get(), but returns item instead of item's value.
 //
 // Sets err to ErrCacheMiss on cache miss.
@@ -677,11 +1074,18 @@ func (cache *Cache) GetDeAsyncItem(key []byte, graceDuration time.Duration) (ite
 //
 // Returned txn must be finished with txn.Commit*() or txn.Rollback() calls.
 //
+// Sets err to ErrItemTooLarge if valueSize exceeds Config.MaxItemSize.
+//
 // Use this method instead of Cache.Set() for storing big items in the cache
 // such as video files.
 func (cache *Cache) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *SetTxn, err error) {
 	cache.dg.CheckLive()
 	checkNonNegative(valueSize)
+	if cache.isTooLarge(valueSize) {
+		err = ErrItemTooLarge
+		return
+	}
+	ttl = cache.jitterTtl(ttl)
 	if ttl < 0 {
 		ttl = 0
 	}
@@ -712,6 +1116,315 @@ func (cache *Cache) Clear() {
 	C.ybc_clear(cache.ctx())
 }
 
+// Calls f for each item in the cache.
+//
+// The iteration stops if f returns false.
+//
+// The key and the item passed to f are valid only until f returns,
+// so f mustn't close the item or hold references to them. Copy the key
+// and the item's value if they are needed after f returns.
+//
+// Expired items are skipped. Items added or deleted during the iteration
+// may be either visited or skipped.
+func (cache *Cache) Iterate(f func(key []byte, item *Item) bool) {
+	cache.dg.CheckLive()
+	var slotIndex C.size_t
+	for {
+		item := acquireItem()
+		rv := C.go_get_next_item(cache.ctx(), &slotIndex, item.ctx())
+		if rv.result == 0 {
+			releaseItem(item)
+			return
+		}
+		item.value = rv.value
+		item.dg.Init()
+		key := newUnsafeSlice(rv.key.ptr, int(rv.key.size))
+		ok := f(key, item)
+		item.Close()
+		if !ok {
+			return
+		}
+	}
+}
+
+// Returns the number of items in the cache.
+//
+// This method iterates over all the items in the cache, so it may take
+// a while for big caches. See Cache.Iterate().
+func (cache *Cache) Len() int {
+	n := 0
+	cache.Iterate(func(key []byte, item *Item) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Returns the total size of items' keys and values in bytes.
+//
+// The returned size doesn't include per-item metadata, so it is slightly
+// smaller than the space occupied by items in the data file.
+// This method iterates over all the items in the cache, so it may take
+// a while for big caches. See Cache.Iterate().
+func (cache *Cache) SizeBytes() int64 {
+	var size int64
+	cache.Iterate(func(key []byte, item *Item) bool {
+		size += int64(len(key) + item.Size())
+		return true
+	})
+	return size
+}
+
+// Returns the cache capacity in bytes, i.e. the data file size.
+func (cache *Cache) Capacity() int64 {
+	cache.dg.CheckLive()
+	return int64(C.ybc_get_data_file_size(cache.ctx()))
+}
+
+// Copies the cache into cfg.IndexFile and cfg.DataFile without closing
+// the cache.
+//
+// The copy may be opened later with cfg.OpenCache(false), so the rest of cfg
+// must match the config the cache has been opened with. This allows taking
+// online backups of persistent caches.
+//
+// New items cannot be added to the cache while it is copied, so Set*()
+// calls are delayed until the copy is complete. Get*() calls and Item.Close()
+// are delayed as well, since items are acquired and released under the same
+// lock (this doesn't apply to SimpleCache, which has no overwrite
+// protection). Items being added during the copy may be missing in the copy.
+//
+// Returns ErrSnapshotFailed if cfg.IndexFile or cfg.DataFile is empty,
+// refers to non-existing directory, already exists or cannot be created,
+// for instance, due to lack of free space.
+func (cache *Cache) Snapshot(cfg *Config) error {
+	cache.dg.CheckLive()
+	if !isSnapshotFileValid(cfg.IndexFile) || !isSnapshotFileValid(cfg.DataFile) {
+		return ErrSnapshotFailed
+	}
+	indexFileCStr := C.CString(cfg.IndexFile)
+	defer C.free(unsafe.Pointer(indexFileCStr))
+	dataFileCStr := C.CString(cfg.DataFile)
+	defer C.free(unsafe.Pointer(dataFileCStr))
+	if C.ybc_snapshot(cache.ctx(), indexFileCStr, dataFileCStr) == 0 {
+		return ErrSnapshotFailed
+	}
+	return nil
+}
+
+// The C library terminates the process if the snapshot file
+// cannot be created, so check for missing directories beforehand.
+func isSnapshotFileValid(filename string) bool {
+	if filename == "" {
+		return false
+	}
+	fi, err := os.Stat(filepath.Dir(filename))
+	return err == nil && fi.IsDir()
+}
+
+// The number of index slots scanned by a single C call
+// during expired items' removal.
+const expirationScanChunkSize = 64 * 1024
+
+// Removes expired items from the cache.
+//
+// Returns the number of removed items and their total size in bytes.
+// This method scans the whole cache index, so it may take a while
+// for caches with big Config.MaxItemsCount. Consider setting
+// Config.ExpirationScanInterval instead of calling this method.
+//
+// Note that the space occupied by removed items in the data file is reused
+// only after the data file wraps, since the data file is a ring buffer.
+// But index slots occupied by expired items are freed instantly.
+func (cache *Cache) RemoveExpired() (itemsCount int, bytes int64) {
+	cache.dg.CheckLive()
+	var startSlot C.size_t
+	for {
+		var n, size C.size_t
+		isDone := C.ybc_remove_expired_items(cache.ctx(), &startSlot, expirationScanChunkSize, &n, &size) != 0
+		itemsCount += int(n)
+		bytes += int64(size)
+		if isDone {
+			break
+		}
+	}
+	atomic.AddUint64(&cache.removedExpiredItems, uint64(itemsCount))
+	atomic.AddUint64(&cache.removedExpiredBytes, uint64(bytes))
+	atomic.AddUint64(&cache.expirationScans, 1)
+	return
+}
+
+// Returns the number of expired items, which occupy cache index slots,
+// and their total size in bytes.
+//
+// Unlike RemoveExpired(), the method doesn't remove the items, so it may
+// be used for estimating the benefit of RemoveExpired() calls. It scans
+// the whole cache index, so it may take a while for caches with big
+// Config.MaxItemsCount.
+func (cache *Cache) CountExpired() (itemsCount int, bytes int64) {
+	cache.dg.CheckLive()
+	var startSlot C.size_t
+	for {
+		var n, size C.size_t
+		isDone := C.ybc_count_expired_items(cache.ctx(), &startSlot, expirationScanChunkSize, &n, &size) != 0
+		itemsCount += int(n)
+		bytes += int64(size)
+		if isDone {
+			break
+		}
+	}
+	return
+}
+
+// Statistics for expired items' removal.
+type ExpirationStats struct {
+	// The number of expired items removed from the cache.
+	RemovedItems uint64
+
+	// The total size of expired items removed from the cache in bytes.
+	RemovedBytes uint64
+
+	// The number of full index scans for expired items.
+	Scans uint64
+}
+
+// Returns statistics for expired items removed via Cache.RemoveExpired()
+// and Config.ExpirationScanInterval.
+func (cache *Cache) ExpirationStats() ExpirationStats {
+	return ExpirationStats{
+		RemovedItems: atomic.LoadUint64(&cache.removedExpiredItems),
+		RemovedBytes: atomic.LoadUint64(&cache.removedExpiredBytes),
+		Scans:        atomic.LoadUint64(&cache.expirationScans),
+	}
+}
+
+func (cache *Cache) startExpirationScanner(interval time.Duration) {
+	cache.stopExpirationScanner = make(chan struct{})
+	cache.expirationScannerWg.Add(1)
+	go func() {
+		defer cache.expirationScannerWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cache.stopExpirationScanner:
+				return
+			case <-ticker.C:
+				cache.RemoveExpired()
+			}
+		}
+	}()
+}
+
+// The number of index slots scanned by a single C call during compaction.
+//
+// It is smaller than expirationScanChunkSize, since moving live items
+// is much slower than removing expired items.
+const compactionChunkSize = 1024
+
+// Live items located in the oldest 1/compactionTailDivisor part
+// of the data file are moved to the front of the data file by Cache.Compact().
+const compactionTailDivisor = 8
+
+// Statistics for Cache.Compact().
+type CompactionStats struct {
+	// The number of expired items removed from the cache.
+	RemovedItems int
+
+	// The total size of expired items removed from the cache in bytes.
+	// This space in the data file is reused instead of holding live items.
+	ReclaimedBytes int64
+
+	// The number of live items moved to the front of the data file.
+	MovedItems int
+
+	// The total size of moved items in bytes.
+	MovedBytes int64
+
+	// Set to true if the compaction pass over the whole cache index
+	// has been completed.
+	Done bool
+}
+
+// Incrementally defragments the cache data file for up to maxDuration.
+//
+// The data file is a ring buffer, so live items are evicted on the next data
+// file wrap together with expired items surrounding them. Compact() removes
+// expired items from the cache and moves live items located in the oldest
+// part of the data file to its front, so live items survive the wrap while
+// the space occupied by expired items is reclaimed.
+//
+// Each call continues the compaction pass from the place where the previous
+// call stopped, so the method may be called periodically with small
+// maxDuration from cron jobs or admin endpoints without blocking the cache
+// for a long time. CompactionStats.Done is set when the pass is complete.
+// The call may last longer than maxDuration by the time required for moving
+// a single item.
+func (cache *Cache) Compact(maxDuration time.Duration) (stats CompactionStats) {
+	cache.dg.CheckLive()
+	cache.compactionLock.Lock()
+	defer cache.compactionLock.Unlock()
+
+	tailSize := C.ybc_get_data_file_size(cache.ctx()) / compactionTailDivisor
+	deadline := time.Now().Add(maxDuration)
+	for !stats.Done && time.Now().Before(deadline) {
+		var cs C.struct_ybc_compaction_stats
+		stats.Done = C.ybc_compact(cache.ctx(), &cache.compactionSlot, compactionChunkSize, tailSize, &cs) != 0
+		stats.RemovedItems += int(cs.removed_items_count)
+		stats.ReclaimedBytes += int64(cs.removed_bytes)
+		stats.MovedItems += int(cs.moved_items_count)
+		stats.MovedBytes += int64(cs.moved_bytes)
+	}
+	return
+}
+
+// The number of index slots loaded by a single C call
+// during lazy index loading.
+const indexLoadChunkSize = 64 * 1024
+
+// Returns the percent of loaded cache index in the range [0..100].
+//
+// Always returns 100 for caches opened without Config.LazyIndexLoad.
+func (cache *Cache) IndexLoadPercent() int {
+	cache.dg.CheckLive()
+	return int(C.ybc_get_index_load_percent(cache.ctx()))
+}
+
+func (cache *Cache) startIndexLoader() {
+	cache.stopIndexLoader = make(chan struct{})
+	cache.indexLoaderWg.Add(1)
+	go func() {
+		defer cache.indexLoaderWg.Done()
+		for C.ybc_load_index(cache.ctx(), indexLoadChunkSize) == 0 {
+			select {
+			case <-cache.stopIndexLoader:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+func (cache *Cache) isTooLarge(valueSize int) bool {
+	return cache.maxItemSize > 0 && valueSize > cache.maxItemSize
+}
+
+// Applies Config.TtlJitter to the given ttl.
+func (cache *Cache) jitterTtl(ttl time.Duration) time.Duration {
+	if cache.ttlJitter == 0 || ttl <= 0 || ttl >= MaxTtl {
+		return ttl
+	}
+	delta := int64(ttl) / 100 * int64(cache.ttlJitter)
+	if delta <= 0 {
+		return ttl
+	}
+	ttl += time.Duration(rand.Int63n(2*delta+1) - delta)
+	if ttl > MaxTtl {
+		ttl = MaxTtl
+	}
+	return ttl
+}
+
 func (cache *Cache) ctx() *C.struct_ybc {
 	return (*C.struct_ybc)(bufPtr(cache.buf))
 }
@@ -728,6 +1441,12 @@ type SetTxn struct {
 	buf            []byte
 	unsafeBufCache []byte
 	offset         int
+
+	// Called with the whole value before the commit. See TieredCacher.
+	onCommit func(value []byte)
+
+	// Shared with readers obtained via Reader().
+	stream *txnStream
 }
 
 // Commits the truncated transaction.
@@ -750,14 +1469,21 @@ func (txn *SetTxn) Commit() (err error) {
 		txn.Rollback()
 		return
 	}
+	if txn.onCommit != nil {
+		txn.onCommit(buf)
+	}
+	txn.finishStream(nil)
 	C.ybc_set_txn_commit(txn.ctx())
 	txn.finish()
 	return
 }
 
 // Rolls back the transaction.
+//
+// Readers obtained via Reader() return ErrTxnRolledBack after the rollback.
 func (txn *SetTxn) Rollback() {
 	txn.dg.CheckLive()
+	txn.finishStream(ErrTxnRolledBack)
 	C.ybc_set_txn_rollback(txn.ctx())
 	txn.finish()
 }
@@ -769,6 +1495,7 @@ func (txn *SetTxn) Write(p []byte) (n int, err error) {
 
 	n = copy(buf[txn.offset:], p)
 	txn.offset += n
+	txn.updateStream()
 	if n < len(p) {
 		err = io.ErrShortWrite
 		return
@@ -783,6 +1510,7 @@ func (txn *SetTxn) ReadFrom(r io.Reader) (n int64, err error) {
 	buf := txn.unsafeBuf()
 	nn, err = io.ReadFull(r, buf[txn.offset:])
 	txn.offset += nn
+	txn.updateStream()
 	n = int64(nn)
 	return
 }
@@ -806,6 +1534,10 @@ func (txn *SetTxn) CommitItem() (item *Item, err error) {
 		txn.Rollback()
 		return
 	}
+	if txn.onCommit != nil {
+		txn.onCommit(buf)
+	}
+	txn.finishStream(nil)
 	item = acquireItem()
 	item.value = C.go_commit_item_and_value(txn.ctx(), item.ctx())
 	txn.finish()
@@ -823,6 +1555,8 @@ func (txn *SetTxn) finish() {
 	txn.dg.Close()
 	txn.unsafeBufCache = nil
 	txn.offset = 0
+	txn.onCommit = nil
+	txn.stream = nil
 	releaseSetTxn(txn)
 }
 
@@ -839,19 +1573,169 @@ func (txn *SetTxn) ctx() *C.struct_ybc_set_txn {
 	return (*C.struct_ybc_set_txn)(bufPtr(txn.buf))
 }
 
-/*******************************************************************************
- * Item
- ******************************************************************************/
-
-// Cache item.
-type Item struct {
-	dg     debugGuard
-	buf    []byte
-	value  C.struct_ybc_value
-	offset int
+// Returns a reader for the value being written in the transaction.
+//
+// The reader returns bytes already written to the transaction and blocks
+// until more bytes are written. It returns io.EOF only after the transaction
+// is committed, while ErrTxnRolledBack is returned after the rollback.
+// This allows streaming the value to other consumers while it is stored
+// in the cache.
+//
+// The reader may be used from other goroutines and it remains usable after
+// the transaction is finished. Bytes not read by the time of the commit are
+// copied to the heap, so the cache may freely reuse the memory occupied
+// by the committed item.
+//
+// Reader() must be called by the goroutine writing to the transaction.
+// Multiple readers may be obtained. Each reader must be closed via Close().
+func (txn *SetTxn) Reader() *SetTxnReader {
+	txn.dg.CheckLive()
+	if txn.stream == nil {
+		s := &txnStream{
+			buf:     txn.unsafeBuf(),
+			written: txn.offset,
+			readers: make(map[*SetTxnReader]struct{}),
+		}
+		s.cond.L = &s.mu
+		txn.stream = s
+	}
+	r := &SetTxnReader{
+		s: txn.stream,
+	}
+	txn.stream.mu.Lock()
+	txn.stream.readers[r] = struct{}{}
+	txn.stream.mu.Unlock()
+	return r
 }
 
-// Closes the item.
+// Notifies readers about newly written bytes.
+func (txn *SetTxn) updateStream() {
+	s := txn.stream
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.written = txn.offset
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// Detaches readers from the transaction buffer before the commit
+// or the rollback.
+func (txn *SetTxn) finishStream(err error) {
+	s := txn.stream
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if err == nil {
+		// Copy unread bytes to the heap, since the buffer belongs
+		// to the cache after the commit.
+		buf := txn.unsafeBuf()
+		minOffset := len(buf)
+		for r := range s.readers {
+			if r.offset < minOffset {
+				minOffset = r.offset
+			}
+		}
+		s.tail = append([]byte(nil), buf[minOffset:]...)
+		s.tailOffset = minOffset
+		s.size = len(buf)
+	}
+	s.err = err
+	s.finished = true
+	s.buf = nil
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// State shared between SetTxn and its readers.
+type txnStream struct {
+	mu   sync.Mutex
+	cond sync.Cond
+
+	// The transaction buffer. It is valid until finished is set.
+	buf     []byte
+	written int
+
+	// The value tail starting at tailOffset, which is available
+	// to readers after the commit.
+	tail       []byte
+	tailOffset int
+	size       int
+
+	readers  map[*SetTxnReader]struct{}
+	finished bool
+	err      error
+}
+
+// Reader for the value being written in SetTxn.
+//
+// See SetTxn.Reader() for details.
+type SetTxnReader struct {
+	s      *txnStream
+	offset int
+	closed bool
+}
+
+// io.Reader interface implementation.
+//
+// Blocks until new bytes are written to the transaction or the transaction
+// is finished.
+func (r *SetTxnReader) Read(p []byte) (n int, err error) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for !s.finished && r.offset >= s.written {
+		s.cond.Wait()
+	}
+	if !s.finished {
+		n = copy(p, s.buf[r.offset:s.written])
+		r.offset += n
+		return
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if r.offset >= s.size {
+		return 0, io.EOF
+	}
+	n = copy(p, s.tail[r.offset-s.tailOffset:])
+	r.offset += n
+	return
+}
+
+// Closes the reader.
+func (r *SetTxnReader) Close() error {
+	s := r.s
+	s.mu.Lock()
+	delete(s.readers, r)
+	r.closed = true
+	s.mu.Unlock()
+	return nil
+}
+
+/*******************************************************************************
+ * Item
+ ******************************************************************************/
+
+// Cache item.
+//
+// Item implements io.Reader, io.ReaderAt, io.Seeker and io.WriterTo,
+// so it may be passed to standard library consumers such as
+// http.ServeContent, which handles Range and conditional requests.
+type Item struct {
+	dg     debugGuard
+	buf    []byte
+	value  C.struct_ybc_value
+	offset int
+}
+
+// Closes the item.
 //
 // Every opened item must be closed only once!
 func (item *Item) Close() error {
@@ -909,13 +1793,14 @@ func (item *Item) Ttl() time.Duration {
 func (item *Item) Seek(offset int64, whence int) (ret int64, err error) {
 	bufSize := int64(len(item.unsafeBuf()))
 	switch whence {
-	case 0:
-	case 1:
+	case io.SeekStart:
+	case io.SeekCurrent:
 		offset += int64(item.offset)
-	case 2:
+	case io.SeekEnd:
 		offset += bufSize
 	default:
-		panic("unsupported whence")
+		err = errors.New("ybc.Item.Seek: invalid whence")
+		return
 	}
 	if offset > bufSize || offset < 0 {
 		err = ErrOutOfRange
@@ -953,7 +1838,7 @@ func (item *Item) Read(p []byte) (n int, err error) {
 // io.ReaderAt interface implementation
 func (item *Item) ReadAt(p []byte, offset int64) (n int, err error) {
 	buf := item.unsafeBuf()
-	if offset > int64(len(buf)) {
+	if offset > int64(len(buf)) || offset < 0 {
 		err = ErrOutOfRange
 		return
 	}
@@ -969,9 +1854,13 @@ func (item *Item) ReadAt(p []byte, offset int64) (n int, err error) {
 func (item *Item) WriteTo(w io.Writer) (n int64, err error) {
 	var nn int
 	buf := item.unsafeBuf()
-	nn, err = w.Write(buf[item.offset:])
+	b := buf[item.offset:]
+	nn, err = w.Write(b)
 	item.offset += nn
 	n = int64(nn)
+	if err == nil && nn < len(b) {
+		err = io.ErrShortWrite
+	}
 	return
 }
 
@@ -1029,24 +1918,66 @@ func (cfg ClusterConfig) OpenCluster(force bool) (cluster *Cluster, err error) {
 			return
 		}
 		openedCachesCount++
-		slotsCount += cfg[i].MaxItemsCount
+		slotsCount += cfg[i].clusterWeight()
 		maxSlotIndexes[i] = slotsCount
 	}
 
+	keyHash := seededKeyHash()
+	if cachesCount > 0 && cfg[0].KeyHash != nil {
+		keyHash = cfg[0].KeyHash
+	} else if cfg.isPersistent() {
+		keyHash = FNVKeyHash
+	}
 	cluster = &Cluster{
 		caches:         caches,
+		shards:         make([]shardHealth, cachesCount),
+		configs:        cfg,
 		slotsCount:     slotsCount,
 		maxSlotIndexes: maxSlotIndexes,
+		keyHash:        keyHash,
 	}
 	cluster.dg.Init()
 	return
 }
 
+func (cfg *Config) clusterWeight() SizeT {
+	if cfg.ClusterWeight != 0 {
+		return cfg.ClusterWeight
+	}
+	return cfg.MaxItemsCount
+}
+
+func (cfg ClusterConfig) isPersistent() bool {
+	for _, c := range cfg {
+		if c.IndexFile != "" || c.DataFile != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg ClusterConfig) filesExist() bool {
+	for _, c := range cfg {
+		for _, path := range []string{c.IndexFile, c.DataFile} {
+			if path == "" {
+				continue
+			}
+			if _, err := os.Stat(path); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Removes all files associated with the cluster.
 func (cfg ClusterConfig) RemoveCluster() {
 	for _, c := range cfg {
 		c.RemoveCache()
 	}
+	if cfg.isPersistent() {
+		os.Remove(cfg.keyHashMarkerFile())
+	}
 }
 
 /*******************************************************************************
@@ -1057,14 +1988,66 @@ func (cfg ClusterConfig) RemoveCluster() {
 type Cluster struct {
 	dg             debugGuard
 	caches         []*Cache
+	shards         []shardHealth
+	configs        ClusterConfig
 	slotsCount     SizeT
 	maxSlotIndexes []SizeT
+	keyHash        KeyHashFunc
+
+	stopHealthMonitor chan struct{}
+	healthMonitorWg   sync.WaitGroup
+}
+
+// See Cache.RemoveExpired()
+func (cluster *Cluster) RemoveExpired() (itemsCount int, bytes int64) {
+	cluster.dg.CheckLive()
+	for i, cache := range cluster.caches {
+		if cluster.isShardFailed(i) {
+			continue
+		}
+		n, size := cache.RemoveExpired()
+		itemsCount += n
+		bytes += size
+	}
+	return
+}
+
+// See Cache.CountExpired()
+func (cluster *Cluster) CountExpired() (itemsCount int, bytes int64) {
+	cluster.dg.CheckLive()
+	for i, cache := range cluster.caches {
+		if cluster.isShardFailed(i) {
+			continue
+		}
+		n, size := cache.CountExpired()
+		itemsCount += n
+		bytes += size
+	}
+	return
+}
+
+// Returns summary expiration stats for all the caches in the cluster.
+//
+// See Cache.ExpirationStats()
+func (cluster *Cluster) ExpirationStats() ExpirationStats {
+	var stats ExpirationStats
+	for _, cache := range cluster.caches {
+		s := cache.ExpirationStats()
+		stats.RemovedItems += s.RemovedItems
+		stats.RemovedBytes += s.RemovedBytes
+		stats.Scans += s.Scans
+	}
+	return stats
 }
 
 // Closes the cluster.
 //
 // Each opened cluster must be closed only once!
 func (cluster *Cluster) Close() error {
+	if cluster.stopHealthMonitor != nil {
+		close(cluster.stopHealthMonitor)
+		cluster.healthMonitorWg.Wait()
+	}
 	cluster.dg.Close()
 	cachesCount := len(cluster.caches)
 	for i := 0; i < cachesCount; i++ {
@@ -1075,78 +2058,1360 @@ func (cluster *Cluster) Close() error {
 
 // See Cache.Set()
 func (cluster *Cluster) Set(key []byte, value []byte, ttl time.Duration) error {
-	return cluster.cache(key).Set(key, value, ttl)
+	cache := cluster.cache(key)
+	if cache == nil {
+		// Writes to failed shards are silently dropped.
+		return nil
+	}
+	return cache.Set(key, value, ttl)
 }
 
 // See Cache.Get()
 func (cluster *Cluster) Get(key []byte) (value []byte, err error) {
-	return cluster.cache(key).Get(key)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.Get(key)
+}
+
+// See Cache.GetMultiInto()
+func (cluster *Cluster) GetMultiInto(keys [][]byte, dst map[string][]byte) (missing [][]byte, err error) {
+	return getMultiInto(cluster, keys, dst)
 }
 
 // See Cache.AppendGet()
 func (cluster *Cluster) AppendGet(dst, key []byte) ([]byte, error) {
-	return cluster.cache(key).AppendGet(dst, key)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return dst, ErrCacheMiss
+	}
+	return cache.AppendGet(dst, key)
 }
 
 // See Cache.GetDe()
 func (cluster *Cluster) GetDe(key []byte, graceDuration time.Duration) (value []byte, err error) {
-	return cluster.cache(key).GetDe(key, graceDuration)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.GetDe(key, graceDuration)
 }
 
 // See Cache.GetDeAsync()
 func (cluster *Cluster) GetDeAsync(key []byte, graceDuration time.Duration) (value []byte, err error) {
-	return cluster.cache(key).GetDeAsync(key, graceDuration)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.GetDeAsync(key, graceDuration)
 }
 
 // See Cache.Delete()
 func (cluster *Cluster) Delete(key []byte) bool {
-	return cluster.cache(key).Delete(key)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return false
+	}
+	return cache.Delete(key)
 }
 
 // See Cache.SetItem()
 func (cluster *Cluster) SetItem(key []byte, value []byte, ttl time.Duration) (item *Item, err error) {
-	return cluster.cache(key).SetItem(key, value, ttl)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrNoSpace
+	}
+	return cache.SetItem(key, value, ttl)
 }
 
 // See Cache.GetItem()
 func (cluster *Cluster) GetItem(key []byte) (item *Item, err error) {
-	return cluster.cache(key).GetItem(key)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.GetItem(key)
+}
+
+// See Cache.GetItemInfo()
+func (cluster *Cluster) GetItemInfo(key []byte) (size int, ttl time.Duration, exists bool) {
+	cache := cluster.cache(key)
+	if cache == nil {
+		return 0, 0, false
+	}
+	return cache.GetItemInfo(key)
 }
 
 // See Cache.GetDeItem()
 func (cluster *Cluster) GetDeItem(key []byte, graceDuration time.Duration) (item *Item, err error) {
-	return cluster.cache(key).GetDeItem(key, graceDuration)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.GetDeItem(key, graceDuration)
 }
 
 // See Cache.GetDeAsyncItem()
 func (cluster *Cluster) GetDeAsyncItem(key []byte, graceDuration time.Duration) (item *Item, err error) {
-	return cluster.cache(key).GetDeAsyncItem(key, graceDuration)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return cache.GetDeAsyncItem(key, graceDuration)
 }
 
 // See Cache.NewSetTxn()
 func (cluster *Cluster) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *SetTxn, err error) {
-	return cluster.cache(key).NewSetTxn(key, valueSize, ttl)
+	cache := cluster.cache(key)
+	if cache == nil {
+		return nil, ErrNoSpace
+	}
+	return cache.NewSetTxn(key, valueSize, ttl)
 }
 
 // See Cache.Clear()
 func (cluster *Cluster) Clear() {
-	for _, cache := range cluster.caches {
+	for i, cache := range cluster.caches {
+		if cluster.isShardFailed(i) {
+			continue
+		}
 		cache.Clear()
 	}
 }
 
+// See Cache.Iterate()
+//
+// Caches marked as failed are skipped.
+func (cluster *Cluster) Iterate(f func(key []byte, item *Item) bool) {
+	cluster.dg.CheckLive()
+	for i, cache := range cluster.caches {
+		if cluster.isShardFailed(i) {
+			continue
+		}
+		ok := true
+		cache.Iterate(func(key []byte, item *Item) bool {
+			ok = f(key, item)
+			return ok
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// See Cache.Len()
+//
+// Items stored in caches marked as failed aren't counted.
+func (cluster *Cluster) Len() int {
+	cluster.dg.CheckLive()
+	n := 0
+	for i, cache := range cluster.caches {
+		if !cluster.isShardFailed(i) {
+			n += cache.Len()
+		}
+	}
+	return n
+}
+
+// See Cache.SizeBytes()
+//
+// Items stored in caches marked as failed aren't counted.
+func (cluster *Cluster) SizeBytes() int64 {
+	cluster.dg.CheckLive()
+	var size int64
+	for i, cache := range cluster.caches {
+		if !cluster.isShardFailed(i) {
+			size += cache.SizeBytes()
+		}
+	}
+	return size
+}
+
+// Returns the total capacity of all the caches in the cluster in bytes.
+func (cluster *Cluster) Capacity() int64 {
+	cluster.dg.CheckLive()
+	var capacity int64
+	for _, cache := range cluster.caches {
+		capacity += cache.Capacity()
+	}
+	return capacity
+}
+
+// Copies caches in the cluster into files from the given cfg.
+//
+// cfg must contain a config per each cache in the cluster. Caches are copied
+// one by one, so the copy of each cache is consistent, while the copy
+// of the whole cluster isn't a point-in-time copy.
+// The copy may be opened later with cfg.OpenCluster(false). Keys are
+// distributed among caches with the cluster's key hash, so the copy must be
+// opened with the same key hash. See Config.KeyHash.
+//
+// Already created copies are removed on error. See Cache.Snapshot().
+func (cluster *Cluster) Snapshot(cfg ClusterConfig) error {
+	cluster.dg.CheckLive()
+	if len(cfg) != len(cluster.caches) {
+		return ErrSnapshotFailed
+	}
+	for i, cache := range cluster.caches {
+		if err := cache.Snapshot(cfg[i]); err != nil {
+			for j := 0; j < i; j++ {
+				cfg[j].RemoveCache()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns cache for the given key.
+//
+// Returns nil if the cache is marked as failed.
 func (cluster *Cluster) cache(key []byte) *Cache {
+	i := cluster.shardIndex(key)
+	if cluster.isShardFailed(i) {
+		return nil
+	}
+	return cluster.caches[i]
+}
+
+func (cluster *Cluster) shardIndex(key []byte) int {
 	cluster.dg.CheckLive()
-	h := fnv.New64a()
-	h.Write(key)
-	idx := SizeT(h.Sum64()) % cluster.slotsCount
+	idx := SizeT(cluster.keyHash(key)) % cluster.slotsCount
 
 	maxSlotIndexes := cluster.maxSlotIndexes
 	i := 0
 	for idx >= maxSlotIndexes[i] {
 		i++
 	}
-	return cluster.caches[i]
+	return i
+}
+
+/*******************************************************************************
+ * Cluster health
+ ******************************************************************************/
+
+// Health state of a single cache in the cluster.
+type shardHealth struct {
+	// Must be at the beginning of the struct for proper alignment
+	// of 64-bit atomic operations on 32-bit platforms.
+	failures   uint64
+	recoveries uint64
+
+	failed uint32
+
+	// Protects lastErr.
+	mu      sync.Mutex
+	lastErr error
+
+	// The offset for the next probe read from backing files.
+	probeOffset int64
+}
+
+// Health stats for a single cache in the cluster.
+type ShardHealth struct {
+	// Whether the cache is marked as failed.
+	//
+	// Failed caches are miss-only - lookups for keys stored in failed
+	// caches return ErrCacheMiss, while writes are dropped.
+	Failed bool
+
+	// The number of times the cache has been marked as failed.
+	Failures uint64
+
+	// The number of times the cache has been recovered after failure.
+	Recoveries uint64
+
+	// The last error, which resulted in cache failure.
+	LastErr error
+}
+
+// Event passed to the callback registered via Cluster.StartHealthMonitor().
+type ShardEvent struct {
+	// Index of the cache in the ClusterConfig.
+	Shard int
+
+	// Whether the cache has been recovered after failure.
+	// Otherwise the cache has been marked as failed.
+	Recovered bool
+
+	// The error, which resulted in cache failure.
+	Err error
+}
+
+// The size of probe reads from backing files of cluster caches.
+const healthProbeSize = 4096
+
+// Starts background health monitoring for caches in the cluster.
+//
+// Backing files for each cache are probed with the given interval by reading
+// small chunks at various offsets. A cache is marked as failed if its' files
+// cannot be read, for instance, due to I/O errors. Failed caches are
+// miss-only, so the rest of the cluster continues working. Failed caches are
+// probed with the same interval and are recovered after their files become
+// readable again. Items stored in a cache are discarded on recovery, since
+// they may be broken.
+//
+// onEvent is called for each failure and recovery if it isn't nil.
+//
+// The monitor is stopped on cluster.Close() call.
+func (cluster *Cluster) StartHealthMonitor(interval time.Duration, onEvent func(e ShardEvent)) {
+	cluster.dg.CheckLive()
+	if cluster.stopHealthMonitor != nil {
+		panic("BUG: cluster health monitor is already started")
+	}
+	cluster.stopHealthMonitor = make(chan struct{})
+	cluster.healthMonitorWg.Add(1)
+	go func() {
+		defer cluster.healthMonitorWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cluster.stopHealthMonitor:
+				return
+			case <-ticker.C:
+				cluster.checkHealth(onEvent)
+			}
+		}
+	}()
+}
+
+// Marks the cache with the given index in the ClusterConfig as failed.
+//
+// This may be used for reporting errors detected outside the cluster.
+// Returns false if the cache is already marked as failed.
+func (cluster *Cluster) MarkShardFailed(shard int, err error) bool {
+	sh := &cluster.shards[shard]
+	if !atomic.CompareAndSwapUint32(&sh.failed, 0, 1) {
+		return false
+	}
+	atomic.AddUint64(&sh.failures, 1)
+	sh.mu.Lock()
+	sh.lastErr = err
+	sh.mu.Unlock()
+	return true
+}
+
+// Returns health stats for each cache in the cluster in the ClusterConfig
+// order.
+func (cluster *Cluster) ShardsHealth() []ShardHealth {
+	cluster.dg.CheckLive()
+	hs := make([]ShardHealth, len(cluster.shards))
+	for i := range cluster.shards {
+		sh := &cluster.shards[i]
+		sh.mu.Lock()
+		lastErr := sh.lastErr
+		sh.mu.Unlock()
+		hs[i] = ShardHealth{
+			Failed:     cluster.isShardFailed(i),
+			Failures:   atomic.LoadUint64(&sh.failures),
+			Recoveries: atomic.LoadUint64(&sh.recoveries),
+			LastErr:    lastErr,
+		}
+	}
+	return hs
+}
+
+func (cluster *Cluster) isShardFailed(shard int) bool {
+	return atomic.LoadUint32(&cluster.shards[shard].failed) != 0
+}
+
+func (cluster *Cluster) checkHealth(onEvent func(e ShardEvent)) {
+	for i := range cluster.shards {
+		err := cluster.probeShard(i)
+		if err != nil {
+			if cluster.MarkShardFailed(i, err) && onEvent != nil {
+				onEvent(ShardEvent{
+					Shard: i,
+					Err:   err,
+				})
+			}
+			continue
+		}
+		if !cluster.isShardFailed(i) {
+			continue
+		}
+
+		// The cache could miss writes and could be partially overwritten
+		// while failed, so discard its' contents.
+		cluster.caches[i].Clear()
+		sh := &cluster.shards[i]
+		atomic.AddUint64(&sh.recoveries, 1)
+		atomic.StoreUint32(&sh.failed, 0)
+		if onEvent != nil {
+			onEvent(ShardEvent{
+				Shard:     i,
+				Recovered: true,
+			})
+		}
+	}
+}
+
+// Reads a small chunk from each backing file of the cache.
+//
+// Reading via file descriptor returns I/O errors instead of crashing
+// the process with SIGBUS as it may happen when accessing broken
+// memory-mapped files.
+func (cluster *Cluster) probeShard(shard int) error {
+	cfg := cluster.configs[shard]
+	sh := &cluster.shards[shard]
+	for _, path := range []string{cfg.IndexFile, cfg.DataFile} {
+		if path == "" {
+			// Anonymous caches have no backing files.
+			continue
+		}
+		if err := probeFile(path, &sh.probeOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func probeFile(path string, offset *int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return fmt.Errorf("ybc: empty cache file %q", path)
+	}
+	off := *offset % size
+	*offset += 1024 * 1024
+	var buf [healthProbeSize]byte
+	if _, err = f.ReadAt(buf[:], off); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * TieredCacher
+ ******************************************************************************/
+
+// The number of hit counters in TieredCacher.
+//
+// Keys are mapped to counters by hash, so the memory usage doesn't depend
+// on the number of keys.
+const tieredHitCountersCount = 64 * 1024
+
+// Policy for promoting items from the second tier to the first tier
+// in TieredCacher.
+type PromotePolicy struct {
+	// The number of hits in the second tier after which the item
+	// is promoted to the first tier.
+	//
+	// Items are promoted on the first hit by default.
+	Hits int
+
+	// The maximum size of items stored in the first tier.
+	// Bigger items are stored only in the second tier.
+	//
+	// Item sizes aren't limited by default.
+	MaxItemSize int
+}
+
+// Stats for TieredCacher.
+type TieredCacherStats struct {
+	// The number of hits in the first tier.
+	L1Hits uint64
+
+	// The number of hits in the second tier.
+	L2Hits uint64
+
+	// The number of items promoted to the first tier.
+	Promotions uint64
+}
+
+// Two-level cache hierarchy such as small in-memory cache in front
+// of big cache backed by files.
+//
+// Reads are served from the first tier (l1) if possible. Otherwise they
+// fall back to the second tier (l2), promoting frequently accessed items
+// to l1 according to PromotePolicy. Writes go to both tiers.
+//
+// l2 is authoritative, so items may disappear from l1 at any time.
+// Grace durations in GetDe*() calls apply only to l2.
+//
+// Usage:
+//
+//   ram, _ := ramConfig.OpenCache(true)
+//   files, _ := filesConfig.OpenCache(true)
+//   cache := NewTieredCacher(ram, files, &PromotePolicy{Hits: 2})
+//   defer cache.Close()
+//   ...
+//   value, err := cache.Get(key)
+type TieredCacher struct {
+	// Must be at the beginning of the struct for proper alignment
+	// of 64-bit atomic operations on 32-bit platforms.
+	stats TieredCacherStats
+
+	l1     Cacher
+	l2     Cacher
+	policy PromotePolicy
+
+	// Nil if items are promoted on the first hit.
+	hitCounters []uint32
+	keyHash     KeyHashFunc
+}
+
+// Creates new TieredCacher on top of l1 and l2.
+//
+// The default PromotePolicy is used if policy is nil.
+// TieredCacher owns l1 and l2, i.e. they are closed by TieredCacher.Close().
+func NewTieredCacher(l1, l2 Cacher, policy *PromotePolicy) *TieredCacher {
+	c := &TieredCacher{
+		l1: l1,
+		l2: l2,
+	}
+	if policy != nil {
+		c.policy = *policy
+	}
+	if c.policy.Hits > 1 {
+		c.hitCounters = make([]uint32, tieredHitCountersCount)
+		c.keyHash = seededKeyHash()
+	}
+	return c
+}
+
+// Returns stats for the cache.
+func (c *TieredCacher) Stats() TieredCacherStats {
+	return TieredCacherStats{
+		L1Hits:     atomic.LoadUint64(&c.stats.L1Hits),
+		L2Hits:     atomic.LoadUint64(&c.stats.L2Hits),
+		Promotions: atomic.LoadUint64(&c.stats.Promotions),
+	}
+}
+
+func (c *TieredCacher) fitsL1(size int) bool {
+	return c.policy.MaxItemSize <= 0 || size <= c.policy.MaxItemSize
+}
+
+func (c *TieredCacher) setL1(key, value []byte, ttl time.Duration) {
+	if c.fitsL1(len(value)) {
+		c.l1.Set(key, value, ttl)
+	}
+}
+
+// Registers the hit in l2 and promotes the item to l1 if required.
+func (c *TieredCacher) registerL2Hit(key []byte, item *Item) {
+	atomic.AddUint64(&c.stats.L2Hits, 1)
+	if !c.fitsL1(item.Size()) {
+		return
+	}
+	if c.hitCounters != nil {
+		counter := &c.hitCounters[c.keyHash(key)%uint64(len(c.hitCounters))]
+		if atomic.AddUint32(counter, 1) < uint32(c.policy.Hits) {
+			return
+		}
+		atomic.StoreUint32(counter, 0)
+	}
+	ttl := item.Ttl()
+	if ttl <= 0 {
+		return
+	}
+	c.l1.Set(key, item.Peek(), ttl)
+	atomic.AddUint64(&c.stats.Promotions, 1)
+}
+
+func (c *TieredCacher) getItem(key []byte, getL2Item func() (*Item, error)) (*Item, error) {
+	if item, err := c.l1.GetItem(key); err == nil {
+		atomic.AddUint64(&c.stats.L1Hits, 1)
+		return item, nil
+	}
+	item, err := getL2Item()
+	if err == nil {
+		c.registerL2Hit(key, item)
+	}
+	return item, err
+}
+
+func tieredItemValue(dst []byte, item *Item, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, item.Peek()...)
+	item.Close()
+	return dst, nil
+}
+
+func (c *TieredCacher) Set(key []byte, value []byte, ttl time.Duration) error {
+	if err := c.l2.Set(key, value, ttl); err != nil {
+		return err
+	}
+	c.setL1(key, value, ttl)
+	return nil
+}
+
+func (c *TieredCacher) Get(key []byte) ([]byte, error) {
+	item, err := c.GetItem(key)
+	return tieredItemValue(nil, item, err)
+}
+
+func (c *TieredCacher) AppendGet(dst, key []byte) ([]byte, error) {
+	item, err := c.GetItem(key)
+	return tieredItemValue(dst, item, err)
+}
+
+func (c *TieredCacher) GetDe(key []byte, graceDuration time.Duration) ([]byte, error) {
+	item, err := c.GetDeItem(key, graceDuration)
+	return tieredItemValue(nil, item, err)
+}
+
+func (c *TieredCacher) GetDeAsync(key []byte, graceDuration time.Duration) ([]byte, error) {
+	item, err := c.GetDeAsyncItem(key, graceDuration)
+	return tieredItemValue(nil, item, err)
+}
+
+func (c *TieredCacher) SetItem(key []byte, value []byte, ttl time.Duration) (*Item, error) {
+	item, err := c.l2.SetItem(key, value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	c.setL1(key, value, ttl)
+	return item, nil
+}
+
+func (c *TieredCacher) GetItem(key []byte) (*Item, error) {
+	return c.getItem(key, func() (*Item, error) {
+		return c.l2.GetItem(key)
+	})
+}
+
+func (c *TieredCacher) GetDeItem(key []byte, graceDuration time.Duration) (*Item, error) {
+	return c.getItem(key, func() (*Item, error) {
+		return c.l2.GetDeItem(key, graceDuration)
+	})
+}
+
+func (c *TieredCacher) GetDeAsyncItem(key []byte, graceDuration time.Duration) (*Item, error) {
+	return c.getItem(key, func() (*Item, error) {
+		return c.l2.GetDeAsyncItem(key, graceDuration)
+	})
+}
+
+// The value is written to l2 via the returned transaction. It is written
+// to l1 on commit if it fits PromotePolicy.MaxItemSize.
+func (c *TieredCacher) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (*SetTxn, error) {
+	c.l1.Delete(key)
+	txn, err := c.l2.NewSetTxn(key, valueSize, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if c.fitsL1(valueSize) {
+		key = append([]byte(nil), key...)
+		txn.onCommit = func(value []byte) {
+			c.l1.Set(key, value, ttl)
+		}
+	}
+	return txn, nil
+}
+
+func (c *TieredCacher) Delete(key []byte) bool {
+	c.l1.Delete(key)
+	return c.l2.Delete(key)
+}
+
+func (c *TieredCacher) Clear() {
+	c.l1.Clear()
+	c.l2.Clear()
+}
+
+func (c *TieredCacher) Close() error {
+	err := c.l1.Close()
+	if err2 := c.l2.Close(); err2 != nil {
+		err = err2
+	}
+	return err
+}
+
+/*******************************************************************************
+ * EncryptedCacher
+ ******************************************************************************/
+
+// Returns the key for EncryptedCacher.
+//
+// The key must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256
+// respectively. Arbitrary key sources such as KMS may be plugged in
+// via custom KeyProvider implementations.
+type KeyProvider func() ([]byte, error)
+
+// Returns KeyProvider reading hex- or base64-encoded key from the given file.
+//
+// Leading and trailing whitespace is ignored. Use RawKeyFromFile for files
+// containing raw key bytes.
+func KeyFromFile(filename string) KeyProvider {
+	return func() ([]byte, error) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return decodeEncryptionKey(string(data))
+	}
+}
+
+// Returns KeyProvider reading raw key bytes from the given file.
+//
+// The file is used as is, so it must contain exactly 16, 24 or 32 bytes.
+// Raw keys are separated from encoded keys, since encoded keys may have
+// valid raw key size. For instance, hex-encoded 16-byte key is 32 bytes long.
+func RawKeyFromFile(filename string) KeyProvider {
+	return func() ([]byte, error) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !isValidEncryptionKeySize(len(data)) {
+			return nil, ErrInvalidEncryptionKey
+		}
+		return data, nil
+	}
+}
+
+// Returns KeyProvider reading hex- or base64-encoded key from the given
+// environment variable.
+func KeyFromEnv(name string) KeyProvider {
+	return func() ([]byte, error) {
+		s := os.Getenv(name)
+		if s == "" {
+			return nil, fmt.Errorf("ybc: missing encryption key in the environment variable %q", name)
+		}
+		return decodeEncryptionKey(s)
+	}
+}
+
+func isValidEncryptionKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+func decodeEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && isValidEncryptionKeySize(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && isValidEncryptionKeySize(len(key)) {
+		return key, nil
+	}
+	return nil, ErrInvalidEncryptionKey
+}
+
+// Cache wrapper, which transparently encrypts values with AES-GCM.
+//
+// Values are encrypted before storing them in the underlying cache
+// and decrypted after reading them from the underlying cache, so values
+// never hit cache files in plaintext. Keys aren't encrypted, so hash
+// sensitive keys before passing them to the cache.
+//
+// Each value is sealed with a random nonce and is bound to its' key,
+// so values cannot be swapped between keys by tampering with cache files.
+// Values, which cannot be decrypted (for instance, after key rotation
+// or file corruption), are deleted and reported as ErrCacheMiss.
+//
+// Encryption adds 28 bytes to each value.
+//
+// Usage:
+//
+//   files, _ := filesConfig.OpenSimpleCache(true)
+//   cache, err := NewEncryptedCacher(files, KeyFromFile("/etc/ybc/cache.key"))
+//   if err != nil {
+//     log.Fatalf("Cannot initialize encryption: [%s]", err)
+//   }
+//   defer cache.Close()
+//   ...
+//   value, err := cache.Get(key)
+//
+// Item-based Cacher methods aren't supported, since they expose
+// values stored in the underlying cache as is.
+type EncryptedCacher struct {
+	cache SimpleCacher
+	aead  cipher.AEAD
+}
+
+// Creates new EncryptedCacher on top of the given cache with the key
+// obtained from keyProvider.
+//
+// EncryptedCacher owns the cache, i.e. it is closed
+// by EncryptedCacher.Close().
+func NewEncryptedCacher(cache SimpleCacher, keyProvider KeyProvider) (*EncryptedCacher, error) {
+	key, err := keyProvider()
+	if err != nil {
+		return nil, err
+	}
+	if !isValidEncryptionKeySize(len(key)) {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedCacher{
+		cache: cache,
+		aead:  aead,
+	}, nil
+}
+
+func (c *EncryptedCacher) seal(key, value []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	buf := make([]byte, nonceSize, nonceSize+len(value)+c.aead.Overhead())
+	if _, err := io.ReadFull(crand.Reader, buf); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(buf, buf, value, key), nil
+}
+
+func (c *EncryptedCacher) open(dst, key, buf []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(buf) < nonceSize {
+		c.cache.Delete(key)
+		return nil, ErrCacheMiss
+	}
+	value, err := c.aead.Open(dst, buf[:nonceSize], buf[nonceSize:], key)
+	if err != nil {
+		c.cache.Delete(key)
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (c *EncryptedCacher) Set(key []byte, value []byte, ttl time.Duration) error {
+	buf, err := c.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(key, buf, ttl)
+}
+
+func (c *EncryptedCacher) Get(key []byte) ([]byte, error) {
+	return c.AppendGet(nil, key)
+}
+
+func (c *EncryptedCacher) AppendGet(dst, key []byte) ([]byte, error) {
+	buf, err := c.cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(dst, key, buf)
+}
+
+func (c *EncryptedCacher) Delete(key []byte) bool {
+	return c.cache.Delete(key)
+}
+
+func (c *EncryptedCacher) Clear() {
+	c.cache.Clear()
+}
+
+func (c *EncryptedCacher) Close() error {
+	return c.cache.Close()
+}
+
+/*******************************************************************************
+ * CasStore
+ ******************************************************************************/
+
+// SHA-256 hash of a blob stored in CasStore.
+type CasHash [sha256.Size]byte
+
+// Returns hex-encoded hash.
+func (h CasHash) String() string {
+	return fmt.Sprintf("%x", h[:])
+}
+
+// Content-addressable blob storage on top of a Cacher.
+//
+// Blobs are stored under their SHA-256 hash, so identical blobs occupy
+// cache space only once. Each blob has a reference count, which is
+// incremented by Put() and decremented by Release(). The blob is deleted
+// when the last reference is released.
+//
+// Usage:
+//
+//   s := NewCasStore(cache)
+//   hash, err := s.Put(data)
+//   ... store hash instead of data ...
+//   data, err = s.Get(hash)
+//   ...
+//   err = s.Release(hash)
+//
+// Blobs and reference counts are stored as ordinary cache items, so they
+// may be evicted from the cache like any other item. Get() returns
+// ErrCacheMiss for evicted blobs. CasStore serializes reference count
+// updates only among goroutines sharing the same CasStore.
+type CasStore struct {
+	cache Cacher
+	kl    *KeyLocker
+}
+
+// Creates new CasStore on top of the given cache.
+//
+// The cache may be shared with other data, since CasStore keys
+// have distinct prefixes.
+func NewCasStore(cache Cacher) *CasStore {
+	return &CasStore{
+		cache: cache,
+		kl:    NewKeyLocker(0),
+	}
+}
+
+const (
+	casBlobKeyPrefix = "\x00cas.blob."
+	casRefsKeyPrefix = "\x00cas.refs."
+)
+
+func casKey(prefix string, hash CasHash) []byte {
+	key := make([]byte, 0, len(prefix)+len(hash))
+	key = append(key, prefix...)
+	return append(key, hash[:]...)
+}
+
+// Stores the given blob and returns its' hash.
+//
+// The blob isn't stored again if it is already in the store. Its' reference
+// count is incremented instead. Each Put() call must be paired
+// with Release() call when the blob is no longer needed.
+func (s *CasStore) Put(data []byte) (hash CasHash, err error) {
+	hash = sha256.Sum256(data)
+	s.kl.Lock(hash[:])
+	defer s.kl.Unlock(hash[:])
+
+	refs := 0
+	blobKey := casKey(casBlobKeyPrefix, hash)
+	if item, err := s.cache.GetItem(blobKey); err == nil {
+		item.Close()
+		refs = s.refs(hash)
+	} else if err = s.storeBlob(blobKey, data); err != nil {
+		return hash, err
+	}
+	return hash, s.setRefs(hash, refs+1)
+}
+
+func (s *CasStore) storeBlob(key, data []byte) error {
+	txn, err := s.cache.NewSetTxn(key, len(data), MaxTtl)
+	if err != nil {
+		return err
+	}
+	if _, err = txn.Write(data); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// Returns the blob with the given hash.
+//
+// Returns ErrCacheMiss if the blob isn't found.
+func (s *CasStore) Get(hash CasHash) ([]byte, error) {
+	return s.cache.Get(casKey(casBlobKeyPrefix, hash))
+}
+
+// Returns the item with the blob with the given hash.
+//
+// Use this method instead of Get() for big blobs. The returned item
+// must be closed after use.
+func (s *CasStore) GetItem(hash CasHash) (*Item, error) {
+	return s.cache.GetItem(casKey(casBlobKeyPrefix, hash))
+}
+
+// Returns the reference count for the blob with the given hash.
+//
+// Returns 0 if the blob isn't found.
+func (s *CasStore) Refs(hash CasHash) int {
+	s.kl.Lock(hash[:])
+	defer s.kl.Unlock(hash[:])
+	return s.refs(hash)
+}
+
+// Releases the reference to the blob with the given hash obtained via Put().
+//
+// The blob is deleted after the last reference is released.
+// Returns ErrCacheMiss if the blob isn't found.
+func (s *CasStore) Release(hash CasHash) error {
+	s.kl.Lock(hash[:])
+	defer s.kl.Unlock(hash[:])
+
+	refs := s.refs(hash)
+	if refs <= 0 {
+		return ErrCacheMiss
+	}
+	if refs > 1 {
+		return s.setRefs(hash, refs-1)
+	}
+	s.cache.Delete(casKey(casRefsKeyPrefix, hash))
+	s.cache.Delete(casKey(casBlobKeyPrefix, hash))
+	return nil
+}
+
+func (s *CasStore) refs(hash CasHash) int {
+	buf, err := s.cache.Get(casKey(casRefsKeyPrefix, hash))
+	if err != nil || len(buf) != 8 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint64(buf))
+}
+
+func (s *CasStore) setRefs(hash CasHash, refs int) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(refs))
+	return s.cache.Set(casKey(casRefsKeyPrefix, hash), buf[:], MaxTtl)
+}
+
+/*******************************************************************************
+ * KeyLocker
+ ******************************************************************************/
+
+// The default number of locks in KeyLocker.
+const DefaultKeyLockerStripesCount = 1024
+
+// Per-key locks for serializing read-modify-write operations on cached
+// values such as increments or merges.
+//
+// Keys are mapped to a fixed number of locks (stripes) by their hash,
+// so distinct keys may share the same lock. This means:
+//   - memory usage doesn't depend on the number of keys;
+//   - a goroutine must not lock more than one key at a time,
+//     since this may result in a deadlock.
+//
+// Usage:
+//
+//   kl := NewKeyLocker(0)
+//   ...
+//   kl.Lock(key)
+//   value, err := cache.Get(key)
+//   ... modify value ...
+//   err = cache.Set(key, value, ttl)
+//   kl.Unlock(key)
+//
+// KeyLocker serializes only goroutines sharing the same KeyLocker,
+// i.e. it doesn't protect cache files shared among processes.
+type KeyLocker struct {
+	locks   []sync.Mutex
+	keyHash KeyHashFunc
+}
+
+// Creates new KeyLocker with the given number of stripes.
+//
+// Bigger stripesCount reduces contention between distinct keys at the cost
+// of higher memory usage. DefaultKeyLockerStripesCount is used
+// if stripesCount isn't positive.
+func NewKeyLocker(stripesCount int) *KeyLocker {
+	if stripesCount <= 0 {
+		stripesCount = DefaultKeyLockerStripesCount
+	}
+	return &KeyLocker{
+		locks:   make([]sync.Mutex, stripesCount),
+		keyHash: seededKeyHash(),
+	}
+}
+
+// Locks the given key.
+//
+// The key must be unlocked with Unlock when the operation on it is complete.
+func (kl *KeyLocker) Lock(key []byte) {
+	kl.lock(key).Lock()
+}
+
+// Unlocks the given key locked with Lock.
+func (kl *KeyLocker) Unlock(key []byte) {
+	kl.lock(key).Unlock()
+}
+
+// Calls f while holding the lock for the given key.
+func (kl *KeyLocker) Do(key []byte, f func()) {
+	l := kl.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	f()
+}
+
+func (kl *KeyLocker) lock(key []byte) *sync.Mutex {
+	return &kl.locks[kl.keyHash(key)%uint64(len(kl.locks))]
+}
+
+/*******************************************************************************
+ * Key hashing
+ ******************************************************************************/
+
+// Hash function for keys. See Config.KeyHash.
+type KeyHashFunc func(key []byte) uint64
+
+// FNV-1a hash for keys.
+//
+// This hash has been used by Cluster before per-process seeding, so it may be
+// used for opening persistent clusters created by older versions.
+// It is fast, but it is susceptible to hash flooding with crafted keys.
+func FNVKeyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// Secret seed for hashing keys. See SetKeyHashSeed().
+type KeyHashSeed [16]byte
+
+// Returns hex-encoded seed.
+func (seed KeyHashSeed) String() string {
+	return hex.EncodeToString(seed[:])
+}
+
+var (
+	keyHashSeedLock sync.Mutex
+	keyHashSeed     KeyHashSeed
+	processKeyHash  KeyHashFunc
+)
+
+func init() {
+	var seed KeyHashSeed
+	if _, err := io.ReadFull(crand.Reader, seed[:]); err != nil {
+		panic(fmt.Sprintf("BUG: cannot generate key hash seed: [%s]", err))
+	}
+	SetKeyHashSeed(seed)
+}
+
+// Returns the per-process key hash seed.
+func GetKeyHashSeed() KeyHashSeed {
+	keyHashSeedLock.Lock()
+	defer keyHashSeedLock.Unlock()
+	return keyHashSeed
+}
+
+// Sets the per-process seed for hashing keys.
+//
+// The seed is used by anonymous Cluster without Config.KeyHash,
+// by KeyLocker and by TieredCacher. It is randomly generated on process
+// start, so keys controlled by untrusted parties cannot be crafted
+// for colliding on the same cache, lock or counter.
+//
+// The seed must be set before opening clusters and creating KeyLockers
+// and TieredCachers, since they capture the seed on creation.
+// The seed must be kept private.
+func SetKeyHashSeed(seed KeyHashSeed) {
+	keyHashSeedLock.Lock()
+	keyHashSeed = seed
+	processKeyHash = NewSipHashKeyHash(seed)
+	keyHashSeedLock.Unlock()
+}
+
+// Pins SipHash key hash for the persistent cluster to the seed stored
+// in the file at the given path, so keys are distributed among caches
+// in the same way after restart. The key hash is stored in cfg[0].KeyHash,
+// so the seed must be pinned before opening the cluster.
+//
+// The file is created with the per-process key hash seed only if the cluster
+// is created, i.e. if cluster files are missing. Clusters created before
+// per-process seeding have no seed file, so FNVKeyHash is used for them
+// and the file isn't created. The file must be protected from reading
+// by untrusted parties.
+//
+// Clusters with pinned seed are marked with a file next to the first cache
+// index file, so an error is returned instead of falling back
+// to FNVKeyHash if the seed file for such a cluster is lost.
+func (cfg ClusterConfig) PinKeyHashSeed(path string) error {
+	if len(cfg) == 0 {
+		return nil
+	}
+	markerFile := cfg.keyHashMarkerFile()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if cfg.filesExist() {
+			if _, err = os.Stat(markerFile); err == nil {
+				return fmt.Errorf("ybc: key hash seed file %q is missing for the cluster created with pinned seed. "+
+					"Restore the seed file or remove the cluster files", path)
+			}
+			cfg[0].KeyHash = FNVKeyHash
+			return nil
+		}
+		seed := GetKeyHashSeed()
+		if err = ioutil.WriteFile(path, []byte(seed.String()), 0600); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(markerFile, nil, 0600); err != nil {
+			return err
+		}
+		cfg[0].KeyHash = NewSipHashKeyHash(seed)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var seed KeyHashSeed
+	s := strings.TrimSpace(string(data))
+	if n, err := hex.Decode(seed[:], []byte(s)); err != nil || n != len(seed) || len(s) != 2*len(seed) {
+		return fmt.Errorf("ybc: cannot parse key hash seed from %q. Expected %d hex-encoded bytes", path, len(seed))
+	}
+	// The marker may be missing for clusters pinned by older versions.
+	if err = ioutil.WriteFile(markerFile, nil, 0600); err != nil {
+		return err
+	}
+	cfg[0].KeyHash = NewSipHashKeyHash(seed)
+	return nil
+}
+
+// Returns the file marking the cluster with pinned key hash seed.
+func (cfg ClusterConfig) keyHashMarkerFile() string {
+	c := cfg[0]
+	if c.IndexFile != "" {
+		return c.IndexFile + ".keyhash"
+	}
+	return c.DataFile + ".keyhash"
+}
+
+// Returns SipHash seeded with the per-process key hash seed.
+func seededKeyHash() KeyHashFunc {
+	keyHashSeedLock.Lock()
+	defer keyHashSeedLock.Unlock()
+	return processKeyHash
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXH64 hash for keys with zero seed.
+//
+// The returned hash matches xxhash.Sum64() from popular xxhash packages,
+// so it may be used for matching existing sharding schemes.
+func XXHashKeyHash(key []byte) uint64 {
+	return xxhash64(key, 0)
+}
+
+func xxhash64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, v uint64) uint64 {
+	acc += v * xxPrime2
+	acc = rotl64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// Returns SipHash-2-4 hash for keys with the given secret key.
+//
+// The returned hash cannot be predicted without knowing the secret key,
+// so it protects Cluster from hash flooding with keys controlled
+// by untrusted parties. The secret key must be randomly generated
+// and kept private.
+func NewSipHashKeyHash(secret [16]byte) KeyHashFunc {
+	k0 := binary.LittleEndian.Uint64(secret[:8])
+	k1 := binary.LittleEndian.Uint64(secret[8:])
+	return func(key []byte) uint64 {
+		return siphash24(k0, k1, key)
+	}
+}
+
+func siphash24(k0, k1 uint64, b []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = rotl64(v1, 13)
+		v1 ^= v0
+		v0 = rotl64(v0, 32)
+		v2 += v3
+		v3 = rotl64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = rotl64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = rotl64(v1, 17)
+		v1 ^= v2
+		v2 = rotl64(v2, 32)
+	}
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b[:8])
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	// The last block contains the remaining bytes and the message length
+	// in the most significant byte.
+	m := uint64(n) << 56
+	for i, c := range b {
+		m |= uint64(c) << (8 * uint(i))
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func rotl64(x uint64, k uint) uint64 {
+	return (x << k) | (x >> (64 - k))
 }
 
 /*******************************************************************************
@@ -106,6 +106,20 @@ static struct go_ret_value go_get_item_and_value(struct ybc *const cache,
   return rv;
 }
 
+static struct go_ret_value go_get_item_info(struct ybc *const cache,
+    const void *const key_ptr, const size_t key_size)
+{
+  struct go_ret_value rv;
+  const struct ybc_key key = {
+    .ptr = key_ptr,
+    .size = key_size,
+  };
+
+  rv.result = ybc_item_get_info(cache, &key, &rv.value);
+
+  return rv;
+}
+
 struct go_ret_de_value {
   struct ybc_value value;
   enum ybc_de_status status;
@@ -163,3 +177,22 @@ static struct ybc_value go_commit_item_and_value(struct ybc_set_txn *const txn,
   ybc_item_get_value(item, &value);
   return value;
 }
+
+struct go_ret_next_item {
+  struct ybc_value value;
+  struct ybc_key key;
+  int result;
+};
+
+static struct go_ret_next_item go_get_next_item(struct ybc *const cache,
+    size_t *const slot_index, struct ybc_item *const item)
+{
+  struct go_ret_next_item rv;
+
+  rv.result = ybc_item_get_next(cache, slot_index, item, &rv.key);
+  if (rv.result != 0) {
+    ybc_item_get_value(item, &rv.value);
+  }
+
+  return rv;
+}
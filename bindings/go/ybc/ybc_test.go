@@ -2,8 +2,15 @@ package ybc
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -62,6 +69,27 @@ func TestConfig_RemoveCache_Existing(t *testing.T) {
 	expectOpenCacheFail(config, false, t)
 }
 
+func TestConfig_OpenCache_Locked(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.open_locked"
+	config.IndexFile = "foobar.index.open_locked"
+	defer config.RemoveCache()
+
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatalf("cannot open cache: [%s]", err)
+	}
+	if !config.isLocked() {
+		t.Fatalf("Cache files must be locked while the cache is opened")
+	}
+	cache.Close()
+
+	if config.isLocked() {
+		t.Fatalf("Cache files must be unlocked after the cache is closed")
+	}
+	expectOpenCacheSuccess(config, false, t)
+}
+
 func TestConfig_OpenCache_Anonymous(t *testing.T) {
 	config := newConfig()
 	expectOpenCacheFail(config, false, t)
@@ -83,6 +111,94 @@ func TestConfig_OpenCache_Existing(t *testing.T) {
 	}
 }
 
+func TestConfig_OpenCacheCtx(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.open_ctx"
+	config.IndexFile = "foobar.index.open_ctx"
+	expectOpenCacheSuccess(config, true, t)
+	defer config.RemoveCache()
+
+	lastPercent := -1
+	config.OpenProgress = func(percent int) {
+		if percent < lastPercent || percent > 100 {
+			t.Fatalf("unexpected percent=%d after percent=%d", percent, lastPercent)
+		}
+		lastPercent = percent
+	}
+	cache, err := config.OpenCacheCtx(context.Background(), false)
+	if err != nil {
+		t.Fatalf("cannot open cache: [%s]", err)
+	}
+	cache.Close()
+	if lastPercent != 100 {
+		t.Fatalf("unexpected last percent=%d. Expected 100", lastPercent)
+	}
+}
+
+func TestConfig_OpenCacheCtx_Canceled(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.open_ctx_canceled"
+	config.IndexFile = "foobar.index.open_ctx_canceled"
+	expectOpenCacheSuccess(config, true, t)
+	defer config.RemoveCache()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache, err := config.OpenCacheCtx(ctx, false)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: [%v]. Expected [%s]", err, context.Canceled)
+	}
+	if cache != nil {
+		t.Fatalf("unexpected non-nil cache")
+	}
+
+	// The cache must be opened after the failed attempt.
+	expectOpenCacheSuccess(config, false, t)
+}
+
+func TestConfig_OpenCache_LazyIndexLoad(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.lazy_index_load"
+	config.IndexFile = "foobar.index.lazy_index_load"
+	config.LazyIndexLoad = true
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatalf("cannot open cache: [%s]", err)
+	}
+	defer config.RemoveCache()
+
+	if n := cache.IndexLoadPercent(); n != 100 {
+		t.Fatalf("unexpected index load percent=%d for new cache. Expected 100", n)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = cache.Set(key, key, MaxTtl); err != nil {
+			t.Fatalf("error when setting item: [%s]", err)
+		}
+	}
+	cache.Close()
+
+	cache, err = config.OpenCache(false)
+	if err != nil {
+		t.Fatalf("cannot open cache: [%s]", err)
+	}
+	defer cache.Close()
+	for i := 0; i < 1000 && cache.IndexLoadPercent() < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cache.IndexLoadPercent(); n != 100 {
+		t.Fatalf("unexpected index load percent=%d. Expected 100", n)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value, err := cache.Get(key)
+		if err != nil {
+			t.Fatalf("cannot obtain item for key=[%s]: [%s]", key, err)
+		}
+		checkValue(t, key, value)
+	}
+}
+
 func TestConfig_OpenCache_EnabledHotItems(t *testing.T) {
 	config := newConfig()
 	config.HotItemsCount = config.MaxItemsCount / 10
@@ -187,6 +303,57 @@ func TestSimpleCache_Set_Get(t *testing.T) {
 	simple_cacher_Set_Get_Remove(sc, t)
 }
 
+func TestSimpleCache_String_JSON(t *testing.T) {
+	cache := newSimpleCache(t)
+	defer cache.Close()
+
+	longKey := string(bytes.Repeat([]byte("k"), 1000))
+	for _, key := range []string{"foo", longKey} {
+		if _, err := cache.GetString(key); err != ErrCacheMiss {
+			t.Fatalf("unexpected error: [%v]. Expected [%s]", err, ErrCacheMiss)
+		}
+		if err := cache.SetString(key, "bar", MaxTtl); err != nil {
+			t.Fatalf("error when setting string: [%s]", err)
+		}
+		value, err := cache.GetString(key)
+		if err != nil {
+			t.Fatalf("cannot obtain string: [%s]", err)
+		}
+		if value != "bar" {
+			t.Fatalf("unexpected value: [%s]. Expected [bar]", value)
+		}
+
+		type point struct {
+			X, Y int
+		}
+		if err = cache.SetJSON(key, &point{1, 2}, MaxTtl); err != nil {
+			t.Fatalf("error when setting json: [%s]", err)
+		}
+		var p point
+		if err = cache.GetJSON(key, &p); err != nil {
+			t.Fatalf("cannot obtain json: [%s]", err)
+		}
+		if p.X != 1 || p.Y != 2 {
+			t.Fatalf("unexpected value: %+v. Expected {X:1 Y:2}", p)
+		}
+
+		if !cache.DeleteString(key) {
+			t.Fatalf("cannot delete key")
+		}
+		if err = cache.GetJSON(key, &p); err != ErrCacheMiss {
+			t.Fatalf("unexpected error: [%v]. Expected [%s]", err, ErrCacheMiss)
+		}
+	}
+
+	// Long keys must be hashed.
+	if err := cache.SetString(longKey, "bar", MaxTtl); err != nil {
+		t.Fatalf("error when setting string: [%s]", err)
+	}
+	if _, err := cache.Get([]byte(longKey)); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected [%s]", err, ErrCacheMiss)
+	}
+}
+
 func simple_cacher_Clear(cache SimpleCacher, t *testing.T) {
 	defer cache.Close()
 	for i := 0; i < 1000; i++ {
@@ -337,6 +504,42 @@ func TestCache_GetItem(t *testing.T) {
 	cacher_GetItem(cache, t)
 }
 
+type itemInfoCacher interface {
+	SimpleCacher
+	GetItemInfo(key []byte) (size int, ttl time.Duration, exists bool)
+}
+
+func cacher_GetItemInfo(cache itemInfoCacher, t *testing.T) {
+	defer cache.Close()
+	key := []byte("key")
+	value := []byte("value")
+	if _, _, exists := cache.GetItemInfo(key); exists {
+		t.Fatalf("Unexpected item found for missing key")
+	}
+	if err := cache.Set(key, value, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	size, ttl, exists := cache.GetItemInfo(key)
+	if !exists {
+		t.Fatalf("Cannot find item info for key=[%s]", key)
+	}
+	if size != len(value) {
+		t.Fatalf("Unexpected size=%d. Expected %d", size, len(value))
+	}
+	if ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("Unexpected ttl=%s. Expected (0..1h]", ttl)
+	}
+	cache.Delete(key)
+	if _, _, exists = cache.GetItemInfo(key); exists {
+		t.Fatalf("Unexpected item found for deleted key")
+	}
+}
+
+func TestCache_GetItemInfo(t *testing.T) {
+	cache := newCache(t)
+	cacher_GetItemInfo(cache, t)
+}
+
 func cacher_GetDeItem(cache Cacher, t *testing.T) {
 	defer cache.Close()
 	for i := 0; i < 1000; i++ {
@@ -408,348 +611,751 @@ func TestCache_NewSetTxn(t *testing.T) {
 	cacher_NewSetTxn(cache, t)
 }
 
-/*******************************************************************************
- * SetTxn
- ******************************************************************************/
+type multiGetter interface {
+	Cacher
+	GetMultiInto(keys [][]byte, dst map[string][]byte) (missing [][]byte, err error)
+}
 
-func TestSetTxn_Commit(t *testing.T) {
-	cache := newCache(t)
+func cacher_GetMultiInto(cache multiGetter, t *testing.T) {
 	defer cache.Close()
 
-	key := []byte("key")
-	value := []byte("value")
-	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
-	if err != nil {
-		t.Fatal(err)
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		keys = append(keys, key)
+		if i%3 != 0 {
+			continue
+		}
+		if err := cache.Set(key, key, MaxTtl); err != nil {
+			t.Fatalf("error when setting item: [%s]", err)
+		}
 	}
-	n, err := txn.Write(value)
+
+	dst := make(map[string][]byte)
+	missing, err := cache.GetMultiInto(keys, dst)
 	if err != nil {
-		txn.Rollback()
-		t.Fatal(err)
+		t.Fatalf("unexpected error: [%s]", err)
 	}
-	if n != len(value) {
-		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	if len(dst) != 34 {
+		t.Fatalf("unexpected number of found values: %d. Expected 34", len(dst))
 	}
-
-	// The item shouldn't exist in the cache before commit
-	_, err = cache.Get(key)
-	if err != ErrCacheMiss {
-		txn.Rollback()
-		t.Fatal(err)
+	if len(missing) != 66 {
+		t.Fatalf("unexpected number of missing keys: %d. Expected 66", len(missing))
 	}
-
-	err = txn.Commit()
-	if err != nil {
-		t.Fatal(err)
+	for i, key := range keys {
+		if i%3 == 0 {
+			checkValue(t, key, dst[string(key)])
+		}
 	}
-
-	// The item should appear in the cache after the commit
-	actualValue, err := cache.Get(key)
-	if err != nil {
-		t.Fatal(err)
+	n := 0
+	for i, key := range keys {
+		if i%3 == 0 {
+			continue
+		}
+		checkValue(t, key, missing[n])
+		n++
 	}
-	checkValue(t, value, actualValue)
 }
 
-func TestSetTxn_CommitTruncated(t *testing.T) {
+func TestCache_GetMultiInto(t *testing.T) {
 	cache := newCache(t)
-	defer cache.Close()
+	cacher_GetMultiInto(cache, t)
+}
 
-	key := []byte("key")
-	value := []byte("value")
-	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
+func TestCache_TtlJitter(t *testing.T) {
+	config := newConfig()
+	config.TtlJitter = 50
+	cache, err := config.OpenCache(true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	n, err := txn.Write(value[:2])
-	if err != nil {
-		txn.Rollback()
-		t.Fatal(err)
+	defer cache.Close()
+
+	ttl := time.Hour
+	minTtl := ttl / 2
+	maxTtl := ttl + ttl/2
+	ttls := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		item, err := cache.SetItem(key, []byte("value"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itemTtl := item.Ttl()
+		item.Close()
+		if itemTtl < minTtl-time.Second || itemTtl > maxTtl {
+			t.Fatalf("unexpected ttl=%s. It must be in the range [%s..%s]", itemTtl, minTtl, maxTtl)
+		}
+		ttls[itemTtl] = struct{}{}
 	}
-	if n != 2 {
-		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, 2)
+	if len(ttls) < 10 {
+		t.Fatalf("too few distinct ttls: %d. Jitter isn't applied?", len(ttls))
 	}
 
-	err = txn.CommitTruncated()
+	item, err := cache.SetItem([]byte("max_ttl"), []byte("value"), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer item.Close()
+	if item.Ttl() < MaxTtl-time.Minute {
+		t.Fatalf("unexpected ttl=%s for MaxTtl item", item.Ttl())
+	}
+}
 
-	// The item should appear in the cache after the commit
-	actualValue, err := cache.Get(key)
+func TestCache_MaxItemSize(t *testing.T) {
+	config := newConfig()
+	config.MaxItemSize = 10
+	cache, err := config.OpenCache(true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	checkValue(t, value[:2], actualValue)
-}
-
-func TestSetTxn_Commit_Partial(t *testing.T) {
-	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
-	value := []byte("value")
-	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
-	if err != nil {
-		t.Fatal(err)
+	value := []byte("0123456789")
+	if err = cache.Set(key, value, MaxTtl); err != nil {
+		t.Fatalf("cannot store value with the maximum size: [%s]", err)
 	}
-	n, err := txn.Write(value[:2])
-	if err != nil {
-		txn.Rollback()
-		t.Fatal(err)
+
+	largeValue := append(value, 'a')
+	if err = cache.Set(key, largeValue, MaxTtl); err != ErrItemTooLarge {
+		t.Fatalf("unexpected error: [%v]. Expected ErrItemTooLarge", err)
 	}
-	if n != 2 {
-		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, 2)
+	if _, err = cache.SetItem(key, largeValue, MaxTtl); err != ErrItemTooLarge {
+		t.Fatalf("unexpected error: [%v]. Expected ErrItemTooLarge", err)
+	}
+	if _, err = cache.NewSetTxn(key, len(largeValue), MaxTtl); err != ErrItemTooLarge {
+		t.Fatalf("unexpected error: [%v]. Expected ErrItemTooLarge", err)
 	}
 
-	err = txn.Commit()
-	if err != ErrPartialCommit {
+	actualValue, err := cache.Get(key)
+	if err != nil {
 		t.Fatal(err)
 	}
+	checkValue(t, value, actualValue)
+}
+
+func setExpiringItems(t *testing.T, cache *Cache, itemsCount int, ttl time.Duration) {
+	for i := 0; i < itemsCount; i++ {
+		key := []byte(fmt.Sprintf("expiring_key_%d", i))
+		if err := cache.Set(key, key, ttl); err != nil {
+			t.Fatalf("error when storing expiring item: [%s]", err)
+		}
+	}
 }
 
-func TestSetTxn_Rollback(t *testing.T) {
+func TestCache_RemoveExpired(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
-	key := []byte("key")
-	value := []byte("value")
+	// Remove broken items from the freshly created index.
+	cache.RemoveExpired()
 
-	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
-	if err != nil {
-		t.Fatal(err)
-	}
-	n, err := txn.Write(value)
-	if err != nil {
-		txn.Rollback()
+	setExpiringItems(t, cache, 100, time.Millisecond*100)
+	liveKey := []byte("live_key")
+	if err := cache.Set(liveKey, liveKey, MaxTtl); err != nil {
 		t.Fatal(err)
 	}
-	if n != len(value) {
-		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	if n, _ := cache.RemoveExpired(); n != 0 {
+		t.Fatalf("unexpected number of removed items: %d. Expected 0", n)
 	}
 
-	txn.Rollback()
+	time.Sleep(time.Millisecond * 200)
+	if n, bytes := cache.CountExpired(); n != 100 || bytes <= 0 {
+		t.Fatalf("unexpected number of expired items=%d with size=%d. Expected 100 items", n, bytes)
+	}
+	stats := cache.ExpirationStats()
+	n, bytes := cache.RemoveExpired()
+	if n != 100 {
+		t.Fatalf("unexpected number of removed items: %d. Expected 100", n)
+	}
+	if bytes <= 0 {
+		t.Fatalf("unexpected size of removed items: %d", bytes)
+	}
+	newStats := cache.ExpirationStats()
+	if newStats.RemovedItems-stats.RemovedItems != 100 {
+		t.Fatalf("unexpected RemovedItems=%d. Expected %d", newStats.RemovedItems, stats.RemovedItems+100)
+	}
+	if newStats.RemovedBytes-stats.RemovedBytes != uint64(bytes) {
+		t.Fatalf("unexpected RemovedBytes=%d. Expected %d", newStats.RemovedBytes, stats.RemovedBytes+uint64(bytes))
+	}
+	if newStats.Scans != stats.Scans+1 {
+		t.Fatalf("unexpected Scans=%d. Expected %d", newStats.Scans, stats.Scans+1)
+	}
 
-	// The item shouldn't exist in the cache after the rollback.
-	_, err = cache.Get(key)
-	if err != ErrCacheMiss {
-		t.Fatal(err)
+	value, err := cache.Get(liveKey)
+	if err != nil {
+		t.Fatalf("cannot obtain live item: [%s]", err)
+	}
+	checkValue(t, liveKey, value)
+	if n, _ := cache.CountExpired(); n != 0 {
+		t.Fatalf("unexpected number of expired items=%d after their removal", n)
 	}
 }
 
-func TestSetTxn_CommitItem(t *testing.T) {
-	cache := newCache(t)
+func TestCache_Compact(t *testing.T) {
+	config := newConfig()
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer cache.Close()
 
-	key := []byte("key")
-	value := []byte("value")
+	// Remove broken items from the freshly created index.
+	if stats := cache.Compact(time.Hour); !stats.Done {
+		t.Fatalf("the compaction must be done")
+	}
 
-	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
-	if err != nil {
+	setExpiringItems(t, cache, 100, time.Millisecond*100)
+	liveKey := []byte("live_key")
+	if err = cache.Set(liveKey, liveKey, MaxTtl); err != nil {
 		t.Fatal(err)
 	}
-	n, err := txn.Write(value)
-	if err != nil {
-		txn.Rollback()
-		t.Fatal(err)
+
+	// Push the live item to the tail of the data file
+	// by overwriting another item.
+	fillerKey := []byte("filler_key")
+	filler := make([]byte, 10*1000)
+	fillerCount := int(config.DataFileSize)*(compactionTailDivisor-1)/compactionTailDivisor/len(filler) + 1
+	for i := 0; i < fillerCount; i++ {
+		if err = cache.Set(fillerKey, filler, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if n != len(value) {
-		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+
+	time.Sleep(time.Millisecond * 200)
+	stats := cache.Compact(time.Hour)
+	if !stats.Done {
+		t.Fatalf("the compaction must be done")
+	}
+	if stats.RemovedItems != 100 {
+		t.Fatalf("unexpected RemovedItems=%d. Expected 100", stats.RemovedItems)
+	}
+	if stats.ReclaimedBytes <= 0 {
+		t.Fatalf("unexpected ReclaimedBytes=%d", stats.ReclaimedBytes)
+	}
+	if stats.MovedItems != 1 {
+		t.Fatalf("unexpected MovedItems=%d. Expected 1", stats.MovedItems)
 	}
 
-	item, err := txn.CommitItem()
+	// The moved item must survive the data file wrap.
+	for i := 0; i < fillerCount/2; i++ {
+		if err = cache.Set(fillerKey, filler, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := cache.Get(liveKey)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot obtain live item: [%s]", err)
 	}
-	defer item.Close()
-	checkValue(t, value, item.Value())
-}
+	checkValue(t, liveKey, value)
 
-func TestSetTxn_CommitItemTruncated(t *testing.T) {
+	// Zero maxDuration must leave the pass unfinished.
+	if stats = cache.Compact(0); stats.Done {
+		t.Fatalf("the compaction mustn't be done")
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := newConfig()
+	config.IndexFile = "foobar.index.snapshot"
+	config.DataFile = "foobar.data.snapshot"
+	if err := cache.Snapshot(config); err != nil {
+		t.Fatalf("cannot take snapshot: [%s]", err)
+	}
+	defer config.RemoveCache()
+
+	// Existing files mustn't be overwritten.
+	if err := cache.Snapshot(config); err != ErrSnapshotFailed {
+		t.Fatalf("unexpected error=[%v]. Expected [%s]", err, ErrSnapshotFailed)
+	}
+
+	// Missing directories must result in error.
+	badConfig := newConfig()
+	badConfig.IndexFile = "non-existing-dir/foobar.index.snapshot"
+	badConfig.DataFile = "non-existing-dir/foobar.data.snapshot"
+	if err := cache.Snapshot(badConfig); err != ErrSnapshotFailed {
+		t.Fatalf("unexpected error=[%v]. Expected [%s]", err, ErrSnapshotFailed)
+	}
+
+	// Items added after the snapshot mustn't appear in the snapshot.
+	if err := cache.Set([]byte("new_key"), []byte("new_value"), MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := config.OpenCache(false)
+	if err != nil {
+		t.Fatalf("cannot open snapshot: [%s]", err)
+	}
+	defer snapshot.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value, err := snapshot.Get(key)
+		if err != nil {
+			t.Fatalf("cannot find key=[%s] in the snapshot: [%s]", key, err)
+		}
+		if string(value) != fmt.Sprintf("value_%d", i) {
+			t.Fatalf("unexpected value=[%s] for key=[%s]", value, key)
+		}
+	}
+	if _, err = snapshot.Get([]byte("new_key")); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v]. Expected [%s]", err, ErrCacheMiss)
+	}
+}
+
+func TestCache_ExpirationScanInterval(t *testing.T) {
+	config := newConfig()
+	config.ExpirationScanInterval = time.Millisecond * 50
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	setExpiringItems(t, cache, 100, time.Millisecond*100)
+	time.Sleep(time.Millisecond * 300)
+
+	stats := cache.ExpirationStats()
+	if stats.Scans == 0 {
+		t.Fatalf("expiration scanner didn't run")
+	}
+	if stats.RemovedItems < 100 {
+		t.Fatalf("unexpected RemovedItems=%d. Expected at least 100", stats.RemovedItems)
+	}
+}
+
+/*******************************************************************************
+ * SetTxn
+ ******************************************************************************/
+
+func TestSetTxn_Commit(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
-
 	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	n, err := txn.Write(value[:2])
+	n, err := txn.Write(value)
 	if err != nil {
 		txn.Rollback()
 		t.Fatal(err)
 	}
-	if n != 2 {
+	if n != len(value) {
 		txn.Rollback()
 		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
 	}
 
-	item, err := txn.CommitItemTruncated()
+	// The item shouldn't exist in the cache before commit
+	_, err = cache.Get(key)
+	if err != ErrCacheMiss {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+
+	err = txn.Commit()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
-	checkValue(t, value[:2], item.Value())
+
+	// The item should appear in the cache after the commit
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, actualValue)
 }
 
-func TestSetTxn_ReadFrom(t *testing.T) {
+func TestSetTxn_CommitTruncated(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
-
 	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	valueBuf := bytes.NewBuffer(value)
-	n, err := txn.ReadFrom(valueBuf)
+	n, err := txn.Write(value[:2])
 	if err != nil {
 		txn.Rollback()
 		t.Fatal(err)
 	}
-	if n != int64(len(value)) {
+	if n != 2 {
 		txn.Rollback()
-		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, 2)
 	}
 
-	item, err := txn.CommitItem()
+	err = txn.CommitTruncated()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
-	checkValue(t, value, item.Value())
-}
 
-/*******************************************************************************
- * Item
- ******************************************************************************/
+	// The item should appear in the cache after the commit
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value[:2], actualValue)
+}
 
-func newCacheItem(t *testing.T) (cache *Cache, item *Item) {
-	cache = newCache(t)
+func TestSetTxn_Commit_Partial(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
-
-	var err error
-	item, err = cache.SetItem(key, value, MaxTtl)
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return
+	n, err := txn.Write(value[:2])
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if n != 2 {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, 2)
+	}
+
+	err = txn.Commit()
+	if err != ErrPartialCommit {
+		t.Fatal(err)
+	}
 }
 
-func TestItem_Value(t *testing.T) {
+func TestSetTxn_Rollback(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
 
-	item, err := cache.SetItem(key, value, MaxTtl)
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
-	checkValue(t, value, item.Value())
+	n, err := txn.Write(value)
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if n != len(value) {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	}
+
+	txn.Rollback()
+
+	// The item shouldn't exist in the cache after the rollback.
+	_, err = cache.Get(key)
+	if err != ErrCacheMiss {
+		t.Fatal(err)
+	}
 }
 
-func TestItem_Size(t *testing.T) {
+func TestSetTxn_CommitItem(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
 
-	item, err := cache.SetItem(key, value, MaxTtl)
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
-	if item.Size() != len(value) {
-		t.Fatalf("Unexpected size=%d. Expected=%d", item.Size(), len(value))
+	n, err := txn.Write(value)
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if n != len(value) {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	}
+
+	item, err := txn.CommitItem()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer item.Close()
+	checkValue(t, value, item.Value())
 }
 
-func TestItem_Available(t *testing.T) {
+func TestSetTxn_CommitItemTruncated(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
-	key := []byte("key12345")
+	key := []byte("key")
 	value := []byte("value")
 
-	item, err := cache.SetItem(key, value, MaxTtl)
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
-
-	buf := make([]byte, 3)
-	if _, err = item.Read(buf); err != nil {
-		t.Fatalf("Cannot read %d bytes from item: [%s]", len(buf), err)
+	n, err := txn.Write(value[:2])
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
 	}
-	if item.Available() != (len(value) - len(buf)) {
-		t.Fatalf("Unexpected size=%d. Expected=%d", item.Size(), len(value))
+	if n != 2 {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	}
+
+	item, err := txn.CommitItemTruncated()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer item.Close()
+	checkValue(t, value[:2], item.Value())
 }
 
-func TestItem_Ttl(t *testing.T) {
+func TestSetTxn_ReadFrom(t *testing.T) {
 	cache := newCache(t)
 	defer cache.Close()
 
 	key := []byte("key")
 	value := []byte("value")
 
-	ttl := time.Minute
-	item, err := cache.SetItem(key, value, ttl)
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer item.Close()
 
-	if item.Ttl() > ttl {
-		t.Fatalf("invalid item's ttl=%s. It cannot be greater than %s", item.Ttl(), ttl)
+	valueBuf := bytes.NewBuffer(value)
+	n, err := txn.ReadFrom(valueBuf)
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if n != int64(len(value)) {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	}
+
+	item, err := txn.CommitItem()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer item.Close()
+	checkValue(t, value, item.Value())
 }
 
-func TestItem_Seek_Read(t *testing.T) {
-	cache, item := newCacheItem(t)
+func TestSetTxn_Reader(t *testing.T) {
+	cache := newCache(t)
 	defer cache.Close()
-	defer item.Close()
 
-	n, err := item.Seek(2, 0)
+	key := []byte("key")
+	value := []byte("value which is read while it is written")
+
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
 	if err != nil {
-		t.Fatalf("Error in Item.Seek(2, 0): [%s]", err)
+		t.Fatal(err)
 	}
-	if n != 2 {
-		t.Fatalf("unexpected n=%d returned in item.Seek(). Expected 2", n)
+	if _, err = txn.Write(value[:5]); err != nil {
+		txn.Rollback()
+		t.Fatal(err)
 	}
+	r := txn.Reader()
+	defer r.Close()
+	lazyReader := txn.Reader()
+	defer lazyReader.Close()
 
-	value := item.Value()
-	buf := make([]byte, len(value))
-	nn, err := item.Read(buf)
-	if nn != len(value)-2 {
-		t.Fatalf("unexpected number of bytes read=%d. Expected %d", nn, len(value)-2)
+	result := make(chan []byte)
+	go func() {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Unexpected error when reading uncommitted txn: [%s]", err)
+		}
+		result <- data
+	}()
+
+	for i := 5; i < len(value); i++ {
+		if _, err = txn.Write(value[i : i+1]); err != nil {
+			txn.Rollback()
+			t.Fatal(err)
+		}
 	}
-	if err != io.EOF {
-		t.Fatalf("unexpected error in Item.Read(): [%s]. Expected io.EOF", err)
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
 	}
-	checkValue(t, value[2:], buf[:nn])
+	checkValue(t, value, <-result)
 
-	if n, err = item.Seek(-3, 2); err != nil {
-		t.Fatalf("Error in Item.Seek(-3, 2): [%s]", err)
+	// The reader must return the value after the commit.
+	data, err := ioutil.ReadAll(lazyReader)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if n != int64(len(value))-3 {
-		t.Fatalf("Unexpected n returned from Item.Seek(-3, 2): %d. Expected %d", n, len(value)-3)
+	checkValue(t, value, data)
+}
+
+func TestSetTxn_Reader_Rollback(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+
+	txn, err := cache.NewSetTxn(key, len(value)*2, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := txn.Reader()
+	defer r.Close()
+	if _, err = txn.Write(value); err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := r.Read(buf)
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	checkValue(t, value, buf[:n])
+
+	txn.Rollback()
+	if _, err = r.Read(buf); err != ErrTxnRolledBack {
+		t.Fatalf("Unexpected error=[%v]. Expected ErrTxnRolledBack", err)
+	}
+}
+
+/*******************************************************************************
+ * Item
+ ******************************************************************************/
+
+func newCacheItem(t *testing.T) (cache *Cache, item *Item) {
+	cache = newCache(t)
+
+	key := []byte("key")
+	value := []byte("value")
+
+	var err error
+	item, err = cache.SetItem(key, value, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestItem_Value(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+
+	item, err := cache.SetItem(key, value, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+	checkValue(t, value, item.Value())
+}
+
+func TestItem_Size(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+
+	item, err := cache.SetItem(key, value, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+	if item.Size() != len(value) {
+		t.Fatalf("Unexpected size=%d. Expected=%d", item.Size(), len(value))
+	}
+}
+
+func TestItem_Available(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key12345")
+	value := []byte("value")
+
+	item, err := cache.SetItem(key, value, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+
+	buf := make([]byte, 3)
+	if _, err = item.Read(buf); err != nil {
+		t.Fatalf("Cannot read %d bytes from item: [%s]", len(buf), err)
+	}
+	if item.Available() != (len(value) - len(buf)) {
+		t.Fatalf("Unexpected size=%d. Expected=%d", item.Size(), len(value))
+	}
+}
+
+func TestItem_Ttl(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+
+	ttl := time.Minute
+	item, err := cache.SetItem(key, value, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+
+	if item.Ttl() > ttl {
+		t.Fatalf("invalid item's ttl=%s. It cannot be greater than %s", item.Ttl(), ttl)
+	}
+}
+
+func TestItem_Seek_Read(t *testing.T) {
+	cache, item := newCacheItem(t)
+	defer cache.Close()
+	defer item.Close()
+
+	n, err := item.Seek(2, 0)
+	if err != nil {
+		t.Fatalf("Error in Item.Seek(2, 0): [%s]", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected n=%d returned in item.Seek(). Expected 2", n)
+	}
+
+	value := item.Value()
+	buf := make([]byte, len(value))
+	nn, err := item.Read(buf)
+	if nn != len(value)-2 {
+		t.Fatalf("unexpected number of bytes read=%d. Expected %d", nn, len(value)-2)
+	}
+	if err != io.EOF {
+		t.Fatalf("unexpected error in Item.Read(): [%s]. Expected io.EOF", err)
+	}
+	checkValue(t, value[2:], buf[:nn])
+
+	if n, err = item.Seek(-3, 2); err != nil {
+		t.Fatalf("Error in Item.Seek(-3, 2): [%s]", err)
+	}
+	if n != int64(len(value))-3 {
+		t.Fatalf("Unexpected n returned from Item.Seek(-3, 2): %d. Expected %d", n, len(value)-3)
 	}
 	nn, err = item.Read(buf)
 	if nn != 3 {
@@ -832,7 +1438,22 @@ func TestItem_Seek_UnsupportedWhence(t *testing.T) {
 	defer cache.Close()
 	defer item.Close()
 
-	expectPanic(t, func() { item.Seek(100, 3) })
+	if _, err := item.Seek(1, 0); err != nil {
+		t.Fatalf("Error in Item.Seek(1, 0): [%s]", err)
+	}
+	n, err := item.Seek(0, 3)
+	if err == nil {
+		t.Fatalf("expecting error for invalid whence in Item.Seek(0, 3)")
+	}
+	if n != 0 {
+		t.Fatalf("unexpected n=%d returned from Item.Seek(0, 3). Expected 0", n)
+	}
+	if n, err = item.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatalf("Error in Item.Seek(0, 1): [%s]", err)
+	}
+	if n != 1 {
+		t.Fatalf("the offset mustn't be changed by invalid whence. Got %d. Expected 1", n)
+	}
 }
 
 func TestItem_ReadAt(t *testing.T) {
@@ -861,6 +1482,69 @@ func TestItem_ReadAt_OutOfRange(t *testing.T) {
 	if err != ErrOutOfRange {
 		t.Fatal(err)
 	}
+	_, err = item.ReadAt(buf, -1)
+	if err != ErrOutOfRange {
+		t.Fatal(err)
+	}
+}
+
+func TestItem_ReadAt_EOF(t *testing.T) {
+	cache, item := newCacheItem(t)
+	defer cache.Close()
+	defer item.Close()
+
+	size := item.Size()
+	buf := make([]byte, 10)
+	n, err := item.ReadAt(buf, int64(size-1))
+	if n != 1 {
+		t.Fatalf("unexpected number of bytes read=%d. Expected 1", n)
+	}
+	if err != io.EOF {
+		t.Fatalf("unexpected error: [%v]. Expected io.EOF", err)
+	}
+	n, err = item.ReadAt(buf, int64(size))
+	if n != 0 || err != io.EOF {
+		t.Fatalf("unexpected result: n=%d, err=[%v]. Expected n=0, err=io.EOF", n, err)
+	}
+}
+
+func TestItem_ServeContent(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("0123456789abcdef")
+	item, err := cache.SetItem(key, value, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+
+	modTime := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	req := httptest.NewRequest("GET", "/foo.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	http.ServeContent(w, req, "foo.txt", modTime, item)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected status code=%d. Expected %d", w.Code, http.StatusPartialContent)
+	}
+	checkValue(t, value[2:6], w.Body.Bytes())
+
+	req = httptest.NewRequest("GET", "/foo.txt", nil)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	http.ServeContent(w, req, "foo.txt", modTime, item)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("unexpected status code=%d. Expected %d", w.Code, http.StatusNotModified)
+	}
+
+	req = httptest.NewRequest("GET", "/foo.txt", nil)
+	w = httptest.NewRecorder()
+	http.ServeContent(w, req, "foo.txt", modTime, item)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code=%d. Expected %d", w.Code, http.StatusOK)
+	}
+	checkValue(t, value, w.Body.Bytes())
 }
 
 func TestItem_WriteTo(t *testing.T) {
@@ -940,89 +1624,907 @@ func TestClusterConfig_RemoveCluster(t *testing.T) {
 	}
 }
 
-/*******************************************************************************
- * Cluster
- ******************************************************************************/
+func TestCluster_Snapshot(t *testing.T) {
+	cluster := newCluster(t)
+	defer cluster.Close()
 
-func newCluster(t *testing.T) *Cluster {
-	config := newClusterConfig(3)
-	cluster, err := config.OpenCluster(true)
-	if err != nil {
-		t.Fatal(err)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err := cluster.Set(key, key, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
 	}
-	return cluster
-}
 
-func TestCluster_Ops(t *testing.T) {
-	config := ClusterConfig{
-		&Config{
-			DataFileSize:  1000 * 1000,
-			MaxItemsCount: 1000,
-			IndexFile:     "cache.index.0",
-			DataFile:      "cache.data.0",
-		},
-		&Config{
-			DataFileSize:  1000 * 1000,
-			MaxItemsCount: 1000,
-			IndexFile:     "cache.index.1",
-			DataFile:      "cache.data.1",
-		},
-		&Config{
-			DataFileSize:  1000 * 1000,
-			MaxItemsCount: 1000,
-			IndexFile:     "cache.index.2",
-			DataFile:      "cache.data.2",
-		},
+	if err := cluster.Snapshot(newClusterConfig(2)); err != ErrSnapshotFailed {
+		t.Fatalf("unexpected error=[%v] for mismatched cluster size. Expected [%s]", err, ErrSnapshotFailed)
 	}
-	cluster, err := config.OpenCluster(true)
-	if err != nil {
-		t.Fatal(err)
+
+	config := newClusterConfig(3)
+	for i, c := range config {
+		c.IndexFile = fmt.Sprintf("cache.index.snapshot.%d", i)
+		c.DataFile = fmt.Sprintf("cache.data.snapshot.%d", i)
+	}
+	// The snapshot of anonymous cluster must be opened with the same key hash.
+	config[0].KeyHash = NewSipHashKeyHash(GetKeyHashSeed())
+	if err := cluster.Snapshot(config); err != nil {
+		t.Fatalf("cannot take snapshot: [%s]", err)
 	}
 	defer config.RemoveCluster()
-	defer cluster.Close()
 
-	for i := 0; i < 1000; i++ {
+	snapshot, err := config.OpenCluster(false)
+	if err != nil {
+		t.Fatalf("cannot open snapshot: [%s]", err)
+	}
+	defer snapshot.Close()
+	for i := 0; i < 100; i++ {
 		key := []byte(fmt.Sprintf("key_%d", i))
-		value := []byte(fmt.Sprintf("value_%d", i))
-		err := cluster.Set(key, value, MaxTtl)
+		value, err := snapshot.Get(key)
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("cannot find key=[%s] in the snapshot: [%s]", key, err)
 		}
-
-		actualValue, err := cluster.Get(key)
-		if err != nil {
-			t.Fatal(err)
+		if !bytes.Equal(value, key) {
+			t.Fatalf("unexpected value=[%s] for key=[%s]", value, key)
 		}
-		checkValue(t, value, actualValue)
 	}
 }
 
-func TestCluster_Set_Get_Remove(t *testing.T) {
-	cluster := newCluster(t)
-	simple_cacher_Set_Get_Remove(cluster, t)
+/*******************************************************************************
+ * TieredCacher
+ ******************************************************************************/
+
+func newTieredCacher(t *testing.T, policy *PromotePolicy) *TieredCacher {
+	return NewTieredCacher(newCache(t), newCache(t), policy)
 }
 
-func TestCluster_GetDe(t *testing.T) {
-	cluster := newCluster(t)
-	cacher_GetDe(cluster, t)
+func TestTieredCacher_GetDe(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	cacher_GetDe(cache, t)
 }
 
-func TestCluster_Clear(t *testing.T) {
-	cluster := newCluster(t)
-	simple_cacher_Clear(cluster, t)
+func TestTieredCacher_SetItem(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	cacher_SetItem(cache, t)
 }
 
-func TestCluster_SetItem(t *testing.T) {
-	cluster := newCluster(t)
-	cacher_SetItem(cluster, t)
+func TestTieredCacher_GetItem(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	cacher_GetItem(cache, t)
 }
 
-func TestCluster_GetItem(t *testing.T) {
-	cluster := newCluster(t)
-	cacher_GetItem(cluster, t)
+func TestTieredCacher_GetDeItem(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	cacher_GetDeItem(cache, t)
 }
 
-func TestCluster_GetDeItem(t *testing.T) {
+func TestTieredCacher_NewSetTxn(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	cacher_NewSetTxn(cache, t)
+}
+
+func TestTieredCacher_NewSetTxn_WriteThrough(t *testing.T) {
+	cache := newTieredCacher(t, nil)
+	defer cache.Close()
+
+	key := []byte("txn_key")
+	value := []byte("txn_value")
+	txn, err := cache.NewSetTxn(key, len(value), MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = txn.Write(value); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	l1Value, err := cache.l1.Get(key)
+	if err != nil {
+		t.Fatalf("the value must be written through to the first tier: [%s]", err)
+	}
+	checkValue(t, value, l1Value)
+}
+
+func TestTieredCacher_Promote(t *testing.T) {
+	l1 := newCache(t)
+	l2 := newCache(t)
+	cache := NewTieredCacher(l1, l2, &PromotePolicy{Hits: 3, MaxItemSize: 10})
+	defer cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+	if err := l2.Set(key, value, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	bigKey := []byte("big_key")
+	bigValue := []byte("value exceeding MaxItemSize")
+	if err := l2.Set(bigKey, bigValue, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := l1.Get(key); err != ErrCacheMiss {
+			t.Fatalf("the item mustn't be promoted after %d hits: [%v]", i, err)
+		}
+		v, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, value, v)
+		v, err = cache.Get(bigKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, bigValue, v)
+	}
+	v, err := l1.Get(key)
+	if err != nil {
+		t.Fatalf("the item must be promoted: [%s]", err)
+	}
+	checkValue(t, value, v)
+	if _, err = l1.Get(bigKey); err != ErrCacheMiss {
+		t.Fatalf("big item mustn't be promoted: [%v]", err)
+	}
+
+	if v, err = cache.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, v)
+	stats := cache.Stats()
+	if stats.L1Hits != 1 || stats.L2Hits != 6 || stats.Promotions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if !cache.Delete(key) {
+		t.Fatalf("cannot delete the item")
+	}
+	if _, err = l1.Get(key); err != ErrCacheMiss {
+		t.Fatalf("the item must be deleted from the first tier: [%v]", err)
+	}
+}
+
+/*******************************************************************************
+ * EncryptedCacher
+ ******************************************************************************/
+
+func newEncryptedCacher(t *testing.T, cache SimpleCacher, key string) *EncryptedCacher {
+	c, err := NewEncryptedCacher(cache, func() ([]byte, error) {
+		return []byte(key), nil
+	})
+	if err != nil {
+		t.Fatalf("Cannot create EncryptedCacher: [%s]", err)
+	}
+	return c
+}
+
+func TestEncryptedCacher_Set_Get(t *testing.T) {
+	simple_cacher_Set_Get_Remove(newEncryptedCacher(t, newCache(t), "0123456789abcdef"), t)
+}
+
+func TestEncryptedCacher_Ciphertext(t *testing.T) {
+	cache := newCache(t)
+	c := newEncryptedCacher(t, cache, "0123456789abcdef")
+	defer c.Close()
+
+	key := []byte("key")
+	value := []byte("secret value")
+	if err := c.Set(key, value, MaxTtl); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	buf, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if bytes.Contains(buf, value) {
+		t.Fatalf("The value must be stored encrypted: [%s]", buf)
+	}
+
+	// Values must be bound to their keys.
+	if err = cache.Set([]byte("another_key"), buf, MaxTtl); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if _, err = c.Get([]byte("another_key")); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+
+	// Values encrypted with another key must be reported as missing.
+	c2 := newEncryptedCacher(t, cache, "fedcba9876543210")
+	if _, err = c2.Get(key); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+	if _, err = c.Get(key); err != ErrCacheMiss {
+		t.Fatalf("Undecryptable value must be deleted. err=[%v]", err)
+	}
+}
+
+func TestEncryptedCacher_InvalidKey(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	_, err := NewEncryptedCacher(cache, func() ([]byte, error) {
+		return []byte("short"), nil
+	})
+	if err != ErrInvalidEncryptionKey {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrInvalidEncryptionKey", err)
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	const name = "YBC_TEST_ENCRYPTION_KEY"
+	defer os.Unsetenv(name)
+
+	if _, err := KeyFromEnv(name)(); err == nil {
+		t.Fatalf("Expecting error for missing environment variable")
+	}
+
+	os.Setenv(name, " 000102030405060708090a0b0c0d0e0f\n")
+	key, err := KeyFromEnv(name)()
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	checkValue(t, []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"), key)
+
+	os.Setenv(name, "AAECAwQFBgcICQoLDA0ODw==")
+	key, err = KeyFromEnv(name)()
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	checkValue(t, []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"), key)
+
+	os.Setenv(name, "foobar")
+	if _, err = KeyFromEnv(name)(); err != ErrInvalidEncryptionKey {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrInvalidEncryptionKey", err)
+	}
+}
+
+func TestKeyFromFile(t *testing.T) {
+	filename := "test.key"
+	defer os.Remove(filename)
+
+	expectedKey := []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f")
+
+	// Hex-encoded 16-byte key has valid raw key size,
+	// but it must be decoded.
+	writeTestKeyFile(t, filename, "000102030405060708090a0b0c0d0e0f")
+	key, err := KeyFromFile(filename)()
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	checkValue(t, expectedKey, key)
+
+	writeTestKeyFile(t, filename, "AAECAwQFBgcICQoLDA0ODw==\n")
+	key, err = KeyFromFile(filename)()
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	checkValue(t, expectedKey, key)
+
+	writeTestKeyFile(t, filename, string(expectedKey))
+	if _, err = KeyFromFile(filename)(); err != ErrInvalidEncryptionKey {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrInvalidEncryptionKey", err)
+	}
+	key, err = RawKeyFromFile(filename)()
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	checkValue(t, expectedKey, key)
+
+	writeTestKeyFile(t, filename, "foobar")
+	if _, err = RawKeyFromFile(filename)(); err != ErrInvalidEncryptionKey {
+		t.Fatalf("Unexpected error: [%v]. Expected ErrInvalidEncryptionKey", err)
+	}
+
+	os.Remove(filename)
+	if _, err = KeyFromFile(filename)(); err == nil {
+		t.Fatalf("Expecting error for missing file")
+	}
+	if _, err = RawKeyFromFile(filename)(); err == nil {
+		t.Fatalf("Expecting error for missing file")
+	}
+}
+
+func writeTestKeyFile(t *testing.T, filename, data string) {
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Cannot write key file [%s]: [%s]", filename, err)
+	}
+}
+
+/*******************************************************************************
+ * CasStore
+ ******************************************************************************/
+
+func TestCasStore_PutGetRelease(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+	s := NewCasStore(cache)
+
+	data := []byte("foobar")
+	hash, err := s.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := s.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hash2 {
+		t.Fatalf("unexpected hash=%s for the same data. Expected %s", hash2, hash)
+	}
+	if refs := s.Refs(hash); refs != 2 {
+		t.Fatalf("unexpected refs=%d. Expected 2", refs)
+	}
+	value, err := s.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, data, value)
+
+	otherHash, err := s.Put([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherHash == hash {
+		t.Fatalf("distinct data must have distinct hashes")
+	}
+
+	if err = s.Release(hash); err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.GetItem(hash)
+	if err != nil {
+		t.Fatalf("the blob must remain after releasing one of two references: [%s]", err)
+	}
+	checkValue(t, data, item.Value())
+	item.Close()
+
+	if err = s.Release(hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(hash); err != ErrCacheMiss {
+		t.Fatalf("the blob must be deleted after releasing the last reference: [%v]", err)
+	}
+	if err = s.Release(hash); err != ErrCacheMiss {
+		t.Fatalf("unexpected error when releasing deleted blob: [%v]", err)
+	}
+	if refs := s.Refs(otherHash); refs != 1 {
+		t.Fatalf("unexpected refs=%d for other blob. Expected 1", refs)
+	}
+}
+
+/*******************************************************************************
+ * KeyLocker
+ ******************************************************************************/
+
+func TestKeyLocker_Incr(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	kl := NewKeyLocker(0)
+	key := []byte("counter")
+	incr := func() error {
+		kl.Lock(key)
+		defer kl.Unlock(key)
+		var n uint64
+		value, err := cache.Get(key)
+		if err == nil {
+			n = binary.LittleEndian.Uint64(value)
+		} else if err != ErrCacheMiss {
+			return fmt.Errorf("unexpected error: [%s]", err)
+		}
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], n+1)
+		if err = cache.Set(key, buf[:], MaxTtl); err != nil {
+			return fmt.Errorf("cannot store counter: [%s]", err)
+		}
+		return nil
+	}
+
+	const workersCount = 10
+	const incrsCount = 100
+	var wg sync.WaitGroup
+	for i := 0; i < workersCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrsCount; j++ {
+				if err := incr(); err != nil {
+					// t.Fatalf cannot be called outside the test goroutine.
+					t.Errorf("%s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	value, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.LittleEndian.Uint64(value); n != workersCount*incrsCount {
+		t.Fatalf("unexpected counter value: %d. Expected %d", n, workersCount*incrsCount)
+	}
+}
+
+func TestKeyLocker_Do(t *testing.T) {
+	kl := NewKeyLocker(1)
+	called := false
+	kl.Do([]byte("key"), func() { called = true })
+	if !called {
+		t.Fatalf("the function must be called")
+	}
+
+	// The lock must be released after Do.
+	kl.Lock([]byte("other_key"))
+	kl.Unlock([]byte("other_key"))
+}
+
+/*******************************************************************************
+ * Cluster
+ ******************************************************************************/
+
+func newCluster(t *testing.T) *Cluster {
+	config := newClusterConfig(3)
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cluster
+}
+
+func TestCluster_Ops(t *testing.T) {
+	config := ClusterConfig{
+		&Config{
+			DataFileSize:  1000 * 1000,
+			MaxItemsCount: 1000,
+			IndexFile:     "cache.index.0",
+			DataFile:      "cache.data.0",
+		},
+		&Config{
+			DataFileSize:  1000 * 1000,
+			MaxItemsCount: 1000,
+			IndexFile:     "cache.index.1",
+			DataFile:      "cache.data.1",
+		},
+		&Config{
+			DataFileSize:  1000 * 1000,
+			MaxItemsCount: 1000,
+			IndexFile:     "cache.index.2",
+			DataFile:      "cache.data.2",
+		},
+	}
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.RemoveCluster()
+	defer cluster.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		err := cluster.Set(key, value, MaxTtl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actualValue, err := cluster.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, value, actualValue)
+	}
+}
+
+type iterator interface {
+	Cacher
+	Iterate(f func(key []byte, item *Item) bool)
+}
+
+func cacher_Iterate(cache iterator, t *testing.T) {
+	defer cache.Close()
+
+	const itemsCount = 100
+	for i := 0; i < itemsCount; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cache.Delete([]byte("key_42")) {
+		t.Fatalf("cannot delete key_42")
+	}
+
+	visited := make(map[string]bool)
+	cache.Iterate(func(key []byte, item *Item) bool {
+		k := string(key)
+		if visited[k] {
+			t.Fatalf("key [%s] has been visited twice", k)
+		}
+		visited[k] = true
+		checkValue(t, []byte("value_"+k[len("key_"):]), item.Value())
+		return true
+	})
+	if len(visited) != itemsCount-1 {
+		t.Fatalf("unexpected number of visited items=%d. Expected %d", len(visited), itemsCount-1)
+	}
+	if visited["key_42"] {
+		t.Fatalf("deleted key_42 has been visited")
+	}
+
+	n := 0
+	cache.Iterate(func(key []byte, item *Item) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("unexpected number of visited items=%d after stopping the iteration. Expected 10", n)
+	}
+
+	cache.Clear()
+	cache.Iterate(func(key []byte, item *Item) bool {
+		t.Fatalf("unexpected item [%s] after clearing the cache", key)
+		return false
+	})
+}
+
+func TestCache_Iterate(t *testing.T) {
+	cache := newCache(t)
+	cacher_Iterate(cache, t)
+}
+
+func TestCluster_Iterate(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Iterate(cluster, t)
+}
+
+type sizer interface {
+	Cacher
+	Sizer
+}
+
+func cacher_Sizer(cache sizer, t *testing.T) {
+	defer cache.Close()
+
+	capacity := cache.Capacity()
+	if capacity <= 0 {
+		t.Fatalf("unexpected capacity=%d", capacity)
+	}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("unexpected number of items=%d in empty cache", n)
+	}
+
+	const itemsCount = 100
+	var expectedSize int64
+	for i := 0; i < itemsCount; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+		expectedSize += int64(len(key) + len(value))
+	}
+	if n := cache.Len(); n != itemsCount {
+		t.Fatalf("unexpected number of items=%d. Expected %d", n, itemsCount)
+	}
+	if size := cache.SizeBytes(); size != expectedSize {
+		t.Fatalf("unexpected size=%d. Expected %d", size, expectedSize)
+	}
+	if cache.Capacity() != capacity {
+		t.Fatalf("capacity mustn't depend on the number of items")
+	}
+
+	cache.Clear()
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("unexpected number of items=%d after clearing the cache", n)
+	}
+	if size := cache.SizeBytes(); size != 0 {
+		t.Fatalf("unexpected size=%d after clearing the cache", size)
+	}
+}
+
+func TestCache_Sizer(t *testing.T) {
+	cache := newCache(t)
+	cacher_Sizer(cache, t)
+}
+
+func TestCluster_Sizer(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Sizer(cluster, t)
+}
+
+func TestCluster_ClusterWeight(t *testing.T) {
+	config := newClusterConfig(3)
+	config[0].ClusterWeight = 1
+	config[1].ClusterWeight = 2
+	config[2].ClusterWeight = 5
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	const keysCount = 80000
+	var counts [3]int
+	for i := 0; i < keysCount; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		counts[cluster.shardIndex(key)]++
+	}
+	for i, c := range config {
+		expectedCount := keysCount * int(c.ClusterWeight) / 8
+		if counts[i] < expectedCount*9/10 || counts[i] > expectedCount*11/10 {
+			t.Fatalf("unexpected number of keys=%d for cache #%d with weight=%d. Expected %d", counts[i], i, c.ClusterWeight, expectedCount)
+		}
+	}
+}
+
+func TestCluster_KeyHash(t *testing.T) {
+	config := newClusterConfig(3)
+	config[0].KeyHash = func(key []byte) uint64 {
+		// Caches have equal weights, so the last cache owns
+		// the last third of slots.
+		return uint64(config[2].MaxItemsCount*3 - 1)
+	}
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if n := cluster.shardIndex(key); n != 2 {
+			cluster.Close()
+			t.Fatalf("unexpected cache #%d for key=[%s]. Expected #2", n, key)
+		}
+	}
+	simple_cacher_Set_Get_Remove(cluster, t)
+}
+
+func newPersistentClusterConfig(name string) ClusterConfig {
+	config := newClusterConfig(3)
+	for i, c := range config {
+		c.IndexFile = fmt.Sprintf("cache.index.%s.%d", name, i)
+		c.DataFile = fmt.Sprintf("cache.data.%s.%d", name, i)
+	}
+	return config
+}
+
+// Emulates process restart with new random key hash seed.
+//
+// Returns a function restoring the original seed.
+func resetKeyHashSeed(seed KeyHashSeed) func() {
+	origSeed := GetKeyHashSeed()
+	SetKeyHashSeed(seed)
+	return func() {
+		SetKeyHashSeed(origSeed)
+	}
+}
+
+func setClusterKeys(t *testing.T, config ClusterConfig) {
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatalf("cannot open cluster: [%s]", err)
+	}
+	defer cluster.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err := cluster.Set(key, key, MaxTtl); err != nil {
+			t.Fatalf("cannot set key=[%s]: [%s]", key, err)
+		}
+	}
+}
+
+func checkClusterKeys(t *testing.T, config ClusterConfig) {
+	cluster, err := config.OpenCluster(false)
+	if err != nil {
+		t.Fatalf("cannot reopen cluster: [%s]", err)
+	}
+	defer cluster.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if _, err := cluster.Get(key); err != nil {
+			t.Fatalf("cannot find key=[%s] after reopening the cluster: [%s]", key, err)
+		}
+	}
+}
+
+func TestClusterConfig_PinKeyHashSeed(t *testing.T) {
+	defer resetKeyHashSeed(KeyHashSeed{1})()
+
+	const seedFile = "foobar.keyseed.pin"
+	os.Remove(seedFile)
+	defer os.Remove(seedFile)
+	config := newPersistentClusterConfig("pin")
+	config.RemoveCluster()
+	defer config.RemoveCluster()
+
+	// The missing file must be created with the current seed
+	// for new cluster.
+	if err := config.PinKeyHashSeed(seedFile); err != nil {
+		t.Fatalf("cannot pin key hash seed: [%s]", err)
+	}
+	key := []byte("foobar")
+	h := NewSipHashKeyHash(KeyHashSeed{1})(key)
+	if config[0].KeyHash(key) != h {
+		t.Fatalf("unexpected key hash for the pinned seed")
+	}
+	setClusterKeys(t, config)
+
+	// The seed must be read from the file after restart.
+	resetKeyHashSeed(KeyHashSeed{2})
+	config[0].KeyHash = nil
+	if err := config.PinKeyHashSeed(seedFile); err != nil {
+		t.Fatalf("cannot pin key hash seed: [%s]", err)
+	}
+	if config[0].KeyHash(key) != h {
+		t.Fatalf("unexpected key hash for the seed read from file")
+	}
+	if seed := GetKeyHashSeed(); seed != (KeyHashSeed{2}) {
+		t.Fatalf("the per-process seed=%s mustn't be changed. Expected %s", seed, KeyHashSeed{2})
+	}
+	checkClusterKeys(t, config)
+
+	// The lost seed file mustn't result in silent fallback to FNVKeyHash.
+	data, err := ioutil.ReadFile(seedFile)
+	if err != nil {
+		t.Fatalf("cannot read seed file: [%s]", err)
+	}
+	os.Remove(seedFile)
+	if err := config.PinKeyHashSeed(seedFile); err == nil {
+		t.Fatalf("expecting error for missing seed file of the cluster with pinned seed")
+	}
+	if _, err := os.Stat(seedFile); !os.IsNotExist(err) {
+		t.Fatalf("seed file mustn't be created for the existing cluster. err=[%v]", err)
+	}
+
+	// The marker must be restored for clusters pinned without the marker.
+	markerFile := config.keyHashMarkerFile()
+	os.Remove(markerFile)
+	if err := ioutil.WriteFile(seedFile, data, 0600); err != nil {
+		t.Fatalf("cannot write seed file: [%s]", err)
+	}
+	if err := config.PinKeyHashSeed(seedFile); err != nil {
+		t.Fatalf("cannot pin key hash seed: [%s]", err)
+	}
+	if _, err := os.Stat(markerFile); err != nil {
+		t.Fatalf("cannot find key hash marker file: [%s]", err)
+	}
+
+	if err := ioutil.WriteFile(seedFile, []byte("foobar"), 0600); err != nil {
+		t.Fatalf("cannot write seed file: [%s]", err)
+	}
+	if err := config.PinKeyHashSeed(seedFile); err == nil {
+		t.Fatalf("expecting error for invalid seed file")
+	}
+
+	// The marker must be removed together with the cluster.
+	config.RemoveCluster()
+	if _, err := os.Stat(markerFile); !os.IsNotExist(err) {
+		t.Fatalf("key hash marker file must be removed with the cluster. err=[%v]", err)
+	}
+}
+
+func TestClusterConfig_OpenCluster_FNVKeyHash(t *testing.T) {
+	defer resetKeyHashSeed(KeyHashSeed{1})()
+
+	const seedFile = "foobar.keyseed.fnv"
+	os.Remove(seedFile)
+	defer os.Remove(seedFile)
+	config := newPersistentClusterConfig("fnv")
+	config.RemoveCluster()
+	defer config.RemoveCluster()
+
+	// Emulate the cluster created before per-process seeding.
+	config[0].KeyHash = FNVKeyHash
+	setClusterKeys(t, config)
+
+	// Persistent cluster without key hash must use FNVKeyHash.
+	resetKeyHashSeed(KeyHashSeed{2})
+	config[0].KeyHash = nil
+	checkClusterKeys(t, config)
+	cluster, err := config.OpenCluster(false)
+	if err != nil {
+		t.Fatalf("cannot reopen cluster: [%s]", err)
+	}
+	key := []byte("foobar")
+	if cluster.keyHash(key) != FNVKeyHash(key) {
+		cluster.Close()
+		t.Fatalf("unexpected key hash for persistent cluster without key hash")
+	}
+	cluster.Close()
+
+	// The seed file mustn't be created for the existing cluster.
+	if err := config.PinKeyHashSeed(seedFile); err != nil {
+		t.Fatalf("cannot pin key hash seed: [%s]", err)
+	}
+	if _, err := os.Stat(seedFile); !os.IsNotExist(err) {
+		t.Fatalf("seed file mustn't be created for the existing cluster. err=[%v]", err)
+	}
+	if _, err := os.Stat(config.keyHashMarkerFile()); !os.IsNotExist(err) {
+		t.Fatalf("key hash marker file mustn't be created for the existing cluster. err=[%v]", err)
+	}
+	if config[0].KeyHash(key) != FNVKeyHash(key) {
+		t.Fatalf("unexpected key hash for the existing cluster without seed file")
+	}
+	checkClusterKeys(t, config)
+}
+
+func TestKeyHash_Vectors(t *testing.T) {
+	xxhashVectors := []struct {
+		key  string
+		hash uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, v := range xxhashVectors {
+		if h := XXHashKeyHash([]byte(v.key)); h != v.hash {
+			t.Fatalf("unexpected XXHashKeyHash(%q)=%x. Expected %x", v.key, h, v.hash)
+		}
+	}
+
+	// Test vectors from SipHash paper: key=00..0f, message=00..(n-1).
+	var secret [16]byte
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	sipHash := NewSipHashKeyHash(secret)
+	sipHashVectors := map[int]uint64{
+		0:  0x726fdb47dd0e0e31,
+		8:  0x93f5f5799a932462,
+		15: 0xa129ca6149be45e5,
+	}
+	for n, expectedHash := range sipHashVectors {
+		key := make([]byte, n)
+		for i := range key {
+			key[i] = byte(i)
+		}
+		if h := sipHash(key); h != expectedHash {
+			t.Fatalf("unexpected siphash for %d bytes=%x. Expected %x", n, h, expectedHash)
+		}
+	}
+	secret[0]++
+	if NewSipHashKeyHash(secret)([]byte("foobar")) == sipHash([]byte("foobar")) {
+		t.Fatalf("siphash mustn't be equal for distinct secret keys")
+	}
+}
+
+func TestCluster_Set_Get_Remove(t *testing.T) {
+	cluster := newCluster(t)
+	simple_cacher_Set_Get_Remove(cluster, t)
+}
+
+func TestCluster_GetDe(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_GetDe(cluster, t)
+}
+
+func TestCluster_Clear(t *testing.T) {
+	cluster := newCluster(t)
+	simple_cacher_Clear(cluster, t)
+}
+
+func TestCluster_SetItem(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_SetItem(cluster, t)
+}
+
+func TestCluster_GetItem(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_GetItem(cluster, t)
+}
+
+func TestCluster_GetItemInfo(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_GetItemInfo(cluster, t)
+}
+
+func TestCluster_GetDeItem(t *testing.T) {
 	cluster := newCluster(t)
 	cacher_GetDeItem(cluster, t)
 }
@@ -1031,3 +2533,97 @@ func TestCluster_NewSetTxn(t *testing.T) {
 	cluster := newCluster(t)
 	cacher_NewSetTxn(cluster, t)
 }
+
+func TestCluster_GetMultiInto(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_GetMultiInto(cluster, t)
+}
+
+func TestCluster_HealthMonitor(t *testing.T) {
+	config := ClusterConfig{
+		&Config{
+			DataFileSize:  1000 * 1000,
+			MaxItemsCount: 1000,
+			IndexFile:     "cache.index.health.0",
+			DataFile:      "cache.data.health.0",
+		},
+		&Config{
+			DataFileSize:  1000 * 1000,
+			MaxItemsCount: 1000,
+			IndexFile:     "cache.index.health.1",
+			DataFile:      "cache.data.health.1",
+		},
+	}
+	cluster, err := config.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.RemoveCluster()
+	defer cluster.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = cluster.Set(key, key, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := make(chan ShardEvent, 10)
+	cluster.StartHealthMonitor(10*time.Millisecond, func(e ShardEvent) {
+		events <- e
+	})
+	expectEvent := func(recovered bool) {
+		select {
+		case e := <-events:
+			if e.Shard != 1 || e.Recovered != recovered {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout when waiting for event recovered=%v", recovered)
+		}
+	}
+
+	if err = os.Rename("cache.data.health.1", "cache.data.health.1.moved"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(false)
+
+	hs := cluster.ShardsHealth()
+	if hs[0].Failed || !hs[1].Failed || hs[1].Failures != 1 || hs[1].LastErr == nil {
+		t.Fatalf("unexpected shards health %+v", hs)
+	}
+	hits := 0
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if _, err = cluster.Get(key); err == nil {
+			hits++
+		} else if err != ErrCacheMiss {
+			t.Fatal(err)
+		}
+		if err = cluster.Set(key, key, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits == 0 || hits == 100 {
+		t.Fatalf("unexpected number of hits=%d while one of two shards failed", hits)
+	}
+
+	if err = os.Rename("cache.data.health.1.moved", "cache.data.health.1"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(true)
+
+	hs = cluster.ShardsHealth()
+	if hs[1].Failed || hs[1].Recoveries != 1 {
+		t.Fatalf("unexpected shards health %+v", hs)
+	}
+	key := []byte("foobar")
+	if err = cluster.Set(key, key, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	value, err := cluster.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, key, value)
+}
@@ -19,6 +19,12 @@ const (
 
 	// see /proc/sys/net/core/wmem_default
 	defaultOSWriteBufferSize = 224 * 1024
+
+	defaultProxyTtl    = time.Minute
+	defaultFallbackTtl = time.Hour
+	defaultHedgeDelay  = 10 * time.Millisecond
+
+	defaultVersionCheckInterval = time.Second
 )
 
 const (
@@ -29,6 +35,8 @@ const (
 
 var (
 	strAdd                 = []byte("add ")
+	strAuth                = []byte("auth")
+	strAuthFailureCrLf     = []byte("CLIENT_ERROR authentication failure\r\n")
 	strCas                 = []byte("cas ")
 	strCget                = []byte("cget ")
 	strCgetDe              = []byte("cgetde ")
@@ -47,6 +55,7 @@ var (
 	strGet                 = []byte("get ")
 	strGetDe               = []byte("getde ")
 	strGets                = []byte("gets ")
+	strHotKeys             = []byte("hotkeys")
 	strNoreply             = []byte("noreply")
 	strNotFound            = []byte("NOT_FOUND")
 	strNotFoundCrLf        = []byte("NOT_FOUND\r\n")
@@ -56,10 +65,17 @@ var (
 	strNotStoredCrLf       = []byte("NOT_STORED\r\n")
 	strOkCrLf              = []byte("OK\r\n")
 	strQuit                = []byte("quit")
+	strServerShutdownCrLf  = []byte("SERVER_ERROR server is shutting down\r\n")
 	strSet                 = []byte("set ")
+	strStatWs              = []byte("STAT ")
+	strStats               = []byte("stats")
+	strStatsWs             = []byte("stats ")
 	strStored              = []byte("STORED")
 	strStoredCrLf          = []byte("STORED\r\n")
 	strValue               = []byte("VALUE ")
+	strVersion             = []byte("version")
+	strVersionCrLf         = []byte("version\r\n")
+	strVersionResponse     = []byte("VERSION ")
 	strWouldBlock          = []byte("WB")
 	strWouldBlockCrLf      = []byte("WB\r\n")
 	strWsNoreplyCrLf       = []byte(" noreply\r\n")
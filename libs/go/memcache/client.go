@@ -3,12 +3,16 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,11 +25,14 @@ var (
 	ErrNilValue             = errors.New("memcache.Client: nil value")
 	ErrNotModified          = errors.New("memcache.Client: item not modified")
 	ErrAlreadyExists        = errors.New("memcache.Client: the item already exists")
+	ErrAcquireTimeout       = errors.New("memcache.Client: timeout when waiting for free slot in pending requests' queue")
 )
 
 const (
 	defaultConnectionsCount        = 4
 	defaultMaxPendingRequestsCount = 1024
+	defaultProbeTimeout            = time.Second
+	defaultIdleConnectionTimeout   = 10 * time.Second
 )
 
 // Memcache client configuration. Can be passed to Client and DistributedClient.
@@ -47,6 +54,32 @@ type ClientConfig struct {
 	//     CPU (thread) per connection.
 	ConnectionsCount int
 
+	// The maximum number of simultaneous TCP connections to memcached
+	// server.
+	// Optional parameter. Equals to ConnectionsCount by default.
+	//
+	// If MaxConnectionsCount exceeds ConnectionsCount, then the Client
+	// establishes additional connections when pending requests start
+	// queueing up, for instance, during bursts of requests or while
+	// memcached server is slow. Additional connections are closed after
+	// IdleConnectionTimeout of inactivity, while ConnectionsCount
+	// connections are always kept open.
+	MaxConnectionsCount int
+
+	// Inactivity duration after which additional connections established
+	// due to MaxConnectionsCount are closed.
+	// Optional parameter.
+	IdleConnectionTimeout time.Duration
+
+	// The maximum duration to wait for free slot in pending requests' queue
+	// when MaxPendingRequestsCount requests are already pending.
+	// Optional parameter. By default requests wait for free slot
+	// without time limit.
+	//
+	// ErrAcquireTimeout is returned if the request cannot be queued
+	// during AcquireTimeout.
+	AcquireTimeout time.Duration
+
 	// The maximum number of pending requests awaiting to be processed
 	// by memcached server.
 	// Optional parameter.
@@ -69,6 +102,91 @@ type ClientConfig struct {
 	// The size in bytes of OS-supplied write buffer per TCP connection.
 	// Optional parameter.
 	OSWriteBufferSize int
+
+	// The maximum duration Client.Start() waits for establishing
+	// all the ConnectionsCount connections to memcached server.
+	// Optional parameter.
+	//
+	// Non-zero value also enables re-warming: broken connections
+	// are re-established in background instead of waiting for the next
+	// request, so requests after memcached failover don't pay
+	// connection setup latency.
+	WarmupTimeout time.Duration
+
+	// Interval for background 'version' requests used for checking
+	// memcached server health. See Client.Healthy().
+	// Optional parameter. Probes are disabled by default.
+	ProbeInterval time.Duration
+
+	// The maximum duration to wait for response to health probe.
+	// Optional parameter.
+	ProbeTimeout time.Duration
+
+	// TLS configuration for connections to memcached server.
+	// Optional parameter. Connections aren't encrypted by default.
+	//
+	// ServerName is obtained from server address if it isn't set.
+	// Use NewTLSConfig() for creating config with custom CA
+	// and client certificate.
+	TLSConfig *tls.Config
+
+	// Username and password for authenticating connections
+	// to memcached server.
+	// Optional parameter. Authentication is disabled if Username is empty.
+	//
+	// Credentials are sent in the form used by memcached's text protocol
+	// authentication, i.e. 'set' request with 'username password' value
+	// right after the connection is established. This is the text protocol
+	// counterpart of SASL PLAIN mechanism, so it is better to use
+	// authentication together with TLSConfig.
+	Username string
+	Password string
+
+	// Hooks called on each operation.
+	// Optional parameter.
+	Hooks ClientHooks
+
+	// The maximum duration requests sent via SetNowait(), DeleteNowait()
+	// and other *Nowait() methods may be buffered before sending them
+	// to memcached server.
+	// Optional parameter. By default requests are sent as soon as there
+	// are no other pending requests.
+	//
+	// Buffering reduces the number of syscalls and network packets
+	// for write-heavy workloads. Buffered requests are lost if the connection
+	// to the server breaks, but *Nowait() methods provide no delivery
+	// guarantees anyway. Requests waiting for responses are never delayed.
+	NowaitFlushDelay time.Duration
+}
+
+// Creates TLS config for ClientConfig.TLSConfig.
+//
+// caFile is a path to PEM-encoded CA certificates used for verifying
+// memcached server certificate. System CAs are used if caFile is empty.
+//
+// certFile and keyFile are paths to PEM-encoded client certificate
+// and its' key. They may be empty if the server doesn't require
+// client certificates.
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file [%s]: [%s]", caFile, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("cannot find PEM-encoded certificates in CA file [%s]", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate from certFile=[%s], keyFile=[%s]: [%s]", certFile, keyFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 // Fast memcache client.
@@ -107,8 +225,28 @@ type Client struct {
 	// The address should be in the form addr:port.
 	ServerAddr string
 
-	requests chan tasker
-	done     *sync.WaitGroup
+	requests   chan tasker
+	done       *sync.WaitGroup
+	stop       chan struct{}
+	proberDone *sync.WaitGroup
+
+	// The number of established connections to the server.
+	connsCount int32
+
+	// The number of running additional connections' handlers.
+	extraConnsCount int32
+
+	// The number of requests failed with ErrAcquireTimeout.
+	acquireTimeoutsCount uint64
+
+	// Signals the pool to establish additional connection.
+	grow chan struct{}
+
+	// Non-zero if the last health probe failed.
+	unhealthy uint32
+
+	// TLSConfig with ServerName set.
+	tlsConfig *tls.Config
 }
 
 // Memcache item.
@@ -146,11 +284,55 @@ type tasker interface {
 	Wait() bool
 }
 
-func requestsSender(w *bufio.Writer, requests <-chan tasker, responses chan<- tasker, c net.Conn, done *sync.WaitGroup) {
+// Returns the next task from requests.
+//
+// Returns false if requests is closed or if no tasks arrived during
+// non-zero idleTimeout.
+//
+// The timer must be stopped. It is left stopped on return.
+func nextTask(requests <-chan tasker, timer *time.Timer, idleTimeout time.Duration) (t tasker, ok bool) {
+	if idleTimeout <= 0 {
+		t, ok = <-requests
+		return
+	}
+	timer.Reset(idleTimeout)
+	select {
+	case t, ok = <-requests:
+		stopTimer(timer)
+	case <-timer.C:
+	}
+	return
+}
+
+// Stops the timer and drains its channel, so the timer may be safely reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+func requestsSender(w *bufio.Writer, requests <-chan tasker, responses chan<- tasker, c net.Conn, flushDelay, idleTimeout time.Duration, done *sync.WaitGroup) {
 	defer done.Done()
 	defer w.Flush()
 	defer close(responses)
 	scratchBuf := make([]byte, 0, 1024)
+
+	// The timer is shared by flushDelay and idleTimeout waits, so it isn't
+	// allocated on each request.
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	// Whether w contains requests awaiting responses.
+	hasSyncRequests := false
+
+	// Time when buffered nowait requests must be flushed. It is set
+	// when the first request is buffered, so a steady stream of nowait
+	// requests doesn't postpone the flush indefinitely.
+	var flushDeadline time.Time
 	for {
 		var t tasker
 		var ok bool
@@ -159,16 +341,36 @@ func requestsSender(w *bufio.Writer, requests <-chan tasker, responses chan<- ta
 		select {
 		case t, ok = <-requests:
 		default:
-			w.Flush()
-			t, ok = <-requests
+			if flushDelay > 0 && !hasSyncRequests && w.Buffered() > 0 {
+				// w contains only nowait requests, so delay the flush
+				// in order to coalesce them with subsequent requests.
+				timer.Reset(time.Until(flushDeadline))
+				select {
+				case t, ok = <-requests:
+					stopTimer(timer)
+				case <-timer.C:
+					w.Flush()
+					t, ok = nextTask(requests, timer, idleTimeout)
+				}
+			} else {
+				w.Flush()
+				hasSyncRequests = false
+				t, ok = nextTask(requests, timer, idleTimeout)
+			}
 		}
 		if !ok {
 			break
 		}
+		if flushDelay > 0 && w.Buffered() == 0 {
+			flushDeadline = time.Now().Add(flushDelay)
+		}
 		if !t.WriteRequest(w, &scratchBuf) {
 			t.Done(false)
 			break
 		}
+		if _, isNowait := t.(nowaitTasker); !isNowait {
+			hasSyncRequests = true
+		}
 		responses <- t
 	}
 }
@@ -189,45 +391,99 @@ func responsesReceiver(r *bufio.Reader, responses <-chan tasker, c net.Conn, don
 	}
 }
 
-func handleAddr(c *Client) {
+// Serves requests over a connection to the server.
+//
+// Non-zero idleTimeout closes the connection after idleTimeout
+// of inactivity.
+//
+// Returns false if the connection cannot be established.
+func handleAddr(c *Client, idleTimeout time.Duration) (connected bool) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", c.ServerAddr)
 	if err != nil {
 		log.Printf("Cannot resolve ServerAddr=[%s]: [%s]", c.ServerAddr, err)
 		return
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
 	if err != nil {
 		log.Printf("Cannot establish tcp connection to addr=[%s]: [%s]", tcpAddr, err)
 		return
 	}
-	defer conn.Close()
+	defer tcpConn.Close()
 
-	if err = conn.SetReadBuffer(c.OSReadBufferSize); err != nil {
+	if err = tcpConn.SetReadBuffer(c.OSReadBufferSize); err != nil {
 		log.Fatalf("Cannot set TCP read buffer size to %d: [%s]", c.OSReadBufferSize, err)
 	}
-	if err = conn.SetWriteBuffer(c.OSWriteBufferSize); err != nil {
+	if err = tcpConn.SetWriteBuffer(c.OSWriteBufferSize); err != nil {
 		log.Fatalf("Cannot set TCP write buffer size to %d: [%s]", c.OSWriteBufferSize, err)
 	}
 
+	var conn net.Conn = tcpConn
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(tcpConn, c.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			log.Printf("Cannot establish TLS connection to addr=[%s]: [%s]", tcpAddr, err)
+			return
+		}
+		conn = tlsConn
+	}
+
 	r := bufio.NewReaderSize(conn, c.ReadBufferSize)
 	w := bufio.NewWriterSize(conn, c.WriteBufferSize)
 
+	if c.Username != "" && !authenticate(r, w, c.Username, c.Password) {
+		log.Printf("Cannot authenticate at addr=[%s] with username=[%s]", tcpAddr, c.Username)
+		return
+	}
+
+	connected = true
+	atomic.AddInt32(&c.connsCount, 1)
+	defer atomic.AddInt32(&c.connsCount, -1)
+
 	responses := make(chan tasker, c.MaxPendingRequestsCount)
 	var sendRecvDone sync.WaitGroup
 	defer sendRecvDone.Wait()
 	sendRecvDone.Add(2)
-	go requestsSender(w, c.requests, responses, conn, &sendRecvDone)
+	go requestsSender(w, c.requests, responses, conn, c.NowaitFlushDelay, idleTimeout, &sendRecvDone)
 	go responsesReceiver(r, responses, conn, &sendRecvDone)
+	return
+}
+
+// Authenticates the connection using memcached's text protocol
+// authentication.
+func authenticate(r *bufio.Reader, w *bufio.Writer, username, password string) bool {
+	item := Item{
+		Key:   strAuth,
+		Value: []byte(username + " " + password),
+	}
+	scratchBuf := make([]byte, 0, 64)
+	if !writeSetRequest(w, &item, false, &scratchBuf) {
+		return false
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Cannot flush authentication request: [%s]", err)
+		return false
+	}
+	return readSetResponse(r)
 }
 
 func addrHandler(c *Client, done *sync.WaitGroup) {
 	defer done.Done()
 	for {
-		handleAddr(c)
+		handleAddr(c, 0)
 
-		// cancel all pending requests
-		for t := range c.requests {
-			t.Done(false)
+		if !cancelPendingRequests(c.requests) {
+			// The requests channel is closed.
+			return
+		}
+
+		if c.WarmupTimeout > 0 {
+			// Re-establish the connection in background.
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(reconnectDelay):
+			}
+			continue
 		}
 
 		// wait for new incoming requests
@@ -240,6 +496,42 @@ func addrHandler(c *Client, done *sync.WaitGroup) {
 	}
 }
 
+// Serves additional connection to the server until it becomes idle
+// for ClientConfig.IdleConnectionTimeout.
+func extraAddrHandler(c *Client, done *sync.WaitGroup) {
+	defer done.Done()
+	defer atomic.AddInt32(&c.extraConnsCount, -1)
+	if !handleAddr(c, c.IdleConnectionTimeout) {
+		// Hold the slot for additional connection for a while,
+		// so failed connection attempts aren't repeated on each request.
+		select {
+		case <-c.stop:
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Delay between attempts to re-establish broken connections to the server
+// if ClientConfig.WarmupTimeout is set.
+const reconnectDelay = 100 * time.Millisecond
+
+// Cancels all the pending requests.
+//
+// Returns false if the requests channel is closed.
+func cancelPendingRequests(requests chan tasker) bool {
+	for {
+		select {
+		case t, ok := <-requests:
+			if !ok {
+				return false
+			}
+			t.Done(false)
+		default:
+			return true
+		}
+	}
+}
+
 func (c *Client) init() {
 	if c.ConnectionsCount == 0 {
 		c.ConnectionsCount = defaultConnectionsCount
@@ -259,10 +551,35 @@ func (c *Client) init() {
 	if c.OSWriteBufferSize == 0 {
 		c.OSWriteBufferSize = defaultOSWriteBufferSize
 	}
+	if c.ProbeTimeout == 0 {
+		c.ProbeTimeout = defaultProbeTimeout
+	}
+	if c.MaxConnectionsCount < c.ConnectionsCount {
+		c.MaxConnectionsCount = c.ConnectionsCount
+	}
+	if c.IdleConnectionTimeout == 0 {
+		c.IdleConnectionTimeout = defaultIdleConnectionTimeout
+	}
+	c.tlsConfig = c.TLSConfig
+	if c.tlsConfig != nil && c.tlsConfig.ServerName == "" {
+		c.tlsConfig = c.tlsConfig.Clone()
+		host, _, err := net.SplitHostPort(c.ServerAddr)
+		if err != nil {
+			host = c.ServerAddr
+		}
+		c.tlsConfig.ServerName = host
+	}
 
 	c.requests = make(chan tasker, c.MaxPendingRequestsCount)
 	c.done = &sync.WaitGroup{}
 	c.done.Add(1)
+	c.stop = make(chan struct{})
+	c.proberDone = &sync.WaitGroup{}
+	c.grow = make(chan struct{}, 1)
+	c.connsCount = 0
+	c.extraConnsCount = 0
+	c.acquireTimeoutsCount = 0
+	c.unhealthy = 0
 }
 
 func (c *Client) run() {
@@ -274,8 +591,117 @@ func (c *Client) run() {
 		connsDone.Add(1)
 		go addrHandler(c, &connsDone)
 	}
+	if c.MaxConnectionsCount == c.ConnectionsCount {
+		return
+	}
+
+	// Establish additional connections when pending requests queue up.
+	maxExtraConnsCount := int32(c.MaxConnectionsCount - c.ConnectionsCount)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.grow:
+		}
+		if atomic.LoadInt32(&c.extraConnsCount) >= maxExtraConnsCount {
+			continue
+		}
+		atomic.AddInt32(&c.extraConnsCount, 1)
+		connsDone.Add(1)
+		go extraAddrHandler(c, &connsDone)
+	}
+}
+
+// Periodically sends 'version' requests to the server and updates
+// the server health according to responses.
+func (c *Client) prober(done *sync.WaitGroup) {
+	defer done.Done()
+	ticker := time.NewTicker(c.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var unhealthy uint32
+		if !c.probe() {
+			unhealthy = 1
+		}
+		atomic.StoreUint32(&c.unhealthy, unhealthy)
+	}
+}
+
+func (c *Client) probe() bool {
+	var t taskVersion
+	t.Init()
+	if err := c.pushTask(&t); err != nil {
+		return false
+	}
+	select {
+	case ok := <-t.done:
+		releaseDoneChan(t.done)
+		return ok
+	case <-time.After(c.ProbeTimeout):
+		// Do not release t.done, since it may be still used by the task.
+		return false
+	}
+}
+
+// Returns true if the client has established connections to the server
+// and the last health probe succeeded.
+//
+// Health probes are sent only if ClientConfig.ProbeInterval is set.
+func (c *Client) Healthy() bool {
+	return atomic.LoadInt32(&c.connsCount) > 0 && atomic.LoadUint32(&c.unhealthy) == 0
 }
 
+// Returns the number of established connections to the server.
+func (c *Client) ConnsCount() int {
+	return int(atomic.LoadInt32(&c.connsCount))
+}
+
+// Connection pool stats. See Client.PoolStats().
+type ClientPoolStats struct {
+	// The number of established connections to the server.
+	ConnsCount int
+
+	// The number of additional connections established due to
+	// ClientConfig.MaxConnectionsCount.
+	ExtraConnsCount int
+
+	// The number of requests awaiting to be sent to the server.
+	PendingRequestsCount int
+
+	// The number of requests failed with ErrAcquireTimeout.
+	AcquireTimeoutsCount uint64
+}
+
+// Returns connection pool stats.
+func (c *Client) PoolStats() ClientPoolStats {
+	return ClientPoolStats{
+		ConnsCount:           c.ConnsCount(),
+		ExtraConnsCount:      int(atomic.LoadInt32(&c.extraConnsCount)),
+		PendingRequestsCount: len(c.requests),
+		AcquireTimeoutsCount: atomic.LoadUint64(&c.acquireTimeoutsCount),
+	}
+}
+
+func (c *Client) warmup() {
+	deadline := time.Now().Add(c.WarmupTimeout)
+	for c.ConnsCount() < c.ConnectionsCount {
+		if time.Now().After(deadline) {
+			log.Printf("Established only %d out of %d connections to [%s] during WarmupTimeout=%s",
+				c.ConnsCount(), c.ConnectionsCount, c.ServerAddr, c.WarmupTimeout)
+			return
+		}
+		time.Sleep(warmupPollInterval)
+	}
+}
+
+const warmupPollInterval = 10 * time.Millisecond
+
 func (c *Client) pushTask(t tasker) error {
 	// There is a race condition here, when c.requests is closed,
 	// but c.done isn't nil yet in Client.Stop().
@@ -289,8 +715,42 @@ func (c *Client) pushTask(t tasker) error {
 	if c.done == nil {
 		return ErrClientNotRunning
 	}
-	c.requests <- t
-	return nil
+	select {
+	case c.requests <- t:
+		if len(c.requests) > 0 {
+			c.growPool()
+		}
+		return nil
+	default:
+	}
+
+	// The pending requests' queue is full.
+	c.growPool()
+	if c.AcquireTimeout <= 0 {
+		c.requests <- t
+		return nil
+	}
+	timer := time.NewTimer(c.AcquireTimeout)
+	defer timer.Stop()
+	select {
+	case c.requests <- t:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&c.acquireTimeoutsCount, 1)
+		return ErrAcquireTimeout
+	}
+}
+
+// Asks for additional connection to the server if ClientConfig.MaxConnectionsCount
+// allows it.
+func (c *Client) growPool() {
+	if c.MaxConnectionsCount == c.ConnectionsCount {
+		return
+	}
+	select {
+	case c.grow <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Client) do(t tasker) (err error) {
@@ -316,6 +776,13 @@ func (c *Client) Start() {
 	}
 	c.init()
 	go c.run()
+	if c.ProbeInterval > 0 {
+		c.proberDone.Add(1)
+		go c.prober(c.proberDone)
+	}
+	if c.WarmupTimeout > 0 {
+		c.warmup()
+	}
 }
 
 // Stops the given client, which has been started via Client.Start() call.
@@ -323,6 +790,10 @@ func (c *Client) Stop() {
 	if c.done == nil {
 		panic("Did you call Client.Start() before calling Client.Stop()?")
 	}
+	close(c.stop)
+	// Wait for the prober before closing c.requests, since the prober
+	// may push tasks to c.requests.
+	c.proberDone.Wait()
 	close(c.requests)
 	c.done.Wait()
 	c.done = nil
@@ -505,7 +976,8 @@ func (t *taskGetMulti) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 //
 // Sets Item.Value, Item.Flags and Item.Casid for each returned item.
 // Doesn't modify Item.Value and Item.Flags for items missing on the server.
-func (c *Client) GetMulti(items []Item) error {
+func (c *Client) GetMulti(items []Item) (err error) {
+	defer c.finishOperation(c.startOperation("GetMulti"), &err)
 	itemsCount := len(items)
 	if itemsCount == 0 {
 		return nil
@@ -533,16 +1005,15 @@ func (t *taskGet) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
 func readSingleItem(r *bufio.Reader, scratchBuf *[]byte, item *Item) (ok bool, eof bool, wouldBlock, notModified bool) {
 	keyOriginal := item.Key
 	ok, eof, wouldBlock, notModified = readItem(r, scratchBuf, item)
-	if !ok || eof || wouldBlock || notModified {
-		return
-	}
-	if ok = matchStr(r, strEndCrLf); !ok {
-		return
-	}
-	if ok = bytes.Equal(keyOriginal, item.Key); !ok {
-		log.Printf("Key mismatch! Expected [%s], but server returned [%s]", keyOriginal, item.Key)
-		return
+	if ok && !eof && !wouldBlock && !notModified {
+		if ok = matchStr(r, strEndCrLf); ok {
+			if ok = bytes.Equal(keyOriginal, item.Key); !ok {
+				log.Printf("Key mismatch! Expected [%s], but server returned [%s]", keyOriginal, item.Key)
+			}
+		}
 	}
+	// readItem() overwrites item.Key, while callers expect it unchanged
+	// even on errors.
 	item.Key = keyOriginal
 	return
 }
@@ -559,7 +1030,8 @@ func (t *taskGet) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // Obtains item.Value, item.Flags and item.Casid for the given item.Key.
 //
 // Returns ErrCacheMiss on cache miss.
-func (c *Client) Get(item *Item) error {
+func (c *Client) Get(item *Item) (err error) {
+	defer c.finishOperation(c.startOperation("Get"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -612,7 +1084,8 @@ func (t *taskCget) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // in multi-level caches. It is modelled after HTTP cache validation approach
 // with entity tags - see
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec3.html#sec3.11 .
-func (c *Client) Cget(item *Item) error {
+func (c *Client) Cget(item *Item) (err error) {
+	defer c.finishOperation(c.startOperation("Cget"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -655,7 +1128,8 @@ func (t *taskCgetDe) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 }
 
 // Combines functionality of Client.Cget() and Client.GetDe().
-func (c *Client) CgetDe(item *Item, graceDuration time.Duration) error {
+func (c *Client) CgetDe(item *Item, graceDuration time.Duration) (err error) {
+	defer c.finishOperation(c.startOperation("CgetDe"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -716,7 +1190,8 @@ func (t *taskGetDe) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // Returns ErrCacheMiss on cache miss. It is expected that the caller
 // will create and store in the cache an item on cache miss during the given
 // graceDuration interval.
-func (c *Client) GetDe(item *Item, graceDuration time.Duration) error {
+func (c *Client) GetDe(item *Item, graceDuration time.Duration) (err error) {
+	defer c.finishOperation(c.startOperation("GetDe"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -782,7 +1257,8 @@ func (t *taskSet) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 }
 
 // Stores the given item in the memcache server.
-func (c *Client) Set(item *Item) error {
+func (c *Client) Set(item *Item) (err error) {
+	defer c.finishOperation(c.startOperation("Set"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -826,7 +1302,8 @@ func (t *taskAdd) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 //
 // Returns ErrAlreadyExists error if the server already holds data under
 // the item.Key.
-func (c *Client) Add(item *Item) error {
+func (c *Client) Add(item *Item) (err error) {
+	defer c.finishOperation(c.startOperation("Add"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -881,7 +1358,8 @@ func (t *taskCas) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 //
 // Returns ErrCacheMiss if the server has no item with such a key.
 // Returns ErrCasidMismatch if item on the server has other casid value.
-func (c *Client) Cas(item *Item) error {
+func (c *Client) Cas(item *Item) (err error) {
+	defer c.finishOperation(c.startOperation("Cas"), &err)
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -902,8 +1380,15 @@ func (c *Client) Cas(item *Item) error {
 	return nil
 }
 
+// Tasks sent via *Nowait() methods implement this interface.
+type nowaitTasker interface {
+	isNowait()
+}
+
 type taskNowait struct{}
 
+func (t *taskNowait) isNowait() {}
+
 func (t *taskNowait) Init() {}
 
 func (t *taskNowait) Done(ok bool) {}
@@ -927,9 +1412,13 @@ func (t *taskSetNowait) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
 
 // The same as Client.Set(), but doesn't wait for operation completion.
 //
+// The request is sent in noreply mode. It may be buffered for up to
+// ClientConfig.NowaitFlushDelay before sending to the server.
+//
 // Do not modify slices pointed by item.Key and item.Value after passing
 // to this function - it actually becomes an owner of these slices.
 func (c *Client) SetNowait(item *Item) {
+	defer c.finishOperation(c.startOperation("SetNowait"), nil)
 	if !validateKey(item.Key) || item.Value == nil {
 		return
 	}
@@ -979,7 +1468,8 @@ func (t *taskDelete) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 //
 // Returns ErrCacheMiss if there were no item with such key
 // on the server.
-func (c *Client) Delete(key []byte) error {
+func (c *Client) Delete(key []byte) (err error) {
+	defer c.finishOperation(c.startOperation("Delete"), &err)
 	if !validateKey(key) {
 		return ErrMalformedKey
 	}
@@ -1005,9 +1495,13 @@ func (t *taskDeleteNowait) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) boo
 
 // The same as Client.Delete(), but doesn't wait for operation completion.
 //
+// The request is sent in noreply mode. It may be buffered for up to
+// ClientConfig.NowaitFlushDelay before sending to the server.
+//
 // Do not modify slice pointed by key after passing to this function -
 // it actually becomes an owner of this slice.
 func (c *Client) DeleteNowait(key []byte) {
+	defer c.finishOperation(c.startOperation("DeleteNowait"), nil)
 	if !validateKey(key) {
 		return
 	}
@@ -1016,6 +1510,37 @@ func (c *Client) DeleteNowait(key []byte) {
 	c.do(&t)
 }
 
+type taskVersion struct {
+	version []byte
+	taskSync
+}
+
+func (t *taskVersion) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	return writeStr(w, strVersionCrLf)
+}
+
+func (t *taskVersion) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	if !readLine(r, scratchBuf) {
+		return false
+	}
+	line := *scratchBuf
+	if !bytes.HasPrefix(line, strVersionResponse) {
+		log.Printf("Unexpected response for 'version' request: [%s]", line)
+		return false
+	}
+	t.version = append(t.version[:0], line[len(strVersionResponse):]...)
+	return true
+}
+
+// Returns memcached server version.
+func (c *Client) Version() (string, error) {
+	var t taskVersion
+	if err := c.do(&t); err != nil {
+		return "", err
+	}
+	return string(t.version), nil
+}
+
 type taskFlushAllDelayed struct {
 	expiration time.Duration
 	taskSync
@@ -1030,7 +1555,8 @@ func (t *taskFlushAllDelayed) ReadResponse(r *bufio.Reader, scratchBuf *[]byte)
 }
 
 // Flushes all the items on the server after the given expiration delay.
-func (c *Client) FlushAllDelayed(expiration time.Duration) error {
+func (c *Client) FlushAllDelayed(expiration time.Duration) (err error) {
+	defer c.finishOperation(c.startOperation("FlushAllDelayed"), &err)
 	var t taskFlushAllDelayed
 	t.expiration = expiration
 	return c.do(&t)
@@ -1049,7 +1575,8 @@ func (t *taskFlushAll) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 }
 
 // Flushes all the items on the server.
-func (c *Client) FlushAll() error {
+func (c *Client) FlushAll() (err error) {
+	defer c.finishOperation(c.startOperation("FlushAll"), &err)
 	var t taskFlushAll
 	return c.do(&t)
 }
@@ -1067,6 +1594,7 @@ func (t *taskFlushAllDelayedNowait) WriteRequest(w *bufio.Writer, scratchBuf *[]
 // The same as Client.FlushAllDelayed(), but doesn't wait for operation
 // completion.
 func (c *Client) FlushAllDelayedNowait(expiration time.Duration) {
+	defer c.finishOperation(c.startOperation("FlushAllDelayedNowait"), nil)
 	var t taskFlushAllDelayedNowait
 	t.expiration = expiration
 	c.do(&t)
@@ -1082,6 +1610,7 @@ func (t *taskFlushAllNowait) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) b
 
 // The same as Client.FlushAll(), but doesn't wait for operation completion.
 func (c *Client) FlushAllNowait() {
+	defer c.finishOperation(c.startOperation("FlushAllNowait"), nil)
 	var t taskFlushAllNowait
 	c.do(&t)
 }
@@ -1,11 +1,20 @@
 package memcache
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"github.com/valyala/ybc/bindings/go/ybc"
 	"io"
+	"math/big"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -65,6 +74,166 @@ func TestServer_Quit(t *testing.T) {
 	conn.Close()
 }
 
+// Sends the given command to the server and returns the response
+// terminated by END.
+func sendStatsCmd(t *testing.T, cmd string) string {
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]\n", testAddr, err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(cmd + "\r\n")); err != nil {
+		t.Fatalf("error when sending %q command to the server: [%s]\n", cmd, err)
+	}
+	r := bufio.NewReader(conn)
+	var response []byte
+	var line []byte
+	for {
+		if !readLine(r, &line) {
+			t.Fatalf("cannot read response for %q command", cmd)
+		}
+		if bytes.Equal(line, strEnd) {
+			return string(response)
+		}
+		response = append(response, line...)
+		response = append(response, '\n')
+	}
+}
+
+func TestServer_StatsCmd(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	s.Stop()
+	s.StatsHandler = func(args []byte, writeStat func(name, value string)) bool {
+		if string(args) != "custom" {
+			return false
+		}
+		writeStat("foo", "bar")
+		return true
+	}
+	s.Start()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	item := Item{
+		Key: []byte("missing"),
+	}
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error in Client.Get(): [%s]. Expected ErrCacheMiss", err)
+	}
+	if response := sendStatsCmd(t, "stats"); !strings.Contains(response, "STAT get_misses 1\n") {
+		t.Fatalf("unexpected response for 'stats' command: [%s]", response)
+	}
+	if response := sendStatsCmd(t, "stats custom"); response != "STAT foo bar\n" {
+		t.Fatalf("unexpected response for 'stats custom' command: [%s]", response)
+	}
+}
+
+func TestServer_RawStatsCmd(t *testing.T) {
+	_, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	s.Stop()
+	s.RawStatsHandler = func(args []byte, writeLine func(line string)) bool {
+		if string(args) != "raw" {
+			return false
+		}
+		writeLine("FOO bar")
+		writeLine("FOO baz")
+		return true
+	}
+	s.StatsHandler = func(args []byte, writeStat func(name, value string)) bool {
+		if string(args) != "custom" {
+			return false
+		}
+		writeStat("foo", "bar")
+		return true
+	}
+	s.Start()
+	defer s.Stop()
+
+	if response := sendStatsCmd(t, "stats raw"); response != "FOO bar\nFOO baz\n" {
+		t.Fatalf("unexpected response for 'stats raw' command: [%s]", response)
+	}
+	if response := sendStatsCmd(t, "stats custom"); response != "STAT foo bar\n" {
+		t.Fatalf("unexpected response for 'stats custom' command: [%s]", response)
+	}
+}
+
+func TestServer_HotKeys(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	s.Stop()
+	s.HotKeysWindow = time.Minute
+	s.HotKeysSampleRate = 1
+	s.Start()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 10; i++ {
+		item := Item{
+			Key: []byte("hot"),
+		}
+		c.Get(&item)
+		if i < 3 {
+			item.Key = []byte("warm")
+			c.Get(&item)
+		}
+	}
+	item := Item{
+		Key: []byte("cold"),
+	}
+	c.Get(&item)
+
+	hotKeys := s.HotKeys(2)
+	if len(hotKeys) != 2 {
+		t.Fatalf("unexpected number of hot keys=%d. Expected 2", len(hotKeys))
+	}
+	if hotKeys[0].Key != "hot" || hotKeys[0].Requests != 10 {
+		t.Fatalf("unexpected the hottest key: %+v. Expected {hot 10}", hotKeys[0])
+	}
+	if hotKeys[1].Key != "warm" || hotKeys[1].Requests != 3 {
+		t.Fatalf("unexpected the second hottest key: %+v. Expected {warm 3}", hotKeys[1])
+	}
+
+	if response := sendStatsCmd(t, "stats hotkeys 1"); response != "STAT hot 10\n" {
+		t.Fatalf("unexpected response for 'stats hotkeys' command: [%s]", response)
+	}
+
+	for _, n := range []int{-1, 0} {
+		if hotKeys = s.HotKeys(n); len(hotKeys) != 0 {
+			t.Fatalf("unexpected hot keys for n=%d: %+v. Expected empty result", n, hotKeys)
+		}
+		cmd := fmt.Sprintf("stats hotkeys %d", n)
+		if readFirstResponseLine(t, cmd) != nil {
+			t.Fatalf("the server must reject %q command", cmd)
+		}
+	}
+	// The server must remain operational after invalid commands.
+	if response := sendStatsCmd(t, "stats hotkeys 1"); response != "STAT hot 10\n" {
+		t.Fatalf("unexpected response for 'stats hotkeys' command: [%s]", response)
+	}
+}
+
+// Sends cmd to the test server and returns the first response line
+// or nil if the server closes the connection without response.
+func readFirstResponseLine(t *testing.T, cmd string) []byte {
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]\n", testAddr, err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(cmd + "\r\n")); err != nil {
+		t.Fatalf("error when sending %q command to the server: [%s]\n", cmd, err)
+	}
+	var line []byte
+	if !readLine(bufio.NewReader(conn), &line) {
+		return nil
+	}
+	return line
+}
+
 func TestServer_StartStop(t *testing.T) {
 	s, cache := newServerCache(t)
 	defer cache.Close()
@@ -820,6 +989,682 @@ func TestClient_DoubleStartDoubleStop(t *testing.T) {
 	client_RunTest(cacher_DoubleStartDoubleStop, t)
 }
 
+func TestClient_Version(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	version, err := c.Version()
+	if err != nil {
+		t.Fatalf("error in Client.Version(): [%s]", err)
+	}
+	if version != string(serverVersion) {
+		t.Fatalf("unexpected version=[%s]. Expected [%s]", version, serverVersion)
+	}
+}
+
+func waitForCondition(t *testing.T, f func() bool, msg string) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("timeout when waiting for %s", msg)
+}
+
+func TestClient_WarmupProbe(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	c := &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 3,
+			WarmupTimeout:    time.Second,
+			ProbeInterval:    time.Millisecond * 10,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	if n := c.ConnsCount(); n != 3 {
+		t.Fatalf("unexpected number of connections after warm-up: %d. Expected 3", n)
+	}
+	waitForCondition(t, c.Healthy, "healthy client")
+}
+
+func TestClient_Rewarm(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+
+	c := &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 3,
+			WarmupTimeout:    time.Millisecond * 100,
+			ProbeInterval:    time.Millisecond * 10,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	if c.Healthy() {
+		t.Errorf("client must be unhealthy without server")
+	}
+
+	// The client must establish connections without incoming requests.
+	s.Start()
+	waitForCondition(t, func() bool { return c.ConnsCount() == 3 }, "established connections")
+	waitForCondition(t, c.Healthy, "healthy client")
+}
+
+func newTestTLSCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: [%s]", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: [%s]", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Cannot parse certificate: [%s]", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Serves 'version' requests on authenticated connections.
+func serveTestAuthConn(conn net.Conn, expectedCredentials string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var line []byte
+	if !readLine(r, &line) || !bytes.HasPrefix(line, strSet) || !readLine(r, &line) {
+		return
+	}
+	if string(line) != expectedCredentials {
+		w.Write([]byte("CLIENT_ERROR authentication failure\r\n"))
+		w.Flush()
+		return
+	}
+	w.Write(strStoredCrLf)
+	w.Flush()
+	for readLine(r, &line) && bytes.Equal(line, strVersion) {
+		w.Write([]byte("VERSION test\r\n"))
+		w.Flush()
+	}
+}
+
+func TestClient_TLSAuth(t *testing.T) {
+	cert, pool := newTestTLSCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:12346", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("Cannot listen: [%s]", err)
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer ln.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveTestAuthConn(conn, "user secret")
+			}()
+		}
+	}()
+
+	c := &Client{
+		ServerAddr: "127.0.0.1:12346",
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 1,
+			TLSConfig:        &tls.Config{RootCAs: pool},
+			Username:         "user",
+			Password:         "secret",
+		},
+	}
+	c.Start()
+	version, err := c.Version()
+	c.Stop()
+	if err != nil {
+		t.Fatalf("error in Client.Version(): [%s]", err)
+	}
+	if version != "test" {
+		t.Fatalf("unexpected version=[%s]. Expected [test]", version)
+	}
+
+	c.Password = "bad"
+	c.Start()
+	_, err = c.Version()
+	c.Stop()
+	if err == nil {
+		t.Fatalf("Client.Version() must fail with invalid credentials")
+	}
+}
+
+func TestServer_ProxyPool(t *testing.T) {
+	const poolAddr = "localhost:12347"
+	pool, poolCache := newServerCacheWithAddr(poolAddr, t)
+	defer poolCache.Close()
+	pool.Start()
+	defer pool.Stop()
+	poolClient := &Client{
+		ServerAddr: poolAddr,
+	}
+	poolClient.Start()
+	defer poolClient.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+		Flags: 123,
+	}
+	if err := poolClient.Set(&item); err != nil {
+		t.Fatalf("error in Client.Set(): [%s]", err)
+	}
+
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	s.Stop()
+	s.ProxyPool = poolClient
+	s.Start()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 2; i++ {
+		it := Item{
+			Key: item.Key,
+		}
+		if err := c.Get(&it); err != nil {
+			t.Fatalf("error in Client.Get(): [%s]", err)
+		}
+		if !bytes.Equal(it.Value, item.Value) || it.Flags != item.Flags {
+			t.Fatalf("unexpected item value=[%s], flags=%d. Expected [%s], %d", it.Value, it.Flags, item.Value, item.Flags)
+		}
+	}
+	if _, err := cache.Get(item.Key); err != nil {
+		t.Fatalf("the item fetched from ProxyPool must be stored in the cache: [%s]", err)
+	}
+
+	it := Item{
+		Key: []byte("missing"),
+	}
+	if err := c.Get(&it); err != ErrCacheMiss {
+		t.Fatalf("unexpected error in Client.Get(): [%s]. Expected ErrCacheMiss", err)
+	}
+
+	var stats ServerStats
+	s.Stats(&stats)
+	if stats.ProxyHits != 1 || stats.ProxyMisses != 1 || stats.ProxyErrors != 0 {
+		t.Fatalf("unexpected proxy stats: hits=%d, misses=%d, errors=%d. Expected 1, 1, 0", stats.ProxyHits, stats.ProxyMisses, stats.ProxyErrors)
+	}
+}
+
+func newAuthClient(username, password string) *Client {
+	return &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 1,
+			Username:         username,
+			Password:         password,
+		},
+	}
+}
+
+func TestServer_Authenticate(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	otherCache := newCache(t)
+	defer otherCache.Close()
+	s.Authenticate = func(username, password []byte) ybc.Cacher {
+		switch {
+		case string(username) == "user" && string(password) == "secret":
+			return cache
+		case string(username) == "other" && string(password) == "secret":
+			return otherCache
+		}
+		return nil
+	}
+	s.Start()
+	defer s.Stop()
+
+	c := newAuthClient("user", "secret")
+	c.Start()
+	defer c.Stop()
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in Client.Set(): [%s]", err)
+	}
+	if _, err := cache.Get(item.Key); err != nil {
+		t.Fatalf("the item must be stored in the cache for the authenticated user: [%s]", err)
+	}
+
+	// Users must be isolated.
+	other := newAuthClient("other", "secret")
+	other.Start()
+	err := other.Get(&item)
+	other.Stop()
+	if err != ErrCacheMiss {
+		t.Fatalf("unexpected error in Client.Get(): [%s]. Expected ErrCacheMiss", err)
+	}
+
+	var stats ServerStats
+	for _, bad := range []*Client{newAuthClient("user", "bad"), newAuthClient("", "")} {
+		bad.Start()
+		_, err = bad.Version()
+		bad.Stop()
+		if err == nil {
+			t.Fatalf("Client.Version() must fail without valid credentials")
+		}
+	}
+	s.Stats(&stats)
+	if stats.AuthErrors != 1 {
+		t.Fatalf("unexpected AuthErrors=%d. Expected 1", stats.AuthErrors)
+	}
+}
+
+type testHooks struct {
+	mu       sync.Mutex
+	started  []string
+	finished []Operation
+}
+
+func (h *testHooks) OperationStart(op *Operation) {
+	h.mu.Lock()
+	h.started = append(h.started, op.Command)
+	h.mu.Unlock()
+}
+
+func (h *testHooks) OperationFinish(op *Operation) {
+	h.mu.Lock()
+	h.finished = append(h.finished, *op)
+	h.mu.Unlock()
+}
+
+func TestClient_Hooks(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	hooks := &testHooks{}
+	c.Hooks = hooks
+	c.Start()
+	defer c.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	item.Key = []byte("missing")
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error in client.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	expectedCommands := []string{"Set", "Get", "Get"}
+	if fmt.Sprint(hooks.started) != fmt.Sprint(expectedCommands) {
+		t.Fatalf("unexpected started operations: %v. Expected %v", hooks.started, expectedCommands)
+	}
+	if len(hooks.finished) != len(expectedCommands) {
+		t.Fatalf("unexpected number of finished operations: %d. Expected %d", len(hooks.finished), len(expectedCommands))
+	}
+	for i, op := range hooks.finished {
+		if op.Command != expectedCommands[i] {
+			t.Fatalf("unexpected command=[%s]. Expected [%s]", op.Command, expectedCommands[i])
+		}
+		if op.ServerAddr != testAddr {
+			t.Fatalf("unexpected server address=[%s]. Expected [%s]", op.ServerAddr, testAddr)
+		}
+		if op.Duration <= 0 {
+			t.Fatalf("unexpected duration=%s for command=[%s]", op.Duration, op.Command)
+		}
+	}
+	if !hooks.finished[1].IsCacheHit() {
+		t.Fatalf("expecting cache hit for existing item")
+	}
+	if !hooks.finished[2].IsCacheMiss() {
+		t.Fatalf("expecting cache miss for missing item")
+	}
+}
+
+func TestClient_NowaitFlushDelay(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.NowaitFlushDelay = time.Millisecond * 50
+	c.Start()
+	defer c.Stop()
+
+	checker := &Client{
+		ServerAddr: testAddr,
+	}
+	checker.Start()
+	defer checker.Stop()
+
+	for i := 0; i < 10; i++ {
+		c.SetNowait(&Item{
+			Key:   []byte(fmt.Sprintf("key_%d", i)),
+			Value: []byte(fmt.Sprintf("value_%d", i)),
+		})
+	}
+	c.DeleteNowait([]byte("key_0"))
+
+	waitForCondition(t, func() bool {
+		item := Item{
+			Key: []byte("key_9"),
+		}
+		return checker.Get(&item) == nil
+	}, "flushed nowait requests")
+
+	item := Item{
+		Key: []byte("key_0"),
+	}
+	if err := checker.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+	for i := 1; i < 10; i++ {
+		item.Key = []byte(fmt.Sprintf("key_%d", i))
+		if err := checker.Get(&item); err != nil {
+			t.Fatalf("error in client.Get(): [%s]", err)
+		}
+		if string(item.Value) != fmt.Sprintf("value_%d", i) {
+			t.Fatalf("unexpected value=[%s] for key=[%s]", item.Value, item.Key)
+		}
+	}
+
+	// Synchronous requests must be sent without delay.
+	item.Key = []byte("key_1")
+	startTime := time.Now()
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	if d := time.Since(startTime); d >= c.NowaitFlushDelay {
+		t.Fatalf("too long duration for synchronous request: %s", d)
+	}
+}
+
+func TestClient_NowaitFlushDelay_SteadyStream(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.NowaitFlushDelay = time.Millisecond * 100
+	// The buffer mustn't be flushed due to overflow during the test.
+	c.WriteBufferSize = 1024 * 1024
+	c.Start()
+	defer c.Stop()
+
+	checker := &Client{
+		ServerAddr: testAddr,
+	}
+	checker.Start()
+	defer checker.Stop()
+
+	// Nowait requests arriving more frequently than NowaitFlushDelay
+	// mustn't postpone the flush of the first request.
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; ; i++ {
+			c.SetNowait(&Item{
+				Key:   []byte(fmt.Sprintf("key_%d", i)),
+				Value: []byte("value"),
+			})
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}()
+	defer func() {
+		close(stopCh)
+		<-doneCh
+	}()
+
+	startTime := time.Now()
+	waitForCondition(t, func() bool {
+		item := Item{
+			Key: []byte("key_0"),
+		}
+		return checker.Get(&item) == nil
+	}, "flushed nowait requests")
+	if d := time.Since(startTime); d >= 10*c.NowaitFlushDelay {
+		t.Fatalf("too long duration for flushing nowait requests: %s", d)
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	items := []Item{
+		{Key: []byte("key")},
+		{Key: []byte("missing")},
+	}
+	if err := c.GetMulti(items); err != nil {
+		t.Fatalf("error in client.GetMulti(): [%s]", err)
+	}
+
+	var stats ServerStats
+	s.Stats(&stats)
+	if stats.CmdSet != 1 {
+		t.Fatalf("unexpected CmdSet=%d. Expected 1", stats.CmdSet)
+	}
+	if stats.CmdGets != 2 {
+		t.Fatalf("unexpected CmdGets=%d. Expected 2", stats.CmdGets)
+	}
+	if stats.GetHits != 2 {
+		t.Fatalf("unexpected GetHits=%d. Expected 2", stats.GetHits)
+	}
+	if stats.GetMisses != 1 {
+		t.Fatalf("unexpected GetMisses=%d. Expected 1", stats.GetMisses)
+	}
+	if stats.TotalConnections != 1 || stats.CurrConnections != 1 {
+		t.Fatalf("unexpected TotalConnections=%d, CurrConnections=%d. Expected 1, 1", stats.TotalConnections, stats.CurrConnections)
+	}
+}
+
+func TestServer_StopGracefully(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	c.Start()
+	defer c.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+
+	// Server.Stop() would wait for the client closing the connection.
+	startTime := time.Now()
+	s.StopGracefully(10 * time.Second)
+	if d := time.Since(startTime); d > 5*time.Second {
+		t.Fatalf("too long StopGracefully() duration: %s", d)
+	}
+}
+
+func TestServer_StopGracefully_Notification(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+
+	s.Start()
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]\n", testAddr, err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("version\r\n")); err != nil {
+		t.Fatalf("error when sending 'version' command to the server: [%s]\n", err)
+	}
+	r := bufio.NewReader(conn)
+	var line []byte
+	if !readLine(r, &line) || !bytes.HasPrefix(line, strVersionResponse) {
+		t.Fatalf("unexpected response for 'version' command: %q", line)
+	}
+
+	s.StopGracefully(10 * time.Second)
+	if !readLine(r, &line) {
+		t.Fatalf("cannot read shutdown notification")
+	}
+	if string(line) != "SERVER_ERROR server is shutting down" {
+		t.Fatalf("unexpected shutdown notification: %q", line)
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		t.Fatalf("unexpected error after shutdown notification: [%v]. Expected EOF", err)
+	}
+}
+
+func TestServer_SlowRequests(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+
+	var mu sync.Mutex
+	var requests []SlowRequest
+	s.SlowRequestThreshold = time.Nanosecond
+	s.SlowRequestHandler = func(r *SlowRequest) {
+		mu.Lock()
+		rr := *r
+		rr.Key = append([]byte(nil), r.Key...)
+		requests = append(requests, rr)
+		mu.Unlock()
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]\n", testAddr, err)
+	}
+	defer conn.Close()
+	setCmd := "set foo 0 0 5\r\nvalue\r\n"
+	getCmd := "get foo\r\n"
+	if _, err = conn.Write([]byte(setCmd + getCmd)); err != nil {
+		t.Fatalf("error when sending commands to the server: [%s]\n", err)
+	}
+	r := bufio.NewReader(conn)
+	var line []byte
+	for !bytes.Equal(line, strEnd) {
+		if !readLine(r, &line) {
+			t.Fatalf("cannot read response from the server")
+		}
+	}
+	// The handler is called after the response is sent.
+	deadline := time.Now().Add(5 * time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	for len(requests) < 2 && time.Now().Before(deadline) {
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+	}
+	if len(requests) != 2 {
+		t.Fatalf("unexpected number of slow requests: %d. Expected 2", len(requests))
+	}
+	expected := []SlowRequest{
+		{Command: "set", Key: []byte("foo"), RequestSize: len(setCmd), ResponseSize: len("STORED\r\n")},
+		{Command: "get", Key: []byte("foo"), RequestSize: len(getCmd), ResponseSize: len("VALUE foo 0 5\r\nvalue\r\nEND\r\n")},
+	}
+	for i, e := range expected {
+		r := requests[i]
+		if r.Command != e.Command || !bytes.Equal(r.Key, e.Key) || r.RequestSize != e.RequestSize || r.ResponseSize != e.ResponseSize {
+			t.Fatalf("unexpected slow request #%d: command=%q, key=%q, requestSize=%d, responseSize=%d. Expected command=%q, key=%q, requestSize=%d, responseSize=%d",
+				i, r.Command, r.Key, r.RequestSize, r.ResponseSize, e.Command, e.Key, e.RequestSize, e.ResponseSize)
+		}
+		if r.Duration <= 0 || r.ClientAddr == nil {
+			t.Fatalf("unexpected slow request #%d: duration=%s, clientAddr=%v", i, r.Duration, r.ClientAddr)
+		}
+	}
+
+	var stats ServerStats
+	s.Stats(&stats)
+	if stats.SlowRequests != 2 {
+		t.Fatalf("unexpected SlowRequests=%d. Expected 2", stats.SlowRequests)
+	}
+}
+
+func TestServer_ListenReusePort(t *testing.T) {
+	ln1, err := ListenReusePort(testAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen at [%s]: [%s]", testAddr, err)
+	}
+	ln2, err := ListenReusePort(testAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen twice at [%s]: [%s]", testAddr, err)
+	}
+	ln2.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+	s := &Server{
+		Cache:    cache,
+		Listener: ln1,
+	}
+	s.Start()
+	defer s.Stop()
+
+	c := &Client{
+		ServerAddr: testAddr,
+	}
+	c.Start()
+	defer c.Stop()
+	if _, err := c.Version(); err != nil {
+		t.Fatalf("error in client.Version(): [%s]", err)
+	}
+}
+
 func TestDistributedClient_NoServers(t *testing.T) {
 	c := DistributedClient{}
 	c.Start()
@@ -1024,6 +1869,66 @@ func TestDistributedClient_GetMulti(t *testing.T) {
 	distributedClientStatic_RunTest(cacher_GetMulti, t)
 }
 
+func TestDistributedClient_GetMulti_PartialFailure(t *testing.T) {
+	c, ss, caches := newDistributedClientServersCaches(t)
+	defer closeCaches(caches)
+	// The first server is stopped in the middle of the test.
+	defer stopServers(ss[1:])
+	serverAddrs := make([]string, len(ss))
+	for i, s := range ss {
+		serverAddrs[i] = s.ListenAddr
+	}
+	c.StartStatic(serverAddrs)
+	defer c.Stop()
+
+	itemsCount := 100
+	items := make([]Item, itemsCount)
+	for i := 0; i < itemsCount; i++ {
+		item := &items[i]
+		item.Key = []byte(fmt.Sprintf("key_%d", i))
+		item.Value = []byte(fmt.Sprintf("value_%d", i))
+		if err := c.Set(item); err != nil {
+			t.Fatalf("error in client.Set(): [%s]", err)
+		}
+	}
+
+	// Values must be returned in the passed items.
+	getItems := make([]Item, itemsCount)
+	for i := range items {
+		getItems[i].Key = items[i].Key
+	}
+	if err := c.GetMulti(getItems); err != nil {
+		t.Fatalf("error in client.GetMulti(): [%s]", err)
+	}
+	for i := range items {
+		if !bytes.Equal(getItems[i].Value, items[i].Value) {
+			t.Fatalf("unexpected value for key=[%s]: [%s]. Expected [%s]", items[i].Key, getItems[i].Value, items[i].Value)
+		}
+	}
+
+	ss[0].StopGracefully(0)
+	for i := range getItems {
+		getItems[i].Value = nil
+	}
+	err := c.GetMulti(getItems)
+	gme, ok := err.(*GetMultiError)
+	if !ok {
+		t.Fatalf("unexpected error in client.GetMulti(): [%v]. Expected *GetMultiError", err)
+	}
+	if len(gme.Errors) == 0 || len(gme.Errors) == itemsCount {
+		t.Fatalf("unexpected number of failed keys: %d", len(gme.Errors))
+	}
+	for i := range items {
+		_, failed := gme.Errors[string(items[i].Key)]
+		if failed != (getItems[i].Value == nil) {
+			t.Fatalf("unexpected value for key=[%s]: [%s]. failed=%v", items[i].Key, getItems[i].Value, failed)
+		}
+		if !failed && !bytes.Equal(getItems[i].Value, items[i].Value) {
+			t.Fatalf("unexpected value for key=[%s]: [%s]. Expected [%s]", items[i].Key, getItems[i].Value, items[i].Value)
+		}
+	}
+}
+
 func TestDistributedClient_SetNowait(t *testing.T) {
 	distributedClient_RunTest(cacher_SetNowait, t)
 	distributedClientStatic_RunTest(cacher_SetNowait, t)
@@ -1078,3 +1983,97 @@ func TestDistributedClient_DoubleStartDoubleStop(t *testing.T) {
 	distributedClient_RunTest(cacher_DoubleStartDoubleStop, t)
 	distributedClientStatic_RunTest(cacher_DoubleStartDoubleStop, t)
 }
+
+func TestClient_PoolIdleConnections(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	c := &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount:      1,
+			MaxConnectionsCount:   2,
+			IdleConnectionTimeout: time.Millisecond * 50,
+			WarmupTimeout:         time.Second,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	c.growPool()
+	waitForCondition(t, func() bool { return c.PoolStats().ExtraConnsCount == 1 && c.ConnsCount() == 2 }, "additional connection")
+
+	// The additional connection must be closed after IdleConnectionTimeout.
+	waitForCondition(t, func() bool { return c.PoolStats().ExtraConnsCount == 0 && c.ConnsCount() == 1 }, "closing idle connection")
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("Error in Client.Set(): [%s]", err)
+	}
+}
+
+func TestClient_PoolAcquireTimeout(t *testing.T) {
+	// The server accepts connections, but never responds.
+	ln, err := net.Listen("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen [%s]: [%s]", testAddr, err)
+	}
+	connsCh := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(connsCh)
+				return
+			}
+			connsCh <- conn
+		}
+	}()
+
+	c := &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount:        1,
+			MaxConnectionsCount:     3,
+			MaxPendingRequestsCount: 2,
+			AcquireTimeout:          time.Millisecond * 10,
+			WarmupTimeout:           time.Second,
+		},
+	}
+	c.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item := Item{
+				Key: []byte("key"),
+			}
+			c.Get(&item)
+		}()
+	}
+
+	// Pending requests must trigger additional connections.
+	waitForCondition(t, func() bool { return c.PoolStats().ExtraConnsCount == 2 && c.ConnsCount() == 3 }, "additional connections")
+	waitForCondition(t, func() bool { return c.PoolStats().AcquireTimeoutsCount > 0 }, "acquire timeouts")
+
+	item := Item{
+		Key: []byte("key"),
+	}
+	if err := c.Get(&item); err != ErrAcquireTimeout {
+		t.Fatalf("Unexpected error returned from Client.Get(): [%v]. Expected ErrAcquireTimeout", err)
+	}
+
+	ln.Close()
+	for conn := range connsCh {
+		conn.Close()
+	}
+	wg.Wait()
+	c.Stop()
+}
@@ -2,6 +2,7 @@ package memcache
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -241,7 +242,8 @@ func (c *DistributedClient) client(key []byte) (client *Client, err error) {
 	return
 }
 
-func (c *DistributedClient) itemsPerClient(items []Item) (m [][]Item, clients []*Client, err error) {
+// Returns indexes of items per each client.
+func (c *DistributedClient) itemIndexesPerClient(items []Item) (m [][]int, clients []*Client, err error) {
 	c.lock()
 	// do not use defer c.unlock() for performance reasons.
 
@@ -251,10 +253,10 @@ func (c *DistributedClient) itemsPerClient(items []Item) (m [][]Item, clients []
 		return
 	}
 
-	m = make([][]Item, clientsCount)
-	for _, item := range items {
-		clientIdx := c.clientIdx(item.Key)
-		m[clientIdx] = append(m[clientIdx], item)
+	m = make([][]int, clientsCount)
+	for i := range items {
+		clientIdx := c.clientIdx(items[i].Key)
+		m[clientIdx] = append(m[clientIdx], i)
 	}
 	if c.isDynamic {
 		clients = make([]*Client, clientsCount)
@@ -272,19 +274,86 @@ func handleRaceCondition(err *error) {
 	}
 }
 
+// Error returned by DistributedClient.GetMulti() if items for some keys
+// cannot be obtained from servers.
+type GetMultiError struct {
+	// Errors per key for items, which cannot be obtained.
+	Errors map[string]error
+}
+
+func (e *GetMultiError) Error() string {
+	for key, err := range e.Errors {
+		return fmt.Sprintf("memcache.DistributedClient: cannot obtain %d items. For instance, the item with key=[%s]: [%s]", len(e.Errors), key, err)
+	}
+	return "memcache.DistributedClient: cannot obtain items"
+}
+
 // See Client.GetMulti().
+//
+// Keys are split by servers, so each server receives a single request
+// for all the keys it owns. Requests to distinct servers are sent
+// in parallel.
+//
+// Items from healthy servers are obtained even if other servers fail.
+// *GetMultiError with per-key errors is returned in this case.
 func (c *DistributedClient) GetMulti(items []Item) (err error) {
-	itemsPerClient, clients, err := c.itemsPerClient(items)
+	indexesPerClient, clients, err := c.itemIndexesPerClient(items)
 	if err != nil {
 		return
 	}
-	if c.isDynamic {
+
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for clientIdx, indexes := range indexesPerClient {
+		if len(indexes) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(clientIdx int, indexes []int) {
+			defer wg.Done()
+			errs[clientIdx] = getMultiByIndexes(clients[clientIdx], items, indexes, c.isDynamic)
+		}(clientIdx, indexes)
+	}
+	wg.Wait()
+
+	var gme *GetMultiError
+	for clientIdx, clientErr := range errs {
+		if clientErr == nil {
+			continue
+		}
+		if len(indexesPerClient) == 1 {
+			// Return the original error for a single server.
+			return clientErr
+		}
+		if gme == nil {
+			gme = &GetMultiError{
+				Errors: make(map[string]error),
+			}
+		}
+		for _, i := range indexesPerClient[clientIdx] {
+			gme.Errors[string(items[i].Key)] = clientErr
+		}
+	}
+	if gme != nil {
+		return gme
+	}
+	return nil
+}
+
+// Obtains items with the given indexes via the given client.
+func getMultiByIndexes(client *Client, items []Item, indexes []int, isDynamic bool) (err error) {
+	if isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	for clientIdx, clientItems := range itemsPerClient {
-		if err = clients[clientIdx].GetMulti(clientItems); err != nil {
-			return
-		}
+	clientItems := make([]Item, len(indexes))
+	for j, i := range indexes {
+		clientItems[j] = items[i]
+	}
+	if err = client.GetMulti(clientItems); err != nil {
+		return
+	}
+	for j, i := range indexes {
+		items[i] = clientItems[j]
 	}
 	return
 }
@@ -489,3 +558,21 @@ func (c *DistributedClient) FlushAllNowait() {
 		client.FlushAllNowait()
 	}
 }
+
+// Returns connection pool stats summed over all the servers.
+//
+// See Client.PoolStats().
+func (c *DistributedClient) PoolStats() (stats ClientPoolStats) {
+	clients, err := c.allClients()
+	if err != nil {
+		return
+	}
+	for _, client := range clients {
+		s := client.PoolStats()
+		stats.ConnsCount += s.ConnsCount
+		stats.ExtraConnsCount += s.ExtraConnsCount
+		stats.PendingRequestsCount += s.PendingRequestsCount
+		stats.AcquireTimeoutsCount += s.AcquireTimeoutsCount
+	}
+	return
+}
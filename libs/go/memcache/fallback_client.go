@@ -0,0 +1,218 @@
+package memcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// Returned by FallbackClient if memcache servers are unreachable,
+// but the item is found in the local fallback cache.
+//
+// Item's value and flags are filled in this case, but the value may be
+// outdated.
+var ErrStaleValue = errors.New("memcache.FallbackClient: stale value returned from local fallback cache")
+
+// Memcache client, which mirrors written items into local cache and returns
+// them from the local cache if memcache servers are unreachable.
+//
+// This improves resilience to memcache servers' outages at the cost
+// of returning stale values during outages. Get() and GetMulti() return
+// ErrStaleValue when values are obtained from the local cache,
+// so callers may decide whether stale values are acceptable.
+//
+// Only items written via the FallbackClient are mirrored into the local cache.
+// Items deleted or overwritten by other clients may remain in the local cache
+// until FallbackTtl expires.
+//
+// Usage:
+//
+//   cache := openCache()
+//   defer cache.Close()
+//
+//   client.Start()
+//   defer client.Stop()
+//
+//   c := memcache.FallbackClient{
+//       Client: client,
+//       Cache:  cache,
+//   }
+//
+//   if err := c.Get(&item); err != nil && err != memcache.ErrStaleValue {
+//       handleError(err)
+//   }
+//
+type FallbackClient struct {
+	// The underlying memcache client.
+	//
+	// The client must be initialized before passing it here.
+	Client Memcacher
+
+	// The local cache for mirrored items.
+	//
+	// The cache should be initialized before passing it here.
+	// A small cache is usually enough, since it is used only during
+	// memcache servers' outages.
+	Cache ybc.Cacher
+
+	// Expiration time for items in the local cache.
+	// Optional parameter. One hour by default.
+	//
+	// It should exceed items' expiration on memcache servers, so items
+	// outlive memcache servers' outages in the local cache.
+	FallbackTtl time.Duration
+}
+
+// Returns true if the error means memcache servers are unreachable.
+func isUnreachableError(err error) bool {
+	return err == ErrCommunicationFailure || err == ErrClientNotRunning || err == ErrNoServers
+}
+
+func (c *FallbackClient) fallbackTtl() time.Duration {
+	if c.FallbackTtl <= 0 {
+		return defaultFallbackTtl
+	}
+	return c.FallbackTtl
+}
+
+func (c *FallbackClient) mirrorItem(item *Item) {
+	buf := make([]byte, flagsSize+len(item.Value))
+	binary.LittleEndian.PutUint32(buf, item.Flags)
+	copy(buf[flagsSize:], item.Value)
+	if err := c.Cache.Set(item.Key, buf, c.fallbackTtl()); err != nil {
+		log.Printf("Cannot mirror item with key=[%s] into local fallback cache: [%s]", item.Key, err)
+	}
+}
+
+// Fills the item from the local cache.
+//
+// Returns ErrStaleValue on success and the original error otherwise.
+func (c *FallbackClient) getStaleItem(item *Item, err error) error {
+	buf, cacheErr := c.Cache.Get(item.Key)
+	if cacheErr != nil {
+		return err
+	}
+	if len(buf) < flagsSize {
+		log.Printf("Unexpected size of locally cached item with key=[%s]: %d. Expected at least %d bytes", item.Key, len(buf), flagsSize)
+		return err
+	}
+	item.Flags = binary.LittleEndian.Uint32(buf)
+	item.Value = buf[flagsSize:]
+	return ErrStaleValue
+}
+
+// See Client.Get()
+//
+// Returns ErrStaleValue if the item is obtained from the local cache.
+func (c *FallbackClient) Get(item *Item) error {
+	err := c.Client.Get(item)
+	if isUnreachableError(err) {
+		return c.getStaleItem(item, err)
+	}
+	return err
+}
+
+// See Client.GetMulti()
+//
+// Returns ErrStaleValue if some items are obtained from the local cache,
+// while the remaining items are obtained from memcache servers.
+func (c *FallbackClient) GetMulti(items []Item) error {
+	err := c.Client.GetMulti(items)
+	if err == nil {
+		return nil
+	}
+	if gme, ok := err.(*GetMultiError); ok {
+		for i := range items {
+			item := &items[i]
+			itemErr, ok := gme.Errors[string(item.Key)]
+			if !ok {
+				continue
+			}
+			if !isUnreachableError(itemErr) || c.getStaleItem(item, itemErr) != ErrStaleValue {
+				return err
+			}
+		}
+		return ErrStaleValue
+	}
+	if !isUnreachableError(err) {
+		return err
+	}
+	// Items missing in the local cache are left untouched, as for cache
+	// misses on memcache servers.
+	for i := range items {
+		c.getStaleItem(&items[i], err)
+	}
+	return ErrStaleValue
+}
+
+// See Client.Set()
+func (c *FallbackClient) Set(item *Item) error {
+	if err := c.Client.Set(item); err != nil {
+		return err
+	}
+	c.mirrorItem(item)
+	return nil
+}
+
+// See Client.SetNowait()
+func (c *FallbackClient) SetNowait(item *Item) {
+	c.Client.SetNowait(item)
+	c.mirrorItem(item)
+}
+
+// See Client.Add()
+func (c *FallbackClient) Add(item *Item) error {
+	if err := c.Client.Add(item); err != nil {
+		return err
+	}
+	c.mirrorItem(item)
+	return nil
+}
+
+// See Client.Cas()
+func (c *FallbackClient) Cas(item *Item) error {
+	if err := c.Client.Cas(item); err != nil {
+		return err
+	}
+	c.mirrorItem(item)
+	return nil
+}
+
+// See Client.Delete()
+func (c *FallbackClient) Delete(key []byte) error {
+	c.Cache.Delete(key)
+	return c.Client.Delete(key)
+}
+
+// See Client.DeleteNowait()
+func (c *FallbackClient) DeleteNowait(key []byte) {
+	c.Cache.Delete(key)
+	c.Client.DeleteNowait(key)
+}
+
+// See Client.FlushAll()
+func (c *FallbackClient) FlushAll() error {
+	c.Cache.Clear()
+	return c.Client.FlushAll()
+}
+
+// See Client.FlushAllNowait()
+func (c *FallbackClient) FlushAllNowait() {
+	c.Cache.Clear()
+	c.Client.FlushAllNowait()
+}
+
+// See Client.FlushAllDelayed()
+func (c *FallbackClient) FlushAllDelayed(expiration time.Duration) error {
+	time.AfterFunc(expiration, cacheClearFunc(c.Cache))
+	return c.Client.FlushAllDelayed(expiration)
+}
+
+// See Client.FlushAllDelayedNowait()
+func (c *FallbackClient) FlushAllDelayedNowait(expiration time.Duration) {
+	time.AfterFunc(expiration, cacheClearFunc(c.Cache))
+	c.Client.FlushAllDelayedNowait(expiration)
+}
@@ -0,0 +1,76 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestFallbackClient_StaleOnError(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	c.Start()
+	defer c.Stop()
+
+	fc := &FallbackClient{
+		Client: c,
+		Cache:  newCache(t),
+	}
+	defer fc.Cache.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+	flags := uint32(1234)
+
+	item := Item{
+		Key:   key,
+		Value: value,
+		Flags: flags,
+	}
+	if err := fc.Set(&item); err != nil {
+		t.Fatalf("Error in FallbackClient.Set(): [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := fc.Get(&item); err != nil {
+		t.Fatalf("Error in FallbackClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, flags, "1", t)
+
+	missingItem := Item{
+		Key: []byte("missing_key"),
+	}
+	if err := fc.Get(&missingItem); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from FallbackClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	// The item must be returned from the local cache
+	// after the server is stopped.
+	s.StopGracefully(0)
+	item.Value = nil
+	item.Flags = 0
+	if err := fc.Get(&item); err != ErrStaleValue {
+		t.Fatalf("Unexpected error returned from FallbackClient.Get(): [%v]. Expected ErrStaleValue", err)
+	}
+	verifyItem(&item, value, flags, "2", t)
+
+	items := []Item{
+		{Key: key},
+		{Key: []byte("missing_key")},
+	}
+	if err := fc.GetMulti(items); err != ErrStaleValue {
+		t.Fatalf("Unexpected error returned from FallbackClient.GetMulti(): [%v]. Expected ErrStaleValue", err)
+	}
+	verifyItem(&items[0], value, flags, "3", t)
+	if items[1].Value != nil {
+		t.Fatalf("Unexpected value returned for missing key: [%s]", items[1].Value)
+	}
+
+	if err := fc.Get(&missingItem); err != ErrCommunicationFailure {
+		t.Fatalf("Unexpected error returned from FallbackClient.Get(): [%v]. Expected ErrCommunicationFailure", err)
+	}
+
+	// Deleted items mustn't be returned from the local cache.
+	fc.Delete(key)
+	if err := fc.Get(&item); err != ErrCommunicationFailure {
+		t.Fatalf("Unexpected error returned from FallbackClient.Get(): [%v]. Expected ErrCommunicationFailure", err)
+	}
+}
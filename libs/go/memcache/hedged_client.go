@@ -0,0 +1,274 @@
+package memcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Memcache client, which sends reads to the secondary server if the primary
+// server doesn't respond during HedgeDelay, and returns the first response.
+//
+// This cuts tail latency for reads at the cost of additional load
+// on the secondary server. Writes are sent to both servers, so the secondary
+// server holds replicas of items written via the HedgedClient.
+//
+// Items returned from the secondary server contain Casid valid only
+// for the secondary server, so use Primary.Get() for obtaining items
+// for Cas().
+//
+// Usage:
+//
+//   primary.Start()
+//   defer primary.Stop()
+//   secondary.Start()
+//   defer secondary.Stop()
+//
+//   c := memcache.HedgedClient{
+//       Primary:    primary,
+//       Secondary:  secondary,
+//       HedgeDelay: 5 * time.Millisecond,
+//   }
+//
+//   if err := c.Get(&item); err != nil {
+//       handleError(err)
+//   }
+//
+type HedgedClient struct {
+	// Memcache client for the primary server.
+	//
+	// The client must be initialized before passing it here.
+	Primary Memcacher
+
+	// Memcache client for the server with item replicas.
+	//
+	// The client must be initialized before passing it here.
+	Secondary Memcacher
+
+	// Delay before sending the read to the Secondary if the Primary
+	// hasn't responded yet.
+	// Optional parameter. 10ms by default.
+	//
+	// The delay should be close to p95-p99 latency for the Primary,
+	// so only a small fraction of reads is hedged.
+	HedgeDelay time.Duration
+
+	hedgedRequests uint64
+}
+
+// Returns the number of reads sent to the Secondary after HedgeDelay.
+func (c *HedgedClient) HedgedRequests() uint64 {
+	return atomic.LoadUint64(&c.hedgedRequests)
+}
+
+func (c *HedgedClient) hedgeDelay() time.Duration {
+	if c.HedgeDelay <= 0 {
+		return defaultHedgeDelay
+	}
+	return c.HedgeDelay
+}
+
+// Returns true if the read result may be returned to the caller
+// without waiting for the response from another server.
+func isHedgedResult(err error) bool {
+	if err == nil || err == ErrCacheMiss {
+		return true
+	}
+	gme, ok := err.(*GetMultiError)
+	if !ok {
+		return false
+	}
+	for _, itemErr := range gme.Errors {
+		if itemErr != ErrCacheMiss {
+			return false
+		}
+	}
+	return true
+}
+
+// Calls read for the primary and, after hedgeDelay, for the secondary.
+//
+// Returns the index of the first successful read, i.e. 0 for the primary
+// and 1 for the secondary, and its' error. If both reads fail, the error
+// from the primary is returned.
+func hedgeRead(primary, secondary Memcacher, hedgeDelay time.Duration, hedgedRequests *uint64, read func(mc Memcacher, i int) error) (int, error) {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, 2)
+	call := func(mc Memcacher, i int) {
+		results <- result{
+			i:   i,
+			err: read(mc, i),
+		}
+	}
+	go call(primary, 0)
+
+	t := time.NewTimer(hedgeDelay)
+	defer t.Stop()
+	var r result
+	select {
+	case r = <-results:
+		if isHedgedResult(r.err) {
+			return r.i, r.err
+		}
+		// Do not wait for hedgeDelay if the primary fails.
+	case <-t.C:
+	}
+	atomic.AddUint64(hedgedRequests, 1)
+	go call(secondary, 1)
+
+	pending := 2
+	var primaryErr error
+	if r.err != nil {
+		primaryErr = r.err
+		pending = 1
+	}
+	for ; pending > 0; pending-- {
+		r = <-results
+		if isHedgedResult(r.err) {
+			return r.i, r.err
+		}
+		if r.i == 0 {
+			primaryErr = r.err
+		}
+	}
+	return 0, primaryErr
+}
+
+// Obtains the item from the primary or, after hedgeDelay,
+// from the secondary.
+func hedgedGet(primary, secondary Memcacher, hedgeDelay time.Duration, hedgedRequests *uint64, item *Item) error {
+	// Reads may outlive the call, so they must work on item copies.
+	var items [2]Item
+	i, err := hedgeRead(primary, secondary, hedgeDelay, hedgedRequests, func(mc Memcacher, i int) error {
+		items[i].Key = item.Key
+		return mc.Get(&items[i])
+	})
+	if err == nil {
+		item.Value = items[i].Value
+		item.Flags = items[i].Flags
+		item.Casid = items[i].Casid
+	}
+	return err
+}
+
+// Obtains items from the primary or, after hedgeDelay,
+// from the secondary.
+func hedgedGetMulti(primary, secondary Memcacher, hedgeDelay time.Duration, hedgedRequests *uint64, items []Item) error {
+	// Reads may outlive the call, so they must work on item copies.
+	var copies [2][]Item
+	i, err := hedgeRead(primary, secondary, hedgeDelay, hedgedRequests, func(mc Memcacher, i int) error {
+		dst := make([]Item, len(items))
+		for j := range items {
+			dst[j].Key = items[j].Key
+		}
+		copies[i] = dst
+		return mc.GetMulti(dst)
+	})
+	if isHedgedResult(err) {
+		gme, _ := err.(*GetMultiError)
+		for j := range items {
+			item := &items[j]
+			if gme != nil {
+				if _, ok := gme.Errors[string(item.Key)]; ok {
+					// Leave missing items untouched.
+					continue
+				}
+			}
+			src := &copies[i][j]
+			item.Value = src.Value
+			item.Flags = src.Flags
+			item.Casid = src.Casid
+		}
+	}
+	return err
+}
+
+// See Client.Get()
+//
+// The item is read from the Secondary if the Primary doesn't respond
+// during HedgeDelay.
+func (c *HedgedClient) Get(item *Item) error {
+	return hedgedGet(c.Primary, c.Secondary, c.hedgeDelay(), &c.hedgedRequests, item)
+}
+
+// See Client.GetMulti()
+//
+// Items are read from the Secondary if the Primary doesn't respond
+// during HedgeDelay.
+func (c *HedgedClient) GetMulti(items []Item) error {
+	return hedgedGetMulti(c.Primary, c.Secondary, c.hedgeDelay(), &c.hedgedRequests, items)
+}
+
+// See Client.Set()
+func (c *HedgedClient) Set(item *Item) error {
+	c.Secondary.SetNowait(item)
+	return c.Primary.Set(item)
+}
+
+// See Client.SetNowait()
+func (c *HedgedClient) SetNowait(item *Item) {
+	c.Secondary.SetNowait(item)
+	c.Primary.SetNowait(item)
+}
+
+// See Client.Add()
+//
+// The item is replicated to the Secondary only if it is added
+// to the Primary.
+func (c *HedgedClient) Add(item *Item) error {
+	if err := c.Primary.Add(item); err != nil {
+		return err
+	}
+	c.Secondary.SetNowait(item)
+	return nil
+}
+
+// See Client.Cas()
+//
+// The item is replicated to the Secondary only if Cas succeeds
+// on the Primary.
+func (c *HedgedClient) Cas(item *Item) error {
+	if err := c.Primary.Cas(item); err != nil {
+		return err
+	}
+	c.Secondary.SetNowait(item)
+	return nil
+}
+
+// See Client.Delete()
+func (c *HedgedClient) Delete(key []byte) error {
+	c.Secondary.DeleteNowait(key)
+	return c.Primary.Delete(key)
+}
+
+// See Client.DeleteNowait()
+func (c *HedgedClient) DeleteNowait(key []byte) {
+	c.Secondary.DeleteNowait(key)
+	c.Primary.DeleteNowait(key)
+}
+
+// See Client.FlushAll()
+func (c *HedgedClient) FlushAll() error {
+	c.Secondary.FlushAllNowait()
+	return c.Primary.FlushAll()
+}
+
+// See Client.FlushAllNowait()
+func (c *HedgedClient) FlushAllNowait() {
+	c.Secondary.FlushAllNowait()
+	c.Primary.FlushAllNowait()
+}
+
+// See Client.FlushAllDelayed()
+func (c *HedgedClient) FlushAllDelayed(expiration time.Duration) error {
+	c.Secondary.FlushAllDelayedNowait(expiration)
+	return c.Primary.FlushAllDelayed(expiration)
+}
+
+// See Client.FlushAllDelayedNowait()
+func (c *HedgedClient) FlushAllDelayedNowait(expiration time.Duration) {
+	c.Secondary.FlushAllDelayedNowait(expiration)
+	c.Primary.FlushAllDelayedNowait(expiration)
+}
@@ -0,0 +1,117 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+// Memcacher with delayed or failing reads.
+type slowMemcacher struct {
+	Memcacher
+	delay time.Duration
+	err   error
+}
+
+func (c *slowMemcacher) Get(item *Item) error {
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return c.err
+	}
+	return c.Memcacher.Get(item)
+}
+
+func (c *slowMemcacher) GetMulti(items []Item) error {
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return c.err
+	}
+	return c.Memcacher.GetMulti(items)
+}
+
+func TestHedgedClient_Get(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	hc := &HedgedClient{
+		Primary:    c,
+		Secondary:  c,
+		HedgeDelay: 10 * time.Millisecond,
+	}
+
+	key := []byte("key")
+	value := []byte("value")
+	flags := uint32(1234)
+	item := Item{
+		Key:   key,
+		Value: value,
+		Flags: flags,
+	}
+	if err := hc.Set(&item); err != nil {
+		t.Fatalf("Error in HedgedClient.Set(): [%s]", err)
+	}
+
+	// Fast primary.
+	item.Value = nil
+	item.Flags = 0
+	if err := hc.Get(&item); err != nil {
+		t.Fatalf("Error in HedgedClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, flags, "1", t)
+	if n := hc.HedgedRequests(); n != 0 {
+		t.Fatalf("Unexpected number of hedged requests: %d. Expected 0", n)
+	}
+
+	// Slow primary.
+	hc.Primary = &slowMemcacher{
+		Memcacher: c,
+		delay:     5 * time.Second,
+	}
+	startTime := time.Now()
+	item.Value = nil
+	item.Flags = 0
+	if err := hc.Get(&item); err != nil {
+		t.Fatalf("Error in HedgedClient.Get(): [%s]", err)
+	}
+	if d := time.Since(startTime); d > time.Second {
+		t.Fatalf("Too long HedgedClient.Get() duration with slow primary: %s", d)
+	}
+	verifyItem(&item, value, flags, "2", t)
+	items := []Item{
+		{Key: key},
+		{Key: []byte("missing_key")},
+	}
+	if err := hc.GetMulti(items); err != nil {
+		t.Fatalf("Error in HedgedClient.GetMulti(): [%s]", err)
+	}
+	verifyItem(&items[0], value, flags, "3", t)
+	if n := hc.HedgedRequests(); n != 2 {
+		t.Fatalf("Unexpected number of hedged requests: %d. Expected 2", n)
+	}
+
+	// Failing primary must not delay reads.
+	hc.Primary = &slowMemcacher{
+		Memcacher: c,
+		err:       ErrCommunicationFailure,
+	}
+	hc.HedgeDelay = 5 * time.Second
+	startTime = time.Now()
+	item.Value = nil
+	item.Flags = 0
+	if err := hc.Get(&item); err != nil {
+		t.Fatalf("Error in HedgedClient.Get(): [%s]", err)
+	}
+	if d := time.Since(startTime); d > time.Second {
+		t.Fatalf("Too long HedgedClient.Get() duration with failing primary: %s", d)
+	}
+	verifyItem(&item, value, flags, "4", t)
+
+	missingItem := Item{
+		Key: []byte("missing_key"),
+	}
+	if err := hc.Get(&missingItem); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from HedgedClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+}
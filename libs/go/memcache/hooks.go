@@ -0,0 +1,92 @@
+package memcache
+
+import (
+	"time"
+)
+
+// Per-operation hooks for Client. Can be passed to ClientConfig.Hooks.
+//
+// Hooks may be used for collecting metrics and traces for memcache
+// operations without wrapping every call site.
+//
+// Hooks are called synchronously from goroutines calling Client methods,
+// so they must be goroutine-safe and fast.
+type ClientHooks interface {
+	// Called before the operation is sent to memcached server.
+	OperationStart(op *Operation)
+
+	// Called after the operation is finished.
+	//
+	// op.Duration and op.Err are already filled.
+	OperationFinish(op *Operation)
+}
+
+// Memcache operation passed to ClientHooks.
+//
+// Do not hold references to Operation after ClientHooks.OperationFinish()
+// returns.
+type Operation struct {
+	// Address of memcached server the operation is sent to.
+	ServerAddr string
+
+	// Operation name. The name matches the corresponding Client method name,
+	// i.e. "Get", "Set", "DeleteNowait", etc.
+	Command string
+
+	// Operation start time.
+	StartTime time.Time
+
+	// Operation duration.
+	//
+	// Nowait operations finish as soon as they are queued for sending
+	// to the server.
+	Duration time.Duration
+
+	// Error returned by the operation.
+	//
+	// ErrCacheMiss means cache miss for Get-like operations.
+	Err error
+
+	// Arbitrary data, which may be set by ClientHooks.OperationStart()
+	// for passing it to ClientHooks.OperationFinish(),
+	// for instance tracing span.
+	UserData interface{}
+}
+
+// Returns true if the operation finished with cache hit.
+func (op *Operation) IsCacheHit() bool {
+	return op.Err == nil || op.Err == ErrNotModified
+}
+
+// Returns true if the operation finished with cache miss.
+func (op *Operation) IsCacheMiss() bool {
+	return op.Err == ErrCacheMiss
+}
+
+// Returns nil if hooks aren't set.
+func (c *Client) startOperation(command string) *Operation {
+	if c.Hooks == nil {
+		return nil
+	}
+	op := &Operation{
+		ServerAddr: c.ServerAddr,
+		Command:    command,
+		StartTime:  time.Now(),
+	}
+	c.Hooks.OperationStart(op)
+	return op
+}
+
+// Must be deferred with the result of startOperation() call.
+//
+// err may be nil for operations without error.
+func (c *Client) finishOperation(op *Operation, err *error) {
+	if op == nil {
+		return
+	}
+	op.Duration = time.Since(op.StartTime)
+	if err != nil {
+		op.Err = *err
+	}
+	c.Hooks.OperationFinish(op)
+}
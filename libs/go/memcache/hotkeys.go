@@ -0,0 +1,136 @@
+package memcache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hot key with the estimated number of requests. See Server.HotKeys().
+type HotKey struct {
+	Key string
+
+	// The estimated number of get requests for the key during
+	// Server.HotKeysWindow.
+	Requests uint64
+}
+
+const (
+	// The number of slots the hot keys window is split into.
+	// The oldest slot is dropped on each slot rotation, so the window slides
+	// by HotKeysWindow/hotKeysSlotsCount steps.
+	hotKeysSlotsCount = 6
+
+	// The maximum number of keys tracked per slot.
+	hotKeysCapacity = 1024
+
+	defaultHotKeysSampleRate = 16
+	defaultHotKeysCount      = 10
+)
+
+// Tracks the most frequently requested keys over sliding window.
+//
+// Each slot counts sampled keys using Misra-Gries algorithm, so memory usage
+// is bounded, while keys requested more frequently than
+// 1/hotKeysCapacity of all the sampled requests are guaranteed to be tracked.
+type hotKeysTracker struct {
+	sampleRate uint64
+	samples    uint64
+
+	slotDuration time.Duration
+
+	lock          sync.Mutex
+	slots         [hotKeysSlotsCount]map[string]uint64
+	currentSlot   int
+	slotStartTime time.Time
+}
+
+func newHotKeysTracker(window time.Duration, sampleRate int) *hotKeysTracker {
+	t := &hotKeysTracker{
+		sampleRate:    uint64(sampleRate),
+		slotDuration:  window / hotKeysSlotsCount,
+		slotStartTime: time.Now(),
+	}
+	for i := range t.slots {
+		t.slots[i] = make(map[string]uint64)
+	}
+	return t
+}
+
+// Registers get request for the given key.
+//
+// Does nothing if t is nil, i.e. if hot keys aren't tracked.
+func (t *hotKeysTracker) Register(key []byte) {
+	if t == nil {
+		return
+	}
+	if atomic.AddUint64(&t.samples, 1)%t.sampleRate != 0 {
+		return
+	}
+	t.lock.Lock()
+	t.rotateSlots(time.Now())
+	m := t.slots[t.currentSlot]
+	if _, ok := m[string(key)]; ok || len(m) < hotKeysCapacity {
+		m[string(key)]++
+	} else {
+		for k, n := range m {
+			if n <= 1 {
+				delete(m, k)
+			} else {
+				m[k] = n - 1
+			}
+		}
+	}
+	t.lock.Unlock()
+}
+
+// Must be called under t.lock.
+func (t *hotKeysTracker) rotateSlots(now time.Time) {
+	for i := 0; i < hotKeysSlotsCount && now.Sub(t.slotStartTime) >= t.slotDuration; i++ {
+		t.currentSlot = (t.currentSlot + 1) % hotKeysSlotsCount
+		t.slots[t.currentSlot] = make(map[string]uint64)
+		t.slotStartTime = t.slotStartTime.Add(t.slotDuration)
+	}
+	if now.Sub(t.slotStartTime) >= t.slotDuration {
+		// All the slots are outdated.
+		t.slotStartTime = now
+	}
+}
+
+// Returns up to n the most frequently requested keys sorted
+// by the number of requests.
+//
+// Returns nil if n isn't positive.
+func (t *hotKeysTracker) HotKeys(n int) []HotKey {
+	if n <= 0 {
+		return nil
+	}
+	counts := make(map[string]uint64)
+	t.lock.Lock()
+	t.rotateSlots(time.Now())
+	for _, m := range t.slots {
+		for k, c := range m {
+			counts[k] += c
+		}
+	}
+	t.lock.Unlock()
+
+	hotKeys := make([]HotKey, 0, len(counts))
+	for k, c := range counts {
+		hotKeys = append(hotKeys, HotKey{
+			Key:      k,
+			Requests: c * t.sampleRate,
+		})
+	}
+	sort.Slice(hotKeys, func(i, j int) bool {
+		if hotKeys[i].Requests != hotKeys[j].Requests {
+			return hotKeys[i].Requests > hotKeys[j].Requests
+		}
+		return hotKeys[i].Key < hotKeys[j].Key
+	})
+	if len(hotKeys) > n {
+		hotKeys = hotKeys[:n]
+	}
+	return hotKeys
+}
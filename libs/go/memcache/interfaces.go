@@ -4,7 +4,8 @@ import (
 	"time"
 )
 
-// Client, DistributedClient and CachingClient implement this interface.
+// Client, DistributedClient, CachingClient, FallbackClient, NamespaceClient,
+// HedgedClient and ReplicatedClient implement this interface.
 type Memcacher interface {
 	Get(item *Item) error
 	GetMulti(items []Item) error
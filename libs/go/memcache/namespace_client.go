@@ -0,0 +1,313 @@
+package memcache
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memcache client, which stores items in a namespace, which may be
+// invalidated at once.
+//
+// Keys are transparently prefixed by the namespace name and the namespace
+// version. The version is stored in memcache under a separate key, so all
+// the clients sharing the namespace name observe the same version.
+// Invalidate() bumps the version, so items stored under the previous version
+// become unreachable and are eventually evicted by memcache servers.
+//
+// Additionally the client may randomize items' expiration times
+// by up to +-ExpirationJitter percents. This prevents mass simultaneous
+// expiration of items stored with identical expiration times, which may
+// result in stampedes on the underlying data source.
+//
+// Usage:
+//
+//   client.Start()
+//   defer client.Stop()
+//
+//   c := &memcache.NamespaceClient{
+//       Client:           client,
+//       Namespace:        "users",
+//       ExpirationJitter: 10,
+//   }
+//
+//   if err := c.Get(&item); err != nil {
+//       handleError(err)
+//   }
+//   ...
+//   // Invalidate all the items in the namespace.
+//   if err := c.Invalidate(); err != nil {
+//       handleError(err)
+//   }
+//
+type NamespaceClient struct {
+	// The underlying memcache client.
+	//
+	// The client must be initialized before passing it here.
+	Client Memcacher
+
+	// Namespace name.
+	//
+	// The name mustn't contain whitespace and control chars.
+	Namespace string
+
+	// Randomized jitter for items' expiration times in percents.
+	//
+	// Expiration times passed to Set(), SetNowait(), Add() and Cas()
+	// are randomly changed by up to +-ExpirationJitter percents.
+	// Zero expiration times (i.e. items without expiration) are never changed.
+	//
+	// Values outside [0..100] range are clamped to the nearest bound.
+	//
+	// Leave this field empty (set to 0) for storing items with exact
+	// expiration times.
+	ExpirationJitter int
+
+	// Interval for re-reading namespace version from memcache.
+	// Optional parameter. One second by default.
+	//
+	// Invalidate() calls from other clients are observed by this client
+	// with up to VersionCheckInterval delay.
+	VersionCheckInterval time.Duration
+
+	mutex            sync.Mutex
+	version          []byte
+	versionCheckTime time.Time
+}
+
+func (c *NamespaceClient) versionCheckInterval() time.Duration {
+	if c.VersionCheckInterval <= 0 {
+		return defaultVersionCheckInterval
+	}
+	return c.VersionCheckInterval
+}
+
+func (c *NamespaceClient) versionKey() []byte {
+	return []byte("nsversion:" + c.Namespace)
+}
+
+func newNamespaceVersion() []byte {
+	return strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+}
+
+// Returns the current namespace version.
+//
+// The version is created in memcache if it is missing there.
+func (c *NamespaceClient) getVersion() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.version != nil && time.Since(c.versionCheckTime) < c.versionCheckInterval() {
+		return c.version, nil
+	}
+
+	item := Item{
+		Key: c.versionKey(),
+	}
+	err := c.Client.Get(&item)
+	if err == ErrCacheMiss {
+		item.Value = newNamespaceVersion()
+		if err = c.Client.Add(&item); err == ErrAlreadyExists {
+			// Somebody else created the version concurrently.
+			item.Value = nil
+			err = c.Client.Get(&item)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.version = item.Value
+	c.versionCheckTime = time.Now()
+	return c.version, nil
+}
+
+// Bumps namespace version, so all the items stored in the namespace
+// become unreachable.
+func (c *NamespaceClient) Invalidate() error {
+	item := Item{
+		Key:   c.versionKey(),
+		Value: newNamespaceVersion(),
+	}
+	if err := c.Client.Set(&item); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.version = item.Value
+	c.versionCheckTime = time.Now()
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *NamespaceClient) namespacedKey(version, key []byte) []byte {
+	buf := make([]byte, 0, len(c.Namespace)+len(version)+len(key)+2)
+	buf = append(buf, c.Namespace...)
+	buf = append(buf, ':')
+	buf = append(buf, version...)
+	buf = append(buf, ':')
+	return append(buf, key...)
+}
+
+// Returns a shallow copy of the item with namespaced key and jittered
+// expiration time.
+func (c *NamespaceClient) namespacedItem(item *Item) (*Item, error) {
+	version, err := c.getVersion()
+	if err != nil {
+		return nil, err
+	}
+	nsItem := *item
+	nsItem.Key = c.namespacedKey(version, item.Key)
+	nsItem.Expiration = jitterExpiration(item.Expiration, c.ExpirationJitter)
+	return &nsItem, nil
+}
+
+// Randomly changes the given expiration time by up to +-jitter percents.
+//
+// Zero expiration means 'no expiration', so it is returned as is.
+func jitterExpiration(expiration time.Duration, jitter int) time.Duration {
+	if jitter > 100 {
+		jitter = 100
+	}
+	if jitter <= 0 || expiration <= 0 {
+		return expiration
+	}
+	delta := int64(expiration) / 100 * int64(jitter)
+	if delta <= 0 {
+		return expiration
+	}
+	expiration += time.Duration(rand.Int63n(2*delta+1) - delta)
+	if expiration < time.Second {
+		// Memcache expiration granularity is one second, while expiration
+		// below one second means 'already expired'.
+		expiration = time.Second
+	}
+	return expiration
+}
+
+// See Client.Get()
+func (c *NamespaceClient) Get(item *Item) error {
+	version, err := c.getVersion()
+	if err != nil {
+		return err
+	}
+	key := item.Key
+	item.Key = c.namespacedKey(version, key)
+	err = c.Client.Get(item)
+	item.Key = key
+	return err
+}
+
+// See Client.GetMulti()
+func (c *NamespaceClient) GetMulti(items []Item) error {
+	version, err := c.getVersion()
+	if err != nil {
+		return err
+	}
+	keys := make([][]byte, len(items))
+	for i := range items {
+		item := &items[i]
+		keys[i] = item.Key
+		item.Key = c.namespacedKey(version, item.Key)
+	}
+	err = c.Client.GetMulti(items)
+	if gme, ok := err.(*GetMultiError); ok {
+		errors := make(map[string]error, len(gme.Errors))
+		for i := range items {
+			if itemErr, ok := gme.Errors[string(items[i].Key)]; ok {
+				errors[string(keys[i])] = itemErr
+			}
+		}
+		err = &GetMultiError{
+			Errors: errors,
+		}
+	}
+	for i := range items {
+		items[i].Key = keys[i]
+	}
+	return err
+}
+
+// See Client.Set()
+func (c *NamespaceClient) Set(item *Item) error {
+	nsItem, err := c.namespacedItem(item)
+	if err != nil {
+		return err
+	}
+	return c.Client.Set(nsItem)
+}
+
+// See Client.SetNowait()
+func (c *NamespaceClient) SetNowait(item *Item) {
+	nsItem, err := c.namespacedItem(item)
+	if err != nil {
+		return
+	}
+	c.Client.SetNowait(nsItem)
+}
+
+// See Client.Add()
+func (c *NamespaceClient) Add(item *Item) error {
+	nsItem, err := c.namespacedItem(item)
+	if err != nil {
+		return err
+	}
+	return c.Client.Add(nsItem)
+}
+
+// See Client.Cas()
+func (c *NamespaceClient) Cas(item *Item) error {
+	nsItem, err := c.namespacedItem(item)
+	if err != nil {
+		return err
+	}
+	return c.Client.Cas(nsItem)
+}
+
+// See Client.Delete()
+func (c *NamespaceClient) Delete(key []byte) error {
+	version, err := c.getVersion()
+	if err != nil {
+		return err
+	}
+	return c.Client.Delete(c.namespacedKey(version, key))
+}
+
+// See Client.DeleteNowait()
+func (c *NamespaceClient) DeleteNowait(key []byte) {
+	version, err := c.getVersion()
+	if err != nil {
+		return
+	}
+	c.Client.DeleteNowait(c.namespacedKey(version, key))
+}
+
+// Invalidates the namespace.
+//
+// Unlike Client.FlushAll(), items outside the namespace are left untouched.
+func (c *NamespaceClient) FlushAll() error {
+	return c.Invalidate()
+}
+
+// Invalidates the namespace without waiting for the result.
+//
+// See NamespaceClient.FlushAll().
+func (c *NamespaceClient) FlushAllNowait() {
+	c.Invalidate()
+}
+
+// Invalidates the namespace after the given delay.
+//
+// See NamespaceClient.FlushAll().
+func (c *NamespaceClient) FlushAllDelayed(expiration time.Duration) error {
+	time.AfterFunc(expiration, c.FlushAllNowait)
+	return nil
+}
+
+// Invalidates the namespace after the given delay without waiting
+// for the result.
+//
+// See NamespaceClient.FlushAll().
+func (c *NamespaceClient) FlushAllDelayedNowait(expiration time.Duration) {
+	time.AfterFunc(expiration, c.FlushAllNowait)
+}
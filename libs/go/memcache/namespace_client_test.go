@@ -0,0 +1,119 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamespaceClient_Invalidate(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	nc := &NamespaceClient{
+		Client:    c,
+		Namespace: "ns",
+	}
+
+	key := []byte("key")
+	value := []byte("value")
+	flags := uint32(1234)
+
+	item := Item{
+		Key:   key,
+		Value: value,
+		Flags: flags,
+	}
+	if err := nc.Set(&item); err != nil {
+		t.Fatalf("Error in NamespaceClient.Set(): [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := nc.Get(&item); err != nil {
+		t.Fatalf("Error in NamespaceClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, flags, "1", t)
+	if string(item.Key) != string(key) {
+		t.Fatalf("Unexpected item.Key=[%s]. Expected [%s]", item.Key, key)
+	}
+
+	// The item mustn't be visible outside the namespace.
+	rawItem := Item{
+		Key: key,
+	}
+	if err := c.Get(&rawItem); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from Client.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	items := []Item{
+		{Key: key},
+		{Key: []byte("missing_key")},
+	}
+	if err := nc.GetMulti(items); err != nil {
+		t.Fatalf("Error in NamespaceClient.GetMulti(): [%s]", err)
+	}
+	verifyItem(&items[0], value, flags, "2", t)
+	if items[1].Value != nil {
+		t.Fatalf("Unexpected value returned for missing key: [%s]", items[1].Value)
+	}
+	if string(items[1].Key) != "missing_key" {
+		t.Fatalf("Unexpected key=[%s]. Expected [missing_key]", items[1].Key)
+	}
+
+	// Other clients sharing the namespace must observe invalidation.
+	nc2 := &NamespaceClient{
+		Client:               c,
+		Namespace:            "ns",
+		VersionCheckInterval: time.Nanosecond,
+	}
+	if err := nc2.Get(&item); err != nil {
+		t.Fatalf("Error in NamespaceClient.Get(): [%s]", err)
+	}
+	if err := nc.Invalidate(); err != nil {
+		t.Fatalf("Error in NamespaceClient.Invalidate(): [%s]", err)
+	}
+	if err := nc.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from NamespaceClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+	if err := nc2.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from NamespaceClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	// Items in other namespaces must survive invalidation.
+	nc3 := &NamespaceClient{
+		Client:    c,
+		Namespace: "other",
+	}
+	item.Value = value
+	if err := nc3.Set(&item); err != nil {
+		t.Fatalf("Error in NamespaceClient.Set(): [%s]", err)
+	}
+	if err := nc.FlushAll(); err != nil {
+		t.Fatalf("Error in NamespaceClient.FlushAll(): [%s]", err)
+	}
+	item.Value = nil
+	if err := nc3.Get(&item); err != nil {
+		t.Fatalf("Error in NamespaceClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, flags, "3", t)
+}
+
+func TestJitterExpiration(t *testing.T) {
+	if e := jitterExpiration(0, 50); e != 0 {
+		t.Fatalf("Unexpected expiration=%s for items without expiration. Expected 0", e)
+	}
+	if e := jitterExpiration(time.Hour, 0); e != time.Hour {
+		t.Fatalf("Unexpected expiration=%s with zero jitter. Expected %s", e, time.Hour)
+	}
+	for i := 0; i < 1000; i++ {
+		e := jitterExpiration(time.Hour, 10)
+		if e < 54*time.Minute || e > 66*time.Minute {
+			t.Fatalf("Unexpected expiration=%s. Expected [54m..66m]", e)
+		}
+		if e = jitterExpiration(time.Second, 1000); e < time.Second || e > 2*time.Second {
+			t.Fatalf("Unexpected expiration=%s. Expected [1s..2s]", e)
+		}
+	}
+}
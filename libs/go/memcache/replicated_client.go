@@ -0,0 +1,468 @@
+package memcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Read preference for ReplicatedClient.
+type ReadPreference int
+
+const (
+	// Reads are sent to the primary server of the shard.
+	ReadPrimary ReadPreference = iota
+
+	// Reads are sent to a server from ReplicatedClient.LocalZone,
+	// preferring the primary server. Reads are sent to the primary server
+	// if the shard has no servers in the local zone.
+	ReadNearest
+
+	// Reads are spread evenly among all the servers of the shard.
+	ReadAny
+)
+
+// Memcache server in ReplicatedClient topology.
+type ReplicaServer struct {
+	// Server address in the form 'host:port'.
+	Addr string
+
+	// Availability zone of the server.
+	// Optional parameter. See ReplicatedClient.LocalZone.
+	Zone string
+}
+
+// Shard in ReplicatedClient topology.
+//
+// Items owned by the shard are written to the primary server and
+// to all the replicas.
+type Shard struct {
+	Primary  ReplicaServer
+	Replicas []ReplicaServer
+}
+
+// Memcache client, which shards requests among multiple shards
+// using consistent hashing, where each shard consists of the primary server
+// and optional replicas.
+//
+// Writes are sent to the primary server and then fanned out to replicas
+// without waiting for their responses. Reads are sent to shard servers
+// according to ReadPreference. Reads are retried on another server
+// of the shard if the selected server is unreachable.
+//
+// Items obtained from replicas contain Casid valid only for the replica,
+// so use ReadPrimary for obtaining items for Cas().
+//
+// The client is goroutine-safe.
+//
+// Usage:
+//
+//   c := memcache.ReplicatedClient{
+//       Shards: []memcache.Shard{
+//           {
+//               Primary:  memcache.ReplicaServer{Addr: "host1:11211", Zone: "us-east-1a"},
+//               Replicas: []memcache.ReplicaServer{{Addr: "host2:11211", Zone: "us-east-1b"}},
+//           },
+//           {
+//               Primary:  memcache.ReplicaServer{Addr: "host3:11211", Zone: "us-east-1b"},
+//               Replicas: []memcache.ReplicaServer{{Addr: "host4:11211", Zone: "us-east-1a"}},
+//           },
+//       },
+//       LocalZone:      "us-east-1a",
+//       ReadPreference: memcache.ReadNearest,
+//   }
+//   c.Start()
+//   defer c.Stop()
+//
+//   if err := c.Get(&item); err != nil {
+//       handleError(err)
+//   }
+//
+type ReplicatedClient struct {
+	ClientConfig
+
+	// Shards with servers.
+	// Required parameter.
+	//
+	// Shards cannot be changed after the client is started.
+	Shards []Shard
+
+	// Availability zone the client runs in. See ReadNearest.
+	// Optional parameter.
+	LocalZone string
+
+	// Servers for reads. ReadPrimary by default.
+	ReadPreference ReadPreference
+
+	// Reads are hedged to another server of the shard if the selected
+	// server doesn't respond during HedgeDelay. See HedgedClient.
+	// Optional parameter. Reads aren't hedged by default.
+	HedgeDelay time.Duration
+
+	mutex          sync.Mutex
+	shards         []*replicaShard
+	shardsHash     consistentHash
+	hedgedRequests uint64
+}
+
+type replicaShard struct {
+	// Clients for shard servers. The primary server goes first.
+	clients []*Client
+
+	// Indexes of clients for servers in the local zone.
+	localClients []int
+
+	// Round-robin counter for ReadAny.
+	next uint32
+}
+
+// Starts the client.
+//
+// Started client must be stopped via ReplicatedClient.Stop() call
+// when no longer needed.
+func (c *ReplicatedClient) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.shards != nil {
+		panic("Did you forgot calling ReplicatedClient.Stop() before calling ReplicatedClient.Start()?")
+	}
+	c.shards = make([]*replicaShard, 0, len(c.Shards))
+	c.shardsHash.ReplicasCount = consistentHashReplicasCount
+	c.shardsHash.BucketsCount = consistentHashBucketsCount
+	c.shardsHash.Init()
+	for shardIdx := range c.Shards {
+		shard := &c.Shards[shardIdx]
+		rs := &replicaShard{}
+		servers := append([]ReplicaServer{shard.Primary}, shard.Replicas...)
+		for i, server := range servers {
+			client := &Client{
+				ServerAddr:   server.Addr,
+				ClientConfig: c.ClientConfig,
+			}
+			client.Start()
+			rs.clients = append(rs.clients, client)
+			if c.LocalZone != "" && server.Zone == c.LocalZone {
+				rs.localClients = append(rs.localClients, i)
+			}
+		}
+		c.shards = append(c.shards, rs)
+		c.shardsHash.Add([]byte(shard.Primary.Addr), shardIdx)
+	}
+}
+
+// Stops the client.
+func (c *ReplicatedClient) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.shards == nil {
+		panic("Did you forgot calling ReplicatedClient.Start() before calling ReplicatedClient.Stop()?")
+	}
+	for _, rs := range c.shards {
+		for _, client := range rs.clients {
+			client.Stop()
+		}
+	}
+	c.shards = nil
+}
+
+// Returns the number of reads hedged to another server. See HedgeDelay.
+func (c *ReplicatedClient) HedgedRequests() uint64 {
+	return atomic.LoadUint64(&c.hedgedRequests)
+}
+
+func (c *ReplicatedClient) shardIdx(key []byte) int {
+	return c.shardsHash.Get(key).(int)
+}
+
+func (c *ReplicatedClient) shard(key []byte) (*replicaShard, error) {
+	if c.shards == nil {
+		return nil, ErrClientNotRunning
+	}
+	if len(c.shards) == 0 {
+		return nil, ErrNoServers
+	}
+	return c.shards[c.shardIdx(key)], nil
+}
+
+// Returns clients for reading from the given shard according
+// to ReadPreference.
+//
+// The second client is used for hedged and retried reads. It is nil
+// if the shard has no replicas.
+func (c *ReplicatedClient) readClients(rs *replicaShard) (first, second *Client) {
+	n := len(rs.clients)
+	if n == 1 {
+		return rs.clients[0], nil
+	}
+	switch c.ReadPreference {
+	case ReadNearest:
+		if len(rs.localClients) == 0 {
+			break
+		}
+		i := rs.localClients[0]
+		if i != 0 {
+			return rs.clients[i], rs.clients[0]
+		}
+		if len(rs.localClients) > 1 {
+			return rs.clients[0], rs.clients[rs.localClients[1]]
+		}
+	case ReadAny:
+		i := int(atomic.AddUint32(&rs.next, 1) % uint32(n))
+		return rs.clients[i], rs.clients[(i+1)%n]
+	}
+	return rs.clients[0], rs.clients[1]
+}
+
+// See Client.Get()
+//
+// The item is read from a shard server selected by ReadPreference.
+func (c *ReplicatedClient) Get(item *Item) error {
+	rs, err := c.shard(item.Key)
+	if err != nil {
+		return err
+	}
+	return c.getFromShard(rs, item)
+}
+
+func (c *ReplicatedClient) getFromShard(rs *replicaShard, item *Item) error {
+	first, second := c.readClients(rs)
+	if second == nil {
+		return first.Get(item)
+	}
+	if c.HedgeDelay > 0 {
+		return hedgedGet(first, second, c.HedgeDelay, &c.hedgedRequests, item)
+	}
+	err := first.Get(item)
+	if isUnreachableError(err) {
+		err = second.Get(item)
+	}
+	return err
+}
+
+func (c *ReplicatedClient) getMultiFromShard(rs *replicaShard, items []Item) error {
+	first, second := c.readClients(rs)
+	if second == nil {
+		return first.GetMulti(items)
+	}
+	if c.HedgeDelay > 0 {
+		return hedgedGetMulti(first, second, c.HedgeDelay, &c.hedgedRequests, items)
+	}
+	err := first.GetMulti(items)
+	if isUnreachableError(err) {
+		err = second.GetMulti(items)
+	}
+	return err
+}
+
+// See Client.GetMulti()
+//
+// Keys are split by shards, so each shard receives a single request
+// for all the keys it owns. Requests to distinct shards are sent
+// in parallel.
+//
+// Items from healthy shards are obtained even if other shards fail.
+// *GetMultiError with per-key errors is returned in this case.
+func (c *ReplicatedClient) GetMulti(items []Item) error {
+	if c.shards == nil {
+		return ErrClientNotRunning
+	}
+	if len(c.shards) == 0 {
+		return ErrNoServers
+	}
+	indexesPerShard := make([][]int, len(c.shards))
+	for i := range items {
+		shardIdx := c.shardIdx(items[i].Key)
+		indexesPerShard[shardIdx] = append(indexesPerShard[shardIdx], i)
+	}
+
+	errs := make([]error, len(c.shards))
+	var wg sync.WaitGroup
+	for shardIdx, indexes := range indexesPerShard {
+		if len(indexes) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shardIdx int, indexes []int) {
+			defer wg.Done()
+			shardItems := make([]Item, len(indexes))
+			for j, i := range indexes {
+				shardItems[j] = items[i]
+			}
+			if errs[shardIdx] = c.getMultiFromShard(c.shards[shardIdx], shardItems); errs[shardIdx] != nil {
+				return
+			}
+			for j, i := range indexes {
+				items[i] = shardItems[j]
+			}
+		}(shardIdx, indexes)
+	}
+	wg.Wait()
+
+	var gme *GetMultiError
+	for shardIdx, shardErr := range errs {
+		if shardErr == nil {
+			continue
+		}
+		if len(c.shards) == 1 {
+			// Return the original error for a single shard.
+			return shardErr
+		}
+		if gme == nil {
+			gme = &GetMultiError{
+				Errors: make(map[string]error),
+			}
+		}
+		for _, i := range indexesPerShard[shardIdx] {
+			gme.Errors[string(items[i].Key)] = shardErr
+		}
+	}
+	if gme != nil {
+		return gme
+	}
+	return nil
+}
+
+// Fans out the item to replicas of the given shard.
+func replicateItem(rs *replicaShard, item *Item) {
+	for _, client := range rs.clients[1:] {
+		client.SetNowait(item)
+	}
+}
+
+// See Client.Set()
+//
+// The item is written to the primary server and then to replicas
+// without waiting for their responses.
+func (c *ReplicatedClient) Set(item *Item) error {
+	rs, err := c.shard(item.Key)
+	if err != nil {
+		return err
+	}
+	if err = rs.clients[0].Set(item); err != nil {
+		return err
+	}
+	replicateItem(rs, item)
+	return nil
+}
+
+// See Client.SetNowait()
+func (c *ReplicatedClient) SetNowait(item *Item) {
+	rs, err := c.shard(item.Key)
+	if err != nil {
+		return
+	}
+	rs.clients[0].SetNowait(item)
+	replicateItem(rs, item)
+}
+
+// See Client.Add()
+//
+// The item is replicated only if it is added to the primary server.
+func (c *ReplicatedClient) Add(item *Item) error {
+	rs, err := c.shard(item.Key)
+	if err != nil {
+		return err
+	}
+	if err = rs.clients[0].Add(item); err != nil {
+		return err
+	}
+	replicateItem(rs, item)
+	return nil
+}
+
+// See Client.Cas()
+//
+// The item is replicated only if Cas succeeds on the primary server.
+func (c *ReplicatedClient) Cas(item *Item) error {
+	rs, err := c.shard(item.Key)
+	if err != nil {
+		return err
+	}
+	if err = rs.clients[0].Cas(item); err != nil {
+		return err
+	}
+	replicateItem(rs, item)
+	return nil
+}
+
+// See Client.Delete()
+func (c *ReplicatedClient) Delete(key []byte) error {
+	rs, err := c.shard(key)
+	if err != nil {
+		return err
+	}
+	for _, client := range rs.clients[1:] {
+		client.DeleteNowait(key)
+	}
+	return rs.clients[0].Delete(key)
+}
+
+// See Client.DeleteNowait()
+func (c *ReplicatedClient) DeleteNowait(key []byte) {
+	rs, err := c.shard(key)
+	if err != nil {
+		return
+	}
+	for _, client := range rs.clients {
+		client.DeleteNowait(key)
+	}
+}
+
+// Calls f for all the servers in parallel and returns the first error.
+func (c *ReplicatedClient) forEachClient(f func(client *Client) error) error {
+	if c.shards == nil {
+		return ErrClientNotRunning
+	}
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var err error
+	for _, rs := range c.shards {
+		for _, client := range rs.clients {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				if clientErr := f(client); clientErr != nil {
+					errLock.Lock()
+					if err == nil {
+						err = clientErr
+					}
+					errLock.Unlock()
+				}
+			}(client)
+		}
+	}
+	wg.Wait()
+	return err
+}
+
+// See Client.FlushAll()
+func (c *ReplicatedClient) FlushAll() error {
+	return c.forEachClient(func(client *Client) error {
+		return client.FlushAll()
+	})
+}
+
+// See Client.FlushAllNowait()
+func (c *ReplicatedClient) FlushAllNowait() {
+	c.forEachClient(func(client *Client) error {
+		client.FlushAllNowait()
+		return nil
+	})
+}
+
+// See Client.FlushAllDelayed()
+func (c *ReplicatedClient) FlushAllDelayed(expiration time.Duration) error {
+	return c.forEachClient(func(client *Client) error {
+		return client.FlushAllDelayed(expiration)
+	})
+}
+
+// See Client.FlushAllDelayedNowait()
+func (c *ReplicatedClient) FlushAllDelayedNowait(expiration time.Duration) {
+	c.forEachClient(func(client *Client) error {
+		client.FlushAllDelayedNowait(expiration)
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestReplicatedClient_ReadPreference(t *testing.T) {
+	const replicaAddr = "localhost:12348"
+	primary, primaryCache := newServerCache(t)
+	defer primaryCache.Close()
+	primary.Start()
+	replica, replicaCache := newServerCacheWithAddr(replicaAddr, t)
+	defer replicaCache.Close()
+	replica.Start()
+	defer replica.Stop()
+
+	c := &ReplicatedClient{
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 1, // tests require single connection!
+		},
+		Shards: []Shard{
+			{
+				Primary:  ReplicaServer{Addr: testAddr, Zone: "a"},
+				Replicas: []ReplicaServer{{Addr: replicaAddr, Zone: "b"}},
+			},
+		},
+		LocalZone:      "b",
+		ReadPreference: ReadNearest,
+	}
+	c.Start()
+	defer c.Stop()
+
+	key := []byte("key")
+	value := []byte("value")
+	flags := uint32(1234)
+	item := Item{
+		Key:   key,
+		Value: value,
+		Flags: flags,
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("Error in ReplicatedClient.Set(): [%s]", err)
+	}
+
+	// The item must be read from the replica in the local zone.
+	replicaClient := &Client{
+		ServerAddr: replicaAddr,
+	}
+	replicaClient.Start()
+	defer replicaClient.Stop()
+	if err := replicaClient.Delete(key); err != nil {
+		t.Fatalf("Error when deleting the item from the replica: [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from ReplicatedClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	// The item must be read from the primary.
+	c.ReadPreference = ReadPrimary
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("Error in ReplicatedClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, flags, "1", t)
+
+	items := []Item{
+		{Key: key},
+		{Key: []byte("missing_key")},
+	}
+	if err := c.GetMulti(items); err != nil {
+		t.Fatalf("Error in ReplicatedClient.GetMulti(): [%s]", err)
+	}
+	verifyItem(&items[0], value, flags, "2", t)
+
+	// Reads must be retried on the replica if the primary is unreachable.
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("Error in ReplicatedClient.Set(): [%s]", err)
+	}
+	primary.StopGracefully(0)
+	item.Value = nil
+	item.Flags = 0
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("Error in ReplicatedClient.Get() with unreachable primary: [%s]", err)
+	}
+	verifyItem(&item, value, flags, "3", t)
+
+	if err := c.Set(&item); err == nil {
+		t.Fatalf("ReplicatedClient.Set() must fail if the primary is unreachable")
+	}
+}
@@ -0,0 +1,34 @@
+package memcache
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEPORT isn't defined in syscall package for all linux architectures.
+const soReusePort = 0xf
+
+// Creates TCP listener with SO_REUSEPORT socket option.
+//
+// SO_REUSEPORT allows multiple processes listening on the same address,
+// so a new server process may start accepting connections before the old one
+// stops. This allows zero-downtime restarts. See Server.Listener.
+func ListenReusePort(addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
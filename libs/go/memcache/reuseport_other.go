@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package memcache
+
+import (
+	"errors"
+	"net"
+)
+
+// Creates TCP listener with SO_REUSEPORT socket option.
+//
+// SO_REUSEPORT is supported only on linux.
+func ListenReusePort(addr string) (*net.TCPListener, error) {
+	return nil, errors.New("SO_REUSEPORT isn't supported on this platform")
+}
@@ -5,13 +5,18 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/valyala/ybc/bindings/go/ybc"
+	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Version returned by the server in response to 'version' command.
+var serverVersion = []byte("ybc-go-memcached")
+
 var (
 	casidCounter uint64
 	casidLock    sync.Mutex
@@ -71,16 +76,19 @@ func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item, shouldWriteCa
 	return writeStr(w, strCrLf) && writeItem(w, item, size)
 }
 
-func getItemAndWriteResponse(w *bufio.Writer, cache ybc.Cacher, key []byte, shouldWriteCasid bool, scratchBuf *[]byte) bool {
-	item, err := cache.GetItem(key)
+func getItemAndWriteResponse(w *bufio.Writer, cache ybc.Cacher, key []byte, shouldWriteCasid bool, scratchBuf *[]byte, s *Server) bool {
+	stats := s.stats
+	item, err := s.getItem(cache, key)
 	if err != nil {
 		if err == ybc.ErrCacheMiss {
+			atomic.AddUint64(&stats.GetMisses, 1)
 			return true
 		}
 		log.Fatalf("Unexpected error returned by cache.GetItem(key=[%s]): [%s]", key, err)
 	}
 	// do not use defer item.Close() for performance reasons
 
+	atomic.AddUint64(&stats.GetHits, 1)
 	ok := writeGetResponse(w, key, item, shouldWriteCasid, scratchBuf)
 	item.Close()
 	return ok
@@ -94,7 +102,12 @@ func writeEndCrLf(w *bufio.Writer) bool {
 	return writeStr(w, strEndCrLf)
 }
 
-func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, shouldWriteCasid bool) bool {
+func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, shouldWriteCasid bool, s *Server) bool {
+	// The line may be backed by scratchBuf, which is overwritten
+	// while writing responses, so keys must be read from a copy.
+	if len(line) > 0 && bytes.IndexByte(line, ' ') >= 0 {
+		line = append([]byte(nil), line...)
+	}
 	last := -1
 	lineSize := len(line)
 	for last < lineSize {
@@ -109,14 +122,72 @@ func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBu
 			continue
 		}
 		key := line[first:last]
-		if !getItemAndWriteResponse(c.Writer, cache, key, shouldWriteCasid, scratchBuf) {
+		if !getItemAndWriteResponse(c.Writer, cache, key, shouldWriteCasid, scratchBuf, s) {
 			return false
 		}
 	}
 	return writeEndCrLf(c.Writer)
 }
 
-func processGetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+// Returns the item for the given key from the cache.
+//
+// Fetches the missing item from Server.ProxyPool if it is set.
+func (s *Server) getItem(cache ybc.Cacher, key []byte) (*ybc.Item, error) {
+	s.hotKeys.Register(key)
+	item, err := cache.GetItem(key)
+	if err == ybc.ErrCacheMiss && s.ProxyPool != nil {
+		return s.proxyItem(cache, key)
+	}
+	return item, err
+}
+
+// Returns the item for the given key from the cache using dogpile effect
+// handling.
+//
+// Fetches the missing item from Server.ProxyPool if it is set.
+func (s *Server) getDeAsyncItem(cache ybc.Cacher, key []byte, graceDuration time.Duration) (*ybc.Item, error) {
+	s.hotKeys.Register(key)
+	item, err := cache.GetDeAsyncItem(key, graceDuration)
+	if err == ybc.ErrCacheMiss && s.ProxyPool != nil {
+		return s.proxyItem(cache, key)
+	}
+	return item, err
+}
+
+// Fetches the item from Server.ProxyPool and stores it in the cache.
+//
+// Returns ybc.ErrCacheMiss if the item cannot be obtained from the pool.
+func (s *Server) proxyItem(cache ybc.Cacher, key []byte) (*ybc.Item, error) {
+	stats := s.stats
+	it := Item{
+		Key: key,
+	}
+	if err := s.ProxyPool.Get(&it); err != nil {
+		if err == ErrCacheMiss {
+			atomic.AddUint64(&stats.ProxyMisses, 1)
+		} else {
+			atomic.AddUint64(&stats.ProxyErrors, 1)
+			log.Printf("Cannot obtain item with key=[%s] from ProxyPool: [%s]", key, err)
+		}
+		return nil, ybc.ErrCacheMiss
+	}
+	atomic.AddUint64(&stats.ProxyHits, 1)
+
+	txn := startSetTxn(cache, key, it.Flags, s.ProxyTtl, len(it.Value))
+	if txn == nil {
+		return nil, ybc.ErrCacheMiss
+	}
+	if _, err := txn.Write(it.Value); err != nil {
+		log.Fatalf("Error in SetTxn.Write(): [%s]", err)
+	}
+	item, err := txn.CommitItem()
+	if err != nil {
+		log.Fatalf("Unexpected error returned from SetTxn.CommitItem(): [%s]", err)
+	}
+	return item, nil
+}
+
+func processGetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, s *Server) bool {
 	n := -1
 
 	key := nextToken(line, &n, "key")
@@ -131,7 +202,7 @@ func processGetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratch
 		return false
 	}
 
-	item, err := cache.GetDeAsyncItem(key, graceDuration)
+	item, err := s.getDeAsyncItem(cache, key, graceDuration)
 	if err != nil {
 		if err == ybc.ErrWouldBlock {
 			return writeStr(c.Writer, strWouldBlockCrLf)
@@ -171,7 +242,7 @@ func checkAndUpdateCasid(item *ybc.Item, casid *uint64) (isModified, ok bool) {
 	return
 }
 
-func processCgetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+func processCgetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, s *Server) bool {
 	n := -1
 
 	key := nextToken(line, &n, "key")
@@ -186,7 +257,7 @@ func processCgetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchB
 		return false
 	}
 
-	item, err := cache.GetItem(key)
+	item, err := s.getItem(cache, key)
 	if err == ybc.ErrCacheMiss {
 		return writeStr(c.Writer, strEndCrLf)
 	}
@@ -210,7 +281,7 @@ func processCgetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchB
 	return ok
 }
 
-func processCgetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+func processCgetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, s *Server) bool {
 	n := -1
 
 	key := nextToken(line, &n, "key")
@@ -229,7 +300,7 @@ func processCgetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratc
 		return false
 	}
 
-	item, err := cache.GetDeAsyncItem(key, graceDuration)
+	item, err := s.getDeAsyncItem(cache, key, graceDuration)
 	if err == ybc.ErrWouldBlock {
 		return writeStr(c.Writer, strWouldBlockCrLf)
 	}
@@ -596,7 +667,63 @@ func processFlushAllCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, flus
 	return writeStr(c.Writer, strOkCrLf)
 }
 
-func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, scratchBuf *[]byte, flushAllTimer **time.Timer) bool {
+func writeStat(w *bufio.Writer, name, value string) bool {
+	return writeStr(w, strStatWs) && writeStr(w, []byte(name)) && writeWs(w) &&
+		writeStr(w, []byte(value)) && writeCrLf(w)
+}
+
+func processStatsCmd(c *bufio.ReadWriter, s *Server, args []byte, scratchBuf *[]byte) bool {
+	ok := true
+	write := func(name, value string) {
+		ok = ok && writeStat(c.Writer, name, value)
+	}
+	writeLine := func(line string) {
+		ok = ok && writeStr(c.Writer, []byte(line)) && writeCrLf(c.Writer)
+	}
+
+	switch {
+	case len(args) == 0:
+		var stats ServerStats
+		s.Stats(&stats)
+		write("curr_connections", strconv.FormatInt(stats.CurrConnections, 10))
+		write("total_connections", strconv.FormatUint(stats.TotalConnections, 10))
+		write("auth_errors", strconv.FormatUint(stats.AuthErrors, 10))
+		write("slow_requests", strconv.FormatUint(stats.SlowRequests, 10))
+		write("cmd_get", strconv.FormatUint(stats.CmdGet+stats.CmdGets, 10))
+		write("cmd_getde", strconv.FormatUint(stats.CmdGetDe, 10))
+		write("cmd_cget", strconv.FormatUint(stats.CmdCget, 10))
+		write("cmd_cgetde", strconv.FormatUint(stats.CmdCgetDe, 10))
+		write("cmd_set", strconv.FormatUint(stats.CmdSet+stats.CmdAdd+stats.CmdCas, 10))
+		write("cmd_delete", strconv.FormatUint(stats.CmdDelete, 10))
+		write("cmd_flush", strconv.FormatUint(stats.CmdFlushAll, 10))
+		write("get_hits", strconv.FormatUint(stats.GetHits, 10))
+		write("get_misses", strconv.FormatUint(stats.GetMisses, 10))
+		write("proxy_hits", strconv.FormatUint(stats.ProxyHits, 10))
+		write("proxy_misses", strconv.FormatUint(stats.ProxyMisses, 10))
+		write("proxy_errors", strconv.FormatUint(stats.ProxyErrors, 10))
+	case bytes.HasPrefix(args, strHotKeys):
+		n := defaultHotKeysCount
+		if countStr := bytes.TrimSpace(args[len(strHotKeys):]); len(countStr) > 0 {
+			var parsed bool
+			if n, parsed = parseInt(countStr); !parsed || n <= 0 {
+				log.Printf("Invalid hot keys count=[%s] in stats command. Expected positive number", countStr)
+				return false
+			}
+		}
+		for _, hk := range s.HotKeys(n) {
+			write(hk.Key, strconv.FormatUint(hk.Requests, 10))
+		}
+	case s.RawStatsHandler != nil && s.RawStatsHandler(args, writeLine):
+	case s.StatsHandler != nil && s.StatsHandler(args, write):
+	default:
+		log.Printf("Unrecognized stats command=[%s]", args)
+		return false
+	}
+	return ok && writeEndCrLf(c.Writer)
+}
+
+func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, scratchBuf *[]byte, flushAllTimer **time.Timer, s *Server) bool {
+	stats := s.stats
 	if !readLine(c.Reader, scratchBuf) {
 		return false
 	}
@@ -605,35 +732,52 @@ func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, scratchBuf *[]byte, f
 		return false
 	}
 	if bytes.HasPrefix(line, strGet) {
-		return processGetCmd(c, cache, line[len(strGet):], scratchBuf, false)
+		atomic.AddUint64(&stats.CmdGet, 1)
+		return processGetCmd(c, cache, line[len(strGet):], scratchBuf, false, s)
 	}
 	if bytes.HasPrefix(line, strGets) {
-		return processGetCmd(c, cache, line[len(strGets):], scratchBuf, true)
+		atomic.AddUint64(&stats.CmdGets, 1)
+		return processGetCmd(c, cache, line[len(strGets):], scratchBuf, true, s)
 	}
 	if bytes.HasPrefix(line, strGetDe) {
-		return processGetDeCmd(c, cache, line[len(strGetDe):], scratchBuf)
+		atomic.AddUint64(&stats.CmdGetDe, 1)
+		return processGetDeCmd(c, cache, line[len(strGetDe):], scratchBuf, s)
 	}
 	if bytes.HasPrefix(line, strCget) {
-		return processCgetCmd(c, cache, line[len(strCget):], scratchBuf)
+		atomic.AddUint64(&stats.CmdCget, 1)
+		return processCgetCmd(c, cache, line[len(strCget):], scratchBuf, s)
 	}
 	if bytes.HasPrefix(line, strCgetDe) {
-		return processCgetDeCmd(c, cache, line[len(strCgetDe):], scratchBuf)
+		atomic.AddUint64(&stats.CmdCgetDe, 1)
+		return processCgetDeCmd(c, cache, line[len(strCgetDe):], scratchBuf, s)
 	}
 	if bytes.HasPrefix(line, strSet) {
+		atomic.AddUint64(&stats.CmdSet, 1)
 		return processSetCmd(c, cache, line[len(strSet):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strCas) {
+		atomic.AddUint64(&stats.CmdCas, 1)
 		return processCasCmd(c, cache, line[len(strCas):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strAdd) {
+		atomic.AddUint64(&stats.CmdAdd, 1)
 		return processAddCmd(c, cache, line[len(strAdd):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strDelete) {
+		atomic.AddUint64(&stats.CmdDelete, 1)
 		return processDeleteCmd(c, cache, line[len(strDelete):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strFlushAll) {
+		atomic.AddUint64(&stats.CmdFlushAll, 1)
 		return processFlushAllCmd(c, cache, line[len(strFlushAll):], flushAllTimer)
 	}
+	if bytes.Equal(line, strVersion) {
+		atomic.AddUint64(&stats.CmdVersion, 1)
+		return writeStr(c.Writer, strVersionResponse) && writeStr(c.Writer, serverVersion) && writeCrLf(c.Writer)
+	}
+	if bytes.Equal(line, strStats) || bytes.HasPrefix(line, strStatsWs) {
+		return processStatsCmd(c, s, bytes.TrimSpace(line[len(strStats):]), scratchBuf)
+	}
 	if bytes.HasPrefix(line, strQuit) {
 		return false
 	}
@@ -641,11 +785,66 @@ func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, scratchBuf *[]byte, f
 	return false
 }
 
-func handleConn(conn net.Conn, cache ybc.Cacher, readBufferSize, writeBufferSize int, done *sync.WaitGroup) {
+// The maximum size of credentials sent by clients during authentication.
+const maxCredentialsSize = 4096
+
+// Authenticates the connection using memcached's text protocol
+// authentication.
+//
+// Returns the cache for serving the connection or nil if the authentication
+// fails.
+func authenticateConn(c *bufio.ReadWriter, authenticate func(username, password []byte) ybc.Cacher, scratchBuf *[]byte, stats *ServerStats) ybc.Cacher {
+	if !readLine(c.Reader, scratchBuf) {
+		return nil
+	}
+	line := *scratchBuf
+	if !bytes.HasPrefix(line, strSet) {
+		log.Printf("Unexpected command=[%s] from unauthenticated connection. Expected 'set' with credentials", line)
+		return nil
+	}
+	_, _, _, size, _, _, ok := parseSetCmd(line[len(strSet):], false)
+	if !ok {
+		return nil
+	}
+	if size > maxCredentialsSize {
+		log.Printf("Too long credentials=[%d]. Max %d bytes are allowed", size, maxCredentialsSize)
+		return nil
+	}
+	credentials := make([]byte, size)
+	if _, err := io.ReadFull(c.Reader, credentials); err != nil {
+		log.Printf("Error when reading credentials with size=[%d]: [%s]", size, err)
+		return nil
+	}
+	if !matchCrLf(c.Reader) {
+		return nil
+	}
+
+	var cache ybc.Cacher
+	if n := bytes.IndexByte(credentials, ' '); n >= 0 {
+		cache = authenticate(credentials[:n], credentials[n+1:])
+	}
+	if cache == nil {
+		atomic.AddUint64(&stats.AuthErrors, 1)
+		writeStr(c.Writer, strAuthFailureCrLf)
+		return nil
+	}
+	if !writeStr(c.Writer, strStoredCrLf) {
+		return nil
+	}
+	return cache
+}
+
+func handleConn(conn net.Conn, s *Server, done *sync.WaitGroup) {
+	cache := s.Cache
+	stats := s.stats
 	defer conn.Close()
 	defer done.Done()
-	r := bufio.NewReaderSize(conn, readBufferSize)
-	w := bufio.NewWriterSize(conn, writeBufferSize)
+	atomic.AddUint64(&stats.TotalConnections, 1)
+	atomic.AddInt64(&stats.CurrConnections, 1)
+	defer atomic.AddInt64(&stats.CurrConnections, -1)
+	slowRequests, rw := newSlowRequestTracker(s, conn)
+	r := bufio.NewReaderSize(rw, s.ReadBufferSize)
+	w := bufio.NewWriterSize(rw, s.WriteBufferSize)
 	c := bufio.NewReadWriter(r, w)
 	defer w.Flush()
 
@@ -653,13 +852,35 @@ func handleConn(conn net.Conn, cache ybc.Cacher, readBufferSize, writeBufferSize
 	defer flushAllTimer.Stop()
 
 	scratchBuf := make([]byte, 0, 1024)
+	if s.Authenticate != nil {
+		if cache = authenticateConn(c, s.Authenticate, &scratchBuf, stats); cache == nil {
+			return
+		}
+		w.Flush()
+	}
+	if slowRequests != nil {
+		slowRequests.r = r
+		slowRequests.w = w
+	}
 	for {
-		if !processRequest(c, cache, &scratchBuf, &flushAllTimer) {
+		if slowRequests != nil && !slowRequests.start() {
 			break
 		}
-		if r.Buffered() == 0 {
+		ok := processRequest(c, cache, &scratchBuf, &flushAllTimer, s)
+		if ok && r.Buffered() == 0 {
 			w.Flush()
 		}
+		if slowRequests != nil {
+			slowRequests.finish()
+		}
+		if !ok {
+			break
+		}
+	}
+	if s.isDraining() {
+		// Notify the client the connection is closed due to server
+		// shutdown, so it may retry pending requests on another server.
+		writeStr(w, strServerShutdownCrLf)
 	}
 }
 
@@ -688,9 +909,19 @@ type Server struct {
 	Cache ybc.Cacher
 
 	// TCP address to listen to. Must be in the form addr:port.
-	// Required parameter.
+	// Required parameter unless Listener is set.
 	ListenAddr string
 
+	// Listener for accepting connections.
+	// Optional parameter. If set, ListenAddr is ignored.
+	//
+	// The listener is closed by Server.Stop(), so a new listener must be set
+	// before the next Server.Start() call.
+	//
+	// Use ListenReusePort() for creating listener, which may be shared
+	// with other processes during zero-downtime restarts.
+	Listener *net.TCPListener
+
 	// The size of buffer used for reading requests from clients
 	// per each connection.
 	// Optional parameter.
@@ -709,9 +940,80 @@ type Server struct {
 	// Optional parameter.
 	OSWriteBufferSize int
 
+	// Callback for authenticating connections.
+	// Optional parameter. Connections aren't authenticated if it isn't set.
+	//
+	// Connections must authenticate before sending other commands using
+	// memcached's text protocol authentication, i.e. 'set' request with
+	// 'username password' value. See ClientConfig.Username.
+	//
+	// The callback must return the cache for serving requests from
+	// the authenticated connection, so distinct users may be isolated
+	// in distinct caches. Return nil for rejecting the credentials.
+	Authenticate func(username, password []byte) ybc.Cacher
+
+	// The duration of sliding window for tracking the most frequently
+	// requested keys. See Server.HotKeys().
+	// Optional parameter. Hot keys aren't tracked if it isn't set.
+	HotKeysWindow time.Duration
+
+	// Only every HotKeysSampleRate-th get request is tracked for finding
+	// hot keys, so tracking doesn't slow down the server.
+	// Optional parameter. See HotKeysWindow.
+	HotKeysSampleRate int
+
+	// Handler for 'stats <args>' commands unknown to the server.
+	// Optional parameter.
+	//
+	// The handler must write stats via writeStat and return true
+	// if it recognizes args. Otherwise it must return false.
+	StatsHandler func(args []byte, writeStat func(name, value string)) bool
+
+	// Handler for 'stats <args>' commands with responses in custom format
+	// such as 'stats detail dump' in the original memcached.
+	// Optional parameter.
+	//
+	// The handler must write response lines without trailing CRLF
+	// via writeLine and return true if it recognizes args. Otherwise
+	// it must return false. The server terminates the response with END.
+	// The handler is called before StatsHandler.
+	RawStatsHandler func(args []byte, writeLine func(line string)) bool
+
+	// Pool of memcache servers for fetching items missing in the cache.
+	// Optional parameter.
+	//
+	// Items found in the pool are stored in the cache with ProxyTtl
+	// and returned to clients, so the server may be used as a near cache
+	// in front of existing memcache servers. Only get-type commands
+	// are proxied. Other commands modify only the cache.
+	ProxyPool Memcacher
+
+	// Ttl for items fetched from ProxyPool.
+	// Optional parameter. See ProxyPool.
+	ProxyTtl time.Duration
+
+	// Requests handled for longer than SlowRequestThreshold are passed
+	// to SlowRequestHandler.
+	// Optional parameter. Slow requests aren't tracked if it isn't set.
+	SlowRequestThreshold time.Duration
+
+	// Handler for slow requests. See SlowRequestThreshold.
+	// Optional parameter.
+	//
+	// The handler is called synchronously from goroutines serving
+	// connections, so it must be goroutine-safe and fast.
+	SlowRequestHandler func(r *SlowRequest)
+
 	listenSocket *net.TCPListener
 	done         sync.WaitGroup
 	err          error
+	stats        *ServerStats
+	hotKeys      *hotKeysTracker
+
+	// Open connections for closing them in Server.StopGracefully().
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+	draining  bool
 }
 
 func (s *Server) init() {
@@ -727,7 +1029,27 @@ func (s *Server) init() {
 	if s.OSWriteBufferSize == 0 {
 		s.OSWriteBufferSize = defaultOSWriteBufferSize
 	}
+	if s.stats == nil {
+		s.stats = &ServerStats{}
+	}
+	if s.ProxyTtl == 0 {
+		s.ProxyTtl = defaultProxyTtl
+	}
+	if s.HotKeysSampleRate == 0 {
+		s.HotKeysSampleRate = defaultHotKeysSampleRate
+	}
+	if s.hotKeys == nil && s.HotKeysWindow > 0 {
+		s.hotKeys = newHotKeysTracker(s.HotKeysWindow, s.HotKeysSampleRate)
+	}
+
+	s.conns = make(map[net.Conn]struct{})
+	s.draining = false
 
+	if s.Listener != nil {
+		s.listenSocket = s.Listener
+		s.done.Add(1)
+		return
+	}
 	listenAddr, err := net.ResolveTCPAddr("tcp", s.ListenAddr)
 	if err != nil {
 		log.Fatalf("Cannot resolve listenAddr=[%s]: [%s]", s.ListenAddr, err)
@@ -761,11 +1083,43 @@ func (s *Server) run() {
 		if err = conn.SetWriteBuffer(s.OSWriteBufferSize); err != nil {
 			log.Fatalf("Cannot set TCP write buffer size to %d: [%s]", s.OSWriteBufferSize, err)
 		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
 		connsDone.Add(1)
-		go handleConn(conn, s.Cache, s.ReadBufferSize, s.WriteBufferSize, connsDone)
+		go s.serveConn(conn, connsDone)
 	}
 }
 
+func (s *Server) serveConn(conn net.Conn, done *sync.WaitGroup) {
+	defer s.untrackConn(conn)
+	handleConn(conn, s, done)
+}
+
+// Returns false if the server is draining connections.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if s.draining {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsLock.Lock()
+	delete(s.conns, conn)
+	s.connsLock.Unlock()
+}
+
+func (s *Server) isDraining() bool {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	return s.draining
+}
+
 // Starts the given server.
 //
 // No longer needed servers must be stopped via Server.Stop() call.
@@ -799,3 +1153,43 @@ func (s *Server) Stop() {
 	s.Wait()
 	s.listenSocket = nil
 }
+
+// Stops the server, which has been started via either Server.Start()
+// or Server.Serve() calls, without waiting for clients to close connections.
+//
+// The server stops accepting new connections, finishes requests, which are
+// already read from open connections, and closes the connections after
+// sending 'SERVER_ERROR server is shutting down' to clients.
+// Connections still open after drainTimeout are closed forcibly.
+//
+// Don't forget closing the Server.Cache, since the server doesn't close it
+// automatically.
+func (s *Server) StopGracefully(drainTimeout time.Duration) {
+	s.listenSocket.Close()
+
+	s.connsLock.Lock()
+	s.draining = true
+	for conn := range s.conns {
+		// Interrupt reading the next request.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsLock.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(drainTimeout):
+		s.connsLock.Lock()
+		log.Printf("Closing %d connections still open after drainTimeout=%s", len(s.conns), drainTimeout)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsLock.Unlock()
+		<-stopped
+	}
+	s.listenSocket = nil
+}
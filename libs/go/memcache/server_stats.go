@@ -0,0 +1,88 @@
+package memcache
+
+import (
+	"sync/atomic"
+)
+
+// Server statistics. See Server.Stats().
+//
+// All the counters are cumulative since the first Server.Start() call.
+type ServerStats struct {
+	// The number of processed commands per command type.
+	CmdGet      uint64
+	CmdGets     uint64
+	CmdGetDe    uint64
+	CmdCget     uint64
+	CmdCgetDe   uint64
+	CmdSet      uint64
+	CmdAdd      uint64
+	CmdCas      uint64
+	CmdDelete   uint64
+	CmdFlushAll uint64
+	CmdVersion  uint64
+
+	// The number of keys found and missing in the cache
+	// for 'get' and 'gets' commands.
+	GetHits   uint64
+	GetMisses uint64
+
+	// The number of accepted connections.
+	TotalConnections uint64
+
+	// The number of currently open connections.
+	CurrConnections int64
+
+	// The number of connections rejected due to invalid credentials.
+	// See Server.Authenticate.
+	AuthErrors uint64
+
+	// The number of requests handled for longer than
+	// Server.SlowRequestThreshold.
+	SlowRequests uint64
+
+	// The number of items found, missing and failed to obtain
+	// in Server.ProxyPool.
+	ProxyHits   uint64
+	ProxyMisses uint64
+	ProxyErrors uint64
+}
+
+// Copies server statistics to dst.
+func (s *Server) Stats(dst *ServerStats) {
+	if s.stats == nil {
+		*dst = ServerStats{}
+		return
+	}
+	src := s.stats
+	dst.CmdGet = atomic.LoadUint64(&src.CmdGet)
+	dst.CmdGets = atomic.LoadUint64(&src.CmdGets)
+	dst.CmdGetDe = atomic.LoadUint64(&src.CmdGetDe)
+	dst.CmdCget = atomic.LoadUint64(&src.CmdCget)
+	dst.CmdCgetDe = atomic.LoadUint64(&src.CmdCgetDe)
+	dst.CmdSet = atomic.LoadUint64(&src.CmdSet)
+	dst.CmdAdd = atomic.LoadUint64(&src.CmdAdd)
+	dst.CmdCas = atomic.LoadUint64(&src.CmdCas)
+	dst.CmdDelete = atomic.LoadUint64(&src.CmdDelete)
+	dst.CmdFlushAll = atomic.LoadUint64(&src.CmdFlushAll)
+	dst.CmdVersion = atomic.LoadUint64(&src.CmdVersion)
+	dst.GetHits = atomic.LoadUint64(&src.GetHits)
+	dst.GetMisses = atomic.LoadUint64(&src.GetMisses)
+	dst.TotalConnections = atomic.LoadUint64(&src.TotalConnections)
+	dst.CurrConnections = atomic.LoadInt64(&src.CurrConnections)
+	dst.AuthErrors = atomic.LoadUint64(&src.AuthErrors)
+	dst.SlowRequests = atomic.LoadUint64(&src.SlowRequests)
+	dst.ProxyHits = atomic.LoadUint64(&src.ProxyHits)
+	dst.ProxyMisses = atomic.LoadUint64(&src.ProxyMisses)
+	dst.ProxyErrors = atomic.LoadUint64(&src.ProxyErrors)
+}
+
+// Returns up to n the most frequently requested keys during
+// Server.HotKeysWindow sorted by the estimated number of get requests.
+//
+// Returns nil if Server.HotKeysWindow isn't set.
+func (s *Server) HotKeys(n int) []HotKey {
+	if s.hotKeys == nil {
+		return nil
+	}
+	return s.hotKeys.HotKeys(n)
+}
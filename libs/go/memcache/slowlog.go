@@ -0,0 +1,147 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Request handled by the server for longer than
+// Server.SlowRequestThreshold. See Server.SlowRequestHandler.
+//
+// Do not hold references to SlowRequest after Server.SlowRequestHandler
+// returns.
+type SlowRequest struct {
+	// Address of the client sent the request.
+	ClientAddr net.Addr
+
+	// Command name, i.e. "get", "set", "delete", etc.
+	Command string
+
+	// The first command argument, i.e. the first key for get, storage
+	// and delete commands. Empty for commands without arguments.
+	Key []byte
+
+	// Request size in bytes including the value for storage commands.
+	RequestSize int
+
+	// Response size in bytes.
+	ResponseSize int
+
+	// Request handling duration from the moment the request became
+	// available for reading until the response has been sent to the client
+	// or buffered for sending together with responses for pipelined
+	// requests.
+	Duration time.Duration
+}
+
+// The maximum command line prefix saved for reporting slow requests.
+const maxSlowRequestLineSize = 1024
+
+// Counts bytes read from and written to the underlying connection.
+type countingConn struct {
+	net.Conn
+	bytesRead    int
+	bytesWritten int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesRead += n
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesWritten += n
+	return n, err
+}
+
+// Measures request handling duration for reporting slow requests.
+//
+// All the methods must be called from the goroutine serving the connection.
+type slowRequestTracker struct {
+	s    *Server
+	conn *countingConn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	line         []byte
+	startTime    time.Time
+	bytesRead    int
+	bytesWritten int
+}
+
+// Wraps conn for counting request and response sizes if slow requests
+// must be reported.
+//
+// Returns nil tracker if slow requests reporting is disabled.
+func newSlowRequestTracker(s *Server, conn net.Conn) (*slowRequestTracker, io.ReadWriter) {
+	if s.SlowRequestThreshold <= 0 || s.SlowRequestHandler == nil {
+		return nil, conn
+	}
+	cc := &countingConn{
+		Conn: conn,
+	}
+	return &slowRequestTracker{
+		s:    s,
+		conn: cc,
+	}, cc
+}
+
+// Waits for the next request and starts measuring its duration.
+//
+// Returns false if the next request cannot be read.
+func (t *slowRequestTracker) start() bool {
+	if _, err := t.r.Peek(1); err != nil {
+		return false
+	}
+	t.startTime = time.Now()
+	t.bytesRead = t.conn.bytesRead - t.r.Buffered()
+	t.bytesWritten = t.conn.bytesWritten + t.w.Buffered()
+
+	// Save the command line, since it is overwritten while processing
+	// the request.
+	buf, _ := t.r.Peek(t.r.Buffered())
+	if n := bytes.IndexByte(buf, '\n'); n >= 0 {
+		buf = buf[:n]
+	}
+	if len(buf) > maxSlowRequestLineSize {
+		buf = buf[:maxSlowRequestLineSize]
+	}
+	t.line = append(t.line[:0], buf...)
+	return true
+}
+
+// Reports the request if it has been handled for longer
+// than Server.SlowRequestThreshold.
+func (t *slowRequestTracker) finish() {
+	d := time.Since(t.startTime)
+	if d < t.s.SlowRequestThreshold {
+		return
+	}
+	atomic.AddUint64(&t.s.stats.SlowRequests, 1)
+	line := bytes.TrimRight(t.line, "\r")
+	var command string
+	var key []byte
+	if n := bytes.IndexByte(line, ' '); n >= 0 {
+		command = string(line[:n])
+		key = line[n+1:]
+		if n = bytes.IndexByte(key, ' '); n >= 0 {
+			key = key[:n]
+		}
+	} else {
+		command = string(line)
+	}
+	t.s.SlowRequestHandler(&SlowRequest{
+		ClientAddr:   t.conn.RemoteAddr(),
+		Command:      command,
+		Key:          key,
+		RequestSize:  t.conn.bytesRead - t.r.Buffered() - t.bytesRead,
+		ResponseSize: t.conn.bytesWritten + t.w.Buffered() - t.bytesWritten,
+		Duration:     d,
+	})
+}
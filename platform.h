@@ -30,6 +30,19 @@
   #define _GNU_SOURCE
 #endif
 
+#ifdef YBC_PLATFORM_WINDOWS
+  /*
+   * Condition variables are available only since Windows Vista.
+   * Enable C99-compatible printf() in MinGW, which supports %zu.
+   * These macros must be defined before any #include's.
+   */
+  #ifndef _WIN32_WINNT
+    #define _WIN32_WINNT 0x0600
+  #endif
+  #define __USE_MINGW_ANSI_STDIO 1
+  #define WIN32_LEAN_AND_MEAN
+#endif
+
 #include <stddef.h>     /* size_t */
 #include <stdint.h>     /* uint*_t */
 
@@ -169,14 +182,33 @@ static void p_file_create_anonymous(struct p_file *file);
 static int p_file_exists(const char *filename);
 
 /*
- * Creates a file with the given filename.
+ * Creates a file with the given filename and acquires exclusive lock on it.
+ *
+ * Returns 1 on success. Returns 0 if the file has been locked by somebody
+ * else in the meantime.
  */
-static void p_file_create(struct p_file *file, const char *filename);
+static int p_file_create(struct p_file *file, const char *filename);
 
 /*
- * Opens a file with the given filename.
+ * Creates a file with the given filename and acquires exclusive lock on it.
+ *
+ * Unlike p_file_create(), doesn't exit on errors.
+ *
+ * Returns 1 on success. Returns 0 on error or if the file has been locked
+ * by somebody else in the meantime.
  */
-static void p_file_open(struct p_file *file, const char *filename);
+static int p_file_try_create(struct p_file *file, const char *filename);
+
+/*
+ * Opens a file with the given filename and acquires exclusive lock on it.
+ *
+ * The lock prevents from opening the same file simultaneously
+ * by distinct processes or by distinct caches in the same process.
+ * It is automatically released when the file is closed.
+ *
+ * Returns 1 on success. Returns 0 if the file is already locked.
+ */
+static int p_file_open(struct p_file *file, const char *filename);
 
 /*
  * Closes the given file.
@@ -200,6 +232,15 @@ static void p_file_get_size(const struct p_file *file, size_t *size);
 static void p_file_resize_and_preallocate(const struct p_file *file,
     size_t size);
 
+/*
+ * The same as p_file_resize_and_preallocate(), but doesn't exit on errors
+ * such as lack of free space on the storage.
+ *
+ * Returns 1 on success, 0 on error.
+ */
+static int p_file_try_resize_and_preallocate(const struct p_file *file,
+    size_t size);
+
 /*
  * Hints the OS about random access pattern to the given file in the range
  * [0...size] bytes.
@@ -243,6 +284,8 @@ static void p_memory_sync(void *ptr, size_t size);
 
 #ifdef YBC_PLATFORM_LINUX
   #include "platform/linux.c"
+#elif defined(YBC_PLATFORM_WINDOWS)
+  #include "platform/windows.c"
 #else
   #error "unsupported platform"
 #endif
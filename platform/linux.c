@@ -26,6 +26,7 @@
 #include <stdio.h>      /* tmpfile, fileno, fclose */
 #include <stdlib.h>     /* malloc, free, EXIT_FAILURE */
 #include <string.h>     /* strdup */
+#include <sys/file.h>   /* flock */
 #include <sys/mman.h>   /* mmap, munmap, msync */
 #include <sys/stat.h>   /* open, fstat */
 #include <sys/types.h>  /* pthread_*_t, open, stat, lseek */
@@ -360,7 +361,33 @@ static int p_file_exists(const char *const filename)
   return 1;
 }
 
-static void p_file_create(struct p_file *const file, const char *const filename)
+/*
+ * Tries acquiring exclusive advisory lock on the given file.
+ *
+ * flock() locks are associated with open file descriptions, so they conflict
+ * even if the same file is opened twice by the same process.
+ *
+ * Returns 1 on success, 0 if the file is already locked.
+ */
+static int m_file_lock(const struct p_file *const file)
+{
+  for (;;) {
+    if (flock(file->fd, LOCK_EX | LOCK_NB) != -1) {
+      return 1;
+    }
+
+    if (errno == EWOULDBLOCK) {
+      return 0;
+    }
+
+    if (errno != EINTR) {
+      error(EXIT_FAILURE, errno, "flock(fd=%d, LOCK_EX | LOCK_NB)", file->fd);
+    }
+  }
+}
+
+static int m_file_create(struct p_file *const file,
+    const char *const filename, const int exit_on_error)
 {
   const int mode = S_IRUSR | S_IWUSR;
   int flags = O_CREAT | O_TRUNC | O_RDWR;
@@ -372,17 +399,42 @@ static void p_file_create(struct p_file *const file, const char *const filename)
   for (;;) {
     file->fd = open(filename, flags, mode);
     if (file->fd != -1) {
-      return;
+      break;
     }
 
     if (errno != EINTR) {
+      if (!exit_on_error) {
+        return 0;
+      }
       error(EXIT_FAILURE, errno, "open(mode=%d, flags=%d, file=[%s])",
           mode, flags, filename);
     }
   }
+
+  /*
+   * Somebody else may open and lock the file between open() and flock()
+   * calls above.
+   */
+  if (!m_file_lock(file)) {
+    p_file_close(file);
+    return 0;
+  }
+
+  return 1;
 }
 
-static void p_file_open(struct p_file *const file, const char *const filename)
+static int p_file_create(struct p_file *const file, const char *const filename)
+{
+  return m_file_create(file, filename, 1);
+}
+
+static int p_file_try_create(struct p_file *const file,
+    const char *const filename)
+{
+  return m_file_create(file, filename, 0);
+}
+
+static int p_file_open(struct p_file *const file, const char *const filename)
 {
   int flags = O_RDWR;
 
@@ -392,13 +444,20 @@ static void p_file_open(struct p_file *const file, const char *const filename)
   for (;;) {
     file->fd = open(filename, flags);
     if (file->fd != -1) {
-      return;
+      break;
     }
 
     if (errno != EINTR) {
       error(EXIT_FAILURE, errno, "open(flags=%d, file=[%s])", flags, filename);
     }
   }
+
+  if (!m_file_lock(file)) {
+    p_file_close(file);
+    return 0;
+  }
+
+  return 1;
 }
 
 static void p_file_close(const struct p_file *const file)
@@ -454,8 +513,8 @@ static void m_file_seek_zero(const struct p_file *const file) {
   }
 }
 
-static void p_file_resize_and_preallocate(const struct p_file *const file,
-    const size_t size)
+static int m_file_resize_and_preallocate(const struct p_file *const file,
+    const size_t size, const int exit_on_error)
 {
   /*
    * Do not use posix_fallocate(), since it cheats and doesn't really
@@ -475,9 +534,16 @@ static void p_file_resize_and_preallocate(const struct p_file *const file,
     if (remain < buf_size) {
       n = remain;
     }
-    const int rv = write(file->fd, buf, n);
-    if (rv == -1 && errno != EINTR) {
-      error(EXIT_FAILURE, rv, "write(fd=%d, size=%zu)", file->fd, n);
+    const ssize_t rv = write(file->fd, buf, n);
+    if (rv == -1) {
+      if (errno == EINTR) {
+        continue;
+      }
+      if (!exit_on_error) {
+        p_free(buf);
+        return 0;
+      }
+      error(EXIT_FAILURE, errno, "write(fd=%d, size=%zu)", file->fd, n);
     }
     assert((size_t)rv <= n);
     remain -= rv;
@@ -486,6 +552,19 @@ static void p_file_resize_and_preallocate(const struct p_file *const file,
   p_free(buf);
 
   m_file_seek_zero(file);
+  return 1;
+}
+
+static void p_file_resize_and_preallocate(const struct p_file *const file,
+    const size_t size)
+{
+  (void)m_file_resize_and_preallocate(file, size, 1);
+}
+
+static int p_file_try_resize_and_preallocate(const struct p_file *const file,
+    const size_t size)
+{
+  return m_file_resize_and_preallocate(file, size, 0);
 }
 
 static void p_file_advise_random_access(const struct p_file *const file,
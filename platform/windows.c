@@ -0,0 +1,539 @@
+/*******************************************************************************
+ * Platform-specific functions' implementation for Windows.
+ *
+ * Naming conventions:
+ * - platform-specific functions and structures must start with p_
+ * - private functions and structures must start with m_
+ * - private macros and constants must start with M_
+ *
+ * Coding rules:
+ * - all (including platform-specific) function must be declared as static.
+ * - All variables, which are expected to be immutable in the given code block,
+ *   MUST be declared as constants! This provides the following benefits:
+ *   + It prevents from accidental modification of the given variable.
+ *   + It may help dumb compilers with 'constant propagation' optimizations.
+ *
+ * Requires Windows Vista or newer due to condition variables' usage.
+ ******************************************************************************/
+
+#include <assert.h>     /* assert */
+#include <stdarg.h>     /* va_list, va_start, va_end */
+#include <stddef.h>     /* size_t */
+#include <stdint.h>     /* uint*_t */
+#include <stdio.h>      /* fprintf, vfprintf, stderr */
+#include <stdlib.h>     /* malloc, free, exit, EXIT_FAILURE */
+#include <string.h>     /* strlen, memcpy */
+#include <windows.h>    /* Win32 API */
+
+
+/*
+ * Prints the given message followed by the given Win32 error code
+ * to stderr and terminates the process.
+ *
+ * This is a counterpart of error(EXIT_FAILURE, ...) used in linux.c.
+ */
+static void m_fatal(const DWORD err, const char *const format, ...)
+{
+  va_list ap;
+
+  fflush(stdout);
+  fprintf(stderr, "ybc: ");
+  va_start(ap, format);
+  vfprintf(stderr, format, ap);
+  va_end(ap);
+  fprintf(stderr, ": error=%lu\n", (unsigned long)err);
+  exit(EXIT_FAILURE);
+}
+
+static void *p_malloc(const size_t size)
+{
+  void *const ptr = malloc(size);
+  if (ptr == NULL) {
+    m_fatal(ERROR_NOT_ENOUGH_MEMORY, "malloc(size=%zu)", size);
+  }
+  return ptr;
+}
+
+static void p_free(void *const ptr)
+{
+  free(ptr);
+}
+
+static void p_strdup(char **const dst, const char *const src)
+{
+  free(*dst);
+
+  if (src == NULL) {
+    *dst = NULL;
+    return;
+  }
+
+  const size_t size = strlen(src) + 1;
+  *dst = p_malloc(size);
+  memcpy(*dst, src, size);
+}
+
+/*
+ * The number of 100-nanosecond intervals between the Windows epoch
+ * (January 1, 1601) and the Unix epoch (January 1, 1970).
+ */
+#define M_EPOCH_DELTA ((uint64_t)116444736 * 1000 * 1000 * 1000)
+
+static uint64_t p_get_current_time(void)
+{
+  FILETIME ft;
+
+  /*
+   * Use wall clock time instead of GetTickCount64() for the same reason
+   * as in linux.c: cache persistence requires expiration times, which are
+   * consistent between system reboots and distinct systems.
+   */
+  GetSystemTimeAsFileTime(&ft);
+
+  const uint64_t t = (((uint64_t)ft.dwHighDateTime) << 32) | ft.dwLowDateTime;
+  assert(t >= M_EPOCH_DELTA);
+  return (t - M_EPOCH_DELTA) / (10 * 1000);
+}
+
+static void p_sleep(const uint64_t milliseconds)
+{
+  uint64_t remain = milliseconds;
+
+  /*
+   * Sleep() accepts DWORD, while INFINITE must be avoided,
+   * so sleep in chunks.
+   */
+  while (remain > INFINITE - 1) {
+    Sleep(INFINITE - 1);
+    remain -= INFINITE - 1;
+  }
+  Sleep((DWORD)remain);
+}
+
+struct p_thread
+{
+  HANDLE t;
+  p_thread_func func;
+  void *ctx;
+};
+
+static DWORD WINAPI m_thread_main_func(LPVOID ctx)
+{
+  struct p_thread *const t = ctx;
+
+  t->func(t->ctx);
+
+  return 0;
+}
+
+static void p_thread_init_and_start(struct p_thread *const t,
+    const p_thread_func func, void *const ctx)
+{
+  t->func = func;
+  t->ctx = ctx;
+
+  t->t = CreateThread(NULL, 0, m_thread_main_func, t, 0, NULL);
+  if (t->t == NULL) {
+    m_fatal(GetLastError(), "CreateThread()");
+  }
+}
+
+static void p_thread_join_and_destroy(struct p_thread *const t)
+{
+  const DWORD rv = WaitForSingleObject(t->t, INFINITE);
+  if (rv != WAIT_OBJECT_0) {
+    m_fatal(GetLastError(), "WaitForSingleObject(thread)");
+  }
+
+  if (!CloseHandle(t->t)) {
+    m_fatal(GetLastError(), "CloseHandle(thread)");
+  }
+}
+
+struct p_lock
+{
+  CRITICAL_SECTION cs;
+};
+
+static void p_lock_init(struct p_lock *const lock)
+{
+  InitializeCriticalSection(&lock->cs);
+}
+
+static void p_lock_destroy(struct p_lock *const lock)
+{
+  DeleteCriticalSection(&lock->cs);
+}
+
+static void p_lock_lock(struct p_lock *const lock)
+{
+  EnterCriticalSection(&lock->cs);
+}
+
+static void p_lock_unlock(struct p_lock *const lock)
+{
+  LeaveCriticalSection(&lock->cs);
+}
+
+struct p_event
+{
+  CONDITION_VARIABLE cond;
+  CRITICAL_SECTION cs;
+  int is_set;
+};
+
+static void p_event_init(struct p_event *const e)
+{
+  InitializeConditionVariable(&e->cond);
+  InitializeCriticalSection(&e->cs);
+  e->is_set = 0;
+}
+
+static void p_event_destroy(struct p_event *const e)
+{
+  /*
+   * Condition variables don't need to be destroyed on Windows.
+   */
+  DeleteCriticalSection(&e->cs);
+}
+
+static void p_event_set(struct p_event *const e)
+{
+  EnterCriticalSection(&e->cs);
+  e->is_set = 1;
+  WakeAllConditionVariable(&e->cond);
+  LeaveCriticalSection(&e->cs);
+}
+
+static int p_event_wait_with_timeout(struct p_event *const e,
+    const uint64_t timeout)
+{
+  int is_set;
+
+  EnterCriticalSection(&e->cs);
+
+  if (!e->is_set) {
+    const DWORD t = (timeout < INFINITE) ? (DWORD)timeout : (INFINITE - 1);
+    if (!SleepConditionVariableCS(&e->cond, &e->cs, t)) {
+      const DWORD err = GetLastError();
+      if (err != ERROR_TIMEOUT) {
+        m_fatal(err, "SleepConditionVariableCS(timeout=%lu)",
+            (unsigned long)t);
+      }
+    }
+  }
+  is_set = e->is_set;
+
+  LeaveCriticalSection(&e->cs);
+
+  return is_set;
+}
+
+/*
+ * All the files are opened without sharing, so only a single handle
+ * to the given file may exist at any time. This provides the same semantics
+ * as exclusive file locking - attempts to open a cache file, which is already
+ * opened by somebody else, fail with ERROR_SHARING_VIOLATION.
+ */
+struct p_file
+{
+  HANDLE h;
+};
+
+/*
+ * Returns 0 if the file is already opened by somebody else, otherwise
+ * returns 1.
+ */
+static int m_file_create_or_open(struct p_file *const file,
+    const char *const filename, const DWORD disposition, const DWORD flags)
+{
+  file->h = CreateFileA(filename, GENERIC_READ | GENERIC_WRITE, 0, NULL,
+      disposition, flags, NULL);
+  if (file->h == INVALID_HANDLE_VALUE) {
+    const DWORD err = GetLastError();
+    if (err == ERROR_SHARING_VIOLATION) {
+      return 0;
+    }
+    m_fatal(err, "CreateFileA(disposition=%lu, flags=%lu, file=[%s])",
+        (unsigned long)disposition, (unsigned long)flags, filename);
+  }
+  return 1;
+}
+
+static void p_file_create_anonymous(struct p_file *const file)
+{
+  char dir[MAX_PATH + 1];
+  char filename[MAX_PATH + 1];
+
+  const DWORD n = GetTempPathA(sizeof(dir), dir);
+  if (n == 0 || n > sizeof(dir)) {
+    m_fatal(GetLastError(), "GetTempPathA()");
+  }
+
+  if (GetTempFileNameA(dir, "ybc", 0, filename) == 0) {
+    m_fatal(GetLastError(), "GetTempFileNameA(dir=[%s])", dir);
+  }
+
+  /*
+   * The file is automatically deleted after its' last handle is closed.
+   * FILE_ATTRIBUTE_TEMPORARY hints the OS to avoid flushing the file
+   * to storage device if enough RAM is available.
+   */
+  if (!m_file_create_or_open(file, filename, CREATE_ALWAYS,
+      FILE_ATTRIBUTE_TEMPORARY | FILE_FLAG_DELETE_ON_CLOSE)) {
+    m_fatal(ERROR_SHARING_VIOLATION, "CreateFileA(file=[%s])", filename);
+  }
+}
+
+static int p_file_exists(const char *const filename)
+{
+  if (GetFileAttributesA(filename) == INVALID_FILE_ATTRIBUTES) {
+    const DWORD err = GetLastError();
+    if (err != ERROR_FILE_NOT_FOUND && err != ERROR_PATH_NOT_FOUND) {
+      m_fatal(err, "GetFileAttributesA(file=[%s])", filename);
+    }
+    return 0;
+  }
+
+  return 1;
+}
+
+static int p_file_create(struct p_file *const file, const char *const filename)
+{
+  /* CREATE_NEW fails if the file already exists. */
+  return m_file_create_or_open(file, filename, CREATE_NEW,
+      FILE_ATTRIBUTE_NORMAL);
+}
+
+static int p_file_try_create(struct p_file *const file,
+    const char *const filename)
+{
+  /* CREATE_NEW fails if the file already exists. */
+  file->h = CreateFileA(filename, GENERIC_READ | GENERIC_WRITE, 0, NULL,
+      CREATE_NEW, FILE_ATTRIBUTE_NORMAL, NULL);
+  return file->h != INVALID_HANDLE_VALUE;
+}
+
+static int p_file_open(struct p_file *const file, const char *const filename)
+{
+  return m_file_create_or_open(file, filename, OPEN_EXISTING,
+      FILE_ATTRIBUTE_NORMAL);
+}
+
+static void p_file_close(const struct p_file *const file)
+{
+  /*
+   * Do not use FlushFileBuffers() before closing the file for the same
+   * reason as in linux.c - it may be extremely slow.
+   */
+  if (!CloseHandle(file->h)) {
+    m_fatal(GetLastError(), "CloseHandle(file)");
+  }
+}
+
+static void p_file_remove(const char *const filename)
+{
+  if (!DeleteFileA(filename)) {
+    m_fatal(GetLastError(), "DeleteFileA(file=[%s])", filename);
+  }
+}
+
+static void p_file_get_size(const struct p_file *const file, size_t *const size)
+{
+  LARGE_INTEGER n;
+
+  if (!GetFileSizeEx(file->h, &n)) {
+    m_fatal(GetLastError(), "GetFileSizeEx()");
+  }
+
+  assert(n.QuadPart >= 0);
+  if ((uint64_t)n.QuadPart > SIZE_MAX) {
+    m_fatal(ERROR_FILE_TOO_LARGE, "GetFileSizeEx(size=%llu)",
+        (unsigned long long)n.QuadPart);
+  }
+
+  *size = (size_t)n.QuadPart;
+}
+
+static void m_file_seek_zero(const struct p_file *const file) {
+  LARGE_INTEGER off;
+
+  off.QuadPart = 0;
+  if (!SetFilePointerEx(file->h, off, NULL, FILE_BEGIN)) {
+    m_fatal(GetLastError(), "SetFilePointerEx(0)");
+  }
+}
+
+static int m_file_resize_and_preallocate(const struct p_file *const file,
+    const size_t size, const int exit_on_error)
+{
+  /*
+   * Just fill the file with garbage like linux.c does, since SetEndOfFile()
+   * alone may leave unallocated gaps in the file on certain filesystems.
+   */
+
+  m_file_seek_zero(file);
+
+  const size_t buf_size = 1024 * 1024;
+  char *const buf = p_malloc(buf_size);
+
+  size_t remain = size;
+  while (remain) {
+    DWORD n = buf_size;
+    if (remain < buf_size) {
+      n = (DWORD)remain;
+    }
+    DWORD written;
+    if (!WriteFile(file->h, buf, n, &written, NULL)) {
+      if (!exit_on_error) {
+        p_free(buf);
+        return 0;
+      }
+      m_fatal(GetLastError(), "WriteFile(size=%lu)", (unsigned long)n);
+    }
+    assert(written <= n);
+    remain -= written;
+  }
+
+  p_free(buf);
+
+  /* Truncate the file if it was bigger than the requested size. */
+  if (!SetEndOfFile(file->h)) {
+    if (!exit_on_error) {
+      return 0;
+    }
+    m_fatal(GetLastError(), "SetEndOfFile(size=%zu)", size);
+  }
+
+  m_file_seek_zero(file);
+  return 1;
+}
+
+static void p_file_resize_and_preallocate(const struct p_file *const file,
+    const size_t size)
+{
+  (void)m_file_resize_and_preallocate(file, size, 1);
+}
+
+static int p_file_try_resize_and_preallocate(const struct p_file *const file,
+    const size_t size)
+{
+  return m_file_resize_and_preallocate(file, size, 0);
+}
+
+static void p_file_advise_random_access(const struct p_file *const file,
+    const size_t size)
+{
+  /*
+   * Windows has no counterpart for posix_fadvise() on already opened files.
+   * FILE_FLAG_RANDOM_ACCESS may be passed only to CreateFile(), while it
+   * is ignored for memory mapped files anyway.
+   */
+  (void)file;
+  (void)size;
+}
+
+static void p_file_cache_in_ram(const struct p_file *const file)
+{
+  m_file_seek_zero(file);
+
+  const size_t buf_size = 1024 * 1024;
+  char *const buf = p_malloc(buf_size);
+
+  for (;;) {
+    DWORD n;
+    if (!ReadFile(file->h, buf, (DWORD)buf_size, &n, NULL)) {
+      m_fatal(GetLastError(), "ReadFile(size=%zu)", buf_size);
+    }
+    if (n == 0) {
+      /* end of file */
+      break;
+    }
+  }
+
+  p_free(buf);
+
+  m_file_seek_zero(file);
+}
+
+/*
+ * The page mask is determined at runtime. See p_memory_init().
+ */
+static size_t m_memory_page_mask = 0;
+
+static size_t p_memory_page_mask(void) {
+  return m_memory_page_mask;
+}
+
+static void p_memory_init(void)
+{
+  if (m_memory_page_mask == 0) {
+    SYSTEM_INFO si;
+
+    GetSystemInfo(&si);
+    const size_t page_size = si.dwPageSize;
+    assert(page_size > 0);
+
+    /*
+     * Make sure that the page size is a power of 2.
+     */
+    if ((page_size & (page_size - 1)) != 0) {
+      m_fatal(0, "Unexpected page size=%zu", page_size);
+    }
+
+    m_memory_page_mask = page_size - 1;
+  }
+  else {
+    assert((m_memory_page_mask & (m_memory_page_mask + 1)) == 0);
+  }
+}
+
+static void p_memory_map(void **const ptr, const struct p_file *const file,
+    const size_t size)
+{
+  const uint64_t size64 = size;
+  const HANDLE mapping = CreateFileMappingA(file->h, NULL, PAGE_READWRITE,
+      (DWORD)(size64 >> 32), (DWORD)(size64 & 0xffffffff), NULL);
+  if (mapping == NULL) {
+    m_fatal(GetLastError(), "CreateFileMappingA(size=%zu)", size);
+  }
+
+  *ptr = MapViewOfFile(mapping, FILE_MAP_WRITE, 0, 0, size);
+  const DWORD err = GetLastError();
+
+  /*
+   * The mapped view holds a reference to the mapping object, so the mapping
+   * handle may be closed right now. The view remains valid until
+   * p_memory_unmap() call.
+   */
+  if (!CloseHandle(mapping)) {
+    m_fatal(GetLastError(), "CloseHandle(mapping)");
+  }
+
+  if (*ptr == NULL) {
+    m_fatal(err, "MapViewOfFile(size=%zu)", size);
+  }
+
+  assert((uintptr_t)size <= UINTPTR_MAX - (uintptr_t)*ptr);
+}
+
+static void p_memory_unmap(void *const ptr, const size_t size)
+{
+  if (!UnmapViewOfFile(ptr)) {
+    m_fatal(GetLastError(), "UnmapViewOfFile(ptr=%p, size=%zu)", ptr, size);
+  }
+}
+
+static void p_memory_sync(void *const ptr, const size_t size)
+{
+  assert(m_memory_page_mask != 0);
+  assert((m_memory_page_mask & (m_memory_page_mask + 1)) == 0);
+
+  /*
+   * FlushViewOfFile() rounds ptr down to the page boundary itself,
+   * so there is no need in adjusting it like linux.c does for msync().
+   */
+  if (!FlushViewOfFile(ptr, size)) {
+    m_fatal(GetLastError(), "FlushViewOfFile(ptr=%p, size=%zu)", ptr, size);
+  }
+}
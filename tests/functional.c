@@ -78,6 +78,45 @@ static void test_persistent_cache_create(struct ybc *const cache)
   ybc_config_destroy(config);
 }
 
+static void test_persistent_cache_double_open(struct ybc *const cache)
+{
+  char config_buf[ybc_config_get_size()];
+  struct ybc_config *const config = (struct ybc_config *)config_buf;
+  char another_cache_buf[ybc_get_size()];
+  struct ybc *const another_cache = (struct ybc *)another_cache_buf;
+
+  ybc_config_init(config);
+
+  ybc_config_set_index_file(config, "./tmp_cache.index");
+  ybc_config_set_data_file(config, "./tmp_cache.data");
+  ybc_config_set_max_items_count(config, 1000);
+  ybc_config_set_data_file_size(config, 1024 * 1024);
+
+  if (!ybc_open(cache, config, 1)) {
+    M_ERROR("cannot create persistent cache");
+  }
+
+  /* Cache files are locked, so the second open must fail. */
+  if (ybc_open(another_cache, config, 0)) {
+    M_ERROR("already opened persistent cache shouldn't be opened again");
+  }
+  if (ybc_open(another_cache, config, 1)) {
+    M_ERROR("already opened persistent cache shouldn't be opened again "
+        "with force");
+  }
+  ybc_close(cache);
+
+  /* The lock must be released after closing the cache. */
+  if (!ybc_open(another_cache, config, 0)) {
+    M_ERROR("cannot open closed persistent cache");
+  }
+  ybc_close(another_cache);
+
+  ybc_remove(config);
+
+  ybc_config_destroy(config);
+}
+
 static void expect_value(struct ybc_item *const item,
     const struct ybc_value *const expected_value)
 {
@@ -116,6 +155,30 @@ static void expect_item_hit(struct ybc *const cache,
   ybc_item_release(item);
 }
 
+static void expect_item_info(struct ybc *const cache,
+    const struct ybc_key *const key,
+    const struct ybc_value *const expected_value)
+{
+  struct ybc_value actual_value;
+
+  if (!ybc_item_get_info(cache, key, &actual_value)) {
+    M_ERROR("cannot find expected item info");
+  }
+  assert(actual_value.ptr == NULL);
+  assert(actual_value.size == expected_value->size);
+  assert(actual_value.ttl <= expected_value->ttl);
+}
+
+static void expect_item_info_miss(struct ybc *const cache,
+    const struct ybc_key *const key)
+{
+  struct ybc_value value;
+
+  if (ybc_item_get_info(cache, key, &value)) {
+    M_ERROR("unexpected item info found");
+  }
+}
+
 static void expect_item_set(struct ybc *const cache,
     const struct ybc_key *const key, const struct ybc_value *const value)
 {
@@ -329,6 +392,7 @@ static void test_item_ops(struct ybc *const cache,
     key.size = sizeof(i);
 
     expect_item_miss(cache, &key);
+    expect_item_info_miss(cache, &key);
   }
 
   for (size_t i = 0; i < iterations_count; ++i) {
@@ -339,7 +403,9 @@ static void test_item_ops(struct ybc *const cache,
 
     expect_item_set_no_acquire(cache, &key, &value);
     expect_item_set(cache, &key, &value);
+    expect_item_info(cache, &key, &value);
     expect_item_remove(cache, &key);
+    expect_item_info_miss(cache, &key);
   }
 
   for (size_t i = 0; i < iterations_count; ++i) {
@@ -347,6 +413,7 @@ static void test_item_ops(struct ybc *const cache,
     key.size = sizeof(i);
 
     expect_item_miss(cache, &key);
+    expect_item_info_miss(cache, &key);
   }
 
   ybc_close(cache);
@@ -375,6 +442,293 @@ static void test_expiration(struct ybc *const cache)
   ybc_close(cache);
 }
 
+static void test_remove_expired_items(struct ybc *const cache)
+{
+  m_open_anonymous(cache);
+
+  struct ybc_key key;
+  struct ybc_value value;
+
+  /* Add items with short ttl. */
+  value.ttl = 200;
+  for (size_t i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    value.ptr = &i;
+    value.size = sizeof(i);
+    expect_item_set(cache, &key, &value);
+  }
+
+  const struct ybc_key live_key = {
+      .ptr = "aaa",
+      .size = 3,
+  };
+  const struct ybc_value live_value = {
+      .ptr = "1234",
+      .size = 4,
+      .ttl = YBC_MAX_TTL,
+  };
+  expect_item_set(cache, &live_key, &live_value);
+
+  size_t start_slot = 0;
+  size_t removed_items_count = 0;
+  size_t removed_bytes = 0;
+
+  /*
+   * Anonymous index file is filled with garbage, so the first scan
+   * may remove broken slots.
+   */
+  while (!ybc_remove_expired_items(cache, &start_slot, 10, &removed_items_count,
+      &removed_bytes)) {
+    assert(start_slot != 0);
+  }
+  assert(start_slot == 0);
+
+  /* Nothing should be removed before the expiration. */
+  removed_items_count = 0;
+  removed_bytes = 0;
+  while (!ybc_remove_expired_items(cache, &start_slot, 10, &removed_items_count,
+      &removed_bytes)) {
+  }
+  assert(removed_items_count == 0);
+  assert(removed_bytes == 0);
+
+  p_sleep(300);
+
+  /* Counting mustn't remove expired items. */
+  for (int i = 0; i < 2; ++i) {
+    size_t expired_items_count = 0;
+    size_t expired_bytes = 0;
+    while (!ybc_count_expired_items(cache, &start_slot, 10,
+        &expired_items_count, &expired_bytes)) {
+    }
+    assert(expired_items_count == 100);
+    assert(expired_bytes > 0);
+  }
+
+  while (!ybc_remove_expired_items(cache, &start_slot, 10, &removed_items_count,
+      &removed_bytes)) {
+  }
+  assert(removed_items_count == 100);
+  assert(removed_bytes > 0);
+
+  /* The live item must survive. */
+  expect_item_hit(cache, &live_key, &live_value);
+
+  ybc_close(cache);
+}
+
+static void test_lazy_index_load(struct ybc *const cache)
+{
+  char config_buf[ybc_config_get_size()];
+  struct ybc_config *const config = (struct ybc_config *)config_buf;
+
+  ybc_config_init(config);
+
+  ybc_config_set_index_file(config, "./tmp_cache.index");
+  ybc_config_set_data_file(config, "./tmp_cache.data");
+  ybc_config_set_max_items_count(config, 1000);
+  ybc_config_set_data_file_size(config, 1024 * 1024);
+  ybc_config_enable_lazy_index_load(config);
+
+  /* Newly created index must be loaded. */
+  if (!ybc_open(cache, config, 1)) {
+    M_ERROR("cannot create persistent cache");
+  }
+  assert(ybc_get_index_load_percent(cache) == 100);
+
+  struct ybc_key key;
+  struct ybc_value value;
+
+  value.ttl = YBC_MAX_TTL;
+  for (size_t i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    value.ptr = &i;
+    value.size = sizeof(i);
+    expect_item_set(cache, &key, &value);
+  }
+  ybc_close(cache);
+
+  if (!ybc_open(cache, config, 0)) {
+    M_ERROR("cannot open existing persistent cache");
+  }
+  assert(ybc_get_index_load_percent(cache) == 0);
+
+  /* Items must be missing until the index is loaded. */
+  for (size_t i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    expect_item_miss(cache, &key);
+  }
+
+  int prev_percent = 0;
+  while (!ybc_load_index(cache, 10)) {
+    const int percent = ybc_get_index_load_percent(cache);
+    assert(percent >= prev_percent);
+    assert(percent < 100);
+    prev_percent = percent;
+  }
+  assert(ybc_get_index_load_percent(cache) == 100);
+
+  for (size_t i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    value.ptr = &i;
+    value.size = sizeof(i);
+    expect_item_hit(cache, &key, &value);
+  }
+  ybc_close(cache);
+
+  ybc_remove(config);
+  ybc_config_destroy(config);
+}
+
+static void test_item_iteration(struct ybc *const cache)
+{
+  m_open_anonymous(cache);
+
+  struct ybc_key key;
+  struct ybc_value value;
+  const size_t items_count = 100;
+  int visited[items_count];
+
+  value.ttl = YBC_MAX_TTL;
+  for (size_t i = 0; i < items_count; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    value.ptr = &i;
+    value.size = sizeof(i);
+    expect_item_set(cache, &key, &value);
+    visited[i] = 0;
+  }
+
+  /* Removed items mustn't be visited. */
+  size_t removed_i = 42;
+  key.ptr = &removed_i;
+  key.size = sizeof(removed_i);
+  expect_item_remove(cache, &key);
+
+  char item_buf[ybc_item_get_size()];
+  struct ybc_item *const item = (struct ybc_item *)item_buf;
+  size_t slot_index = 0;
+  size_t visited_count = 0;
+  while (ybc_item_get_next(cache, &slot_index, item, &key)) {
+    size_t i;
+    assert(key.size == sizeof(i));
+    memcpy(&i, key.ptr, sizeof(i));
+    assert(i < items_count);
+    assert(i != removed_i);
+    assert(!visited[i]);
+    visited[i] = 1;
+
+    ybc_item_get_value(item, &value);
+    assert(value.size == sizeof(i));
+    assert(memcmp(value.ptr, &i, sizeof(i)) == 0);
+    ybc_item_release(item);
+    ++visited_count;
+  }
+  assert(visited_count == items_count - 1);
+
+  /* Cleared items mustn't be visited. */
+  ybc_clear(cache);
+  slot_index = 0;
+  assert(!ybc_item_get_next(cache, &slot_index, item, &key));
+
+  ybc_close(cache);
+}
+
+static void m_compact_all(struct ybc *const cache, const size_t tail_size,
+    struct ybc_compaction_stats *const stats)
+{
+  size_t start_slot = 0;
+
+  memset(stats, 0, sizeof(*stats));
+  while (!ybc_compact(cache, &start_slot, 10, tail_size, stats)) {
+    assert(start_slot != 0);
+  }
+  assert(start_slot == 0);
+}
+
+static void test_compaction(struct ybc *const cache)
+{
+  char config_buf[ybc_config_get_size()];
+  struct ybc_config *const config = (struct ybc_config *)config_buf;
+  const size_t data_file_size = 128 * 1024;
+
+  ybc_config_init(config);
+
+  ybc_config_set_max_items_count(config, 1000);
+  ybc_config_set_data_file_size(config, data_file_size);
+  ybc_config_set_hot_data_size(config, 0);
+
+  if (!ybc_open(cache, config, 1)) {
+    M_ERROR("cannot create anonymous cache");
+  }
+
+  ybc_config_destroy(config);
+
+  assert(ybc_get_data_file_size(cache) == data_file_size);
+
+  struct ybc_key key;
+  struct ybc_value value;
+  const size_t items_count = 100;
+  char buf[100];
+
+  memset(buf, 'x', sizeof(buf));
+  value.ptr = buf;
+  value.size = sizeof(buf);
+  for (size_t i = 0; i < items_count; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    /* Odd items expire soon. */
+    value.ttl = (i % 2) ? 200 : YBC_MAX_TTL;
+    expect_item_set(cache, &key, &value);
+  }
+
+  struct ybc_compaction_stats stats;
+
+  /*
+   * Anonymous index file is filled with garbage, so the first scan
+   * may remove broken slots.
+   */
+  m_compact_all(cache, 0, &stats);
+  assert(stats.moved_items_count == 0);
+
+  /* Nothing should be moved if the items are far from the tail. */
+  m_compact_all(cache, data_file_size / 2, &stats);
+  assert(stats.removed_items_count == 0);
+  assert(stats.moved_items_count == 0);
+
+  /* All the live items are moved if the tail covers the whole storage. */
+  m_compact_all(cache, data_file_size, &stats);
+  assert(stats.removed_items_count == 0);
+  assert(stats.moved_items_count >= items_count);
+  assert(stats.moved_bytes > items_count * sizeof(buf));
+
+  p_sleep(300);
+
+  m_compact_all(cache, 0, &stats);
+  assert(stats.removed_items_count == items_count / 2);
+  assert(stats.removed_bytes > items_count / 2 * sizeof(buf));
+  assert(stats.moved_items_count == 0);
+
+  /* Live items must survive the compaction. */
+  value.ttl = YBC_MAX_TTL;
+  for (size_t i = 0; i < items_count; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    if (i % 2) {
+      expect_item_miss(cache, &key);
+    }
+    else {
+      expect_item_hit(cache, &key, &value);
+    }
+  }
+
+  ybc_close(cache);
+}
+
 static void test_dogpile_effect_ops(struct ybc *const cache)
 {
   m_open_anonymous(cache);
@@ -943,6 +1297,72 @@ static void test_broken_index_handling(struct ybc *const cache)
   ybc_config_destroy(config);
 }
 
+static void test_snapshot(struct ybc *const cache)
+{
+  char config_buf[ybc_config_get_size()];
+  struct ybc_config *const config = (struct ybc_config *)config_buf;
+
+  ybc_config_init(config);
+
+  ybc_config_set_max_items_count(config, 1000);
+  ybc_config_set_data_file_size(config, 64 * 1024);
+
+  /* Snapshots may be taken from anonymous caches too. */
+  if (!ybc_open(cache, config, 1)) {
+    M_ERROR("cannot create anonymous cache");
+  }
+
+  struct ybc_key key;
+  const struct ybc_value value = {
+      .ptr = "foobar",
+      .size = 6,
+      .ttl = YBC_MAX_TTL,
+  };
+
+  for (size_t i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    expect_item_set(cache, &key, &value);
+  }
+
+  if (!ybc_snapshot(cache, "./tmp_snapshot.index", "./tmp_snapshot.data")) {
+    M_ERROR("cannot take cache snapshot");
+  }
+
+  /* Existing files mustn't be overwritten. */
+  if (ybc_snapshot(cache, "./tmp_snapshot.index", "./tmp_snapshot.data")) {
+    M_ERROR("cache snapshot shouldn't overwrite existing files");
+  }
+
+  /* Items added after the snapshot mustn't be visible in the snapshot. */
+  size_t i = 100;
+  key.ptr = &i;
+  key.size = sizeof(i);
+  expect_item_set(cache, &key, &value);
+
+  ybc_close(cache);
+
+  ybc_config_set_index_file(config, "./tmp_snapshot.index");
+  ybc_config_set_data_file(config, "./tmp_snapshot.data");
+
+  if (!ybc_open(cache, config, 0)) {
+    M_ERROR("cannot open cache snapshot");
+  }
+
+  for (i = 0; i < 100; ++i) {
+    key.ptr = &i;
+    key.size = sizeof(i);
+    expect_item_hit(cache, &key, &value);
+  }
+  expect_item_miss(cache, &key);
+
+  ybc_close(cache);
+
+  ybc_remove(config);
+
+  ybc_config_destroy(config);
+}
+
 static void provoke_data_wrapping(struct ybc *const cache)
 {
   const size_t value_buf_size = 13 * 3457;
@@ -1352,10 +1772,15 @@ int main(void)
 
   test_anonymous_cache_create(cache);
   test_persistent_cache_create(cache);
+  test_persistent_cache_double_open(cache);
 
   test_set_txn_ops(cache);
   test_item_ops(cache, 1000);
   test_expiration(cache);
+  test_remove_expired_items(cache);
+  test_lazy_index_load(cache);
+  test_item_iteration(cache);
+  test_compaction(cache);
   test_dogpile_effect_ops_async(cache);
   test_dogpile_effect_ops(cache);
   test_dogpile_effect_hashtable(cache);
@@ -1367,6 +1792,7 @@ int main(void)
   test_instant_clear(cache);
   test_persistent_survival(cache);
   test_broken_index_handling(cache);
+  test_snapshot(cache);
   test_large_cache(cache);
   test_overwrite_protection(cache);
   test_out_of_memory(cache);
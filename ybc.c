@@ -87,7 +87,8 @@ static void m_file_remove_if_exists(const char *const filename)
  * If filename is NULL and force is set, then creates an anonymous file,
  * which will be automatically deleted after the file is closed.
  *
- * Returns non-zero on success, zero on failre.
+ * Returns non-zero on success, zero on failre. Fails if the file is already
+ * opened by somebody else, since the file is exclusively locked while opened.
  * Sets is_file_created to 1 if new file has been created (including
  * anonymous file).
  */
@@ -124,11 +125,14 @@ static int m_file_open_or_create(struct p_file *const file,
       return 0;
     }
 
-    p_file_create(file, filename);
+    if (!p_file_create(file, filename)) {
+      return 0;
+    }
     *is_file_created = 1;
   }
-  else {
-    p_file_open(file, filename);
+  else if (!p_file_open(file, filename)) {
+    /* The file is already opened by somebody else. */
+    return 0;
   }
 
   p_file_get_size(file, &actual_file_size);
@@ -1257,6 +1261,15 @@ struct m_index
    */
   struct m_map map_cache;
 
+  /*
+   * The number of loaded slots at the beginning of the map.
+   *
+   * Slots beyond this number aren't loaded yet, so lookups for them
+   * always fail. It equals to map.slots_count unless the index is loaded
+   * lazily. See ybc_config_enable_lazy_index_load().
+   */
+  size_t loaded_slots_count;
+
   /*
    * A pointer to hash seed.
    *
@@ -1286,8 +1299,8 @@ static size_t m_index_get_file_size(const size_t slots_count)
 static int m_index_open(struct m_index *const index,
     struct p_file *const index_file,
     const size_t map_slots_count, const size_t map_cache_slots_count,
-    const char *const filename, const int force, int *const is_file_created,
-    struct m_storage_cursor **const next_cursor)
+    const char *const filename, const int force, const int is_lazy_load,
+    int *const is_file_created, struct m_storage_cursor **const next_cursor)
 {
   void *ptr;
 
@@ -1298,6 +1311,12 @@ static int m_index_open(struct m_index *const index,
     return 0;
   }
 
+  /*
+   * Newly created index file is already in RAM, so there is no sense
+   * in loading it lazily.
+   */
+  const int is_loaded = !is_lazy_load || *is_file_created;
+
   /*
    * Cache index file contents in RAM in order to minimize random I/O during
    * cache warm-up.
@@ -1309,8 +1328,12 @@ static int m_index_open(struct m_index *const index,
    * achieving low fragmentation by pre-allocating file contents
    * at creation time.
    * See m_file_open_or_create() for details.
+   *
+   * Lazily loaded index is cached in RAM by ybc_load_index() calls.
    */
-  p_file_cache_in_ram(index_file);
+  if (is_loaded) {
+    p_file_cache_in_ram(index_file);
+  }
 
   /*
    * Hint the OS about random access pattern to index file contents.
@@ -1331,6 +1354,7 @@ static int m_index_open(struct m_index *const index,
   struct m_storage_payload *const payloads = (struct m_storage_payload *)
       (key_digests + map_slots_count);
   m_map_init(&index->map, map_slots_count, key_digests, payloads);
+  index->loaded_slots_count = is_loaded ? map_slots_count : 0;
 
   *next_cursor = (struct m_storage_cursor *)(payloads + map_slots_count);
   index->hash_seed_ptr = (uint64_t *)(*next_cursor + 1);
@@ -1348,6 +1372,25 @@ static int m_index_open(struct m_index *const index,
   return 1;
 }
 
+/*
+ * Returns non-zero if the bucket for the given key_digest is loaded.
+ */
+static int m_index_is_loaded(const struct m_index *const index,
+    const struct m_key_digest *const key_digest)
+{
+  /*
+   * Racy read is OK here, since loaded_slots_count only grows.
+   */
+  const size_t loaded_slots_count = index->loaded_slots_count;
+  if (loaded_slots_count == index->map.slots_count) {
+    return 1;
+  }
+
+  const size_t start_index = (m_key_digest_mod(key_digest,
+      index->map.slots_count) & ~M_MAP_BUCKET_MASK);
+  return start_index < loaded_slots_count;
+}
+
 static void m_index_close(struct m_index *const index,
     struct p_file *const index_file)
 {
@@ -1760,6 +1803,7 @@ struct ybc_config
   size_t de_hashtable_size;
   uint64_t sync_interval;
   int has_overwrite_protection;
+  int is_lazy_index_load;
 };
 
 size_t ybc_config_get_size(void)
@@ -1778,6 +1822,7 @@ void ybc_config_init(struct ybc_config *const config)
   config->de_hashtable_size = C_CONFIG_DEFAULT_DE_HASHTABLE_SIZE;
   config->sync_interval = C_CONFIG_DEFAULT_SYNC_INTERVAL;
   config->has_overwrite_protection = 1;
+  config->is_lazy_index_load = 0;
 }
 
 void ybc_config_destroy(struct ybc_config *const config)
@@ -1843,6 +1888,11 @@ void ybc_config_disable_overwrite_protection(struct ybc_config *const config)
   config->has_overwrite_protection = 0;
 }
 
+void ybc_config_enable_lazy_index_load(struct ybc_config *const config)
+{
+  config->is_lazy_index_load = 1;
+}
+
 
 /*******************************************************************************
  * Cache management API
@@ -1882,8 +1932,8 @@ static int m_open(struct ybc *const cache,
   m_map_cache_fix_slots_count(&map_cache_slots_count, map_slots_count);
 
   if (!m_index_open(&cache->index, &cache->index_file, map_slots_count,
-      map_cache_slots_count, config->index_file, force, &is_index_file_created,
-      &next_cursor)) {
+      map_cache_slots_count, config->index_file, force,
+      config->is_lazy_index_load, &is_index_file_created, &next_cursor)) {
     return 0;
   }
   if (next_cursor->offset > cache->storage.size) {
@@ -1967,6 +2017,202 @@ void ybc_clear(struct ybc *const cache)
   *cache->index.hash_seed_ptr = cache->storage.hash_seed;
 }
 
+/*
+ * Scans index slots for expired and overwritten items.
+ *
+ * Found items are removed from the index if should_remove is set.
+ * See ybc_remove_expired_items() for details.
+ */
+static int m_scan_expired_items(struct ybc *const cache,
+    size_t *const start_slot, const size_t slots_count,
+    size_t *const items_count, size_t *const bytes, const int should_remove)
+{
+  const struct m_map *const map = &cache->index.map;
+
+  /*
+   * The scan intentionally races with concurrent map updates the same way
+   * other map operations do. See m_map for details.
+   */
+  const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+  const uint64_t current_time = p_get_current_time();
+
+  size_t slot_index = *start_slot;
+  if (slot_index >= map->slots_count) {
+    slot_index = 0;
+  }
+  size_t end_index = map->slots_count;
+  if (slots_count < end_index - slot_index) {
+    end_index = slot_index + slots_count;
+  }
+
+  for (; slot_index < end_index; ++slot_index) {
+    if (m_key_digest_is_empty(&map->key_digests[slot_index])) {
+      continue;
+    }
+    const struct m_storage_payload payload = map->payloads[slot_index];
+    if (m_storage_payload_check(&cache->storage, &next_cursor, &payload,
+        current_time)) {
+      continue;
+    }
+    if (should_remove) {
+      m_key_digest_clear(&map->key_digests[slot_index]);
+    }
+    ++*items_count;
+    *bytes += payload.size;
+  }
+
+  if (slot_index == map->slots_count) {
+    *start_slot = 0;
+    return 1;
+  }
+  *start_slot = slot_index;
+  return 0;
+}
+
+int ybc_remove_expired_items(struct ybc *const cache, size_t *const start_slot,
+    const size_t slots_count, size_t *const removed_items_count,
+    size_t *const removed_bytes)
+{
+  return m_scan_expired_items(cache, start_slot, slots_count,
+      removed_items_count, removed_bytes, 1);
+}
+
+int ybc_count_expired_items(struct ybc *const cache, size_t *const start_slot,
+    const size_t slots_count, size_t *const expired_items_count,
+    size_t *const expired_bytes)
+{
+  return m_scan_expired_items(cache, start_slot, slots_count,
+      expired_items_count, expired_bytes, 0);
+}
+
+int ybc_load_index(struct ybc *const cache, const size_t slots_count)
+{
+  struct m_index *const index = &cache->index;
+  const struct m_map *const map = &index->map;
+
+  /*
+   * Validation intentionally races with concurrent map updates the same way
+   * other map operations do. See m_map for details.
+   */
+  const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+  const uint64_t current_time = p_get_current_time();
+
+  size_t slot_index = index->loaded_slots_count;
+  size_t end_index = map->slots_count;
+  if (slots_count < end_index - slot_index) {
+    /*
+     * Load only whole buckets, since m_index_is_loaded() checks buckets.
+     * map->slots_count is divided by C_MAP_BUCKET_SIZE,
+     * so end_index cannot exceed it.
+     */
+    end_index = slot_index + slots_count;
+    if (end_index % C_MAP_BUCKET_SIZE) {
+      end_index += C_MAP_BUCKET_SIZE - (end_index % C_MAP_BUCKET_SIZE);
+    }
+  }
+
+  for (; slot_index < end_index; ++slot_index) {
+    if (m_key_digest_is_empty(&map->key_digests[slot_index])) {
+      continue;
+    }
+    const struct m_storage_payload payload = map->payloads[slot_index];
+    if (!m_storage_payload_check(&cache->storage, &next_cursor, &payload,
+        current_time)) {
+      m_key_digest_clear(&map->key_digests[slot_index]);
+    }
+  }
+
+  index->loaded_slots_count = end_index;
+  return end_index == map->slots_count;
+}
+
+int ybc_get_index_load_percent(const struct ybc *const cache)
+{
+  const struct m_index *const index = &cache->index;
+  return (int)((uint64_t)index->loaded_slots_count * 100 /
+      index->map.slots_count);
+}
+
+size_t ybc_get_data_file_size(const struct ybc *const cache)
+{
+  return cache->storage.size;
+}
+
+/*
+ * Creates a file with the given size for ybc_snapshot() and maps it
+ * into memory.
+ *
+ * Snapshots are taken while the program is running, so errors such as lack
+ * of free space on the storage aren't fatal. Partially created file
+ * is removed on error.
+ *
+ * Returns zero if the file already exists or cannot be created.
+ */
+static int m_snapshot_file_create(struct p_file *const file, void **const ptr,
+    const char *const filename, const size_t size)
+{
+  if (p_file_exists(filename) || !p_file_try_create(file, filename)) {
+    return 0;
+  }
+  if (!p_file_try_resize_and_preallocate(file, size)) {
+    p_file_close(file);
+    p_file_remove(filename);
+    return 0;
+  }
+  p_memory_map(ptr, file, size);
+  return 1;
+}
+
+static void m_snapshot_file_close(struct p_file *const file, void *const ptr,
+    const size_t size)
+{
+  p_memory_sync(ptr, size);
+  p_memory_unmap(ptr, size);
+  p_file_close(file);
+}
+
+int ybc_snapshot(struct ybc *const cache, const char *const index_file,
+    const char *const data_file)
+{
+  struct p_file snapshot_index_file, snapshot_data_file;
+  void *index_ptr, *data_ptr;
+
+  const size_t index_size = m_index_get_file_size(cache->index.map.slots_count);
+  const size_t data_size = cache->storage.size;
+
+  if (!m_snapshot_file_create(&snapshot_index_file, &index_ptr, index_file,
+      index_size)) {
+    return 0;
+  }
+  if (!m_snapshot_file_create(&snapshot_data_file, &data_ptr, data_file,
+      data_size)) {
+    m_snapshot_file_close(&snapshot_index_file, index_ptr, index_size);
+    p_file_remove(index_file);
+    return 0;
+  }
+
+  /*
+   * All the storage allocations and next_cursor updates are performed
+   * under the cache lock, so the copy cannot contain half-allocated items.
+   * Concurrent map updates intentionally race with the copy the same way
+   * they race with each other. See m_map for details.
+   *
+   * Items are acquired and released under the cache lock if overwrite
+   * protection is enabled, so Get calls are blocked during the copy
+   * as well. The data isn't copied in chunks with the lock released between
+   * chunks, since chunks copied at distinct times may refer to overwritten
+   * items.
+   */
+  p_lock_lock(&cache->lock);
+  memcpy(index_ptr, cache->index.map.key_digests, index_size);
+  memcpy(data_ptr, cache->storage.data, data_size);
+  p_lock_unlock(&cache->lock);
+
+  m_snapshot_file_close(&snapshot_data_file, data_ptr, data_size);
+  m_snapshot_file_close(&snapshot_index_file, index_ptr, index_size);
+  return 1;
+}
+
 void ybc_remove(const struct ybc_config *const config)
 {
   m_file_remove_if_exists(config->index_file);
@@ -2184,6 +2430,9 @@ static int m_item_acquire(struct ybc *const cache, struct ybc_item *const item,
   item->key_size = key->size;
   item->is_set_txn = 0;
 
+  if (!m_index_is_loaded(&cache->index, key_digest)) {
+    return 0;
+  }
   if (!m_map_cache_get(&cache->index.map, &cache->index.map_cache,
       key_digest, &item->payload)) {
     return 0;
@@ -2285,6 +2534,221 @@ int ybc_item_get(struct ybc *const cache, struct ybc_item *const item,
   return m_item_acquire(cache, item, key, &key_digest);
 }
 
+int ybc_item_get_info(struct ybc *const cache, const struct ybc_key *const key,
+    struct ybc_value *const value)
+{
+  /*
+   * Item with different key may be reported if it has the same key digest,
+   * since item's metadata in the storage isn't checked. But it should be OK
+   * for existence checks and introspection.
+   */
+
+  struct m_key_digest key_digest;
+  struct m_storage_payload payload;
+
+  m_key_digest_get(&key_digest, cache->storage.hash_seed, key);
+  if (!m_index_is_loaded(&cache->index, &key_digest)) {
+    return 0;
+  }
+  if (!m_map_cache_get(&cache->index.map, &cache->index.map_cache,
+      &key_digest, &payload)) {
+    return 0;
+  }
+
+  /* See the comment in m_item_acquire() regarding the racy copy. */
+  const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+
+  const uint64_t current_time = p_get_current_time();
+  if (!m_storage_payload_check(&cache->storage, &next_cursor, &payload,
+      current_time)) {
+    return 0;
+  }
+
+  const size_t metadata_size = m_storage_metadata_get_size(key->size);
+  if (payload.size < metadata_size) {
+    /* The payload belongs to an item with different key. */
+    return 0;
+  }
+
+  value->ptr = NULL;
+  value->size = payload.size - metadata_size;
+  value->ttl = payload.expiration_time - current_time;
+  return 1;
+}
+
+/*
+ * Acquires an item with the given payload from the index slot with the given
+ * key digest.
+ *
+ * Unlike m_item_acquire(), the key isn't known in advance, so it is read
+ * from item's metadata and then verified against the key digest.
+ *
+ * Returns non-zero on success.
+ */
+static int m_item_acquire_slot(struct ybc *const cache,
+    struct ybc_item *const item, struct ybc_key *const key,
+    const struct m_key_digest *const key_digest,
+    const struct m_storage_payload *const payload)
+{
+  const struct m_storage *const storage = &cache->storage;
+  const struct m_storage_cursor next_cursor = *storage->next_cursor;
+  const uint64_t current_time = p_get_current_time();
+  if (!m_storage_payload_check(storage, &next_cursor, payload, current_time)) {
+    return 0;
+  }
+
+  const size_t min_metadata_size = m_storage_metadata_get_size(0);
+  if (payload->size < min_metadata_size) {
+    return 0;
+  }
+
+  item->cache = cache;
+  item->key_size = 0;
+  item->payload = *payload;
+  item->is_set_txn = 0;
+  if (cache->has_overwrite_protection) {
+    p_lock_lock(&cache->lock);
+    m_item_register(item, &cache->acquired_items_head);
+    p_lock_unlock(&cache->lock);
+  }
+
+  /*
+   * Metadata may be read only after the item is registered, since otherwise
+   * it may be overwritten concurrently.
+   */
+  const char *const ptr = m_storage_get_ptr(storage, payload->cursor.offset);
+  size_t digest;
+  memcpy(&digest, ptr, sizeof(digest));
+
+  /* See m_storage_metadata_get_digest(). */
+  const size_t key_size = digest ^ (size_t)storage->hash_seed ^ payload->size;
+  if (key_size > payload->size - min_metadata_size) {
+    /* Broken metadata or the item has been added before ybc_clear(). */
+    m_item_release(item);
+    return 0;
+  }
+  key->ptr = ptr + sizeof(digest);
+  key->size = key_size;
+
+  struct m_key_digest actual_key_digest;
+  m_key_digest_get(&actual_key_digest, storage->hash_seed, key);
+  if (!m_key_digest_equal(&actual_key_digest, key_digest)) {
+    /* The slot has been overwritten or the item belongs to another slot. */
+    m_item_release(item);
+    return 0;
+  }
+  item->key_size = key_size;
+
+  return 1;
+}
+
+int ybc_item_get_next(struct ybc *const cache, size_t *const slot_index,
+    struct ybc_item *const item, struct ybc_key *const key)
+{
+  const struct m_map *const map = &cache->index.map;
+
+  /*
+   * The scan intentionally races with concurrent map updates the same way
+   * other map operations do. See m_map for details.
+   */
+  const size_t loaded_slots_count = cache->index.loaded_slots_count;
+
+  for (; *slot_index < loaded_slots_count; ++*slot_index) {
+    const struct m_key_digest key_digest = map->key_digests[*slot_index];
+    if (m_key_digest_is_empty(&key_digest)) {
+      continue;
+    }
+    const struct m_storage_payload payload = map->payloads[*slot_index];
+    if (m_item_acquire_slot(cache, item, key, &key_digest, &payload)) {
+      ++*slot_index;
+      return 1;
+    }
+  }
+
+  return 0;
+}
+
+/*
+ * Returns the distance in bytes from the item pointed by the given payload
+ * to the next_cursor, i.e. the number of bytes written to the storage
+ * after the item.
+ */
+static size_t m_storage_payload_get_age(const struct m_storage *const storage,
+    const struct m_storage_cursor *const next_cursor,
+    const struct m_storage_payload *const payload)
+{
+  return (next_cursor->offset >= payload->cursor.offset) ?
+      (next_cursor->offset - payload->cursor.offset) :
+      (storage->size - (payload->cursor.offset - next_cursor->offset));
+}
+
+int ybc_compact(struct ybc *const cache, size_t *const start_slot,
+    const size_t slots_count, const size_t tail_size,
+    struct ybc_compaction_stats *const stats)
+{
+  const struct m_map *const map = &cache->index.map;
+  const struct m_storage *const storage = &cache->storage;
+  const size_t loaded_slots_count = cache->index.loaded_slots_count;
+
+  size_t slot_index = *start_slot;
+  if (slot_index >= map->slots_count) {
+    slot_index = 0;
+  }
+  size_t end_index = map->slots_count;
+  if (slots_count < end_index - slot_index) {
+    end_index = slot_index + slots_count;
+  }
+
+  /*
+   * The scan intentionally races with concurrent map updates the same way
+   * other map operations do. See m_map for details.
+   */
+  for (; slot_index < end_index; ++slot_index) {
+    const struct m_key_digest key_digest = map->key_digests[slot_index];
+    if (m_key_digest_is_empty(&key_digest)) {
+      continue;
+    }
+    const struct m_storage_payload payload = map->payloads[slot_index];
+    const struct m_storage_cursor next_cursor = *storage->next_cursor;
+    if (!m_storage_payload_check(storage, &next_cursor, &payload,
+        p_get_current_time())) {
+      m_key_digest_clear(&map->key_digests[slot_index]);
+      ++stats->removed_items_count;
+      stats->removed_bytes += payload.size;
+      continue;
+    }
+
+    const size_t age = m_storage_payload_get_age(storage, &next_cursor,
+        &payload);
+    if (tail_size == 0 || age < storage->size - tail_size) {
+      /* The item isn't located in the oldest part of the storage. */
+      continue;
+    }
+    if (slot_index >= loaded_slots_count) {
+      /* Slots beyond loaded_slots_count haven't been validated yet. */
+      continue;
+    }
+
+    char item_buf[sizeof(struct ybc_item)];
+    struct ybc_item *const item = (struct ybc_item *)item_buf;
+    struct ybc_key key;
+    if (!m_item_acquire_slot(cache, item, &key, &key_digest, &payload)) {
+      continue;
+    }
+    m_ws_defragment(cache, item, &key);
+    m_item_release(item);
+    ++stats->moved_items_count;
+    stats->moved_bytes += payload.size;
+  }
+
+  if (slot_index == map->slots_count) {
+    *start_slot = 0;
+    return 1;
+  }
+  *start_slot = slot_index;
+  return 0;
+}
+
 static uint64_t m_item_adjust_grace_ttl(const uint64_t grace_ttl)
 {
   uint64_t adjusted_grace_ttl = grace_ttl;
@@ -254,6 +254,23 @@ YBC_API void ybc_config_set_sync_interval(struct ybc_config *config,
  */
 YBC_API void ybc_config_disable_overwrite_protection(struct ybc_config *config);
 
+/*
+ * Enables lazy index loading.
+ *
+ * By default ybc_open() reads the whole index file into RAM in order
+ * to minimize random I/O during cache warm-up. This can take a while
+ * for big index files.
+ *
+ * If lazy index loading is enabled, ybc_open() returns without reading
+ * index file, so the cache starts serving requests immediately. The index
+ * must be loaded and validated with ybc_load_index() calls then, possibly
+ * from a separate thread. Items from not yet loaded index parts are reported
+ * as missing.
+ *
+ * The index is always fully loaded for newly created index files.
+ */
+YBC_API void ybc_config_enable_lazy_index_load(struct ybc_config *config);
+
 
 /*******************************************************************************
  * Cache management API.
@@ -304,8 +321,9 @@ YBC_API size_t ybc_get_size(void);
  * Otherwise the function returns 0 if some files are missing or errors
  * are found in these files.
  *
- * Do not open the same cache files simultaneously from distinct threads
- * or processes!
+ * Cache files are exclusively locked while the cache is opened, so the function
+ * returns 0 if the same cache files are already opened by another process
+ * or by another cache in the current process.
  *
  * Returns non-zero value on success, 0 on error.
  */
@@ -328,6 +346,140 @@ YBC_API void ybc_close(struct ybc *cache);
  */
 YBC_API void ybc_clear(struct ybc *cache);
 
+/*
+ * Removes expired and overwritten items from the cache index.
+ *
+ * Expired items are never returned from the cache, but they occupy index
+ * slots until overwritten by new items. This may result in premature eviction
+ * of live items sharing index buckets with expired items. Periodic calls
+ * to this function free such slots. Note that the space occupied by expired
+ * items in the data file is reused only after the data file wraps.
+ *
+ * Scans up to slots_count index slots starting from *start_slot and sets
+ * *start_slot to the index of the next slot to scan. *start_slot is set to 0
+ * after the last slot in the index is scanned, i.e. the function may be called
+ * repeatedly for incremental scanning of the whole index.
+ *
+ * Increments *removed_items_count by the number of removed items and
+ * *removed_bytes by their total size in the data file.
+ *
+ * Returns non-zero if the last slot in the index has been scanned.
+ */
+YBC_API int ybc_remove_expired_items(struct ybc *cache, size_t *start_slot,
+    size_t slots_count, size_t *removed_items_count, size_t *removed_bytes);
+
+/*
+ * Counts expired and overwritten items, which occupy cache index slots.
+ *
+ * Works like ybc_remove_expired_items(), but doesn't remove the items.
+ * Increments *expired_items_count by the number of found items
+ * and *expired_bytes by their total size in the data file.
+ *
+ * Returns non-zero if the last slot in the index has been scanned.
+ */
+YBC_API int ybc_count_expired_items(struct ybc *cache, size_t *start_slot,
+    size_t slots_count, size_t *expired_items_count, size_t *expired_bytes);
+
+/*
+ * Statistics for ybc_compact().
+ */
+struct ybc_compaction_stats
+{
+  /*
+   * The number of expired and overwritten items removed from the index.
+   */
+  size_t removed_items_count;
+
+  /*
+   * The total size of removed items in the data file.
+   */
+  size_t removed_bytes;
+
+  /*
+   * The number of live items moved to the front of the data file.
+   */
+  size_t moved_items_count;
+
+  /*
+   * The total size of moved items in the data file.
+   */
+  size_t moved_bytes;
+};
+
+/*
+ * Incrementally compacts the cache.
+ *
+ * The data file is a ring buffer, so live items located in the oldest part
+ * of the data file are evicted on the next data file wrap together with
+ * the surrounding space occupied by expired and overwritten items. This
+ * function moves live items located in the oldest tail_size bytes
+ * of the data file to the front of the data file, so they survive the wrap,
+ * while the space occupied by dead items is reused. It also removes expired
+ * and overwritten items from the index like ybc_remove_expired_items() does.
+ *
+ * Scans up to slots_count index slots starting from *start_slot and sets
+ * *start_slot to the index of the next slot to scan. *start_slot is set to 0
+ * after the last slot in the index is scanned, i.e. the function may be called
+ * repeatedly for incremental compaction.
+ *
+ * Increments the corresponding counters in stats.
+ *
+ * Returns non-zero if the last slot in the index has been scanned.
+ */
+YBC_API int ybc_compact(struct ybc *cache, size_t *start_slot,
+    size_t slots_count, size_t tail_size, struct ybc_compaction_stats *stats);
+
+/*
+ * Loads and validates up to slots_count the next index slots for the cache
+ * opened with lazy index loading. See ybc_config_enable_lazy_index_load().
+ *
+ * Broken slots are cleared during validation. Items from loaded slots
+ * become visible to ybc_item_get*() functions.
+ *
+ * The function may be called concurrently with other cache operations,
+ * but it mustn't be called concurrently from multiple threads.
+ *
+ * Returns non-zero if the whole index has been loaded.
+ */
+YBC_API int ybc_load_index(struct ybc *cache, size_t slots_count);
+
+/*
+ * Returns the percent of loaded index slots in the range [0..100].
+ *
+ * Always returns 100 for caches opened without lazy index loading.
+ */
+YBC_API int ybc_get_index_load_percent(const struct ybc *cache);
+
+/*
+ * Returns the size of the cache data file in bytes.
+ */
+YBC_API size_t ybc_get_data_file_size(const struct ybc *cache);
+
+/*
+ * Copies the cache index and data into new files with the given names.
+ *
+ * The files may be opened later by ybc_open() with the config used
+ * for opening the given cache, where index_file and data_file are substituted
+ * by the given file names. This allows taking backups of the cache
+ * without closing it.
+ *
+ * Items' allocation in the cache is blocked while the cache is copied,
+ * so the copy doesn't contain half-allocated items. Items being written
+ * during the copy may be broken in the copy, but the cache discovers
+ * and drops such items on the fly, like it does after a program crash.
+ * Items' acquisition and release are blocked as well if the cache
+ * has overwrite protection (the default), i.e. both reads and writes
+ * are stalled during the copy. See ybc_config_disable_overwrite_protection().
+ *
+ * Directories for the given files must exist.
+ *
+ * Returns non-zero on success. Returns zero if any of the given files
+ * already exists or cannot be created, for instance, due to lack of free
+ * space. Partially created files are removed on error.
+ */
+YBC_API int ybc_snapshot(struct ybc *cache, const char *index_file,
+    const char *data_file);
+
 /*
  * Removes files associated with the given cache.
  *
@@ -679,6 +831,44 @@ YBC_API int ybc_item_remove(struct ybc *cache, const struct ybc_key *key);
 YBC_API int ybc_item_get(struct ybc *cache, struct ybc_item *item,
     const struct ybc_key *key);
 
+/*
+ * Obtains value size and remaining ttl for the item with the given key
+ * without acquiring the item.
+ *
+ * Only the cache index is read, i.e. neither the item's key nor its value
+ * are read from the data file. So the function is cheaper than
+ * ybc_item_get() + ybc_item_release(), but it may report an item with
+ * different key if it has the same key digest.
+ *
+ * Sets value->size and value->ttl on success. value->ptr is set to NULL.
+ *
+ * Returns non-zero on success.
+ * Returns zero if an item with the given key isn't found.
+ */
+YBC_API int ybc_item_get_info(struct ybc *cache, const struct ybc_key *key,
+    struct ybc_value *value);
+
+/*
+ * Acquires the next item for iterating over all the items in the cache.
+ *
+ * Scans index slots starting from *slot_index and acquires the first valid
+ * item. Sets *slot_index to the slot following the acquired item, so the next
+ * call continues the iteration. Start the iteration with *slot_index = 0.
+ *
+ * Sets key to the item's key. The key remains valid until the item
+ * is released.
+ *
+ * Returns non-zero on success. Returns zero if there are no more items.
+ *
+ * Expired items are skipped. Items added or removed during the iteration
+ * may be either visited or skipped. Items from index slots, which aren't loaded
+ * yet, are skipped. See ybc_config_enable_lazy_index_load().
+ *
+ * Acquired items MUST be released via ybc_item_release() call.
+ */
+YBC_API int ybc_item_get_next(struct ybc *cache, size_t *slot_index,
+    struct ybc_item *item, struct ybc_key *key);
+
 /*
  * Acquires an item with automatic dogpile effect (de) handling.
  *